@@ -22,44 +22,58 @@ import (
 	"os"
 
 	conf "github.com/andmarios/bashistdb/configuration"
-	"github.com/andmarios/bashistdb/llog"
+	"github.com/andmarios/bashistdb/doctor"
 	"github.com/andmarios/bashistdb/local"
 	"github.com/andmarios/bashistdb/network"
 	"github.com/andmarios/bashistdb/setup"
 	"github.com/andmarios/bashistdb/version"
 )
 
-var log *llog.Logger
 var v = version.Version // a debug build will append pprof to this
 
+// debugHook is set by debug builds, it runs after configuration is parsed.
+var debugHook func(cfg *conf.Config)
+
 func main() {
-	log = conf.Log
+	cfg, err := conf.Parse(os.Args[1:], os.Getenv, os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n\n", err)
+		cfg.PrintHelp(os.Stderr) // On error help goes to stderr
+		os.Exit(1)
+	}
+	log := cfg.Log
+
+	if debugHook != nil {
+		debugHook(cfg)
+	}
 
-	switch conf.Mode {
+	switch cfg.Mode {
 	case conf.MODE_PRINT_VERSION:
 		fmt.Println("bashistdb v" + v)
 		fmt.Println("https://github.com/andmarios/bashistdb")
 	case conf.MODE_SERVER:
-		if err := network.ServerMode(); err != nil {
+		if err := network.ServerMode(cfg); err != nil {
 			log.Fatalln(err)
 		}
 	case conf.MODE_CLIENT:
-		if err := network.ClientMode(); err != nil {
+		if err := network.ClientMode(cfg); err != nil {
 			log.Fatalln(err)
 		}
 	case conf.MODE_LOCAL:
-		if err := local.Run(); err != nil {
+		if err := local.Run(cfg); err != nil {
 			log.Fatalln(err)
 		}
 	case conf.MODE_INIT:
-		if err := setup.Apply(true); err != nil {
+		if err := setup.Apply(cfg, true); err != nil {
 			log.Fatalln(err)
 		}
-	case conf.MODE_ERROR:
-		fmt.Printf("%s\n\n", conf.Error)
-		conf.PrintHelp(os.Stderr) // On error help goes to stderr
-		os.Exit(1)
+	case conf.MODE_DOCTOR:
+		if err := doctor.Run(cfg, os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+	case conf.MODE_CONFIG:
+		cfg.PrintConfig(os.Stdout)
 	case conf.MODE_HELP:
-		conf.PrintHelp(os.Stdout) // Help when asked goes to stdout
+		cfg.PrintHelp(os.Stdout) // Help when asked goes to stdout
 	}
 }
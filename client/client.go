@@ -0,0 +1,334 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+/*
+Package client is a Go client for bashistdb servers. It lets programs push
+history lines to a server and run queries against it.
+
+A Client opens a new connection for each request. Every method takes a
+context; if the context has no deadline, the client's Timeout is used.
+
+	c := client.New("history.example.com:25625", []byte("passphrase"))
+	rows, err := c.Query(ctx, conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10,
+		User: "%", Host: "%", Command: "%git%"})
+*/
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/llog"
+	"github.com/andmarios/bashistdb/protocol"
+	"github.com/andmarios/bashistdb/redact"
+	"github.com/andmarios/bashistdb/result"
+	"github.com/andmarios/bashistdb/version"
+)
+
+// DefaultTimeout is the Timeout of clients created by New.
+const DefaultTimeout = time.Minute
+
+// Errors returned by the client. Errors reported by the server are
+// returned as a *ServerError. If the context expires, its error is
+// returned.
+var (
+	ErrClosed    = errors.New("Server closed the connection. Is the passphrase correct?")
+	ErrNoRows    = errors.New("Query type does not return rows.")
+	ErrMultiline = errors.New("Command contains a newline.")
+	ErrName      = errors.New("User or host name has characters the server can't import.")
+)
+
+// The user and host names the server imports: the export format is split on
+// spaces.
+var (
+	validUser = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_-]*$`)
+	validHost = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9.-]*$`)
+)
+
+// A ServerError is an error the server reported for a request.
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "Server error: " + e.Message
+}
+
+// A Client talks to a bashistdb server.
+type Client struct {
+	Address  string           // Address is the server's address (host:port)
+	Key      []byte           // Key is the passphrase shared with the server
+	User     string           // User is sent to the server and used by Import
+	Hostname string           // Hostname is sent to the server and used by Import
+	Dir      string           // Dir, if set, is stored by Import as the working directory
+	Session  string           // Session, if set, is stored by Import as the shell session
+	Timeout  time.Duration    // Timeout is used if a context has no deadline, zero means none
+	Log      *llog.Logger     // Log, if set, gets informational messages
+	Redactor *redact.Redactor // Redactor, if set, removes secrets from history before it is sent
+	AdminKey []byte           // AdminKey is the server's admin key, needed by Backup, Restore, Check, Vacuum and admin queries
+}
+
+// A Record is a history line to push to the server.
+type Record struct {
+	User     string // if empty, the client's User is used
+	Host     string // if empty, the client's Hostname is used
+	Command  string
+	Datetime time.Time
+}
+
+// New returns a new Client for the server at address, that uses key
+// to encrypt communications.
+func New(address string, key []byte) *Client {
+	return &Client{Address: address, Key: key, Timeout: DefaultTimeout}
+}
+
+// Import sends history, as printed by bash's history command, to the server.
+// History lines are stored under the client's User and Hostname. It returns
+// the server's import stats. Secrets are removed first, if the client has a
+// Redactor.
+func (c *Client) Import(ctx context.Context, history []byte) (stats string, err error) {
+	msg := protocol.Message{Type: protocol.HISTORY, Payload: c.Redactor.Lines(history), Dir: c.Dir, Session: c.Session}
+	err = c.do(ctx, msg, func(reply protocol.Message) (bool, error) {
+		stats = string(reply.Payload)
+		return false, nil
+	})
+	return stats, err
+}
+
+// Push sends records to the server. It returns the server's import stats.
+// Command lines have to be on one line, and users and hosts names like
+// those of the export format, e.g "root" and "web-1.example.com".
+func (c *Client) Push(ctx context.Context, records []Record) (stats string, err error) {
+	var history bytes.Buffer
+	for _, r := range records {
+		if strings.ContainsAny(r.Command, "\r\n") {
+			return "", ErrMultiline
+		}
+		user, host := r.User, r.Host
+		if user == "" {
+			user = c.User
+		}
+		if host == "" {
+			host = c.Hostname
+		}
+		if !validUser.MatchString(user) || !validHost.MatchString(host) {
+			return "", ErrName
+		}
+		fmt.Fprintf(&history, result.FORMAT_EXPORT_S+"\n", user, host, r.Datetime.Format(result.RFC3339alt), r.Command)
+	}
+	return c.Import(ctx, history.Bytes())
+}
+
+// RunQuery runs a query on the server and returns its result formatted
+// as set in qp.Format. Queries that change history in bulk, or who it
+// belongs to, are sent with the client's AdminKey.
+func (c *Client) RunQuery(ctx context.Context, qp conf.QueryParams) (res []byte, err error) {
+	if protocol.Admin(qp.Type) {
+		return c.admin(ctx, qp, nil)
+	}
+	msg := protocol.Message{Type: protocol.QUERY, QParams: qp}
+	err = c.do(ctx, msg, func(reply protocol.Message) (bool, error) {
+		res = reply.Payload
+		return false, nil
+	})
+	return res, err
+}
+
+// Query runs a query that returns history lines and decodes them. Query
+// types that do not return rows (e.g users, demo, delete) get ErrNoRows.
+func (c *Client) Query(ctx context.Context, qp conf.QueryParams) ([]result.Row, error) {
+	switch qp.Type {
+	case conf.QUERY, conf.QUERY_LASTK, conf.QUERY_TOPK, conf.QUERY_CONTENT, conf.QUERY_NEXT:
+	default:
+		return nil, ErrNoRows
+	}
+	qp.Format = conf.FORMAT_JSON
+	res, err := c.RunQuery(ctx, qp)
+	if err != nil {
+		return nil, err
+	}
+	return result.Decode(res)
+}
+
+// Delete moves the rows with the given rowids to the trash.
+func (c *Client) Delete(ctx context.Context, rowids []int) error {
+	_, err := c.RunQuery(ctx, conf.QueryParams{Type: conf.DELETE, Rows: rowids})
+	return err
+}
+
+// Users returns the user and host pairs in the server's database. Only
+// the User and Host fields of the rows are set.
+func (c *Client) Users(ctx context.Context) ([]result.Row, error) {
+	res, err := c.RunQuery(ctx, conf.QueryParams{Type: conf.QUERY_USERS,
+		User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_JSON})
+	if err != nil {
+		return nil, err
+	}
+	return result.Decode(res)
+}
+
+// Ping checks that the server is reachable and shares the client's key.
+// It returns the server's time. Servers of earlier versions do not know
+// ping and reply with a *ServerError, which still proves the key is right.
+func (c *Client) Ping(ctx context.Context) (t time.Time, err error) {
+	err = c.do(ctx, protocol.Message{Type: protocol.PING}, func(reply protocol.Message) (bool, error) {
+		t, err = time.Parse(time.RFC3339Nano, string(reply.Payload))
+		return false, err
+	})
+	return t, err
+}
+
+// Backup returns a copy of the server's database.
+func (c *Client) Backup(ctx context.Context) ([]byte, error) {
+	return c.admin(ctx, conf.QueryParams{Type: conf.BACKUP}, nil)
+}
+
+// Restore replaces the server's database with backup. It returns the
+// server's report.
+func (c *Client) Restore(ctx context.Context, backup []byte) (string, error) {
+	res, err := c.admin(ctx, conf.QueryParams{Type: conf.RESTORE}, backup)
+	return string(res), err
+}
+
+// Check returns the problems the server finds in its database.
+func (c *Client) Check(ctx context.Context) (string, error) {
+	res, err := c.admin(ctx, conf.QueryParams{Type: conf.CHECK}, nil)
+	return string(res), err
+}
+
+// Vacuum reclaims free space in the server's database. It returns the
+// server's report.
+func (c *Client) Vacuum(ctx context.Context) (string, error) {
+	res, err := c.admin(ctx, conf.QueryParams{Type: conf.VACUUM}, nil)
+	return string(res), err
+}
+
+// admin sends the maintenance operation or admin query qp to the server and
+// returns the reply's payload.
+func (c *Client) admin(ctx context.Context, qp conf.QueryParams, payload []byte) (res []byte, err error) {
+	msg := protocol.Message{Type: protocol.ADMIN, QParams: qp, Payload: payload, AdminKey: c.AdminKey}
+	err = c.do(ctx, msg, func(reply protocol.Message) (bool, error) {
+		res = reply.Payload
+		return false, nil
+	})
+	return res, err
+}
+
+// Follow subscribes to new history lines that match qp and calls fn with
+// each one, formatted as set in qp.Format. It returns when ctx is done,
+// when the server closes the connection or when fn returns an error.
+// The client's Timeout applies only to connecting.
+func (c *Client) Follow(ctx context.Context, qp conf.QueryParams, fn func(line []byte) error) error {
+	msg := protocol.Message{Type: protocol.SUBSCRIBE, QParams: qp}
+	return c.do(ctx, msg, func(reply protocol.Message) (bool, error) {
+		if reply.Type == protocol.RESULT {
+			return true, fn(reply.Payload)
+		}
+		return true, nil
+	})
+}
+
+// do sends msg to the server and passes every reply to fn, until fn
+// returns false or an error.
+func (c *Client) do(ctx context.Context, msg protocol.Message, fn func(reply protocol.Message) (more bool, err error)) error {
+	if _, ok := ctx.Deadline(); !ok && c.Timeout > 0 && msg.Type != protocol.SUBSCRIBE {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	c.debug("Connecting to: ", c.Address)
+	d := net.Dialer{Timeout: c.Timeout}
+	conn, err := d.DialContext(ctx, "tcp", c.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Closing the connection unblocks reads and writes when ctx is done.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	msg.User, msg.Hostname, msg.Version = c.User, c.Hostname, version.Version
+	if err := protocol.Send(conn, msg, c.Key); err != nil {
+		return c.connErr(ctx, err)
+	}
+	c.info("Sent request.")
+
+	// A subscription gets many replies, everything else just one.
+	r := bufio.NewReader(conn)
+	for {
+		reply, err := protocol.Receive(r, c.Key)
+		if err != nil {
+			return c.connErr(ctx, err)
+		}
+		if reply.Version != version.Version {
+			c.info("Server runs different bashistdb version from client:", reply.Version)
+		}
+
+		switch reply.Type {
+		case protocol.ERROR:
+			return &ServerError{string(reply.Payload)}
+		case protocol.LOGINFO:
+			c.info("Received:", string(reply.Payload))
+		}
+
+		more, err := fn(reply)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// connErr returns the error to report for a failed read or write.
+func (c *Client) connErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrClosed
+	}
+	return err
+}
+
+func (c *Client) info(v ...interface{}) {
+	if c.Log != nil {
+		c.Log.Info.Println(v...)
+	}
+}
+
+func (c *Client) debug(v ...interface{}) {
+	if c.Log != nil {
+		c.Log.Debug.Println(v...)
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andmarios/bashistdb/client"
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/confirm"
+	"github.com/andmarios/bashistdb/database"
+	"github.com/andmarios/bashistdb/llog"
+	"github.com/andmarios/bashistdb/network"
+	"github.com/andmarios/bashistdb/protocol"
+)
+
+// testServer starts a server with an in-memory store. Close the returned
+// listener to stop it.
+func testServer(t *testing.T, key string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &conf.Config{Key: []byte(key), Log: llog.New(llog.SILENT)}
+	go network.Serve(l, database.NewMemory(nil), cfg)
+	return l
+}
+
+func TestClient(t *testing.T) {
+	l := testServer(t, "secret")
+	defer l.Close()
+	c := client.New(l.Addr().String(), []byte("secret"))
+	c.User, c.Hostname = "user1", "host1"
+	ctx := context.Background()
+
+	tt := time.Date(2015, 10, 12, 12, 0, 0, 0, time.UTC)
+	stats, err := c.Push(ctx, []client.Record{
+		{Command: "ls", Datetime: tt},
+		{Command: "git status", Datetime: tt.Add(time.Second)},
+		{Command: "git status", Datetime: tt.Add(2 * time.Second)},
+		{User: "user2", Host: "host2", Command: "git log", Datetime: tt},
+		{Command: "ls", Datetime: tt},
+	})
+	if err != nil {
+		t.Fatal("Push failed: " + err.Error())
+	}
+	if stats != "Processed 5 entries, successful 4, failed 1." {
+		t.Fatalf("Push returned wrong stats: %s", stats)
+	}
+
+	if _, err = c.Push(ctx, []client.Record{{Command: "a\nb", Datetime: tt}}); err != client.ErrMultiline {
+		t.Fatalf("Push of multiline command returned %v", err)
+	}
+	for _, r := range []client.Record{{User: "John Doe", Command: "ls", Datetime: tt}, {Host: "-host", Command: "ls", Datetime: tt}} {
+		if _, err = c.Push(ctx, []client.Record{r}); err != client.ErrName {
+			t.Fatalf("Push as %q@%q returned %v", r.User, r.Host, err)
+		}
+	}
+
+	rows, err := c.Query(ctx, conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 2, User: "%", Host: "%", Command: "%git%"})
+	if err != nil {
+		t.Fatal("Query failed: " + err.Error())
+	}
+	if len(rows) != 2 || rows[0].Row != 2 || rows[1].User != "user1" || !rows[1].Datetime.Equal(tt.Add(2*time.Second)) {
+		t.Fatalf("Query returned wrong rows: %v", rows)
+	}
+
+	rows, err = c.Query(ctx, conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 1, User: "%", Host: "%", Command: "%%"})
+	if err != nil {
+		t.Fatal("Query failed: " + err.Error())
+	}
+	if len(rows) != 1 || rows[0].Count != 2 || rows[0].Command != "git status" {
+		t.Fatalf("TopK query returned wrong rows: %v", rows)
+	}
+
+	users, err := c.Users(ctx)
+	if err != nil {
+		t.Fatal("Users failed: " + err.Error())
+	}
+	if len(users) != 2 || users[0].User != "user1" || users[1].Host != "host2" {
+		t.Fatalf("Users returned wrong rows: %v", users)
+	}
+
+	if err = c.Delete(ctx, []int{1}); err != nil {
+		t.Fatal("Delete failed: " + err.Error())
+	}
+	rows, err = c.Query(ctx, conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "ls"})
+	if err != nil || len(rows) != 0 {
+		t.Fatalf("Deleted row still found: %v, %v", rows, err)
+	}
+
+	if _, err = c.Query(ctx, conf.QueryParams{Type: conf.QUERY_DEMO}); err != client.ErrNoRows {
+		t.Fatalf("Demo query returned %v instead of ErrNoRows", err)
+	}
+
+	_, err = c.Query(ctx, conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "(", Regex: true})
+	if _, ok := err.(*client.ServerError); !ok {
+		t.Fatalf("Bad regular expression returned %v instead of a ServerError", err)
+	}
+
+	before := time.Now()
+	now, err := c.Ping(ctx)
+	if err != nil || now.Before(before.Add(-time.Second)) || now.After(time.Now().Add(time.Second)) {
+		t.Fatalf("Ping returned wrong time %v, %v", now, err)
+	}
+
+	// Wrong passphrase
+	bad := client.New(l.Addr().String(), []byte("wrong"))
+	if _, err = bad.Users(ctx); err != client.ErrClosed {
+		t.Fatalf("Wrong passphrase returned %v instead of ErrClosed", err)
+	}
+	if _, err = bad.Ping(ctx); err != client.ErrClosed {
+		t.Fatalf("Ping with wrong passphrase returned %v instead of ErrClosed", err)
+	}
+}
+
+func TestClientAdmin(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cfg := &conf.Config{Key: []byte("secret"), AdminKey: []byte("admin"), Log: llog.New(llog.SILENT)}
+	go network.Serve(l, database.NewMemory(nil), cfg)
+	c := client.New(l.Addr().String(), []byte("secret"))
+	c.User, c.Hostname = "user1", "host1"
+	ctx := context.Background()
+	if _, err = c.Push(ctx, []client.Record{{Command: "ls", Datetime: time.Date(2015, 10, 12, 12, 0, 0, 0, time.UTC)}}); err != nil {
+		t.Fatal(err)
+	}
+	rename := conf.QueryParams{Type: conf.RENAME, Identity: conf.IDENTITY_USER, From: "user1", To: "user2"}
+
+	// A query message can't rename, with or without the admin key.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = protocol.Send(conn, protocol.Message{Type: protocol.QUERY, QParams: rename, AdminKey: []byte("admin")}, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := protocol.Receive(conn, []byte("secret")); err != nil || reply.Type != protocol.ERROR {
+		t.Fatalf("Rename in a query message got %v, %v", reply, err)
+	}
+	if _, err = c.RunQuery(ctx, rename); err == nil {
+		t.Fatal("Rename without the admin key should fail")
+	}
+	users, err := c.Users(ctx)
+	if err != nil || len(users) != 1 || users[0].User != "user1" {
+		t.Fatalf("Refused rename changed the users: %v, %v", users, err)
+	}
+
+	c.AdminKey = []byte("admin")
+	if _, err = c.RunQuery(ctx, rename); err != nil {
+		t.Fatal("Rename with the admin key failed: " + err.Error())
+	}
+	if users, err = c.Users(ctx); err != nil || len(users) != 1 || users[0].User != "user2" {
+		t.Fatalf("Rename didn't change the users: %v, %v", users, err)
+	}
+}
+
+func TestClientDelete(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cfg := &conf.Config{Key: []byte("secret"), AdminKey: []byte("admin"), Log: llog.New(llog.SILENT)}
+	go network.Serve(l, database.NewMemory(nil), cfg)
+	c := client.New(l.Addr().String(), []byte("secret"))
+	c.User, c.Hostname = "user1", "host1"
+	ctx := context.Background()
+	tt := time.Date(2015, 10, 12, 12, 0, 0, 0, time.UTC)
+	if _, err = c.Push(ctx, []client.Record{{Command: "ls", Datetime: tt}, {Command: "rm a", Datetime: tt.Add(time.Minute)},
+		{Command: "rm b", Datetime: tt.Add(2 * time.Minute)}}); err != nil {
+		t.Fatal(err)
+	}
+	run := func(qp conf.QueryParams) ([]byte, error) { return c.RunQuery(ctx, qp) }
+	yes := func(string) (bool, error) { return true, nil }
+	var out strings.Builder
+
+	// Row ids need no admin key, neither from -del nor from the delete command.
+	if err = c.Delete(ctx, []int{1}); err != nil {
+		t.Fatal("Delete without the admin key failed: " + err.Error())
+	}
+	rows := conf.QueryParams{Type: conf.DELETE, User: "%", Host: "%", Command: "%%", Rows: []int{2}}
+	if err = confirm.Run(run, rows, &out, yes); err != nil {
+		t.Fatal("Delete command with row ids failed: " + err.Error())
+	}
+	if _, err = c.RunQuery(ctx, conf.QueryParams{Type: conf.UNDELETE, Rows: []int{1}}); err != nil {
+		t.Fatal("Undelete without the admin key failed: " + err.Error())
+	}
+	// A search does.
+	search := conf.QueryParams{Type: conf.DELETE_QUERY, User: "%", Host: "%", Command: "rm%"}
+	if err = confirm.Run(run, search, &out, yes); err == nil {
+		t.Fatal("Delete command with a search should need the admin key")
+	}
+
+	res, err := c.Query(ctx, conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%%"})
+	var got []string
+	for _, r := range res {
+		got = append(got, r.Command)
+	}
+	if err != nil || strings.Join(got, ",") != "ls,rm b" {
+		t.Fatalf("Deletes left %v, %v, want ls and rm b", got, err)
+	}
+}
+
+func TestClientFollow(t *testing.T) {
+	l := testServer(t, "")
+	defer l.Close()
+	c := client.New(l.Addr().String(), nil)
+	c.User, c.Hostname = "user1", "host1"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lines := make(chan string)
+	errc := make(chan error)
+	go func() {
+		errc <- c.Follow(ctx, conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%git%"},
+			func(line []byte) error {
+				lines <- string(line)
+				return errors.New("stop")
+			})
+	}()
+
+	// Push until the subscription is in place.
+	tt := time.Date(2015, 10, 12, 12, 0, 0, 0, time.UTC)
+	for i := 0; ; i++ {
+		if _, err := c.Push(context.Background(), []client.Record{{Command: "git status", Datetime: tt.Add(time.Duration(i) * time.Second)}}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case line := <-lines:
+			if !strings.HasSuffix(line, " git status") {
+				t.Fatalf("Follow got wrong line: %s", line)
+			}
+			if err := <-errc; err == nil || err.Error() != "stop" {
+				t.Fatalf("Follow returned %v instead of the callback's error", err)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	// A server that never replies.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	c := client.New(l.Addr().String(), nil)
+	c.Timeout = 50 * time.Millisecond
+	if _, err = c.Users(context.Background()); err != context.DeadlineExceeded {
+		t.Fatalf("Unresponsive server returned %v instead of a timeout", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = c.Users(ctx); err == nil {
+		t.Fatal("Canceled context did not return an error")
+	}
+}
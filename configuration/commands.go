@@ -0,0 +1,1372 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package configuration
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andmarios/bashistdb/llog"
+)
+
+// A command is a bashistdb subcommand. Each command registers its own
+// flags and, after they are parsed, sets the mode, operation and query
+// parameters from them and its non-flag arguments.
+type command struct {
+	name  string
+	args  string // arguments, as shown in usage
+	short string // one line description
+	help  string // long description
+	flags func(p *parser, f *flag.FlagSet)
+	run   func(p *parser, args []string) error
+}
+
+// commands are the available subcommands, in the order we list them in help.
+var commands = []*command{
+	{
+		name:  "import",
+		short: "import history from stdin",
+		help: `Import history from stdin. Lines may be in the format of bash's history
+command with timestamps, or in bashistdb's export format. This is what
+your PROMPT_COMMAND runs.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			p.identityFlags(f)
+			p.timeFlags(f)
+			f.StringVar(&p.dir, "dir", p.dir, "store `DIR` as the working directory of new lines")
+			f.StringVar(&p.session, "session", p.session, "store `ID` as the shell session of new lines")
+		},
+		run: func(p *parser, args []string) error {
+			p.cfg.Operation = OP_IMPORT
+			p.cfg.Dir = p.dir
+			p.cfg.Session = p.session
+			return nil
+		},
+	},
+	{
+		name:  "search",
+		args:  "[QUERY]",
+		short: "search command lines, like grep",
+		help: `Return the command lines that include QUERY. SQLite wildcard operators are
+percent (%) instead of asterisk (*) and undercore (_) instead of question
+mark (?). You may use backslash (\) to escape. The query term always runs
+with both a wildcard prefix and suffix. Think of it as grep. With -session,
+return the whole shell session of each match instead of lines around it.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			p.searchFlags(f)
+			f.BoolVar(&p.uniqueSet, "u", p.uniqueSet, "return the most recent execution of each command line")
+			f.BoolVar(&p.uniqueSet, "unique", p.uniqueSet, aliasUsage+"u")
+			f.BoolVar(&p.regexSet, "R", p.regexSet, "QUERY is a regular expression")
+			f.IntVar(&p.afterContent, "A", p.afterContent, "also return `K` lines after each match")
+			f.IntVar(&p.beforeContent, "B", p.beforeContent, "also return `K` lines before each match")
+			f.IntVar(&p.content, "C", p.content, "also return `K` lines before and after each match")
+			f.BoolVar(&p.sessionSet, "session", p.sessionSet, "also return the shell session of each match")
+		},
+		run: func(p *parser, args []string) error {
+			c := p.cfg
+			c.Operation = OP_QUERY
+			c.QParams.Type = QUERY
+			if p.sessionSet {
+				if p.afterContentSet || p.beforeContentSet || p.contentSet {
+					return errors.New("Incompatible options: -session and -A, -B or -C.")
+				}
+				c.QParams.Type = QUERY_CONTENT
+				c.QParams.Sessions = true
+			} else if p.afterContentSet || p.beforeContentSet || p.contentSet {
+				if p.uniqueSet {
+					c.Log.Info.Println("u(nique) flag doesn't work with content, before, after search")
+				}
+				c.QParams.Type = QUERY_CONTENT
+				if p.afterContentSet {
+					c.QParams.AfterContent = p.afterContent
+				}
+				if p.beforeContentSet {
+					c.QParams.BeforeContent = p.beforeContent
+				}
+				if p.contentSet {
+					c.QParams.AfterContent, c.QParams.BeforeContent = p.content, p.content
+				}
+			}
+			p.setSearch(args)
+			return nil
+		},
+	},
+	{
+		name:  "top",
+		args:  "[QUERY]",
+		short: "return the most frequent command lines",
+		help:  `Return the K most frequent command lines. If you add a query term, return the K most frequent command lines that include it.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			p.searchFlags(f)
+			f.IntVar(&p.topk, "n", p.topk, "return `K` command lines")
+		},
+		run: func(p *parser, args []string) error {
+			c := p.cfg
+			c.Operation = OP_QUERY
+			c.QParams.Type = QUERY_TOPK
+			c.QParams.Kappa = p.topk
+			p.setSearch(args)
+			return nil
+		},
+	},
+	{
+		name:  "programs",
+		args:  "[QUERY]",
+		short: "return the most used programs, subcommands or flags",
+		help: `Return the K most used programs. Command lines are split the way your shell
+does, so every program of a pipeline or a && list counts, and prefixes like
+sudo and env are skipped. With -by subcommand, count programs with their
+subcommands, e.g 'git commit'; with -by flag, count the flags of each program.
+-program counts only one program, and by subcommand unless you set -by. If you
+add a query term, count only the command lines that include it.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			p.searchFlags(f)
+			f.IntVar(&p.topk, "n", p.topk, "return `K` programs")
+			f.StringVar(&p.group, "by", p.group, "count `WHAT`: "+GROUP_PROGRAM+", "+GROUP_SUBCOMMAND+" or "+GROUP_FLAG)
+			f.StringVar(&p.program, "program", p.program, "count only `PROGRAM`, e.g git")
+		},
+		run: func(p *parser, args []string) error {
+			c := p.cfg
+			switch p.group {
+			case "":
+				c.QParams.Group = GROUP_PROGRAM
+				if p.program != "" {
+					c.QParams.Group = GROUP_SUBCOMMAND
+				}
+			case GROUP_PROGRAM, GROUP_SUBCOMMAND, GROUP_FLAG:
+				c.QParams.Group = p.group
+			default:
+				return errors.New("Unknown count: " + p.group + ", use " + GROUP_PROGRAM + ", " + GROUP_SUBCOMMAND + " or " + GROUP_FLAG + ".")
+			}
+			c.Operation = OP_QUERY
+			c.QParams.Type = QUERY_PROGRAMS
+			c.QParams.Kappa = p.topk
+			c.QParams.Program = p.program
+			p.setSearch(args)
+			return nil
+		},
+	},
+	{
+		name:  "suggest-aliases",
+		args:  "[QUERY]",
+		short: "suggest aliases and functions for long command lines you repeat",
+		help: `Suggest aliases and functions that would save you the most typing, ready to
+paste into your .bashrc. Long command lines you run often become aliases, and
+so do their starts, e.g 'git commit -m', to which you add arguments; lists and
+pipelines become functions. Names are the initials of the words, with a number
+if a builtin, a command installed here or a program in your history has the
+name already. If you add a query term, look only at the command lines that
+include it.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			p.searchFlags(f)
+			f.IntVar(&p.topk, "n", 10, "return `K` suggestions")
+		},
+		run: func(p *parser, args []string) error {
+			c := p.cfg
+			c.Operation = OP_QUERY
+			c.QParams.Type = QUERY_SUGGEST_ALIASES
+			c.QParams.Kappa = p.topk
+			// The server may be elsewhere, so we tell it what is installed here.
+			c.QParams.Taken = installed(p.getenv("PATH"))
+			p.setSearch(args)
+			return nil
+		},
+	},
+	{
+		name:  "next",
+		args:  "[COMMAND]",
+		short: "return the command lines that usually follow a command line",
+		help: `Return the K command lines you most often ran right after COMMAND, in the
+same shell session, with how many times you did. COMMAND is a whole command
+line; the percent sign (%) acts as wildcard, e.g 'terraform plan%'. Without
+COMMAND, predict what follows the last command line you ran. With
+-f command_line, return only the command lines, e.g for a shell widget.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			p.identityFlags(f)
+			f.BoolVar(&p.globalSet, "g", p.globalSet, "search all users and hosts, same as -U % -H %")
+			f.BoolVar(&p.globalSet, "global", p.globalSet, aliasUsage+"g")
+			f.StringVar(&p.format, "f", FORMAT_ALL, "output `FORMAT`: "+strings.Join(formatNames(), ", "))
+			f.StringVar(&p.format, "format", FORMAT_ALL, aliasUsage+"f")
+			f.BoolVar(&p.regexSet, "R", p.regexSet, "COMMAND is a regular expression")
+			f.IntVar(&p.topk, "n", 5, "return `K` command lines")
+			f.StringVar(&p.since, "since", p.since, "count what followed command lines run at or after `TIME`: a date, RFC3339 time or age")
+			f.StringVar(&p.until, "until", p.until, "count what followed command lines run before `TIME`: a date, RFC3339 time or age")
+		},
+		run: func(p *parser, args []string) error {
+			c := p.cfg
+			now := time.Now()
+			var err error
+			if c.QParams.Since, err = parseTime(p.since, now); err != nil {
+				return err
+			}
+			if c.QParams.Until, err = parseTime(p.until, now); err != nil {
+				return err
+			}
+			c.Operation = OP_QUERY
+			c.QParams.Type = QUERY_NEXT
+			c.QParams.Kappa = p.topk
+			p.setSearch(args)
+			// The command line is matched whole.
+			c.QParams.Command = strings.Join(args, " ")
+			return nil
+		},
+	},
+	{
+		name:  "typos",
+		args:  "[QUERY]",
+		short: "report the command lines you mistype most",
+		help: `Report the command lines and programs you mistype most, with their typos and
+corrections. A command line is a typo of one you ran at least 3 times as
+often if you usually retyped it as that within a minute, with a letter or two
+changed, or if its program is that one's with two letters swapped, e.g 'gti'
+for 'git'; for these an alias that fixes them is suggested. If you add a query
+term, report only typos that include it. With -delete, move the typos to the
+trash; bashistdb first prints how many and some of them, and asks you.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.adminFlags(f)
+			p.searchFlags(f)
+			f.IntVar(&p.topk, "n", 10, "report `K` command lines or programs")
+			f.BoolVar(&p.deleteSet, "delete", p.deleteSet, "move the typos to the trash")
+			p.confirmFlags(f, "with -delete, print the typos that would be deleted, delete nothing")
+		},
+		run: func(p *parser, args []string) error {
+			c := p.cfg
+			if !p.deleteSet && (p.dryRunSet || p.yesSet) {
+				return errors.New("Incompatible options: -dry-run and -y work only with -delete.")
+			}
+			c.Operation = OP_QUERY
+			c.QParams.Type = QUERY_TYPOS
+			if p.deleteSet {
+				p.setConfirm(DELETE_TYPOS)
+			}
+			c.QParams.Kappa = p.topk
+			p.setSearch(args)
+			return nil
+		},
+	},
+	{
+		name:  "tail",
+		args:  "[QUERY]",
+		short: "return the most recent command lines",
+		help: `Return the K most recent command lines. If you add a query term, return the
+K most recent command lines that include it. With -follow, keep the connection
+to the server open and print new command lines as they are stored, much like
+'tail -f'. By default -follow follows all users and hosts unless you set them.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			p.searchFlags(f)
+			f.IntVar(&p.lastk, "n", p.lastk, "return `K` command lines")
+			f.BoolVar(&p.uniqueSet, "u", p.uniqueSet, "return the most recent execution of each command line")
+			f.BoolVar(&p.uniqueSet, "unique", p.uniqueSet, aliasUsage+"u")
+			f.BoolVar(&p.followSet, "follow", p.followSet, "print new command lines as they arrive (client mode only)")
+		},
+		run: func(p *parser, args []string) error {
+			c := p.cfg
+			c.Operation = OP_QUERY
+			c.QParams.Type = QUERY_LASTK
+			c.QParams.Kappa = p.lastk
+			if p.followSet {
+				if c.Mode != MODE_CLIENT {
+					return errors.New("Incompatible options: -follow works only in client mode")
+				}
+				c.Operation = OP_FOLLOW
+				c.QParams.Type = QUERY
+				c.QParams.Kappa = 0
+			}
+			p.setSearch(args)
+			return nil
+		},
+	},
+	{
+		name:  "find",
+		args:  "[QUERY]",
+		short: "search interactively, print the selected command line",
+		help: `Search your history interactively. Results update as you type; the
+characters of QUERY have to appear in order, not next to each other, and
+the best matches come first. Below the results are the lines that were run
+before and after the selected one. Enter prints the selected command line to
+stdout, Esc cancels. Alt-u, Alt-h and Alt-g toggle searching your user only,
+your host only, or everything; Ctrl-r toggles unique, Alt-p the preview.
+The search draws on /dev/tty, so you may bind it to a key in your shell;
+'bashistdb init -keys' does it for you.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			p.identityFlags(f)
+			f.BoolVar(&p.globalSet, "g", p.globalSet, "start searching all users and hosts, same as -U % -H %")
+			f.BoolVar(&p.globalSet, "global", p.globalSet, aliasUsage+"g")
+			f.BoolVar(&p.uniqueSet, "u", p.uniqueSet, "start with unique command lines")
+			f.BoolVar(&p.uniqueSet, "unique", p.uniqueSet, aliasUsage+"u")
+		},
+		run: func(p *parser, args []string) error {
+			p.cfg.Operation = OP_FIND
+			p.setSearch(args)
+			return nil
+		},
+	},
+	{
+		name:  "back",
+		args:  "N",
+		short: "print the command line N steps back in history",
+		help: `Print the N-th most recent command line, without its row id, or nothing if
+history is shorter. With -dir, count only the command lines run in DIR. The
+up arrow key bindings of init use it.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			p.identityFlags(f)
+			f.BoolVar(&p.globalSet, "g", p.globalSet, "all users and hosts, same as -U % -H %")
+			f.BoolVar(&p.globalSet, "global", p.globalSet, aliasUsage+"g")
+			f.BoolVar(&p.uniqueSet, "u", p.uniqueSet, "count each command line once")
+			f.BoolVar(&p.uniqueSet, "unique", p.uniqueSet, aliasUsage+"u")
+			f.StringVar(&p.dir, "dir", p.dir, "count only command lines run in `DIR`")
+		},
+		run: func(p *parser, args []string) error {
+			if len(args) != 1 {
+				return errors.New("back needs exactly one number.")
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 1 {
+				return errors.New("Bad number of steps: " + args[0])
+			}
+			c := p.cfg
+			c.Operation = OP_BACK
+			c.QParams.Type = QUERY_LASTK
+			c.QParams.Kappa = n
+			c.QParams.Dir = p.dir
+			p.setSearch(nil)
+			return nil
+		},
+	},
+	{
+		name:  "users",
+		args:  "[QUERY]",
+		short: "return the users in the database",
+		help: `Return the user@host pairs in the database. You may use search criteria, eg
+to find users who run a certain command. By default it searches across all
+users and hosts unless you set them.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			p.searchFlags(f)
+		},
+		run: func(p *parser, args []string) error {
+			p.cfg.Operation = OP_QUERY
+			p.cfg.QParams.Type = QUERY_USERS
+			p.usersSet = true
+			p.setSearch(args)
+			return nil
+		},
+	},
+	{
+		name:  "alias",
+		args:  "[user|host ALIAS CANONICAL]",
+		short: "show a user or host under another name",
+		help: `Make ALIAS, a user or host name, another name of CANONICAL: queries show and
+search the command lines of ALIAS as CANONICAL's. Use it when a user has
+different login names on different computers, or a host is sometimes known by
+its full name. Without arguments, list the aliases; with -d, remove ALIAS.
+Stored command lines don't change; 'bashistdb rename' changes them.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.adminFlags(f)
+			f.BoolVar(&p.removeSet, "d", p.removeSet, "remove ALIAS, CANONICAL isn't needed")
+		},
+		run: func(p *parser, args []string) error {
+			c := p.cfg
+			c.Operation = OP_QUERY
+			if len(args) == 0 && !p.removeSet {
+				c.QParams.Type = QUERY_ALIASES
+				return nil
+			}
+			want := 3
+			if p.removeSet {
+				want = 2
+			}
+			if len(args) != want {
+				return errors.New("Usage: bashistdb alias user|host ALIAS CANONICAL, or alias -d user|host ALIAS.")
+			}
+			c.QParams.Type = ALIAS
+			return p.setIdentity(args)
+		},
+	},
+	{
+		name:  "rename",
+		args:  "user|host OLD NEW",
+		short: "rename a user or host in stored command lines",
+		help: `Store the command lines of the user or host OLD as NEW's; to merge two users
+or hosts, rename one to the other. A user can't run the same command line
+twice at the same time, so the command lines of OLD that NEW already has are
+moved to the trash. Aliases of OLD become aliases of NEW.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.adminFlags(f)
+		},
+		run: func(p *parser, args []string) error {
+			if len(args) != 3 {
+				return errors.New("Usage: bashistdb rename user|host OLD NEW.")
+			}
+			p.cfg.Operation = OP_QUERY
+			p.cfg.QParams.Type = RENAME
+			return p.setIdentity(args)
+		},
+	},
+	{
+		name:  "sessions",
+		args:  "[QUERY]",
+		short: "list shell sessions",
+		help: `List the shell sessions of today: their id, user@host, when they started and
+ended and how many command lines they have. If you add a query term, list
+the sessions with a command line that includes it. Command lines from hooks
+of earlier versions or imported history have no session; bashistdb starts a
+new one for them after 30 minutes without commands. 'bashistdb session ROWID'
+prints a session and 'bashistdb search -session' the sessions of matches.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			p.searchFlags(f)
+			f.BoolVar(&p.regexSet, "R", p.regexSet, "QUERY is a regular expression")
+			f.StringVar(&p.since, "since", p.since, "list sessions that ended at or after `TIME`: a date, RFC3339 time or age; default today")
+			f.StringVar(&p.until, "until", p.until, "list sessions that started before `TIME`: a date, RFC3339 time or age")
+			f.BoolVar(&p.allSet, "all", p.allSet, "list sessions of all times")
+		},
+		run: func(p *parser, args []string) error {
+			c := p.cfg
+			now := time.Now()
+			var err error
+			if c.QParams.Since, err = parseTime(p.since, now); err != nil {
+				return err
+			}
+			if c.QParams.Until, err = parseTime(p.until, now); err != nil {
+				return err
+			}
+			if p.since == "" && p.until == "" && !p.allSet {
+				c.QParams.Since = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+			}
+			c.Operation = OP_QUERY
+			c.QParams.Type = QUERY_SESSIONS
+			p.setSearch(args)
+			return nil
+		},
+	},
+	{
+		name:  "session",
+		args:  "ROWID",
+		short: "return the shell session of a command line",
+		help:  `Return the command lines of the shell session the command line at ROWID ran in.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			p.searchFlags(f)
+		},
+		run: func(p *parser, args []string) error {
+			if len(args) != 1 {
+				return errors.New("session needs exactly one row id.")
+			}
+			row, err := strconv.Atoi(args[0])
+			if err != nil {
+				return errors.New("Bad row id: " + args[0])
+			}
+			c := p.cfg
+			c.Operation = OP_QUERY
+			c.QParams.Type = QUERY_CONTENT
+			c.QParams.Sessions = true
+			c.QParams.Kappa = row
+			p.setSearch(nil)
+			// Row ids are unique across users and hosts.
+			if !p.userSet && !p.hostSet {
+				c.QParams.User, c.QParams.Host = "%", "%"
+			}
+			return nil
+		},
+	},
+	{
+		name:  "row",
+		args:  "ROWID",
+		short: "return a single command line",
+		help:  `Return the command line stored at ROWID. You can pipe it to bash.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+		},
+		run: func(p *parser, args []string) error {
+			if len(args) != 1 {
+				return errors.New("row needs exactly one row id.")
+			}
+			row, err := strconv.Atoi(args[0])
+			if err != nil {
+				return errors.New("Bad row id: " + args[0])
+			}
+			p.cfg.Operation = OP_QUERY
+			p.cfg.QParams.Type = QUERY_ROW
+			p.cfg.QParams.Kappa = row
+			p.setSearch(nil)
+			return nil
+		},
+	},
+	{
+		name:  "delete",
+		args:  "[ROWIDS]",
+		short: "move command lines to the trash",
+		help: `Move command lines to the trash: those with the given row ids, those a search
+matches, or both. Row ids may be given as a list of numbers and ranges, e.g
+9-13,100,5. A search takes the usual -U, -H and -g options, -q for the query
+term and -since and -until for a time range; it searches across all users and
+hosts only if you give row ids alone. Bashistdb first prints how many command
+lines would go and some of them, and asks you; -y skips the question and
+-dry-run prints them all and moves nothing. A search needs the admin key of a
+remote server, row ids alone don't. 'bashistdb trash' lists the trash,
+'bashistdb undelete' restores command lines from it and 'bashistdb
+purge-trash' deletes them for good.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.adminFlags(f)
+			p.searchFlags(f)
+			f.StringVar(&p.term, "q", p.term, "delete command lines that include `QUERY`")
+			f.StringVar(&p.term, "query", p.term, aliasUsage+"q")
+			f.BoolVar(&p.regexSet, "R", p.regexSet, "QUERY is a regular expression")
+			f.StringVar(&p.since, "since", p.since, "delete command lines run at or after `TIME`: a date, RFC3339 time or age, e.g 2015-10-12 or 7d")
+			f.StringVar(&p.until, "until", p.until, "delete command lines run before `TIME`: a date, RFC3339 time or age")
+			p.confirmFlags(f, "print the command lines that would be deleted, delete nothing")
+		},
+		run: func(p *parser, args []string) error {
+			var rows []int
+			var err error
+			if len(args) > 0 {
+				if rows, err = parseRange(strings.Join(args, ",")); err != nil {
+					return err
+				}
+			}
+			search := p.term != "" || p.since != "" || p.until != "" || p.userSet || p.hostSet || p.globalSet
+			if len(rows) == 0 && !search {
+				return errors.New("delete needs row ids or a search.")
+			}
+			c := p.cfg
+			if c.QParams.Since, err = parseTime(p.since, time.Now()); err != nil {
+				return err
+			}
+			if c.QParams.Until, err = parseTime(p.until, time.Now()); err != nil {
+				return err
+			}
+			// Row ids alone are a plain delete, which needs no admin key.
+			if search {
+				p.setConfirm(DELETE_QUERY)
+			} else {
+				p.setConfirm(DELETE)
+			}
+			c.QParams.Rows = rows
+			if p.term != "" {
+				p.setSearch([]string{p.term})
+			} else {
+				p.regexSet = false
+				p.setSearch(nil)
+			}
+			// Row ids are unique across users and hosts.
+			if !search {
+				c.QParams.User, c.QParams.Host = "%", "%"
+			}
+			return nil
+		},
+	},
+	{
+		name:  "trash",
+		short: "list the command lines in the trash",
+		help: `List the command lines that delete moved to the trash. Their row ids are
+their ids in the trash, which undelete and purge-trash take.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			f.StringVar(&p.format, "f", p.format, "output `FORMAT`: "+strings.Join(formatNames(), ", "))
+			f.StringVar(&p.format, "format", p.format, aliasUsage+"f")
+		},
+		run: func(p *parser, args []string) error {
+			p.cfg.Operation = OP_QUERY
+			p.cfg.QParams.Type = QUERY_TRASH
+			p.setSearch(nil)
+			return nil
+		},
+	},
+	{
+		name:  "undelete",
+		args:  "[IDS]",
+		short: "restore command lines from the trash",
+		help: `Restore the command lines with the given ids, as 'bashistdb trash' lists
+them, from the trash; with -all, restore everything in it. Ids may be given as
+a list of numbers and ranges, e.g 9-13,100,5. Command lines get back their row
+id, unless a new one took it. Those imported again meanwhile are dropped.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			f.StringVar(&p.format, "f", p.format, "output `FORMAT`: "+strings.Join(formatNames(), ", "))
+			f.StringVar(&p.format, "format", p.format, aliasUsage+"f")
+			f.BoolVar(&p.allSet, "all", p.allSet, "restore everything in the trash")
+		},
+		run: func(p *parser, args []string) error {
+			ids, err := p.trashIDs(args)
+			if err != nil {
+				return err
+			}
+			if len(ids) == 0 && !p.allSet {
+				return errors.New("undelete needs the ids to restore or -all.")
+			}
+			p.cfg.Operation = OP_QUERY
+			p.cfg.QParams.Type = UNDELETE
+			p.cfg.QParams.Rows = ids
+			p.setSearch(nil)
+			return nil
+		},
+	},
+	{
+		name:  "purge-trash",
+		args:  "[IDS]",
+		short: "delete command lines in the trash for good",
+		help: `Delete the command lines with the given ids, as 'bashistdb trash' lists them,
+from the trash for good; without ids, empty the trash. Bashistdb first prints
+how many command lines would go and some of them, and asks you; -y skips the
+question and -dry-run prints them all and deletes nothing.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.adminFlags(f)
+			f.StringVar(&p.format, "f", p.format, "output `FORMAT`: "+strings.Join(formatNames(), ", "))
+			f.StringVar(&p.format, "format", p.format, aliasUsage+"f")
+			p.confirmFlags(f, "print the command lines that would be deleted, delete nothing")
+		},
+		run: func(p *parser, args []string) error {
+			ids, err := p.trashIDs(args)
+			if err != nil {
+				return err
+			}
+			p.setConfirm(PURGE_TRASH)
+			p.cfg.QParams.Rows = ids
+			p.setSearch(nil)
+			return nil
+		},
+	},
+	{
+		name:  "stats",
+		args:  "[QUERY]",
+		short: "show statistics about your history",
+		help: `Show statistics of your command lines: totals, how many were new and how
+many repeated, command lines per day, week and month, an hour of day by
+weekday heatmap, the busiest users and hosts and your streaks of days with
+command lines. If you add a query term, count only the command lines that
+include it. With -g, show the statistics of all users and hosts.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			p.identityFlags(f)
+			f.BoolVar(&p.globalSet, "g", p.globalSet, "all users and hosts, same as -U % -H %")
+			f.BoolVar(&p.globalSet, "global", p.globalSet, aliasUsage+"g")
+			f.StringVar(&p.since, "since", p.since, "count command lines run at or after `TIME`: a date, RFC3339 time or age")
+			f.StringVar(&p.until, "until", p.until, "count command lines run before `TIME`: a date, RFC3339 time or age")
+			f.StringVar(&p.statsFormat, "f", FORMAT_CHART, "output `FORMAT`: "+FORMAT_CHART+", "+FORMAT_JSON+", "+FORMAT_CSV)
+			f.StringVar(&p.statsFormat, "format", FORMAT_CHART, aliasUsage+"f")
+		},
+		run: func(p *parser, args []string) error {
+			c := p.cfg
+			switch p.statsFormat {
+			case FORMAT_CHART, FORMAT_JSON, FORMAT_CSV:
+			default:
+				return errors.New("Unknown stats format: " + p.statsFormat + ".")
+			}
+			now := time.Now()
+			var err error
+			if c.QParams.Since, err = parseTime(p.since, now); err != nil {
+				return err
+			}
+			if c.QParams.Until, err = parseTime(p.until, now); err != nil {
+				return err
+			}
+			c.Operation = OP_QUERY
+			c.QParams.Type = QUERY_STATS
+			p.setSearch(args)
+			c.QParams.Format = p.statsFormat
+			return nil
+		},
+	},
+	{
+		name:  "redact",
+		short: "remove secrets from stored command lines",
+		help: `Remove secrets, like passwords and tokens, from the command lines already
+in the database. Bashistdb removes them from new command lines as they are
+imported, with built-in rules for common credentials plus the regular
+expressions in the "redact" list of the configuration file; run this after
+you add a pattern. If a pattern has a group named secret, or any group, only
+that part of the match is replaced. With -dry-run, print what would change.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.adminFlags(f)
+			f.StringVar(&p.format, "f", p.format, "output `FORMAT`: "+strings.Join(formatNames(), ", "))
+			f.StringVar(&p.format, "format", p.format, aliasUsage+"f")
+			f.BoolVar(&p.dryRunSet, "dry-run", p.dryRunSet, "print the command lines that would change, change nothing")
+		},
+		run: func(p *parser, args []string) error {
+			p.cfg.Operation = OP_QUERY
+			p.cfg.QParams.Type = REDACT
+			p.cfg.QParams.DryRun = p.dryRunSet
+			p.setSearch(nil)
+			return nil
+		},
+	},
+	{
+		name:  "purge",
+		short: "delete stored command lines that are ignored",
+		help: `Delete the command lines in the database that the ignore rules of the
+configuration file match. Bashistdb doesn't record these command lines, but
+it may have stored them before you added a rule. Command lines are stored
+without their leading spaces, so ignorespace can't purge them. With -dry-run,
+print what would be deleted.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.adminFlags(f)
+			f.StringVar(&p.format, "f", p.format, "output `FORMAT`: "+strings.Join(formatNames(), ", "))
+			f.StringVar(&p.format, "format", p.format, aliasUsage+"f")
+			f.BoolVar(&p.dryRunSet, "dry-run", p.dryRunSet, "print the command lines that would be deleted, delete nothing")
+		},
+		run: func(p *parser, args []string) error {
+			p.cfg.Operation = OP_QUERY
+			p.cfg.QParams.Type = PURGE
+			p.cfg.QParams.DryRun = p.dryRunSet
+			p.setSearch(nil)
+			return nil
+		},
+	},
+	{
+		name:  "prune",
+		short: "delete command lines the retention policy doesn't keep",
+		help: `Delete the command lines the retention policy of the configuration file
+doesn't keep: those older than maxage, all but the newest maxrows of each
+user@host, and all but the newest keeplatest runs of each command line of each
+user@host. Overrides for users replace the policy. Server mode prunes every
+interval, an hour unless set; in client mode the server's policy applies.
+With -dry-run, print what would be deleted.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.adminFlags(f)
+			f.StringVar(&p.format, "f", p.format, "output `FORMAT`: "+strings.Join(formatNames(), ", "))
+			f.StringVar(&p.format, "format", p.format, aliasUsage+"f")
+			f.BoolVar(&p.dryRunSet, "dry-run", p.dryRunSet, "print the command lines that would be deleted, delete nothing")
+		},
+		run: func(p *parser, args []string) error {
+			p.cfg.Operation = OP_QUERY
+			p.cfg.QParams.Type = PRUNE
+			p.cfg.QParams.DryRun = p.dryRunSet
+			p.setSearch(nil)
+			return nil
+		},
+	},
+	{
+		name:  "merge",
+		args:  "FILE",
+		short: "merge another bashistdb database into yours",
+		help: `Merge the bashistdb database in FILE, e.g one you kept on another computer,
+into yours: its command lines, with their working directories, and its
+connection log. Command lines you already have are skipped, and the ignore
+and redaction rules apply as on import. Rename users and hosts of FILE with
+-map-user and -map-host, once for each. If FILE is encrypted at rest, it must
+use the same key. FILE isn't changed. Merge works on the database directly;
+to merge into a server's, run it on the server.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.databaseFlags(f)
+			f.StringVar(&p.passphrase, "k", p.passphrase, "`PASSPHRASE` of the databases, if they are encrypted at rest")
+			f.StringVar(&p.passphrase, "key", p.passphrase, aliasUsage+"k")
+			if p.mapUsers == nil {
+				p.mapUsers, p.mapHosts = mapping{}, mapping{}
+			}
+			f.Var(p.mapUsers, "map-user", "store user OLD of FILE as NEW, given as `OLD=NEW`")
+			f.Var(p.mapHosts, "map-host", "store host OLD of FILE as NEW, given as `OLD=NEW`")
+		},
+		run: func(p *parser, args []string) error {
+			if len(args) != 1 {
+				return errors.New("The merge command needs a file.")
+			}
+			c := p.cfg
+			c.Operation = OP_MERGE
+			c.File = args[0]
+			c.Merge = MergeParams{Users: p.mapUsers, Hosts: p.mapHosts}
+			return nil
+		},
+	},
+	{
+		name:  "backup",
+		args:  "FILE",
+		short: "copy the database to a file",
+		help: `Copy the database to FILE, which must not exist. The copy is consistent
+even while bashistdb keeps recording history. In client mode the server
+backs up its database and the copy is written here; the server must have an
+admin key and you must give the same one.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.adminFlags(f)
+		},
+		run: func(p *parser, args []string) error {
+			return p.setAdmin(BACKUP, args)
+		},
+	},
+	{
+		name:  "restore",
+		args:  "FILE",
+		short: "replace the database with a backup",
+		help: `Replace the database with the backup in FILE. Bashistdb refuses backups that
+fail an integrity check or come from a newer version, and migrates older
+ones. If the database is encrypted at rest, the backup must open with the
+same key. Bashistdb asks you first; -y skips the question. In client mode the
+backup is sent to the server, which needs an admin key.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.adminFlags(f)
+			f.BoolVar(&p.yesSet, "y", p.yesSet, "don't ask for confirmation")
+			f.BoolVar(&p.yesSet, "yes", p.yesSet, aliasUsage+"y")
+		},
+		run: func(p *parser, args []string) error {
+			p.cfg.Yes = p.yesSet
+			return p.setAdmin(RESTORE, args)
+		},
+	},
+	{
+		name:  "check",
+		short: "look for damage and inconsistencies in the database",
+		help: `Run SQLite's integrity check on the database and check that its schema is
+current, that timestamps are sane and that no working directories or reverse
+lookups are left without the rows they belong to. In client mode the server
+checks its database; it needs an admin key.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.adminFlags(f)
+		},
+		run: func(p *parser, args []string) error {
+			return p.setAdmin(CHECK, nil)
+		},
+	},
+	{
+		name:  "vacuum",
+		short: "reclaim free space in the database",
+		help: `Rebuild the database file to reclaim the space deleted command lines left,
+and print its size before and after. In client mode the server vacuums its
+database; it needs an admin key.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.adminFlags(f)
+		},
+		run: func(p *parser, args []string) error {
+			return p.setAdmin(VACUUM, nil)
+		},
+	},
+	{
+		name:  "migrate-status",
+		short: "show the schema migrations of the database",
+		help: `Print the schema version of the local database and, for each migration,
+whether and when it was applied. It doesn't migrate the database; opening it
+with any other command does, after backing it up next to the database file.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.databaseFlags(f)
+		},
+		run: func(p *parser, args []string) error {
+			p.cfg.Operation = OP_MIGRATE_STATUS
+			return nil
+		},
+	},
+	{
+		name:  "server",
+		short: "run in server mode",
+		help: `Run in server mode. Bashistdb currently binds to 0.0.0.0. Verbosity is at
+least 1 (info). With an admin key, clients that give it may back up, restore,
+check and vacuum the database.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.databaseFlags(f)
+			f.StringVar(&p.port, "p", p.port, "`PORT` to listen on")
+			f.StringVar(&p.port, "port", p.port, aliasUsage+"p")
+			f.StringVar(&p.passphrase, "k", p.passphrase, "`PASSPHRASE` to encrypt network communications")
+			f.StringVar(&p.passphrase, "key", p.passphrase, aliasUsage+"k")
+			f.StringVar(&p.adminKey, "admin-key", p.adminKey, "`KEY` clients must give to back up, restore, check or vacuum, and to change history in bulk")
+		},
+		run: func(p *parser, args []string) error {
+			return nil
+		},
+	},
+	{
+		name:  "init",
+		short: "set-up your system to use bashistdb",
+		help: `Setup system for bashistdb: (1) Save settings to the configuration file.
+(2) Add to your shell's rc file hooks that send each command to bashistdb
+(remote or local, taken from settings), (3) for bash, back up your
+bash_history and add a unique serial timestamp to any untimestamped line.
+Init keeps what it adds to the rc file in a marked block; running it again
+replaces the block and -uninstall removes it. With -keys, also bind Ctrl-R to
+'bashistdb find' in your shell. With -up, bind the up and down arrows to walk
+your bashistdb history at this host (-up host), or only the lines you run in
+the current directory (-up dir).`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			p.timeFlags(f)
+			f.BoolVar(&p.keysSet, "keys", p.keysSet, "install key bindings")
+			f.StringVar(&p.up, "up", p.up, "bind the up arrow to walk history by `SCOPE`: "+UP_HOST+" or "+UP_DIR)
+			f.StringVar(&p.shell, "shell", p.shell, "`SHELL` to set up: "+SHELL_BASH+", "+SHELL_ZSH+" or "+SHELL_FISH)
+			f.BoolVar(&p.uninstallSet, "uninstall", p.uninstallSet, "remove the bashistdb block from the rc file")
+		},
+		run: func(p *parser, args []string) error {
+			switch p.shell {
+			case SHELL_BASH, SHELL_ZSH, SHELL_FISH:
+			default:
+				return errors.New("Unknown shell: " + p.shell)
+			}
+			switch p.up {
+			case "", UP_HOST, UP_DIR:
+			default:
+				return errors.New("Unknown up arrow scope: " + p.up)
+			}
+			p.cfg.Setup = SetupParams{Shell: p.shell, Keys: p.keysSet || p.up != "", Up: p.up, Uninstall: p.uninstallSet}
+			// Uninstall leaves the configuration file alone.
+			p.setupSet = !p.uninstallSet
+			return nil
+		},
+	},
+	{
+		name:  "config",
+		short: "show or save settings",
+		help: `Show your settings. With -save, write the database, remote, port, key,
+histtimeformat and timezone settings to the configuration file. These
+settings override environment variables.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			p.timeFlags(f)
+			f.BoolVar(&p.writeconfSet, "save", p.writeconfSet, "write settings to the configuration file")
+		},
+		run: func(p *parser, args []string) error {
+			p.cfg.Key = []byte(p.passphrase)
+			return nil
+		},
+	},
+	{
+		name:  "doctor",
+		short: "check that your set-up works",
+		help: `Check what recording your history depends on and print what passes, what
+fails and how to fix it: HISTTIMEFORMAT gives history lines bashistdb can
+read, the hook is installed once in your shell's rc file, the database opens
+and is on the current schema, the configuration file parses and, if a remote
+is set, the server is reachable, the passphrase matches and the clocks agree.
+Since the hook hides its errors, run this when history stops being recorded.`,
+		flags: func(p *parser, f *flag.FlagSet) {
+			p.connFlags(f)
+			f.StringVar(&p.shell, "shell", p.shell, "`SHELL` to check: "+SHELL_BASH+", "+SHELL_ZSH+" or "+SHELL_FISH)
+		},
+		run: func(p *parser, args []string) error {
+			switch p.shell {
+			case SHELL_BASH, SHELL_ZSH, SHELL_FISH:
+			default:
+				return errors.New("Unknown shell: " + p.shell)
+			}
+			p.cfg.Setup.Shell = p.shell
+			return nil
+		},
+	},
+	{
+		name:  "version",
+		short: "print version",
+		help:  `Print version info.`,
+		flags: func(p *parser, f *flag.FlagSet) {},
+		run: func(p *parser, args []string) error {
+			return nil
+		},
+	},
+	{
+		name:  "help",
+		args:  "[COMMAND]",
+		short: "show help for bashistdb or a command",
+		help:  `Show help for bashistdb or a command. 'bashistdb help flags' shows the flags of earlier versions, which are still accepted.`,
+		flags: func(p *parser, f *flag.FlagSet) {},
+		run: func(p *parser, args []string) error {
+			if len(args) > 0 {
+				p.cfg.Subcommand = args[0]
+			} else {
+				p.cfg.Subcommand = ""
+			}
+			p.helpSet = true
+			return nil
+		},
+	},
+}
+
+// aliasUsage is the usage prefix of flags that are another name of a flag.
+const aliasUsage = "same as -"
+
+// findCommand returns the command named name or nil.
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// databaseFlags registers the flags of local database access.
+func (p *parser) databaseFlags(f *flag.FlagSet) {
+	f.StringVar(&p.database, "db", p.database, "path to database `FILE`, :memory: for an in-memory database")
+	f.IntVar(&p.verbosity, "v", p.verbosity, "verbosity `LEVEL`: 0 for silent, 1 for info, 2 for debug")
+	f.IntVar(&p.verbosity, "verbose", p.verbosity, aliasUsage+"v")
+}
+
+// connFlags registers the flags that select the database or the server.
+func (p *parser) connFlags(f *flag.FlagSet) {
+	p.databaseFlags(f)
+	f.StringVar(&p.remote, "r", p.remote, "run as client, connect to `SERVER`")
+	f.StringVar(&p.remote, "remote", p.remote, aliasUsage+"r")
+	f.StringVar(&p.port, "p", p.port, "server `PORT`")
+	f.StringVar(&p.port, "port", p.port, aliasUsage+"p")
+	f.StringVar(&p.passphrase, "k", p.passphrase, "`PASSPHRASE` to encrypt network communications")
+	f.StringVar(&p.passphrase, "key", p.passphrase, aliasUsage+"k")
+	f.BoolVar(&p.localSet, "local", p.localSet, "force local mode, despite remote being set by env or conf")
+}
+
+// identityFlags registers the flags that set user and host.
+func (p *parser) identityFlags(f *flag.FlagSet) {
+	f.StringVar(&p.user, "U", p.user, "`USER` name; in queries a search term, wildcards work")
+	f.StringVar(&p.user, "user", p.user, aliasUsage+"U")
+	f.StringVar(&p.host, "H", p.host, "`HOST` name; in queries a search term, wildcards work")
+	f.StringVar(&p.host, "host", p.host, aliasUsage+"H")
+}
+
+// timeFlags registers the flags that set how timestamps of imported
+// history are read.
+func (p *parser) timeFlags(f *flag.FlagSet) {
+	f.StringVar(&p.histFormat, "histtimeformat", p.histFormat, "`FORMAT` of history timestamps, as HISTTIMEFORMAT; empty to detect it")
+	f.StringVar(&p.timeZone, "timezone", p.timeZone, "time `ZONE` of timestamps without one, e.g Europe/Athens; empty for local time")
+}
+
+// searchFlags registers the flags of queries.
+func (p *parser) searchFlags(f *flag.FlagSet) {
+	p.identityFlags(f)
+	f.BoolVar(&p.globalSet, "g", p.globalSet, "search all users and hosts, same as -U % -H %")
+	f.BoolVar(&p.globalSet, "global", p.globalSet, aliasUsage+"g")
+	f.StringVar(&p.format, "f", p.format, "output `FORMAT`: "+strings.Join(formatNames(), ", "))
+	f.StringVar(&p.format, "format", p.format, aliasUsage+"f")
+}
+
+// confirmFlags registers the flags of queries that we preview and confirm
+// before we run them.
+func (p *parser) confirmFlags(f *flag.FlagSet, dryRunUsage string) {
+	f.BoolVar(&p.dryRunSet, "dry-run", p.dryRunSet, dryRunUsage)
+	f.BoolVar(&p.yesSet, "y", p.yesSet, "don't ask for confirmation")
+	f.BoolVar(&p.yesSet, "yes", p.yesSet, aliasUsage+"y")
+}
+
+// setConfirm sets the operation of a query of type t that we preview and
+// confirm before we run it.
+func (p *parser) setConfirm(t string) {
+	c := p.cfg
+	c.Operation = OP_CONFIRM
+	if p.dryRunSet || p.yesSet {
+		c.Operation = OP_QUERY
+	}
+	c.QParams.Type = t
+	c.QParams.DryRun = p.dryRunSet
+}
+
+// adminFlags registers the flags of maintenance operations and of commands
+// that change history in bulk.
+func (p *parser) adminFlags(f *flag.FlagSet) {
+	p.connFlags(f)
+	f.StringVar(&p.adminKey, "admin-key", p.adminKey, "the server's admin `KEY`")
+}
+
+// setAdmin sets the maintenance operation op. Backup and restore take a
+// file, the rest nothing.
+func (p *parser) setAdmin(op string, args []string) error {
+	c := p.cfg
+	switch {
+	case (op == BACKUP || op == RESTORE) && len(args) != 1:
+		return errors.New("The " + op + " command needs a file.")
+	case len(args) == 1:
+		c.File = args[0]
+	}
+	c.Operation = OP_ADMIN
+	c.QParams.Type = op
+	return nil
+}
+
+// setIdentity sets the kind and names of alias and rename from args: user
+// or host, then one or two names.
+func (p *parser) setIdentity(args []string) error {
+	qp := &p.cfg.QParams
+	switch args[0] {
+	case IDENTITY_USER, IDENTITY_HOST:
+	default:
+		return errors.New("Unknown kind of name: " + args[0] + ", use " + IDENTITY_USER + " or " + IDENTITY_HOST + ".")
+	}
+	qp.Identity, qp.From = args[0], args[1]
+	if len(args) > 2 {
+		qp.To = args[2]
+	}
+	return nil
+}
+
+// trashIDs parses the ids of command lines in the trash.
+func (p *parser) trashIDs(args []string) ([]int, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	return parseRange(strings.Join(args, ","))
+}
+
+// mapping is a flag that renames, with OLD=NEW, and may be repeated.
+type mapping map[string]string
+
+func (m mapping) String() string {
+	var s []string
+	for k, v := range m {
+		s = append(s, k+"="+v)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (m mapping) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 1 || i == len(s)-1 {
+		return errors.New("Bad mapping " + s + ", use OLD=NEW.")
+	}
+	m[s[:i]] = s[i+1:]
+	return nil
+}
+
+// parseTime parses s as a date, an RFC3339 time or an age, such as 7d, before
+// now. Dates and times without a time zone are in local time. An empty s is
+// the zero time.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if age, err := ParseAge(s); err == nil {
+		return now.Add(-age), nil
+	}
+	return time.Time{}, errors.New("Bad time " + s + ", use e.g 2015-10-12, 2015-10-12T12:00:00+03:00 or 7d.")
+}
+
+// aliasName matches the names an alias suggestion may take.
+var aliasName = regexp.MustCompile(`^[a-z][a-z0-9]{1,8}$`)
+
+// installed returns the names of the executables in the directories of path,
+// a PATH variable, that an alias suggestion could take.
+func installed(path string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, dir := range filepath.SplitList(path) {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			n := f.Name()
+			if seen[n] || f.IsDir() || f.Mode()&0111 == 0 || !aliasName.MatchString(n) {
+				continue
+			}
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// setSearch sets the query parameters that are common to all queries.
+func (p *parser) setSearch(args []string) {
+	c := p.cfg
+	if availableFormats[p.format] {
+		c.QParams.Format = p.format
+	} else {
+		c.Log.Info.Println("The specified format doesn't exist. Reverting to default:", FORMAT_DEFAULT)
+		c.QParams.Format = FORMAT_DEFAULT
+	}
+
+	c.QParams.Unique = p.uniqueSet
+
+	c.QParams.User = p.user
+	c.QParams.Host = p.host
+	// Users and follow queries should be global, unless set.
+	if (p.usersSet || p.followSet) && !p.userSet {
+		c.QParams.User = "%"
+	}
+	if (p.usersSet || p.followSet) && !p.hostSet {
+		c.QParams.Host = "%"
+	}
+	if p.globalSet {
+		c.QParams.User, c.QParams.Host = "%", "%"
+	}
+
+	c.QParams.Regex = p.regexSet
+	c.QParams.Command = strings.Join(args, " ")
+	if !p.regexSet {
+		c.QParams.Command = "%" + c.QParams.Command + "%" // Grep like behaviour
+	}
+}
+
+// parseCommand parses the flags and arguments of cmd.
+func (p *parser) parseCommand(cmd *command, args []string) error {
+	c := p.cfg
+	c.Subcommand = cmd.name
+
+	f := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	f.SetOutput(ioutil.Discard)
+	p.flags = f
+	cmd.flags(p, f)
+	err := f.Parse(args)
+	if err == flag.ErrHelp {
+		p.helpSet, err = true, nil
+	}
+	p.setHelpValues()
+	if err != nil {
+		return err
+	}
+	f.Visit(p.setVisitedFlags)
+	if p.helpSet {
+		c.Mode = MODE_HELP
+		return nil
+	}
+
+	// Verbosity reaches up to 2 (DEBUG)
+	if p.verbosity > 2 {
+		p.verbosity = 2
+	}
+
+	switch cmd.name {
+	case "help":
+		c.Mode = MODE_HELP
+	case "version":
+		c.Mode = MODE_PRINT_VERSION
+	case "init":
+		c.Mode = MODE_INIT
+	case "config":
+		c.Mode = MODE_CONFIG
+	case "merge", "migrate-status":
+		c.Mode = MODE_LOCAL
+	case "doctor":
+		c.Mode = MODE_DOCTOR
+		if p.remote != "" && !p.localSet {
+			c.Address = p.remote + ":" + p.port
+		}
+	case "server":
+		c.Mode = MODE_SERVER
+		c.Address = ":" + p.port
+		if p.verbosity < 1 { // Server mode sets min verbosity of 1 (INFO)
+			p.verbosity = 1
+		}
+	default:
+		if p.remote != "" && !p.localSet {
+			c.Mode = MODE_CLIENT
+			c.Address = p.remote + ":" + p.port
+		} else {
+			c.Mode = MODE_LOCAL
+		}
+	}
+
+	// Create logger
+	c.Log = llog.New(p.verbosity)
+
+	if err := cmd.run(p, f.Args()); err != nil {
+		return err
+	}
+	if p.helpSet { // the help command
+		if s := c.Subcommand; s != "" && s != "flags" && findCommand(s) == nil {
+			c.Subcommand = ""
+			return errors.New("Unknown command: " + s)
+		}
+		return nil
+	}
+
+	return p.finish()
+}
+
+// formatNames returns the names of the available output formats.
+func formatNames() []string {
+	return []string{FORMAT_ALL, FORMAT_BASH_HISTORY, FORMAT_COMMAND_LINE, FORMAT_JSON,
+		FORMAT_LOG, FORMAT_TIMESTAMP, FORMAT_EXPORT, FORMAT_ROWS}
+}
+
+// printCommandsHelp prints the list of commands.
+func printCommandsHelp(w io.Writer) {
+	fmt.Fprintln(w, `Usage of bashistdb.
+  bashistdb COMMAND [OPTIONS] [ARGUMENTS]
+
+Commands:`)
+	width := 0
+	for _, cmd := range commands {
+		if len(cmd.name) > width {
+			width = len(cmd.name)
+		}
+	}
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "    %-*s %s\n", width, cmd.name, cmd.short)
+	}
+	fmt.Fprintln(w, `
+Run 'bashistdb help COMMAND' or 'bashistdb COMMAND -h' for a command's options.
+The flags of earlier versions are still accepted; run 'bashistdb help flags'
+to see them.`)
+}
+
+// printCommandHelp prints the help of cmd. Defaults of flags are the
+// current settings in c.
+func printCommandHelp(w io.Writer, cmd *command, c *Config) {
+	usage := "bashistdb " + cmd.name + " [OPTIONS]"
+	if cmd.args != "" {
+		usage += " " + cmd.args
+	}
+	fmt.Fprintf(w, "Usage:\n  %s\n\n%s\n", usage, cmd.help)
+
+	p := &parser{database: c.Database, user: c.User, host: c.Hostname,
+		remote: c.Remote, port: c.Port, format: FORMAT_DEFAULT, topk: 20, lastk: 20,
+		afterContent: 5, beforeContent: 5, content: 5}
+	f := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	cmd.flags(p, f)
+
+	// Flags with a usage of "same as -NAME" are listed with NAME.
+	aliases := make(map[string][]string)
+	n := 0
+	f.VisitAll(func(fl *flag.Flag) {
+		if strings.HasPrefix(fl.Usage, aliasUsage) {
+			target := strings.TrimPrefix(fl.Usage, aliasUsage)
+			aliases[target] = append(aliases[target], fl.Name)
+		}
+		n++
+	})
+	if n == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "\nOptions:")
+	f.VisitAll(func(fl *flag.Flag) {
+		if strings.HasPrefix(fl.Usage, aliasUsage) {
+			return
+		}
+		arg, usage := flag.UnquoteUsage(fl)
+		names := "-" + fl.Name
+		for _, a := range aliases[fl.Name] {
+			names += ", -" + a
+		}
+		if arg != "" {
+			names += " " + strings.ToUpper(arg)
+		}
+		switch fl.DefValue {
+		case "", "0", "false":
+		default:
+			usage += ". Current: " + fl.DefValue
+		}
+		fmt.Fprintf(w, "    %s\n        %s\n", names, usage)
+	})
+}
@@ -21,9 +21,13 @@ package configuration
 import (
 	"errors"
 	"flag"
-	"log"
+	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/andmarios/bashistdb/llog"
 )
@@ -32,98 +36,180 @@ const (
 	bashistPort = "25625"
 )
 
-// flag variables
+// osHostname returns the system's hostname. Tests replace it.
+var osHostname = os.Hostname
+
+// A parser holds the state of a single Parse call.
 // Vars ending in Set are bool
 // For non-bool vars we may create a bool counterpart using flag.Visit
-// We set them all here so we can copy this to test for resetting vars
-var (
+type parser struct {
+	cfg    *Config
+	flags  *flag.FlagSet
+	getenv func(string) string
+	stdin  io.Reader
+
 	// These are used as actual flagvars
-	database      = os.Getenv("HOME") + "/.bashistdb.sqlite3"
-	versionSet    = false
-	verbosity     = 0
-	user          = os.Getenv("USER")
-	host, _       = os.Hostname()
-	serverSet     = false
-	remote        = os.Getenv("BASHISTDB_REMOTE")
-	port          = os.Getenv("BASHISTDB_PORT")
-	passphrase    = os.Getenv("BASHISTDB_KEY")
-	format        = FORMAT_DEFAULT
-	helpSet       = false
-	globalSet     = false
-	writeconfSet  = false
-	setupSet      = false
-	topk          = 20
-	lastk         = 20
-	localSet      = false
-	uniqueSet     = false
-	usersSet      = false
-	row           = 0
-	delRows       = ""
-	regexSet      = false
-	afterContent  = 5
-	beforeContent = 5
-	content       = 5
+	database      string
+	versionSet    bool
+	verbosity     int
+	user          string
+	host          string
+	serverSet     bool
+	remote        string
+	port          string
+	passphrase    string
+	format        string
+	statsFormat   string
+	group         string
+	program       string
+	deleteSet     bool
+	helpSet       bool
+	globalSet     bool
+	writeconfSet  bool
+	setupSet      bool
+	topk          int
+	lastk         int
+	localSet      bool
+	uniqueSet     bool
+	usersSet      bool
+	row           int
+	delRows       string
+	regexSet      bool
+	afterContent  int
+	beforeContent int
+	content       int
+	followSet     bool
+	dir           string
+	keysSet       bool
+	uninstallSet  bool
+	up            string
+	shell         string
+	histFormat    string
+	timeZone      string
+	redact        []string
+	ignore        IgnoreRules
+	retention     RetentionRules
+	encrypt       string
+	dryRunSet     bool
+	yesSet        bool
+	allSet        bool
+	removeSet     bool
+	migrateSet    bool
+	session       string
+	sessionSet    bool
+	term          string
+	since         string
+	until         string
+	adminKey      string
+	mapUsers      mapping
+	mapHosts      mapping
 	// Custom Flags that need custom (non-flag package code) to parse and set. //
 	// These are not parsed from flags but we set them with flag.Visit
-	userSet          = false
-	hostSet          = false
-	remoteSet        = false
-	topkSet          = false
-	lastkSet         = false
-	rowSet           = false
-	delRowsSet       = false
-	afterContentSet  = false
-	beforeContentSet = false
-	contentSet       = false
+	userSet          bool
+	hostSet          bool
+	remoteSet        bool
+	topkSet          bool
+	lastkSet         bool
+	rowSet           bool
+	delRowsSet       bool
+	afterContentSet  bool
+	beforeContentSet bool
+	contentSet       bool
 	// These are set with manual searches
-	querySet = false
-	stdinSet = false
+	querySet bool
+	stdinSet bool
 	// Vars below can not be overriden by user
-	confFile      = os.Getenv("HOME") + "/.bashistdb.conf"
-	foundConfFile = false
-)
+	confFile      string
+	foundConfFile bool
+}
+
+// newParser sets the default values of flag variables. Some are read
+// from the environment.
+func newParser(getenv func(string) string, stdin io.Reader) *parser {
+	host, _ := osHostname()
+	return &parser{
+		cfg:           &Config{Stdin: stdin, Log: llog.New(llog.SILENT)},
+		flags:         flag.NewFlagSet("bashistdb", flag.ContinueOnError),
+		getenv:        getenv,
+		stdin:         stdin,
+		database:      getenv("HOME") + "/.bashistdb.sqlite3",
+		user:          getenv("USER"),
+		host:          host,
+		remote:        getenv("BASHISTDB_REMOTE"),
+		port:          getenv("BASHISTDB_PORT"),
+		passphrase:    getenv("BASHISTDB_KEY"),
+		format:        FORMAT_DEFAULT,
+		topk:          20,
+		lastk:         20,
+		afterContent:  5,
+		beforeContent: 5,
+		content:       5,
+		shell:         defaultShell(getenv("SHELL")),
+		histFormat:    getenv("HISTTIMEFORMAT"),
+		confFile:      getenv("HOME") + "/.bashistdb.conf",
+	}
+}
+
+// defaultShell returns the shell init sets up if not told: the login shell
+// if we support it, else bash.
+func defaultShell(shell string) string {
+	switch shell = path.Base(shell); shell {
+	case SHELL_BASH, SHELL_ZSH, SHELL_FISH:
+		return shell
+	}
+	return SHELL_BASH
+}
 
 // Set visited flags so we may have boolean expression criteria
-func setVisitedFlags(f *flag.Flag) {
+func (p *parser) setVisitedFlags(f *flag.Flag) {
 	switch f.Name {
 	case "U", "user":
-		userSet = true
+		p.userSet = true
 	case "H", "host":
-		hostSet = true
+		p.hostSet = true
 	case "r", "remote":
-		remoteSet = true
+		p.remoteSet = true
 	case "topk":
-		topkSet = true
+		p.topkSet = true
 	case "lastk", "tail":
-		lastkSet = true
+		p.lastkSet = true
 	case "row":
-		rowSet = true
+		p.rowSet = true
 	case "del":
-		delRowsSet = true
+		p.delRowsSet = true
 	case "A":
-		afterContentSet = true
+		p.afterContentSet = true
 	case "B":
-		beforeContentSet = true
+		p.beforeContentSet = true
 	case "C":
-		contentSet = true
+		p.contentSet = true
 	}
 }
 
 // Set all boolean flags. Besides flag vars, this is also for stdin
 // detection and query detection (non-flag argument).
-func parseCustomFlags() {
+func (p *parser) parseCustomFlags() {
 	// Set boolean counterparts for non-boolean flag vars.
-	flag.Visit(setVisitedFlags)
+	p.flags.Visit(p.setVisitedFlags)
 
 	// Detect if there is a QUERY in the command line (that is non-flag arguments)
-	if len(flag.Args()) > 0 {
-		querySet = true
-	}
-
-	// Detect if there are data coming from stdin:
-	stats, _ := os.Stdin.Stat()
-	if (stats.Mode() & os.ModeCharDevice) != os.ModeCharDevice {
-		stdinSet = true
+	if len(p.flags.Args()) > 0 {
+		p.querySet = true
+	}
+
+	// Detect if there are data coming from stdin. If stdin is a file
+	// we check that it isn't a terminal, else we trust the caller.
+	switch f := p.stdin.(type) {
+	case nil:
+	case interface {
+		Stat() (os.FileInfo, error)
+	}:
+		stats, err := f.Stat()
+		if err == nil && (stats.Mode()&os.ModeCharDevice) != os.ModeCharDevice {
+			p.stdinSet = true
+		}
+	default:
+		p.stdinSet = true
 	}
 }
 
@@ -132,298 +218,415 @@ func parseCustomFlags() {
 // detect incompatible arguments, just that the user will see only
 // one of the arguments executed. This function serves more as a help
 // mode.
-func checkFlagCombination() error {
+func (p *parser) checkFlagCombination() error {
+	c := p.cfg
 	// Do not mix server, client and local modes:
 	// Server mode incompatible with client mode.
-	if Mode == MODE_SERVER && remoteSet { // User may just set his BASHISTDB_REMOTE env var
+	if c.Mode == MODE_SERVER && p.remoteSet { // User may just set his BASHISTDB_REMOTE env var
 		return errors.New("Incompatible options: server and client.")
 	}
 
-	if lastkSet && topkSet {
+	if p.lastkSet && p.topkSet {
 		return errors.New("Incompatible options: -lastk and -topk.")
 	}
 
-	if topkSet && uniqueSet {
+	if p.topkSet && p.uniqueSet {
 		return errors.New("Incompatible options: -topk and -unique.")
 	}
 
-	if rowSet && (lastkSet || topkSet) {
+	if p.rowSet && (p.lastkSet || p.topkSet) {
 		return errors.New("Incompatible options: -rows and one of -lastk, -topk")
 	}
 
-	if usersSet && (lastkSet || topkSet || querySet || rowSet) {
+	if p.usersSet && (p.lastkSet || p.topkSet || p.querySet || p.rowSet) {
 		return errors.New("Incompatible options: -users with other type of query")
 	}
 
-	if rowSet && querySet {
+	if p.rowSet && p.querySet {
 		return errors.New("Incompatible options: -row combined with query")
 	}
 
-	if delRowsSet && (lastkSet || topkSet || querySet || rowSet || usersSet) {
+	if p.delRowsSet && (p.lastkSet || p.topkSet || p.querySet || p.rowSet || p.usersSet) {
 		return errors.New("Incompatible options: -del combined with other type of query")
 	}
 
-	if regexSet && (lastkSet || topkSet || rowSet || usersSet || delRowsSet) {
-		Log.Info.Println("R(egexp) flag works only for simple queries. For other types it works as an exact match flag.")
+	if p.regexSet && (p.lastkSet || p.topkSet || p.rowSet || p.usersSet || p.delRowsSet) {
+		c.Log.Info.Println("R(egexp) flag works only for simple queries. For other types it works as an exact match flag.")
 	}
 
-	if uniqueSet && (afterContentSet || beforeContentSet || contentSet) {
-		Log.Info.Println("u(nique) flag doesn't work with content, before, after search")
+	if p.uniqueSet && (p.afterContentSet || p.beforeContentSet || p.contentSet) {
+		c.Log.Info.Println("u(nique) flag doesn't work with content, before, after search")
 	}
 
-	if (afterContentSet || beforeContentSet || contentSet) && (lastkSet || topkSet || rowSet || usersSet || delRowsSet) {
+	if (p.afterContentSet || p.beforeContentSet || p.contentSet) && (p.lastkSet || p.topkSet || p.rowSet || p.usersSet || p.delRowsSet) {
 		return errors.New("Incompatible options: content search (-A, -B, -C) and a non standard query")
 	}
 
+	if p.followSet && (p.lastkSet || p.topkSet || p.rowSet || p.usersSet || p.delRowsSet || p.afterContentSet || p.beforeContentSet || p.contentSet) {
+		return errors.New("Incompatible options: -follow combined with other type of query")
+	}
+
+	if p.followSet && c.Mode == MODE_LOCAL {
+		return errors.New("Incompatible options: -follow works only in client mode")
+	}
+
 	// Check mode-operation incompatibility
-	if Mode == MODE_SERVER && QParams.Type != QUERY_DEMO {
+	if c.Mode == MODE_SERVER && c.QParams.Type != QUERY_DEMO {
 		return errors.New("Incompatible options: asked for server mode and other functions.\n\n")
 	}
 	return nil
 }
 
 // Sets Operation Query Parameters
-func setOpAndQParams() error {
+func (p *parser) setOpAndQParams() error {
+	c := p.cfg
 	var err error
 	// Determine operation (used in local and client mode)
 	switch {
-	case topkSet:
-		Operation = OP_QUERY
-		QParams.Type = QUERY_TOPK
-		QParams.Kappa = topk
-	case lastkSet:
-		Operation = OP_QUERY
-		QParams.Type = QUERY_LASTK
-		QParams.Kappa = lastk
-	case usersSet:
-		Operation = OP_QUERY
-		QParams.Type = QUERY_USERS
-	case afterContentSet, beforeContentSet, contentSet:
-		Operation = OP_QUERY
-		QParams.Type = QUERY_CONTENT
-		if afterContentSet {
-			QParams.AfterContent = afterContent
+	case p.migrateSet:
+		c.Operation = OP_MIGRATE_STATUS
+	case p.topkSet:
+		c.Operation = OP_QUERY
+		c.QParams.Type = QUERY_TOPK
+		c.QParams.Kappa = p.topk
+	case p.lastkSet:
+		c.Operation = OP_QUERY
+		c.QParams.Type = QUERY_LASTK
+		c.QParams.Kappa = p.lastk
+	case p.usersSet:
+		c.Operation = OP_QUERY
+		c.QParams.Type = QUERY_USERS
+	case p.afterContentSet, p.beforeContentSet, p.contentSet:
+		c.Operation = OP_QUERY
+		c.QParams.Type = QUERY_CONTENT
+		if p.afterContentSet {
+			c.QParams.AfterContent = p.afterContent
 		}
-		if beforeContentSet {
-			QParams.BeforeContent = beforeContent
+		if p.beforeContentSet {
+			c.QParams.BeforeContent = p.beforeContent
 		}
-		if contentSet {
-			QParams.AfterContent, QParams.BeforeContent = content, content
+		if p.contentSet {
+			c.QParams.AfterContent, c.QParams.BeforeContent = p.content, p.content
 		}
-	case querySet: // We have non-flag arguments -> it is a query
-		Operation = OP_QUERY
-		QParams.Type = QUERY
-	case rowSet:
-		Operation = OP_QUERY
-		QParams.Type = QUERY_ROW
-		QParams.Kappa = row
-	case delRowsSet:
-		Operation = OP_QUERY
-		QParams.Type = DELETE
-		QParams.Rows, err = parseRange(delRows)
+	case p.followSet: // Follow may have a query, so it goes before querySet
+		c.Operation = OP_FOLLOW
+		c.QParams.Type = QUERY
+	case p.querySet: // We have non-flag arguments -> it is a query
+		c.Operation = OP_QUERY
+		c.QParams.Type = QUERY
+	case p.rowSet:
+		c.Operation = OP_QUERY
+		c.QParams.Type = QUERY_ROW
+		c.QParams.Kappa = p.row
+	case p.delRowsSet:
+		c.Operation = OP_QUERY
+		c.QParams.Type = DELETE
+		c.QParams.Rows, err = parseRange(p.delRows)
 		if err != nil {
 			return err
 		}
-	case stdinSet:
-		Operation = OP_IMPORT
+	case p.stdinSet:
+		c.Operation = OP_IMPORT
 	default: // Demo mode
-		Operation = OP_QUERY
-		QParams.Type = QUERY_DEMO
+		c.Operation = OP_QUERY
+		c.QParams.Type = QUERY_DEMO
 	}
 
-	if availableFormats[format] { // Query uses output format
-		QParams.Format = format
+	if availableFormats[p.format] { // Query uses output format
+		c.QParams.Format = p.format
 	} else {
-		Log.Info.Println("The specified format doesn't exist. Reverting to default:", FORMAT_DEFAULT)
-		QParams.Format = FORMAT_DEFAULT
+		c.Log.Info.Println("The specified format doesn't exist. Reverting to default:", FORMAT_DEFAULT)
+		c.QParams.Format = FORMAT_DEFAULT
 	}
 
-	switch uniqueSet {
-	case true:
-		QParams.Unique = true
-	default:
-		QParams.Unique = false
-	}
+	c.QParams.Unique = p.uniqueSet
 
-	QParams.User = user
-	if usersSet && !userSet { // simple users query should be global
-		QParams.User = "%"
+	c.QParams.User = p.user
+	if (p.usersSet || p.followSet) && !p.userSet { // simple users and follow queries should be global
+		c.QParams.User = "%"
 	}
 
-	QParams.Host = host
-	if usersSet && !hostSet { // simple users query should be global
-		QParams.Host = "%"
+	c.QParams.Host = p.host
+	if (p.usersSet || p.followSet) && !p.hostSet { // simple users and follow queries should be global
+		c.QParams.Host = "%"
 	}
 
 	// Check for global (search) flag
-	if Operation == OP_QUERY && globalSet {
-		// User, Hostname = "%", "%" // TODO: remove
-		QParams.User, QParams.Host = "%", "%"
+	if (c.Operation == OP_QUERY || c.Operation == OP_FOLLOW) && p.globalSet {
+		c.QParams.User, c.QParams.Host = "%", "%"
 	}
 
 	// Query is the non flag os.Args parts.
 	// Depending on the pcre flag, we prepare the query differently.
-	switch regexSet {
+	switch p.regexSet {
 	case true:
-		QParams.Regex = true
-		QParams.Command = strings.Join(flag.Args(), " ")
+		c.QParams.Regex = true
+		c.QParams.Command = strings.Join(p.flags.Args(), " ")
 	default:
-		QParams.Regex = false
-		QParams.Command = "%" + strings.Join(flag.Args(), " ") + "%" // Grep like behaviour
+		c.QParams.Regex = false
+		c.QParams.Command = "%" + strings.Join(p.flags.Args(), " ") + "%" // Grep like behaviour
 	}
 
 	return nil
 }
 
-// Sets and parses flags. Helps for testing to separate these.
-func setParseFlags() {
+// Sets and parses flags.
+func (p *parser) setParseFlags(args []string) error {
+	f := p.flags
+	// We print our own help and errors.
+	f.SetOutput(ioutil.Discard)
 	// flagVars, we keep actual documentation separated
-	flag.StringVar(&database, "db", database, "Database file")
-	flag.BoolVar(&versionSet, "V", versionSet, "Show version.")
-	flag.IntVar(&verbosity, "v", verbosity, "verbosity level")
-	flag.IntVar(&verbosity, "verbose", verbosity, "verbosity level")
-	flag.StringVar(&user, "U", user, "custom username")
-	flag.StringVar(&user, "user", user, "custom username")
-	flag.StringVar(&host, "H", host, "custom hostname")
-	flag.StringVar(&host, "host", host, " custom hostname")
-	flag.BoolVar(&serverSet, "s", serverSet, "run as server")
-	flag.BoolVar(&serverSet, "server", serverSet, "run as server")
-	flag.StringVar(&remote, "r", remote, "run as client, connect to SERVER")
-	flag.StringVar(&remote, "remote", remote, "run as client, connect to SERVER")
-	flag.StringVar(&port, "p", port, "port")
-	flag.StringVar(&port, "port", port, "port")
-	flag.StringVar(&passphrase, "k", passphrase, "passphrase")
-	flag.StringVar(&passphrase, "key", passphrase, "passphrase")
-	flag.StringVar(&format, "f", format, "query output format")
-	flag.StringVar(&format, "format", format, "query output format")
-	flag.BoolVar(&helpSet, "h", helpSet, "help")
-	flag.BoolVar(&helpSet, "help", helpSet, "help")
-	flag.BoolVar(&globalSet, "g", globalSet, "global: '-user % -host %'")
-	flag.BoolVar(&writeconfSet, "save", writeconfSet, "write ~/.bashistdb.conf")
-	flag.BoolVar(&setupSet, "init", setupSet, "set-up system to use bashistdb")
-	flag.BoolVar(&uniqueSet, "u", uniqueSet, "show unique (distinct) command lines")
-	flag.BoolVar(&uniqueSet, "unique", uniqueSet, "show unique (distinct) command lines")
-	flag.IntVar(&topk, "topk", topk, "return K most used command lines")
-	flag.IntVar(&lastk, "lastk", lastk, "return K most recent command lines")
-	flag.IntVar(&lastk, "tail", lastk, "return K most recent command lines")
-	flag.BoolVar(&usersSet, "users", usersSet, "show users in database")
-	flag.BoolVar(&localSet, "local", localSet, "force local mode")
-	flag.IntVar(&row, "row", row, "return this row")
-	flag.StringVar(&delRows, "del", delRows, "delete these rows")
-	flag.BoolVar(&regexSet, "R", regexSet, "regular expression search")
-	flag.IntVar(&afterContent, "A", afterContent, "return this many rows after match")
-	flag.IntVar(&beforeContent, "B", beforeContent, "return this many rows before match")
-	flag.IntVar(&content, "C", content, "return this many rows before and after match")
-	flag.Parse()
+	f.StringVar(&p.database, "db", p.database, "Database file")
+	f.BoolVar(&p.versionSet, "V", p.versionSet, "Show version.")
+	f.IntVar(&p.verbosity, "v", p.verbosity, "verbosity level")
+	f.IntVar(&p.verbosity, "verbose", p.verbosity, "verbosity level")
+	f.StringVar(&p.user, "U", p.user, "custom username")
+	f.StringVar(&p.user, "user", p.user, "custom username")
+	f.StringVar(&p.host, "H", p.host, "custom hostname")
+	f.StringVar(&p.host, "host", p.host, " custom hostname")
+	f.BoolVar(&p.serverSet, "s", p.serverSet, "run as server")
+	f.BoolVar(&p.serverSet, "server", p.serverSet, "run as server")
+	f.StringVar(&p.remote, "r", p.remote, "run as client, connect to SERVER")
+	f.StringVar(&p.remote, "remote", p.remote, "run as client, connect to SERVER")
+	f.StringVar(&p.port, "p", p.port, "port")
+	f.StringVar(&p.port, "port", p.port, "port")
+	f.StringVar(&p.passphrase, "k", p.passphrase, "passphrase")
+	f.StringVar(&p.passphrase, "key", p.passphrase, "passphrase")
+	f.StringVar(&p.format, "f", p.format, "query output format")
+	f.StringVar(&p.format, "format", p.format, "query output format")
+	f.BoolVar(&p.helpSet, "h", p.helpSet, "help")
+	f.BoolVar(&p.helpSet, "help", p.helpSet, "help")
+	f.BoolVar(&p.globalSet, "g", p.globalSet, "global: '-user % -host %'")
+	f.BoolVar(&p.writeconfSet, "save", p.writeconfSet, "write ~/.bashistdb.conf")
+	f.BoolVar(&p.setupSet, "init", p.setupSet, "set-up system to use bashistdb")
+	f.BoolVar(&p.uniqueSet, "u", p.uniqueSet, "show unique (distinct) command lines")
+	f.BoolVar(&p.uniqueSet, "unique", p.uniqueSet, "show unique (distinct) command lines")
+	f.IntVar(&p.topk, "topk", p.topk, "return K most used command lines")
+	f.IntVar(&p.lastk, "lastk", p.lastk, "return K most recent command lines")
+	f.IntVar(&p.lastk, "tail", p.lastk, "return K most recent command lines")
+	f.BoolVar(&p.usersSet, "users", p.usersSet, "show users in database")
+	f.BoolVar(&p.localSet, "local", p.localSet, "force local mode")
+	f.IntVar(&p.row, "row", p.row, "return this row")
+	f.StringVar(&p.delRows, "del", p.delRows, "delete these rows")
+	f.BoolVar(&p.regexSet, "R", p.regexSet, "regular expression search")
+	f.IntVar(&p.afterContent, "A", p.afterContent, "return this many rows after match")
+	f.IntVar(&p.beforeContent, "B", p.beforeContent, "return this many rows before match")
+	f.IntVar(&p.content, "C", p.content, "return this many rows before and after match")
+	f.BoolVar(&p.followSet, "follow", p.followSet, "print new matching history lines as they arrive")
+	f.BoolVar(&p.migrateSet, "migrate-status", p.migrateSet, "show the schema migrations of the database")
+	err := f.Parse(args)
+	if err == flag.ErrHelp { // -help is a flag of ours, this is for -h
+		p.helpSet, err = true, nil
+	}
+	return err
 }
 
-// parse is the “main” of out configuration code.
+// Parse builds a Config from the command line arguments (without the
+// program name), the environment and stdin. Environment variables are
+// read with getenv, usually os.Getenv. Stdin is where history to import
+// may be read from; if it is a terminal or nil, there is nothing to import.
+// Even if Parse returns an error, the returned Config may be used to print
+// help.
+//
 // Configuration seems a bit messy but that's the way it is.
-func parse() error {
-	// If this is set, skip reading settings from configuration file.
-	if t := os.Getenv("BASHISTDB_TEST"); t == "" {
-		if err := readConfFile(); err != nil {
+func Parse(args []string, getenv func(string) string, stdin io.Reader) (*Config, error) {
+	p := newParser(getenv, stdin)
+	err := p.parse(args)
+	if err != nil {
+		p.cfg.Mode = MODE_ERROR
+	}
+	return p.cfg, err
+}
+
+// parse is the “main” of out configuration code.
+func (p *parser) parse(args []string) error {
+	c := p.cfg
+	c.ConfFile = p.confFile
+
+	// Try to load settings from configuration file, they override the
+	// environment.
+	// Doctor reports a broken configuration file instead of failing.
+	if err := p.readConfFile(); err != nil {
+		if len(args) == 0 || args[0] != "doctor" {
+			p.setHelpValues()
 			return err
 		}
+		c.ConfErr = err
 	}
 
 	// If port isn't set yet, set default port.
-	if port == "" {
-		port = bashistPort
+	if p.port == "" {
+		p.port = bashistPort
+	}
+
+	// Subcommands have their own flags. Without one, we parse the flags
+	// of earlier versions, so existing hooks keep working.
+	if len(args) > 0 {
+		if cmd := findCommand(args[0]); cmd != nil {
+			return p.parseCommand(cmd, args[1:])
+		}
 	}
+	return p.parseFlags(args)
+}
+
+// parseFlags parses the flags of bashistdb versions before subcommands.
+func (p *parser) parseFlags(args []string) error {
+	c := p.cfg
 
 	// Set flag vars and parse them
-	setParseFlags()
+	err := p.setParseFlags(args)
+	p.setHelpValues()
+	if err != nil {
+		return err
+	}
 
 	// Set custom flags (non flag-package variables)
-	parseCustomFlags()
+	p.parseCustomFlags()
 
-	if helpSet {
-		Mode = MODE_HELP
+	if p.helpSet {
+		c.Mode = MODE_HELP
 		return nil
 	}
 
 	// Verbosity reaches up to 2 (DEBUG)
-	if verbosity > 2 {
-		verbosity = 2
+	if p.verbosity > 2 {
+		p.verbosity = 2
 	}
 
-	// Create global logger
-	Log = llog.New(verbosity)
-
 	// Determine run mode. A run mode is expected to run and then bashistdb toexit.
 	switch { // Cases are in precedence order
-	case setupSet:
-		Mode = MODE_INIT
-	case versionSet:
-		Mode = MODE_PRINT_VERSION
-	case serverSet:
-		Mode = MODE_SERVER
-		Address = ":" + port
-		if verbosity < 1 { // Server mode sets min verbosity of 1 (INFO)
-			verbosity = 1
+	case p.setupSet:
+		c.Mode = MODE_INIT
+	case p.versionSet:
+		c.Mode = MODE_PRINT_VERSION
+	case p.serverSet:
+		c.Mode = MODE_SERVER
+		c.Address = ":" + p.port
+		if p.verbosity < 1 { // Server mode sets min verbosity of 1 (INFO)
+			p.verbosity = 1
 		}
-	case remote != "" && !localSet:
-		Mode = MODE_CLIENT
-		Address = remote + ":" + port
+	case p.remote != "" && !p.localSet && !p.migrateSet: // migrations are local
+		c.Mode = MODE_CLIENT
+		c.Address = p.remote + ":" + p.port
 	default:
-		Mode = MODE_LOCAL
+		c.Mode = MODE_LOCAL
 	}
 
-	if err := setOpAndQParams(); err != nil {
+	// Create logger
+	c.Log = llog.New(p.verbosity)
+
+	if err := p.setOpAndQParams(); err != nil {
 		return err
 	}
 
-	if err := checkFlagCombination(); err != nil {
+	if err := p.checkFlagCombination(); err != nil {
 		return err
 	}
 
+	return p.finish()
+}
+
+// finish checks and completes the configuration once the mode and
+// operation are set.
+func (p *parser) finish() error {
+	c := p.cfg
+
 	// Protest about username issues.
-	if user == "" {
+	if p.user == "" {
 		return errors.New("Couldn't read username from $USER system variable and none was provided by -user flag.")
 	}
-	User = user // TODO: remove
 
 	// Protest about hostname issues.
-	if host == "" {
+	if p.host == "" {
 		return errors.New("Couldn't get hostname from system and none was provided by -host flag.")
 	}
-	Hostname = host // TODO: remove
 
-	welcomeMessages()
+	p.welcomeMessages()
 
-	// Set database filename
-	Database = database
+	c.HistTimeFormat = p.histFormat
+	c.Location = time.Local
+	if p.timeZone != "" {
+		loc, err := time.LoadLocation(p.timeZone)
+		if err != nil {
+			return errors.New("Unknown time zone: " + p.timeZone)
+		}
+		c.Location = loc
+	}
+
+	for _, r := range p.redact {
+		if _, err := regexp.Compile(r); err != nil {
+			return errors.New("Bad redaction pattern " + r + ": " + err.Error())
+		}
+	}
+	c.Redact = p.redact
+	c.Ignore = p.ignore
+
+	r := p.retention
+	for _, d := range []string{r.MaxAge, r.Interval} {
+		if _, err := ParseAge(d); d != "" && err != nil {
+			return err
+		}
+	}
+	for _, u := range r.Users {
+		if _, err := ParseAge(u.MaxAge); u.MaxAge != "" && err != nil {
+			return err
+		}
+	}
+	c.Retention = r
+
+	switch p.encrypt {
+	case ENCRYPT_KEEP, ENCRYPT_NONE, ENCRYPT_COMMANDS, ENCRYPT_ALL:
+	default:
+		return errors.New("Unknown encryption setting: " + p.encrypt)
+	}
+	c.Encrypt = p.encrypt
 
 	// When we setup the system, we should also save settings
-	if setupSet {
-		writeconfSet = true
+	if p.setupSet {
+		p.writeconfSet = true
 	}
 
 	// Passphrase may come from environment or flag
-	if Mode == MODE_SERVER || Mode == MODE_CLIENT || writeconfSet {
-		if passphrase == "" {
-			log.Println("Using empty passphrase.")
+	if c.Mode == MODE_SERVER || c.Mode == MODE_CLIENT || (c.Mode == MODE_DOCTOR && c.Address != "") || p.writeconfSet {
+		if p.passphrase == "" {
+			c.Log.Println("Using empty passphrase.")
 		}
-		Key = []byte(passphrase)
 	}
+	// The database's encryption at rest uses it too, also in local mode.
+	c.Key = []byte(p.passphrase)
+	if c.Encrypt != ENCRYPT_KEEP && c.Encrypt != ENCRYPT_NONE && c.Mode != MODE_CLIENT && p.passphrase == "" {
+		return errors.New("Encryption at rest needs a passphrase, set key.")
+	}
+	c.AdminKey = []byte(p.adminKey)
 
-	if writeconfSet {
-		if err := writeConfFile(); err != nil {
+	if p.writeconfSet {
+		if err := p.writeConfFile(); err != nil {
 			return err
 		}
-		Log.Info.Println("Wrote settings to ", confFile)
+		c.Log.Info.Println("Wrote settings to ", p.confFile)
 	}
 
-	Log.Debug.Printf("Database: %s, mode: %d, operation: %d, address: %s\n", Database, Mode, Operation, Address)
+	c.Log.Debug.Printf("Database: %s, mode: %d, operation: %d, address: %s\n", c.Database, c.Mode, c.Operation, c.Address)
 
 	return nil
 }
 
-func welcomeMessages() {
+// setHelpValues copies to the Config the settings we show in help text,
+// so they are there even if parsing fails.
+func (p *parser) setHelpValues() {
+	c := p.cfg
+	c.Database = p.database
+	c.User = p.user
+	c.Hostname = p.host
+	c.Remote = p.remote
+	c.Port = p.port
+}
+
+func (p *parser) welcomeMessages() {
+	c := p.cfg
 	// Welcome message
 	m := ""
-	switch Mode {
+	switch c.Mode {
 	case MODE_SERVER:
 		m = "server"
 	case MODE_CLIENT:
@@ -432,13 +635,13 @@ func welcomeMessages() {
 		m = "local"
 	}
 
-	Log.Info.Println("Welcome " + User + "@" + Hostname + ". Bashistdb is in " + m + " mode.")
-	Log.Debug.Println("Loaded some settings from environment. Configuration file and flags can override them.")
-	if foundConfFile {
-		Log.Info.Println("Loaded some settings from ~/.bashistdbconf. Command line flags can override them.")
+	c.Log.Info.Println("Welcome " + c.User + "@" + c.Hostname + ". Bashistdb is in " + m + " mode.")
+	c.Log.Debug.Println("Loaded some settings from environment. Configuration file and flags can override them.")
+	if p.foundConfFile {
+		c.Log.Info.Println("Loaded some settings from ~/.bashistdbconf. Command line flags can override them.")
 	}
 
-	if Operation == OP_QUERY {
-		Log.Info.Printf("Your query parameters are user: %s, host: %s, command line: %s.\n", QParams.User, QParams.Host, QParams.Command)
+	if c.Operation == OP_QUERY || c.Operation == OP_FOLLOW {
+		c.Log.Info.Printf("Your query parameters are user: %s, host: %s, command line: %s.\n", c.QParams.User, c.QParams.Host, c.QParams.Command)
 	}
 }
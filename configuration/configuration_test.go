@@ -16,17 +16,17 @@
 // along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
 
 /*
-Testing configuration is difficult because it is meant to run on the init stage,
-use flags, use non-flag command line arguments, use environment variables and settings
-from a file. All these are almost impossible to test. Even more so since they overlap.
+Testing configuration is difficult because it uses flags, non-flag command line
+arguments, environment variables and settings from a file. Since they overlap,
+we can't test every combination.
 
 Thus we test parts of our code. In general we accept that the process below is correct:
 
 1. Set default variables. Some are read from the environment.
 2. If there is a configuration file, read it and update the variables it includes values for.
 
-And we test the rest of the code that uses the variables and set flags to set the exported
-set of variables.
+And we test the rest of the code that uses the variables and set flags to set the
+returned Config.
 
 It is important to test and use go coverage tool for this test. It will help you see
 if the test passed from the codepaths you would expect.
@@ -36,68 +36,24 @@ package configuration
 
 import (
 	"errors"
-	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
-func init() {
-	os.Setenv("BASHISTDB_TEST", "test")
-}
-
-func resetFlags(args ...string) {
-	os.Args = args
-	// This is where magic happens. Think of it as resetting the flag package.
-	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-
-	// These are used as actual flagvars
-	database = "test.sqlite3"
-	versionSet = false
-	verbosity = 0
-	user = "test"
-	host = "test"
-	serverSet = false
-	remote = ""
-	port = ""
-	passphrase = ""
-	format = FORMAT_DEFAULT
-	helpSet = false
-	globalSet = false
-	writeconfSet = false
-	setupSet = false
-	topk = 20
-	lastk = 20
-	localSet = false
-	uniqueSet = false
-	usersSet = false
-	row = 0
-	regexSet = false
-	// Here we will store the non flag arguments //
-	// These are not parsed from flags but we set them with flag.Visit
-	userSet = false
-	hostSet = false
-	remoteSet = false
-	topkSet = false
-	lastkSet = false
-	rowSet = false
-	// These are set with manual searches
-	querySet = false
-	stdinSet = false
-	// Vars below can not be overriden by user
-	confFile = "test.conf"
-	foundConfFile = false
-
-	// Exported variables
-	Mode = 0
-	Operation = 0
-	Address = ""
-	Database = ""
-	Key = []byte{}
-	User = ""
-	Hostname = ""
-	QParams = *new(QueryParams)
+// testEnv returns a getenv function for a test environment with the
+// given home directory.
+func testEnv(home string, vars ...string) func(string) string {
+	env := map[string]string{"HOME": home, "USER": "test"}
+	for i := 0; i+1 < len(vars); i += 2 {
+		env[vars[i]] = vars[i+1]
+	}
+	return func(key string) string { return env[key] }
 }
 
 func TestParse(t *testing.T) {
@@ -107,6 +63,15 @@ func TestParse(t *testing.T) {
 		ER // We expect test to return error
 	)
 
+	home, err := ioutil.TempDir("", "bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	osHostname = func() (string, error) { return "test", nil }
+	defer func() { osHostname = os.Hostname }()
+	db := home + "/.bashistdb.sqlite3"
+
 	test := []struct {
 		want   exportedVars
 		expect int
@@ -126,7 +91,7 @@ func TestParse(t *testing.T) {
 			test:   "Test topk and lastk incompatibility: ",
 		},
 		{
-			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test1", Hostname: "test2",
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: db, User: "test1", Hostname: "test2",
 				QParams: QueryParams{Type: QUERY_LASTK, User: "test1", Host: "test2", Format: FORMAT_JSON, Command: "%git%", Unique: true, Kappa: 5}},
 			expect: OK,
 			input:  []string{"cmd", "-U", "test1", "-host", "test2", "-lastk", "5", "-format", "json", "-unique", "git"},
@@ -153,35 +118,35 @@ func TestParse(t *testing.T) {
 			test:   "Test row - default query incompatibility: ",
 		},
 		{
-			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_QUERY, Address: "localhost:25625", Database: "test.sqlite3", User: "test", Hostname: "test",
+			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_QUERY, Address: "localhost:25625", Database: db, User: "test", Hostname: "test",
 				QParams: QueryParams{Type: QUERY_ROW, User: "test", Host: "test", Format: FORMAT_BASH_HISTORY, Command: "%%", Unique: true, Kappa: 500}},
 			expect: OK,
 			input:  []string{"cmd", "-r", "localhost", "-row", "500", "-format", "restore", "-unique"},
 			test:   "Test row query: ",
 		},
 		{
-			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_QUERY, Address: "localhost:25625", Database: "test.sqlite3", User: "test", Hostname: "test",
+			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_QUERY, Address: "localhost:25625", Database: db, User: "test", Hostname: "test",
 				QParams: QueryParams{Type: QUERY_ROW, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%", Unique: true, Kappa: 500}},
 			expect: OK,
 			input:  []string{"cmd", "-r", "localhost", "-row", "500", "-format", "abadformat", "-unique"},
 			test:   "Test non-existant format, use default: ",
 		},
 		{
-			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: db, User: "test", Hostname: "test",
 				QParams: QueryParams{Type: QUERY, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%s%s%"}},
 			expect: OK,
 			input:  []string{"cmd", "-g", "s%s"},
 			test:   "Test global flag: ",
 		},
 		{
-			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: db, User: "test", Hostname: "test",
 				QParams: QueryParams{Type: QUERY_USERS, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Unique: false, Kappa: 0}},
 			expect: OK,
 			input:  []string{"cmd", "--local", "-users"},
 			test:   "Test users flag: ",
 		},
 		{
-			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: db, User: "test", Hostname: "test",
 				QParams: QueryParams{Type: DELETE, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%", Rows: []int{1, 3, 4, 5, 9}}},
 			expect: OK,
 			input:  []string{"cmd", "-del", "1,3-5,9,3"},
@@ -198,7 +163,434 @@ func TestParse(t *testing.T) {
 			test:   "Test del flag with non-compatible row flag: ",
 		},
 		{
-			want:   exportedVars{Mode: MODE_HELP},
+			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_FOLLOW, Address: "localhost:25625", Database: db, User: "test", Hostname: "test2",
+				QParams: QueryParams{Type: QUERY, User: "%", Host: "test2", Format: FORMAT_DEFAULT, Command: "%git%"}},
+			expect: OK,
+			input:  []string{"cmd", "-r", "localhost", "-follow", "-H", "test2", "git"},
+			test:   "Test follow flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-follow", "git"},
+			test:   "Test follow flag in local mode: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-r", "localhost", "-follow", "-lastk", "5"},
+			test:   "Test follow flag with non-compatible lastk flag: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_CONTENT, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%git push%"}},
+			expect: OK,
+			input:  []string{"cmd", "search", "-C", "2", "git", "push"},
+			test:   "Test search command: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_QUERY, Address: "localhost:25625", Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_TOPK, User: "%", Host: "%", Format: FORMAT_JSON, Command: "%%", Kappa: 5}},
+			expect: OK,
+			input:  []string{"cmd", "top", "-r", "localhost", "-g", "-n", "5", "-f", "json"},
+			test:   "Test top command: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_FOLLOW, Address: "localhost:25625", Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%git%"}},
+			expect: OK,
+			input:  []string{"cmd", "tail", "-r", "localhost", "-follow", "git"},
+			test:   "Test tail command with follow: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "tail", "-follow", "git"},
+			test:   "Test tail command with follow in local mode: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_FIND, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%git st%", Unique: true}},
+			expect: OK,
+			input:  []string{"cmd", "find", "-g", "-u", "git", "st"},
+			test:   "Test find command: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_CONFIRM, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: DELETE, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Rows: []int{1, 3, 4, 5, 9}}},
+			expect: OK,
+			input:  []string{"cmd", "delete", "1,3-5", "9"},
+			test:   "Test delete command: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "%",
+				QParams: QueryParams{Type: DELETE_QUERY, User: "test", Host: "%", Format: FORMAT_DEFAULT, Command: "%secret%",
+					Since: time.Date(2015, 10, 12, 0, 0, 0, 0, time.Local), Until: time.Date(2015, 10, 13, 12, 0, 0, 0, time.UTC)}},
+			expect: OK,
+			input:  []string{"cmd", "delete", "-y", "-H", "%", "-q", "secret", "-since", "2015-10-12", "-until", "2015-10-13T12:00:00Z"},
+			test:   "Test delete command with a search: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "delete"},
+			test:   "Test delete command without rows or search: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "delete", "-since", "yesterday"},
+			test:   "Test delete command with bad time: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: UNDELETE, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%"}},
+			expect: OK,
+			input:  []string{"cmd", "undelete", "-all"},
+			test:   "Test undelete command: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "undelete"},
+			test:   "Test undelete command without ids: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: PURGE_TRASH, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%", Rows: []int{2, 3}, DryRun: true}},
+			expect: OK,
+			input:  []string{"cmd", "purge-trash", "-dry-run", "2-3"},
+			test:   "Test purge-trash command: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_ALIASES}},
+			expect: OK,
+			input:  []string{"cmd", "alias"},
+			test:   "Test alias command without arguments: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: ALIAS, Identity: IDENTITY_USER, From: "me", To: "marios"}},
+			expect: OK,
+			input:  []string{"cmd", "alias", "user", "me", "marios"},
+			test:   "Test alias command: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: ALIAS, Identity: IDENTITY_HOST, From: "laptop"}},
+			expect: OK,
+			input:  []string{"cmd", "alias", "-d", "host", "laptop"},
+			test:   "Test alias command with -d: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "alias", "user", "me"},
+			test:   "Test alias command without canonical name: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: RENAME, Identity: IDENTITY_HOST, From: "laptop", To: "work"}},
+			expect: OK,
+			input:  []string{"cmd", "rename", "host", "laptop", "work"},
+			test:   "Test rename command: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "rename", "group", "wheel", "admin"},
+			test:   "Test rename command with an unknown kind: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_MERGE, Database: db, User: "test", Hostname: "test", File: "old.sqlite3",
+				Merge: MergeParams{Users: map[string]string{"me": "test", "root": "admin"}, Hosts: map[string]string{"laptop": "test"}}},
+			expect: OK,
+			input:  []string{"cmd", "merge", "-map-user", "me=test", "-map-user", "root=admin", "-map-host", "laptop=test", "old.sqlite3"},
+			test:   "Test merge command: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "merge", "-map-user", "me", "old.sqlite3"},
+			test:   "Test merge command with a bad mapping: ",
+		},
+		{
+			want:   exportedVars{Mode: MODE_LOCAL, Operation: OP_MIGRATE_STATUS, Database: db, User: "test", Hostname: "test"},
+			expect: OK,
+			input:  []string{"cmd", "migrate-status"},
+			test:   "Test migrate-status command: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_MIGRATE_STATUS, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%"}},
+			expect: OK,
+			input:  []string{"cmd", "-migrate-status", "-r", "10.10.0.1"},
+			test:   "Test -migrate-status flag: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_ADMIN, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: BACKUP}, File: "backup.sqlite3"},
+			expect: OK,
+			input:  []string{"cmd", "backup", "backup.sqlite3"},
+			test:   "Test backup command: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "backup"},
+			test:   "Test backup command without a file: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_ADMIN, Address: "10.10.0.1:25625", Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: RESTORE}, File: "backup.sqlite3", Yes: true, AdminKey: []byte("admin")},
+			expect: OK,
+			input:  []string{"cmd", "restore", "-r", "10.10.0.1", "-admin-key", "admin", "-y", "backup.sqlite3"},
+			test:   "Test restore command in remote mode: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_ADMIN, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: CHECK}},
+			expect: OK,
+			input:  []string{"cmd", "check"},
+			test:   "Test check command: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: REDACT, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%", DryRun: true}},
+			expect: OK,
+			input:  []string{"cmd", "redact", "-dry-run"},
+			test:   "Test redact command: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: PURGE, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%"}},
+			expect: OK,
+			input:  []string{"cmd", "purge"},
+			test:   "Test purge command: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: PRUNE, User: "test", Host: "test", Format: FORMAT_JSON, Command: "%%", DryRun: true}},
+			expect: OK,
+			input:  []string{"cmd", "prune", "-dry-run", "-f", "json"},
+			test:   "Test prune command: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "row", "a"},
+			test:   "Test row command with bad row id: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "top", "-lastk", "5"},
+			test:   "Test command with flag of other command: ",
+		},
+		{
+			want:   exportedVars{Mode: MODE_LOCAL, Operation: OP_IMPORT, Database: db, User: "test1", Hostname: "test"},
+			expect: OK,
+			input:  []string{"cmd", "import", "-U", "test1"},
+			test:   "Test import command: ",
+		},
+		{
+			want:   exportedVars{Mode: MODE_LOCAL, Operation: OP_IMPORT, Database: db, User: "test", Hostname: "test", Dir: "/tmp"},
+			expect: OK,
+			input:  []string{"cmd", "import", "-dir", "/tmp"},
+			test:   "Test import command with directory: ",
+		},
+		{
+			want:   exportedVars{Mode: MODE_LOCAL, Operation: OP_IMPORT, Database: db, User: "test", Hostname: "test", Dir: "/tmp", Session: "1445000000-42"},
+			expect: OK,
+			input:  []string{"cmd", "import", "-dir", "/tmp", "-session", "1445000000-42"},
+			test:   "Test import command with session: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_CONTENT, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%make%", Sessions: true}},
+			expect: OK,
+			input:  []string{"cmd", "search", "-session", "make"},
+			test:   "Test search command with sessions: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "search", "-session", "-C", "3", "make"},
+			test:   "Test search command with sessions and content: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_SESSIONS, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%make%",
+					Since: time.Date(2015, 10, 12, 0, 0, 0, 0, time.Local)}},
+			expect: OK,
+			input:  []string{"cmd", "sessions", "-since", "2015-10-12", "make"},
+			test:   "Test sessions command: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_SESSIONS, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%"}},
+			expect: OK,
+			input:  []string{"cmd", "sessions", "-all"},
+			test:   "Test sessions command for all times: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_CONTENT, Kappa: 42, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Sessions: true}},
+			expect: OK,
+			input:  []string{"cmd", "session", "42"},
+			test:   "Test session command: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "session", "last"},
+			test:   "Test session command with a bad row id: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_PROGRAMS, Kappa: 20, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%", Group: GROUP_PROGRAM}},
+			expect: OK,
+			input:  []string{"cmd", "programs"},
+			test:   "Test programs command: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_PROGRAMS, Kappa: 5, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Group: GROUP_SUBCOMMAND, Program: "git"}},
+			expect: OK,
+			input:  []string{"cmd", "programs", "-g", "-n", "5", "-program", "git"},
+			test:   "Test programs command for a program: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_PROGRAMS, Kappa: 20, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%docker%", Group: GROUP_FLAG}},
+			expect: OK,
+			input:  []string{"cmd", "programs", "-by", "flag", "docker"},
+			test:   "Test programs command by flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "programs", "-by", "user"},
+			test:   "Test programs command with a bad count: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_SUGGEST_ALIASES, Kappa: 10, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%"}},
+			expect: OK,
+			input:  []string{"cmd", "suggest-aliases"},
+			test:   "Test suggest-aliases command: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_SUGGEST_ALIASES, Kappa: 3, User: "%", Host: "%", Format: FORMAT_JSON, Command: "%git%"}},
+			expect: OK,
+			input:  []string{"cmd", "suggest-aliases", "-g", "-n", "3", "-f", "json", "git"},
+			test:   "Test suggest-aliases command with a query: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_NEXT, Kappa: 5, User: "test", Host: "test", Format: FORMAT_ALL, Command: ""}},
+			expect: OK,
+			input:  []string{"cmd", "next"},
+			test:   "Test next command: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_NEXT, Kappa: 1, User: "%", Host: "%", Format: FORMAT_COMMAND_LINE, Command: "terraform plan%",
+					Since: time.Date(2015, 10, 12, 0, 0, 0, 0, time.Local)}},
+			expect: OK,
+			input:  []string{"cmd", "next", "-g", "-n", "1", "-f", "command_line", "-since", "2015-10-12", "terraform", "plan%"},
+			test:   "Test next command with a command line: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_TYPOS, Kappa: 10, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%git%"}},
+			expect: OK,
+			input:  []string{"cmd", "typos", "git"},
+			test:   "Test typos command: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_CONFIRM, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: DELETE_TYPOS, Kappa: 10, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%"}},
+			expect: OK,
+			input:  []string{"cmd", "typos", "-g", "-delete"},
+			test:   "Test typos command with -delete: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: DELETE_TYPOS, Kappa: 10, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%", DryRun: true}},
+			expect: OK,
+			input:  []string{"cmd", "typos", "-delete", "-dry-run"},
+			test:   "Test typos command with -delete and -dry-run: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "typos", "-y"},
+			test:   "Test typos command with -y but not -delete: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_STATS, User: "test", Host: "test", Format: FORMAT_CHART, Command: "%%"}},
+			expect: OK,
+			input:  []string{"cmd", "stats"},
+			test:   "Test stats command: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_STATS, User: "%", Host: "%", Format: FORMAT_CSV, Command: "%git%",
+					Since: time.Date(2015, 10, 12, 0, 0, 0, 0, time.Local)}},
+			expect: OK,
+			input:  []string{"cmd", "stats", "-g", "-f", "csv", "-since", "2015-10-12", "git"},
+			test:   "Test stats command with a query, time range and format: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "stats", "-f", "log"},
+			test:   "Test stats command with a bad format: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_BACK, Database: db, User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_LASTK, Kappa: 3, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%", Dir: "/tmp"}},
+			expect: OK,
+			input:  []string{"cmd", "back", "-dir", "/tmp", "3"},
+			test:   "Test back command: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "back", "0"},
+			test:   "Test back command with bad number: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_INIT, Database: db, User: "test", Hostname: "test",
+				Setup: SetupParams{Shell: SHELL_ZSH, Keys: true, Up: UP_DIR}},
+			expect: OK,
+			input:  []string{"cmd", "init", "-shell", "zsh", "-up", "dir"},
+			test:   "Test init command with key bindings: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_INIT, Database: db, User: "test", Hostname: "test",
+				Setup: SetupParams{Shell: SHELL_FISH, Uninstall: true}},
+			expect: OK,
+			input:  []string{"cmd", "init", "-uninstall", "-shell", "fish"},
+			test:   "Test init command uninstall: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "init", "-keys", "-shell", "csh"},
+			test:   "Test init command with unknown shell: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_DOCTOR, Address: "server:4000", Database: db, User: "test", Hostname: "test", Key: []byte("pass"),
+				Setup: SetupParams{Shell: SHELL_ZSH}},
+			expect: OK,
+			input:  []string{"cmd", "doctor", "-r", "server", "-p", "4000", "-k", "pass", "-shell", "zsh"},
+			test:   "Test doctor command: ",
+		},
+		{
+			want:   exportedVars{Mode: MODE_SERVER, Address: ":4000", Database: db, User: "test", Hostname: "test", Key: []byte("pass")},
+			expect: OK,
+			input:  []string{"cmd", "server", "-p", "4000", "-k", "pass"},
+			test:   "Test server command: ",
+		},
+		{
+			want:   exportedVars{Mode: MODE_HELP, Database: db, User: "test", Hostname: "test"},
+			expect: OK,
+			input:  []string{"cmd", "help", "search"},
+			test:   "Test help command: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "help", "nosuchcommand"},
+			test:   "Test help for unknown command: ",
+		},
+		{
+			want:   exportedVars{Mode: MODE_HELP, Database: db, User: "test", Hostname: "test"},
 			expect: OK,
 			input:  []string{"cmd", "-s", "-k", "pass", "-h"},
 			test:   "Test help flag: ",
@@ -206,32 +598,119 @@ func TestParse(t *testing.T) {
 	}
 
 	// Test remote override by server (remote set by env or conf file)
-	resetFlags("cmd", "-s")
-	remote = "localhost"
-	if err := parse(); err != nil {
+	if _, err := Parse([]string{"-s"}, testEnv(home, "BASHISTDB_REMOTE", "localhost"), nil); err != nil {
 		t.Fatalf("Test remote override by server failed. " + err.Error())
 	}
 
 	for _, v := range test {
-		resetFlags(v.input...)
-		err := parse()
+		c, err := Parse(v.input[1:], testEnv(home), nil)
 		switch v.expect {
 		case OK:
 			if err != nil {
 				t.Fatal(v.test + err.Error())
 			}
-			if err := compare(v.want); err != nil {
+			if err := compare(c, v.want); err != nil {
 				t.Fatal(v.test + err.Error())
 			}
 		case ER:
 			if err == nil {
 				t.Fatal(v.test + "should not get error")
 			}
+			if c.Mode != MODE_ERROR {
+				t.Fatal(v.test + "mode should be MODE_ERROR")
+			}
 		}
+		c.PrintHelp(ioutil.Discard)
 	}
 
-	PrintHelp(ioutil.Discard)
+	// Test import when there are data in stdin
+	c, err := Parse([]string{"-U", "test1"}, testEnv(home), strings.NewReader("1 ls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Mode != MODE_LOCAL || c.Operation != OP_IMPORT || c.User != "test1" {
+		t.Fatalf("Test import failed. Got mode %d, operation %d, user %s.", c.Mode, c.Operation, c.User)
+	}
 
+	// Test settings from configuration file
+	err = ioutil.WriteFile(home+"/.bashistdb.conf", []byte(`{"database": "conf.sqlite3", "remote": "10.10.0.2"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = Parse([]string{"ls"}, testEnv(home), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Database != "conf.sqlite3" || c.Address != "10.10.0.2:25625" || c.Mode != MODE_CLIENT {
+		t.Fatalf("Test configuration file failed. Got database %s, address %s.", c.Database, c.Address)
+	}
+
+	// Test timestamp settings, the configuration file overrides the environment
+	err = ioutil.WriteFile(home+"/.bashistdb.conf", []byte(`{"histtimeformat": "%F %T ", "timezone": "UTC"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = Parse([]string{"import"}, testEnv(home, "HISTTIMEFORMAT", "%s "), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HistTimeFormat != "%F %T " || c.Location != time.UTC {
+		t.Fatalf("Test timestamp settings failed. Got format %q, zone %v.", c.HistTimeFormat, c.Location)
+	}
+	if _, err = Parse([]string{"import", "-timezone", "Nowhere/Special"}, testEnv(home), nil); err == nil {
+		t.Fatal("Test unknown time zone should get error")
+	}
+
+	// Test redaction patterns and ignore rules survive saving the configuration
+	err = ioutil.WriteFile(home+"/.bashistdb.conf", []byte(`{"redact": ["pin (\\d+)"],
+		"ignore": {"patterns": ["ls"], "ignorespace": true, "hosts": {"prod-*": {"keep": ["ls"]}}},
+		"retention": {"maxage": "90d", "users": {"root": {"maxrows": 10}}}, "key": "secret", "encrypt": "all"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Parse([]string{"config", "-save"}, testEnv(home), nil); err != nil {
+		t.Fatal(err)
+	}
+	c, err = Parse([]string{"import"}, testEnv(home), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Redact) != 1 || c.Redact[0] != `pin (\d+)` {
+		t.Fatalf("Test redaction patterns failed. Got %q.", c.Redact)
+	}
+	if ig := c.Ignore; len(ig.Patterns) != 1 || !ig.IgnoreSpace || len(ig.Hosts["prod-*"].Keep) != 1 {
+		t.Fatalf("Test ignore rules failed. Got %+v.", ig)
+	}
+	if r := c.Retention; r.MaxAge != "90d" || r.Users["root"].MaxRows != 10 {
+		t.Fatalf("Test retention rules failed. Got %+v.", r)
+	}
+	if c.Encrypt != ENCRYPT_ALL || string(c.Key) != "secret" {
+		t.Fatalf("Test encryption at rest failed. Got %q, key %q.", c.Encrypt, c.Key)
+	}
+	err = ioutil.WriteFile(home+"/.bashistdb.conf", []byte(`{"encrypt": "commands"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Parse([]string{"import"}, testEnv(home), nil); err == nil {
+		t.Fatal("Test encryption at rest without a passphrase should get error")
+	}
+	err = ioutil.WriteFile(home+"/.bashistdb.conf", []byte(`{}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err = Parse([]string{"import"}, testEnv(home), nil); err != nil {
+		t.Fatal(err)
+	}
+	if c.Encrypt != ENCRYPT_KEEP {
+		t.Fatalf("Test unset encryption at rest failed. Got %q.", c.Encrypt)
+	}
+	err = ioutil.WriteFile(home+"/.bashistdb.conf", []byte(`{"redact": ["pin (\\d+"]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Parse([]string{"import"}, testEnv(home), nil); err == nil {
+		t.Fatal("Test bad redaction pattern should get error")
+	}
 }
 
 type exportedVars struct {
@@ -243,56 +722,93 @@ type exportedVars struct {
 	User      string      // User is the username detected or explicitly set
 	Hostname  string      // Hostname is the hostname detected or explicitly set
 	QParams   QueryParams // Parameters to query
+	Dir       string      // Dir is the working directory stored with imported history
+	Session   string      // Session is the shell session stored with imported history
+	Setup     SetupParams // Setup are the options of init
+	AdminKey  []byte      // AdminKey authenticates admin messages
+	File      string      // File is the backup file of backup and restore
+	Yes       bool        // Yes skips asking before restore
+	Merge     MergeParams // Merge are the options of merge
 }
 
-func compare(v exportedVars) error {
+func compare(c *Config, v exportedVars) error {
 	s := ""
-	if Mode != v.Mode {
-		s += fmt.Sprintf("Mode wrong. Wanted %d, got %d.\n", v.Mode, Mode)
+	if c.Mode != v.Mode {
+		s += fmt.Sprintf("Mode wrong. Wanted %d, got %d.\n", v.Mode, c.Mode)
+	}
+	if c.Operation != v.Operation {
+		s += fmt.Sprintf("Operation wrong. Wanted %d, got %d.\n", v.Operation, c.Operation)
+	}
+	if c.Address != v.Address {
+		s += fmt.Sprintf("Address wrong. Wanted %s, got %s.\n", v.Address, c.Address)
 	}
-	if Operation != v.Operation {
-		s += fmt.Sprintf("Operation wrong. Wanted %d, got %d.\n", v.Operation, Operation)
+	if c.Database != v.Database {
+		s += fmt.Sprintf("Database wrong. Wanted %s, got %s.\n", v.Database, c.Database)
 	}
-	if Address != v.Address {
-		s += fmt.Sprintf("Address wrong. Wanted %s, got %s.\n", v.Address, Address)
+	if string(c.Key) != string(v.Key) {
+		s += fmt.Sprintf("Key wrong. Wanted %s, got %s.\n", string(v.Key), string(c.Key))
 	}
-	if Database != v.Database {
-		s += fmt.Sprintf("Database wrong. Wanted %s, got %s.\n", v.Database, Database)
+	if c.User != v.User {
+		s += fmt.Sprintf("User wrong. Wanted %s, got %s.\n", v.User, c.User)
 	}
-	if string(Key) != string(v.Key) {
-		s += fmt.Sprintf("Key wrong. Wanted %s, got %s.\n", string(v.Key), string(Key))
+	if c.Hostname != v.Hostname {
+		s += fmt.Sprintf("Hostname wrong. Wanted %s, got %s.\n", v.Hostname, c.Hostname)
 	}
-	if User != v.User {
-		s += fmt.Sprintf("User wrong. Wanted %s, got %s.\n", v.User, User)
+	if c.Dir != v.Dir || c.Session != v.Session {
+		s += fmt.Sprintf("Dir/Session wrong. Wanted %s %s, got %s %s.\n", v.Dir, v.Session, c.Dir, c.Session)
 	}
-	if Hostname != v.Hostname {
-		s += fmt.Sprintf("Hostname wrong. Wanted %s, got %s.\n", v.Hostname, Hostname)
+	if c.Setup != v.Setup {
+		s += fmt.Sprintf("Setup wrong. Wanted %+v, got %+v.\n", v.Setup, c.Setup)
+	}
+	if string(c.AdminKey) != string(v.AdminKey) {
+		s += fmt.Sprintf("AdminKey wrong. Wanted %s, got %s.\n", string(v.AdminKey), string(c.AdminKey))
+	}
+	if fmt.Sprint(c.Merge) != fmt.Sprint(v.Merge) {
+		s += fmt.Sprintf("Merge wrong. Wanted %v, got %v.\n", v.Merge, c.Merge)
+	}
+	if c.File != v.File || c.Yes != v.Yes {
+		s += fmt.Sprintf("File/Yes wrong. Wanted %s %v, got %s %v.\n", v.File, v.Yes, c.File, c.Yes)
 	}
 
-	if QParams.Type != v.QParams.Type {
-		s += fmt.Sprintf("QParams.Type wrong. Wanted %s, got %s.\n", v.QParams.Type, QParams.Type)
+	if c.QParams.Type != v.QParams.Type {
+		s += fmt.Sprintf("QParams.Type wrong. Wanted %s, got %s.\n", v.QParams.Type, c.QParams.Type)
 	}
-	if QParams.Kappa != v.QParams.Kappa {
-		s += fmt.Sprintf("QParams.Kappa wrong. Wanted %d, got %d.\n", v.QParams.Kappa, QParams.Kappa)
+	if c.QParams.Kappa != v.QParams.Kappa {
+		s += fmt.Sprintf("QParams.Kappa wrong. Wanted %d, got %d.\n", v.QParams.Kappa, c.QParams.Kappa)
 	}
-	if QParams.User != v.QParams.User {
-		s += fmt.Sprintf("QParams.User wrong. Wanted %s, got %s.\n", v.QParams.User, QParams.User)
+	if c.QParams.User != v.QParams.User {
+		s += fmt.Sprintf("QParams.User wrong. Wanted %s, got %s.\n", v.QParams.User, c.QParams.User)
 	}
-	if QParams.Host != v.QParams.Host {
-		s += fmt.Sprintf("QParams.Host wrong. Wanted %s, got %s.\n", v.QParams.Host, QParams.Host)
+	if c.QParams.Host != v.QParams.Host {
+		s += fmt.Sprintf("QParams.Host wrong. Wanted %s, got %s.\n", v.QParams.Host, c.QParams.Host)
 	}
 
-	if QParams.Format != v.QParams.Format {
-		s += fmt.Sprintf("QParams.Format wrong. Wanted %s, got %s.\n", v.QParams.Format, QParams.Format)
+	if c.QParams.Format != v.QParams.Format {
+		s += fmt.Sprintf("QParams.Format wrong. Wanted %s, got %s.\n", v.QParams.Format, c.QParams.Format)
+	}
+	if c.QParams.Command != v.QParams.Command {
+		s += fmt.Sprintf("QParams.Command wrong. Wanted %s, got %s.\n", v.QParams.Command, c.QParams.Command)
+	}
+	if c.QParams.Dir != v.QParams.Dir {
+		s += fmt.Sprintf("QParams.Dir wrong. Wanted %s, got %s.\n", v.QParams.Dir, c.QParams.Dir)
+	}
+	if c.QParams.Unique != v.QParams.Unique {
+		s += fmt.Sprintf("QParams.Unique wrong. Wanted %v, got %v.\n", v.QParams.Unique, c.QParams.Unique)
+	}
+	if c.QParams.Sessions != v.QParams.Sessions {
+		s += fmt.Sprintf("QParams.Sessions wrong. Wanted %v, got %v.\n", v.QParams.Sessions, c.QParams.Sessions)
+	}
+	if c.QParams.Group != v.QParams.Group || c.QParams.Program != v.QParams.Program {
+		s += fmt.Sprintf("QParams.Group/Program wrong. Wanted %s %s, got %s %s.\n", v.QParams.Group, v.QParams.Program, c.QParams.Group, c.QParams.Program)
 	}
-	if QParams.Command != v.QParams.Command {
-		s += fmt.Sprintf("QParams.Command wrong. Wanted %s, got %s.\n", v.QParams.Command, QParams.Command)
+	if c.QParams.DryRun != v.QParams.DryRun {
+		s += fmt.Sprintf("QParams.DryRun wrong. Wanted %v, got %v.\n", v.QParams.DryRun, c.QParams.DryRun)
 	}
-	if QParams.Unique != v.QParams.Unique {
-		s += fmt.Sprintf("QParams.Unique wrong. Wanted %v, got %v.\n", v.QParams.Unique, QParams.Unique)
+	if !c.QParams.Since.Equal(v.QParams.Since) || !c.QParams.Until.Equal(v.QParams.Until) {
+		s += fmt.Sprintf("QParams.Since/Until wrong. Wanted %v %v, got %v %v.\n", v.QParams.Since, v.QParams.Until, c.QParams.Since, c.QParams.Until)
 	}
-	if !compareIntSlice(QParams.Rows, v.QParams.Rows) {
-		s += fmt.Sprintf("QParams.Rows wrong. Wanted %v, got %v.\n", v.QParams.Rows, QParams.Rows)
+	if !compareIntSlice(c.QParams.Rows, v.QParams.Rows) {
+		s += fmt.Sprintf("QParams.Rows wrong. Wanted %v, got %v.\n", v.QParams.Rows, c.QParams.Rows)
 	}
 
 	if s != "" {
@@ -300,3 +816,57 @@ func compare(v exportedVars) error {
 	}
 	return nil
 }
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"90d", 90 * 24 * time.Hour, true},
+		{"2w", 14 * 24 * time.Hour, true},
+		{"36h", 36 * time.Hour, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"d", 0, false},
+		{"-3d", 0, false},
+		{"3 days", 0, false},
+	}
+	for _, v := range tests {
+		got, err := ParseAge(v.in)
+		if (err == nil) != v.ok || got != v.want {
+			t.Errorf("ParseAge(%q): wanted %v, got %v %v", v.in, v.want, got, err)
+		}
+	}
+}
+
+func TestInstalled(t *testing.T) {
+	home, err := ioutil.TempDir("", "bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	bin, sbin := home+"/bin", home+"/sbin"
+	for _, f := range []struct {
+		name string
+		mode os.FileMode
+	}{
+		{bin + "/gcm", 0755}, {bin + "/notes.txt", 0644}, {bin + "/Gs", 0755}, {bin + "/kubectlxyz", 0755},
+		{sbin + "/gcm", 0755}, {sbin + "/dclfw2", 0755},
+	} {
+		if err = os.MkdirAll(filepath.Dir(f.name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(f.name, nil, f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Suggestions skip the names of executables on the PATH of the client.
+	c, err := Parse([]string{"suggest-aliases"}, testEnv(home, "PATH", bin+":"+sbin+":"+home+"/none"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"gcm", "dclfw2"}; !reflect.DeepEqual(c.QParams.Taken, want) {
+		t.Errorf("Installed names: wanted %v, got %v", want, c.QParams.Taken)
+	}
+}
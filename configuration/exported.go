@@ -18,25 +18,50 @@
 package configuration
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/andmarios/bashistdb/llog"
 )
 
-// Exported fields are global settings.
-var (
-	Mode      int          // Mode of operation (local, server, client, etc)
-	Operation int          // function (read, restore, et)
-	Log       *llog.Logger // Log is the mail logger to log to
-	Address   string       // Address is the remote server's address for client mode or server's address for server mode
-	Database  string       // Database is the filename of the sqlite database
-	Key       []byte       // Key it the user passphrase to generate keys for net comms
-	User      string       // User is the username detected or explicitly set
-	Error     error        // Will contain an error message if configuration setup failed
-	Hostname  string       // Hostname is the hostname detected or explicitly set
-	QParams   QueryParams  // Parameters to query
-)
+// A Config holds the settings of a bashistdb instance. It is created by
+// Parse, but it may also be filled by hand when bashistdb is used as a
+// library.
+type Config struct {
+	Mode       int          // Mode of operation (local, server, client, etc)
+	Operation  int          // function (read, restore, et)
+	Log        *llog.Logger // Log is the mail logger to log to
+	Address    string       // Address is the remote server's address for client mode or server's address for server mode
+	Database   string       // Database is the filename of the sqlite database
+	Key        []byte       // Key it the user passphrase to generate keys for net comms
+	User       string       // User is the username detected or explicitly set
+	Hostname   string       // Hostname is the hostname detected or explicitly set
+	Dir        string       // Dir is the working directory stored with imported history, if set
+	Session    string       // Session is the shell session stored with imported history, if set
+	Setup      SetupParams  // Setup are the options of init
+	QParams    QueryParams  // Parameters to query
+	Stdin      io.Reader    // Stdin is where history is imported from
+	Remote     string       // Remote is the server set by flag, environment or configuration file
+	Port       string       // Port is the server's port
+	ConfFile   string       // ConfFile is the configuration file's path
+	Subcommand string       // Subcommand is the command run, empty for the flags of earlier versions
+	ConfErr    error        // ConfErr is why the configuration file couldn't be read, set only in doctor mode
+
+	HistTimeFormat string         // HistTimeFormat is the HISTTIMEFORMAT of imported history, empty to detect it
+	Location       *time.Location // Location is the time zone of imported timestamps without one
+	Redact         []string       // Redact are patterns of secrets to remove from command lines, besides the built-in ones
+	Ignore         IgnoreRules    // Ignore are the rules of command lines not to record
+	Retention      RetentionRules // Retention limits how much history the database keeps
+	Encrypt        string         // Encrypt is what the database keeps encrypted at rest, with a key derived from Key
+	AdminKey       []byte         // AdminKey authenticates admin messages; servers without one refuse them
+	File           string         // File is the backup file of backup and restore, or the database to merge
+	Merge          MergeParams    // Merge are the options of merge
+	Yes            bool           // Yes skips asking before restore replaces the database
+}
 
 // Output Formats
 const (
@@ -51,6 +76,12 @@ const (
 	FORMAT_DEFAULT      = FORMAT_COMMAND_LINE
 )
 
+// Output formats of stats, besides json
+const (
+	FORMAT_CHART = "chart"
+	FORMAT_CSV   = "csv"
+)
+
 var availableFormats = map[string]bool{
 	FORMAT_BASH_HISTORY: true,
 	FORMAT_ALL:          true,
@@ -62,6 +93,10 @@ var availableFormats = map[string]bool{
 	FORMAT_ROWS:         true,
 }
 
+// HISTTIMEFORMAT_DEFAULT is the HISTTIMEFORMAT init sets, unless you
+// have set another.
+const HISTTIMEFORMAT_DEFAULT = "%FT%T%z "
+
 // Run Modes, you may only add entries at the end.
 // If many are set, precedence should be PRINT_VERSION > INIT > SERVER > CLIENT > LOCAL
 // It is ok that we use ints because these are not communicated between client and server.
@@ -74,57 +109,288 @@ const (
 	MODE_INIT
 	MODE_ERROR
 	MODE_HELP
+	MODE_CONFIG // print settings
+	MODE_DOCTOR // check the set-up
 )
 
 // Operations, you may only add entries at the end.
 const (
-	_         = iota
-	OP_IMPORT // Import history from stdin
-	OP_QUERY  // Run a query
+	_                 = iota
+	OP_IMPORT         // Import history from stdin
+	OP_QUERY          // Run a query
+	OP_FOLLOW         // Subscribe to new history lines
+	OP_FIND           // Interactive search
+	OP_BACK           // Print a command line from the end of history
+	OP_CONFIRM        // Preview a query that changes the database, ask, then run it
+	OP_ADMIN          // Run the maintenance operation in QParams.Type
+	OP_MERGE          // Merge another database into ours
+	OP_MIGRATE_STATUS // Report the schema migrations of the database
+)
+
+// What the database may keep encrypted at rest.
+const (
+	ENCRYPT_KEEP     = ""         // unset: as the database is
+	ENCRYPT_NONE     = "none"     // nothing
+	ENCRYPT_COMMANDS = "commands" // command lines
+	ENCRYPT_ALL      = "all"      // command lines, users and hosts
+)
+
+// Shells that init can set up.
+const (
+	SHELL_BASH = "bash"
+	SHELL_ZSH  = "zsh"
+	SHELL_FISH = "fish"
+)
+
+// What the up arrow key binding walks through.
+const (
+	UP_HOST = "host" // history of the user at this host
+	UP_DIR  = "dir"  // history of the user at this host in the working directory
 )
 
+// SetupParams are the options of init.
+type SetupParams struct {
+	Shell     string // Shell is the shell to set up
+	Keys      bool   // Keys installs key bindings for the interactive search
+	Up        string // Up, if set, binds the up and down arrows to walk history, UP_HOST or UP_DIR
+	Uninstall bool   // Uninstall removes what init added to the shell's rc file
+}
+
+// MergeParams are the options of merge.
+type MergeParams struct {
+	Users map[string]string // Users renames users of the merged database
+	Hosts map[string]string // Hosts renames hosts of the merged database
+}
+
+// IgnoreRules select the command lines bashistdb does not record. Patterns
+// are globs that match the whole command line, as bash's HISTIGNORE, or, if
+// prefixed with "re:", regular expressions. Overrides apply to the hosts or
+// users that match their key, a glob.
+type IgnoreRules struct {
+	Patterns    []string                  `json:"patterns,omitempty"`    // Patterns of command lines to ignore
+	IgnoreSpace bool                      `json:"ignorespace,omitempty"` // IgnoreSpace ignores command lines that start with a space
+	Hosts       map[string]IgnoreOverride `json:"hosts,omitempty"`       // Hosts are overrides by host
+	Users       map[string]IgnoreOverride `json:"users,omitempty"`       // Users are overrides by user, they win over Hosts
+}
+
+// An IgnoreOverride changes the IgnoreRules of some hosts or users.
+type IgnoreOverride struct {
+	Patterns    []string `json:"patterns,omitempty"`    // Patterns are ignored, besides the global ones
+	Keep        []string `json:"keep,omitempty"`        // Keep are patterns of command lines to record even if ignored
+	IgnoreSpace *bool    `json:"ignorespace,omitempty"` // IgnoreSpace, if set, replaces the global setting
+}
+
+// A RetentionPolicy limits how much history is kept for each user@host.
+// Zero values set no limit.
+type RetentionPolicy struct {
+	MaxAge     string `json:"maxage,omitempty"`     // Older command lines are removed, e.g 720h, 90d or 52w
+	MaxRows    int    `json:"maxrows,omitempty"`    // Only this many of the newest command lines are kept
+	KeepLatest int    `json:"keeplatest,omitempty"` // Only this many of the newest runs of each command line are kept
+}
+
+// RetentionRules are the retention policy of a database. Overrides replace
+// the policy for the users that match their key, a glob; if more match, the
+// last in alphabetical order wins.
+type RetentionRules struct {
+	RetentionPolicy
+	Users    map[string]RetentionPolicy `json:"users,omitempty"`    // Users are overrides by user
+	Interval string                     `json:"interval,omitempty"` // Interval is how often server mode prunes, an hour if empty
+}
+
+// String describes r.
+func (r RetentionRules) String() string {
+	if !r.Enabled() {
+		return "keep everything"
+	}
+	s := r.RetentionPolicy.String()
+	if len(r.Users) > 0 {
+		s += fmt.Sprintf(", %d user overrides", len(r.Users))
+	}
+	return s
+}
+
+// String describes p.
+func (p RetentionPolicy) String() string {
+	var limits []string
+	if p.MaxAge != "" {
+		limits = append(limits, "max age "+p.MaxAge)
+	}
+	if p.MaxRows > 0 {
+		limits = append(limits, fmt.Sprintf("max %d rows", p.MaxRows))
+	}
+	if p.KeepLatest > 0 {
+		limits = append(limits, fmt.Sprintf("latest %d runs of each command line", p.KeepLatest))
+	}
+	if len(limits) == 0 {
+		return "no limits"
+	}
+	return strings.Join(limits, ", ")
+}
+
+// Enabled reports whether r limits anything.
+func (r RetentionRules) Enabled() bool {
+	if r.RetentionPolicy != (RetentionPolicy{}) {
+		return true
+	}
+	for _, p := range r.Users {
+		if p != (RetentionPolicy{}) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAge parses a duration as time.ParseDuration does, and also in days
+// (e.g 90d) or weeks (e.g 52w).
+func ParseAge(s string) (time.Duration, error) {
+	var unit time.Duration
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+	if unit > 0 {
+		if n, err := strconv.Atoi(s[:len(s)-1]); err == nil && n >= 0 {
+			return time.Duration(n) * unit, nil
+		}
+	} else if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return d, nil
+	}
+	return 0, errors.New("Bad duration " + s + ", use e.g 720h, 90d or 52w.")
+}
+
 // A QueryParams contains parameters that are used to run a query.
 // Depending on query type, some fields may not be used.
 type QueryParams struct {
-	Type          string // Query type
-	Kappa         int    // If topk or lastk, we store k here
-	User          string // Search User
-	Host          string // Search Host
-	Format        string // Return format
-	Command       string // Search Term for command line field
-	Unique        bool   // Return unique command lines
-	Rows          []int  // Rowids
-	Regex         bool   // Search is a regular expression
-	AfterContent  int    // Return also this many lines after match
-	BeforeContent int    // Return also this many lines before match
+	Type          string    // Query type
+	Kappa         int       // If topk or lastk, we store k here; if row or content, a rowid
+	User          string    // Search User
+	Host          string    // Search Host
+	Format        string    // Return format
+	Command       string    // Search Term for command line field; if next, empty for the most recent command line
+	Unique        bool      // Return unique command lines
+	Rows          []int     // Rowids
+	Dir           string    // If set, lastk returns only command lines run in this directory
+	Regex         bool      // Search is a regular expression
+	AfterContent  int       // Return also this many lines after match
+	BeforeContent int       // Return also this many lines before match
+	DryRun        bool      // If a query changes the database, report the changes without making them
+	Since         time.Time // If delete_query or sessions, only command lines run at or after this time
+	Until         time.Time // If delete_query or sessions, only command lines run before this time
+	Identity      string    // If alias or rename, whether From and To are users or hosts: IDENTITY_USER or IDENTITY_HOST
+	From          string    // If alias or rename, the user or host name to alias or rename
+	To            string    // If alias or rename, the name From becomes; if alias and empty, From's alias is removed
+	Sessions      bool      // If content, return the whole shell sessions of matches instead of lines around them
+	Group         string    // If programs, what to count: GROUP_PROGRAM, GROUP_SUBCOMMAND or GROUP_FLAG
+	Program       string    // If programs, count only the simple commands that run this program
+	Taken         []string  // If suggest_aliases, the commands installed where the query is asked, which names skip
 }
 
 // Available query types
 // Since we implement a protocol and client/server could have different versions,
 // hardcoded strings instead of Go's autoincrement is better.
 const (
-	QUERY         = "query"   // A normal search (grep)
-	QUERY_LASTK   = "lastk"   // K most recent commands
-	QUERY_TOPK    = "topk"    // K most used commands
-	QUERY_USERS   = "users"   // users@host in database
-	QUERY_CLIENTS = "clients" // unique clients connected
-	QUERY_DEMO    = "demo"    // Run some demo queries
-	QUERY_ROW     = "row"     // Return a plain single row given its rowid
-	QUERY_CONTENT = "content" // Content search (n lines before, after or both)
-	DELETE        = "delete"  // Delete rows given their rowid
+	QUERY                 = "query"           // A normal search (grep)
+	QUERY_LASTK           = "lastk"           // K most recent commands
+	QUERY_TOPK            = "topk"            // K most used commands
+	QUERY_USERS           = "users"           // users@host in database
+	QUERY_CLIENTS         = "clients"         // unique clients connected
+	QUERY_DEMO            = "demo"            // Run some demo queries
+	QUERY_ROW             = "row"             // Return a plain single row given its rowid
+	QUERY_CONTENT         = "content"         // Content search (n lines before, after or both)
+	DELETE                = "delete"          // Move rows to the trash given their rowid
+	REDACT                = "redact"          // Remove secrets from stored command lines
+	PURGE                 = "purge"           // Delete stored command lines that are ignored
+	PRUNE                 = "prune"           // Delete command lines the retention policy doesn't keep
+	DELETE_QUERY          = "delete_query"    // Move the command lines a search matches to the trash
+	QUERY_TRASH           = "trash"           // Command lines in the trash
+	UNDELETE              = "undelete"        // Restore command lines from the trash
+	PURGE_TRASH           = "purge_trash"     // Delete command lines in the trash for good
+	ALIAS                 = "alias"           // Make a user or host name another name of one
+	QUERY_ALIASES         = "aliases"         // Aliases of users and hosts
+	RENAME                = "rename"          // Rename a user or host in stored command lines
+	QUERY_SESSIONS        = "sessions"        // Shell sessions
+	QUERY_STATS           = "stats"           // Statistics of command lines
+	QUERY_PROGRAMS        = "programs"        // Most used programs, subcommands or flags
+	QUERY_SUGGEST_ALIASES = "suggest_aliases" // Aliases and functions for repeated long command lines
+	QUERY_NEXT            = "next"            // Command lines that usually follow a command line
+	QUERY_TYPOS           = "typos"           // Command lines mistyped most, with their typos
+	DELETE_TYPOS          = "delete_typos"    // Move the typos the typos query finds to the trash
+)
+
+// What the names of alias and rename are.
+const (
+	IDENTITY_USER = "user"
+	IDENTITY_HOST = "host"
 )
 
-// We do this in order to be able to test the parse code (we can't test init).
-func init() {
-	if err := parse(); err != nil {
-		Mode = MODE_ERROR
-		Error = err
+// What programs counts.
+const (
+	GROUP_PROGRAM    = "program"
+	GROUP_SUBCOMMAND = "subcommand"
+	GROUP_FLAG       = "flag"
+)
+
+// Maintenance operations, the query types of OP_ADMIN. Over the network
+// they are admin messages.
+const (
+	BACKUP  = "backup"  // Copy the database
+	RESTORE = "restore" // Replace the database with a backup
+	CHECK   = "check"   // Look for damage and inconsistencies
+	VACUUM  = "vacuum"  // Reclaim free space
+)
+
+// PrintHelp prints the help text of the subcommand set in c, or the list
+// of subcommands. Current values are read from c.
+func (c *Config) PrintHelp(w io.Writer) {
+	switch c.Subcommand {
+	case "":
+		printCommandsHelp(w)
+	case "flags":
+		c.printFlagsHelp(w)
+	default:
+		if cmd := findCommand(c.Subcommand); cmd != nil {
+			printCommandHelp(w, cmd, c)
+		}
+	}
+}
+
+// PrintConfig prints the settings in c.
+func (c *Config) PrintConfig(w io.Writer) {
+	key := "not set"
+	if len(c.Key) > 0 {
+		key = "set"
+	}
+	adminKey := "not set"
+	if len(c.AdminKey) > 0 {
+		adminKey = "set"
+	}
+	encrypt := c.Encrypt
+	if encrypt == ENCRYPT_KEEP {
+		encrypt = "as the database"
 	}
+	fmt.Fprintf(w, `Configuration file: %s
+Database: %s
+Remote: %s
+Port: %s
+Key: %s
+User: %s
+Host: %s
+HISTTIMEFORMAT: %s
+Time zone: %s
+Redaction patterns: %d
+Ignore patterns: %d, overrides: %d
+Retention: %s
+Encryption at rest: %s
+Admin key: %s
+`, c.ConfFile, c.Database, c.Remote, c.Port, key, c.User, c.Hostname, c.HistTimeFormat, c.Location, len(c.Redact),
+		len(c.Ignore.Patterns), len(c.Ignore.Hosts)+len(c.Ignore.Users), c.Retention, encrypt, adminKey)
 }
 
-// PrintHelp prints the help text.
-func PrintHelp(w io.Writer) {
-	fmt.Fprintln(w, ""+`Usage of bashistdb.
+// printFlagsHelp prints the help text of the flags of earlier versions.
+func (c *Config) printFlagsHelp(w io.Writer) {
+	fmt.Fprintln(w, ""+`Usage of bashistdb with the flags of earlier versions.
 Query or run in server mode:
   bashistdb [OPTIONS] [QUERY]
 Import history:
@@ -139,7 +405,8 @@ and suffix. Think of it as grep.
 Available options:
     -db FILE
         Path to database file. It will be created if it doesn't exist.
-        Current: `+database+`
+        Use :memory: for an in-memory database that is lost on exit, e.g
+        for an ephemeral server. Current: `+c.Database+`
 
     -V
         Print version info and exit.
@@ -152,12 +419,12 @@ Available options:
         Optional user name to use instead of reading $USER variable. In query
         operations it doubles as search term for the username. Wildcard
         operators (%, _) work but unlike query we search for the exact term.
-        Current: `+user+`
+        Current: `+c.User+`
     -H, -host HOST
         Optional hostname to use instead of reading it from the system. In query
         operations, it doubles as search term for the hostname. Wildcard
         operators (%, _) work but unlike query we search for the exact term.
-        Current: `+host+`
+        Current: `+c.Hostname+`
     -g, --global
         Sets user and host to % for query operation. (equiv: -user % -host %)
 
@@ -179,8 +446,9 @@ Available options:
     -row K
         Return the K row from the database. You can pipe it to bash.
     -del EXPRESSION (e.g: 9-13,100,5)
-        Delete rows with the given row ids. Row ids stay unique unless you delete
-        the last row, where its id will be given to the next new entry.
+        Move rows with the given row ids to the trash, without asking. Row ids
+        stay unique unless you delete the last row, where its id will be given
+        to the next new entry.
     -users
         Return the users in the database. You may use search criteria, eg to
         find users who run a certain commands. By default this option searches
@@ -188,6 +456,15 @@ Available options:
     -A K, -B K, -C K
         Also print K lines A(fter), B(efore) or before and after C(ontent) of
         each match.
+    -follow
+        Keep the connection to the server open and print new history lines
+        as they are stored, much like 'tail -f'. You may add a query term and
+        user or host search criteria. By default this option follows all
+        users and hosts unless you explicitly set them via flags. Works only
+        in client mode.
+    -migrate-status
+        Print the schema version of the local database and which migrations
+        it had and needs, without migrating it.
 
     -local
         Force local [db] mode, despite remote mode being set by env or conf.
@@ -195,10 +472,10 @@ Available options:
         Run in server mode. Bashistdb currently binds to 0.0.0.0.
     -r, -remote SERVER_ADDRESS
         Run in network client mode, connect to server address. You may also set
-        this with the BASHISTDB_REMOTE env variable. Current: `+remote+`
+        this with the BASHISTDB_REMOTE env variable. Current: `+c.Remote+`
     -p, -port PORT
         Server port to listen on/connect to. You may also set this with the
-        BASHISTDB_PORT env variable. Current: `+port+`
+        BASHISTDB_PORT env variable. Current: `+c.Port+`
     -k, -key PASSPHRASE
         Passphrase to use for creating keys to encrypt network communications.
         You may also set it via the BASHISTDB_KEY env variable.
@@ -216,7 +493,7 @@ Available options:
 
     -save
         Write some settings (database, remote, port, key) to configuration file:
-        `+confFile+`. These settings override environment variables.
+        `+c.ConfFile+`. These settings override environment variables.
     -init
         Setup system for bashistdb: (1) Save settings to file. (2) Add to bashrc
         functions to timestamp history and sent each command to bashistdb
@@ -32,27 +32,56 @@ type exportFields struct {
 	Remote   string
 	Port     string
 	Key      string
+
+	HistTimeFormat string
+	TimeZone       string
+	Redact         []string
+	Ignore         *IgnoreRules
+	Retention      *RetentionRules
+	Encrypt        string
+	AdminKey       string
 }
 
 // Read configuration file, overrides environment variables.
-func readConfFile() error {
+func (p *parser) readConfFile() error {
 	// Try to load settings from configuration file (if exists)
-	if c, err := ioutil.ReadFile(confFile); err == nil {
+	if c, err := ioutil.ReadFile(p.confFile); err == nil {
 		e := &exportFields{}
 		if err = json.Unmarshal(c, e); err == nil {
 			if e.Database != "" {
-				database = e.Database
+				p.database = e.Database
 			}
 			if e.Remote != "" {
-				remote = e.Remote
+				p.remote = e.Remote
 			}
 			if e.Port != "" {
-				port = e.Port
+				p.port = e.Port
 			}
 			if e.Key != "" {
-				passphrase = e.Key
+				p.passphrase = e.Key
+			}
+			if e.HistTimeFormat != "" {
+				p.histFormat = e.HistTimeFormat
+			}
+			if e.TimeZone != "" {
+				p.timeZone = e.TimeZone
+			}
+			if len(e.Redact) > 0 {
+				p.redact = e.Redact
+			}
+			if e.Ignore != nil {
+				p.ignore = *e.Ignore
 			}
-			foundConfFile = true
+			if e.Retention != nil {
+				p.retention = *e.Retention
+			}
+			if e.Encrypt != "" {
+				p.encrypt = e.Encrypt
+			}
+			if e.AdminKey != "" {
+				p.adminKey = e.AdminKey
+			}
+			p.foundConfFile = true
 		} else {
 			return errors.New("Could not parse configuration file: " +
 				err.Error())
@@ -62,15 +91,37 @@ func readConfFile() error {
 }
 
 // Write configuration file, pretty prints JSON instead of just Marshal
-func writeConfFile() error {
+func (p *parser) writeConfFile() error {
+	redact, err := json.Marshal(p.redact)
+	if err != nil {
+		return err
+	}
+	if p.redact == nil {
+		redact = []byte("[]")
+	}
+	ignore, err := json.Marshal(p.ignore)
+	if err != nil {
+		return err
+	}
+	retention, err := json.Marshal(p.retention)
+	if err != nil {
+		return err
+	}
 	conf := fmt.Sprintf(`{
 "database": %#v,
 "remote"  : %#v,
 "port"    : %#v,
-"key"     : %#v
+"key"     : %#v,
+"histtimeformat": %#v,
+"timezone": %#v,
+"redact"  : %s,
+"ignore"  : %s,
+"retention": %s,
+"encrypt" : %#v,
+"adminkey": %#v
 }
-`, Database, remote, port, string(Key))
-	err := ioutil.WriteFile(confFile, []byte(conf), 0600)
+`, p.database, p.remote, p.port, p.passphrase, p.histFormat, p.timeZone, redact, ignore, retention, p.encrypt, p.adminKey)
+	err = ioutil.WriteFile(p.confFile, []byte(conf), 0600)
 	if err != nil {
 		return err
 	}
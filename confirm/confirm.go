@@ -0,0 +1,118 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+/*
+Package confirm runs the queries that delete command lines only after the
+user agrees. It previews a query with a dry run, prints how many command
+lines it would change and some of them, and asks.
+*/
+package confirm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/result"
+)
+
+// Samples is how many of the command lines a query would change we print.
+const Samples = 10
+
+// Run previews qp with run, asks the user and, if they agree, runs qp on the
+// command lines of the preview and prints its result to out. The question is
+// passed to ask.
+func Run(run func(qp conf.QueryParams) ([]byte, error), qp conf.QueryParams, out io.Writer,
+	ask func(question string) (bool, error)) error {
+	preview := qp
+	preview.DryRun, preview.Format = true, conf.FORMAT_JSON
+	res, err := run(preview)
+	if err != nil {
+		return err
+	}
+	rows, err := result.Decode(res)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		fmt.Fprintln(out, "No command lines match.")
+		return nil
+	}
+
+	format := qp.Format
+	if format == conf.FORMAT_JSON {
+		format = conf.FORMAT_DEFAULT
+	}
+	r := result.New(format)
+	for i, row := range rows {
+		if i == Samples {
+			break
+		}
+		r.AddRow(row.Row, row.User, row.Host, row.Command, row.Datetime)
+	}
+	fmt.Fprintf(out, "%d command lines match:\n%s\n", len(rows), r.Formatted())
+	if len(rows) > Samples {
+		fmt.Fprintf(out, "... and %d more.\n", len(rows)-Samples)
+	}
+
+	question := "Move them to the trash?"
+	if qp.Type == conf.PURGE_TRASH {
+		question = "Delete them for good?"
+	}
+	ok, err := ask(question)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Fprintln(out, "Nothing changed.")
+		return nil
+	}
+	// Change only what we printed, not what matches meanwhile.
+	qp.DryRun, qp.Rows = false, nil
+	for _, row := range rows {
+		qp.Rows = append(qp.Rows, row.Row)
+	}
+	if res, err = run(qp); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, string(res))
+	return nil
+}
+
+// Terminal asks question on the terminal, so it works while stdin and
+// stdout are redirected. Only yes or y is a yes.
+func Terminal(question string) (bool, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false, errors.New("Cannot ask for confirmation, use -y to skip it: " + err.Error())
+	}
+	defer tty.Close()
+	fmt.Fprint(tty, question+" [y/N] ")
+	answer, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package confirm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/database"
+	"github.com/andmarios/bashistdb/result"
+)
+
+func TestRun(t *testing.T) {
+	db := database.NewMemory(nil)
+	tt := time.Date(2015, 10, 12, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 12; i++ {
+		db.AddRecord("user", "host", fmt.Sprintf("rm %d", i), tt.Add(time.Duration(i)*time.Second))
+	}
+	db.AddRecord("user", "host", "ls", tt)
+	qp := conf.QueryParams{Type: conf.DELETE_QUERY, User: "%", Host: "%", Command: "rm%", Format: conf.FORMAT_COMMAND_LINE}
+
+	tests := []struct {
+		answer bool
+		want   []string
+		left   int
+	}{
+		{false, []string{"12 command lines match:\n", "... and 2 more.\n", "Nothing changed.\n"}, 13},
+		{true, []string{"12 command lines match:\n", "Moved 12 command lines to the trash."}, 1},
+		{true, []string{"No command lines match.\n"}, 1},
+	}
+	for _, v := range tests {
+		var out bytes.Buffer
+		var asked string
+		err := Run(db.RunQuery, qp, &out, func(question string) (bool, error) {
+			asked = question
+			return v.answer, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range v.want {
+			if !strings.Contains(out.String(), w) {
+				t.Errorf("Answer %v: output should contain %q, got:\n%s", v.answer, w, out.String())
+			}
+		}
+		if len(v.want) > 1 && asked != "Move them to the trash?" {
+			t.Errorf("Answer %v: wrong question %q", v.answer, asked)
+		}
+		res, _ := db.RunQuery(conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_JSON})
+		if rows, err := result.Decode(res); err != nil || len(rows) != v.left {
+			t.Errorf("Answer %v: %d command lines left instead of %d: %v", v.answer, len(rows), v.left, err)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/llog"
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrNotSQLite is returned by the maintenance operations the in-memory
+// store doesn't have.
+var ErrNotSQLite = errors.New("The in-memory database can't be backed up, restored or vacuumed.")
+
+// NewerVersion reports whether schema version a is newer than b. Versions
+// are numbers separated by dots.
+func NewerVersion(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+// Maintain runs the maintenance operation op, one of conf's BACKUP,
+// RESTORE, CHECK and VACUUM, on s and returns its report. Backups are
+// written to w and restores read from r.
+func Maintain(s Store, op string, r io.Reader, w io.Writer) (string, error) {
+	switch op {
+	case conf.BACKUP:
+		if err := s.Backup(w); err != nil {
+			return "", err
+		}
+		return "Backed up the database.", nil
+	case conf.RESTORE:
+		if err := s.Restore(r); err != nil {
+			return "", err
+		}
+		return "Restored the database.", nil
+	case conf.CHECK:
+		problems, err := s.Check()
+		if err != nil {
+			return "", err
+		}
+		if len(problems) == 0 {
+			return "No problems found.", nil
+		}
+		return fmt.Sprintf("Found %d problems:\n%s", len(problems), strings.Join(problems, "\n")), nil
+	case conf.VACUUM:
+		before, after, err := s.Vacuum()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Vacuumed the database from %d to %d bytes.", before, after), nil
+	}
+	return "", errors.New("Unknown maintenance operation: " + op)
+}
+
+// checkRecords returns the problems of the records in s: timestamps that
+// are missing, too old or in the future.
+func checkRecords(s Store, now time.Time) ([]string, error) {
+	oldest := time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC)
+	future := now.Add(24 * time.Hour)
+	// A dry run purge lists the records.
+	bad, err := s.Purge(func(r Record) bool {
+		return r.Datetime.Before(oldest) || r.Datetime.After(future)
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	for _, r := range bad {
+		problems = append(problems, fmt.Sprintf("Row %d has a bad timestamp: %s.", r.Row, r.Datetime.Format(RFC3339alt)))
+	}
+	return problems, nil
+}
+
+// Backup writes a copy of the database to w. It is consistent even while
+// other connections write to the database.
+func (d Database) Backup(w io.Writer) error {
+	dir, err := ioutil.TempDir("", "bashistdb-backup")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "backup.sqlite3")
+	if _, err = d.Exec(`VACUUM INTO ?`, file); err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Restore replaces the database with the backup r reads. The backup has to
+// pass an integrity check and have a schema version this bashistdb knows;
+// older ones are migrated. If the database was encrypted at rest with
+// Encrypt, the backup has to open with the same passphrase, and it is
+// encrypted or decrypted the same way.
+func (d Database) Restore(r io.Reader) error {
+	dir, err := ioutil.TempDir("", "bashistdb-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	src, err := openCopy(r, filepath.Join(dir, "restore.sqlite3"), "backup", d.log)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	d.rest.mu.RLock()
+	passphrase, mode := d.rest.passphrase, d.rest.want
+	d.rest.mu.RUnlock()
+	if passphrase != nil {
+		if _, err = src.Encrypt(passphrase, mode); err != nil {
+			return err
+		}
+	}
+
+	if err = copyDatabase(d.DB, src.DB); err != nil {
+		return err
+	}
+	if err = d.loadEncryption(); err != nil {
+		return err
+	}
+	if passphrase != nil {
+		_, err = d.Encrypt(passphrase, mode)
+	}
+	return err
+}
+
+// openCopy copies the bashistdb database r reads, the backup or database
+// of what we report, to file and opens it. The copy has to pass an
+// integrity check and have a schema version this bashistdb knows; older ones
+// are migrated.
+func openCopy(r io.Reader, file, what string, log *llog.Logger) (Database, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return Database{}, err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return Database{}, err
+	}
+
+	version, err := SchemaVersion(file)
+	if err != nil {
+		return Database{}, errors.New("Not a bashistdb database: " + err.Error())
+	}
+	if NewerVersion(version, VERSION) {
+		return Database{}, errors.New("The " + what + " has schema version " + version + ", newer than " + VERSION + " that this bashistdb supports.")
+	}
+	src, err := NewSQLite(file, log)
+	if err != nil {
+		return Database{}, err
+	}
+	if problems, err := integrityCheck(src.DB); err != nil || len(problems) > 0 {
+		src.Close()
+		if err == nil {
+			err = errors.New(strings.Join(problems, " "))
+		}
+		return Database{}, errors.New("The " + what + " is damaged: " + err.Error())
+	}
+	return src, nil
+}
+
+// copyDatabase copies src over dst with SQLite's online backup API.
+func copyDatabase(dst, src *sql.DB) error {
+	ctx := context.Background()
+	dc, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	sc, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	return dc.Raw(func(dconn interface{}) error {
+		return sc.Raw(func(sconn interface{}) error {
+			b, err := dconn.(*sqlite3.SQLiteConn).Backup("main", sconn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err = b.Step(-1); err != nil {
+				b.Finish()
+				return err
+			}
+			return b.Finish()
+		})
+	})
+}
+
+// integrityCheck returns the problems SQLite's integrity_check finds.
+func integrityCheck(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var p string
+		if err = rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		if p != "ok" {
+			problems = append(problems, p)
+		}
+	}
+	return problems, rows.Err()
+}
+
+// Check runs SQLite's integrity check and checks that the schema version
+// is current, that timestamps are sane and that no working directories,
+// sessions or reverse lookups are orphaned. It returns the problems it finds.
+func (d Database) Check() ([]string, error) {
+	problems, err := integrityCheck(d.DB)
+	if err != nil {
+		return nil, err
+	}
+	version, err := admin(d, "version")
+	if err != nil {
+		return nil, err
+	}
+	if version != VERSION {
+		problems = append(problems, "Schema version is "+version+" instead of "+VERSION+".")
+	}
+	orphans := []struct{ query, problem string }{
+		{`SELECT count(*) FROM dirs WHERE id NOT IN (SELECT rowid FROM history)`, "%d working directories belong to no command line."},
+		{`SELECT count(*) FROM sessions WHERE id NOT IN (SELECT rowid FROM history)`, "%d sessions belong to no command line."},
+		{`SELECT count(*) FROM rlookup WHERE ip NOT IN (SELECT remote FROM connlog)`, "%d reverse lookups belong to no connection."},
+	}
+	for _, o := range orphans {
+		var n int
+		if err = d.QueryRow(o.query).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			problems = append(problems, fmt.Sprintf(o.problem, n))
+		}
+	}
+	if err = d.rest.usable(); err != nil {
+		return append(problems, err.Error()), nil
+	}
+	records, err := checkRecords(d, time.Now())
+	return append(problems, records...), err
+}
+
+// Vacuum rebuilds the database file to reclaim free space. It returns the
+// size of the database before and after.
+func (d Database) Vacuum() (before, after int64, err error) {
+	size := func() (n int64, err error) {
+		var count, page int64
+		if err = d.QueryRow(`PRAGMA page_count`).Scan(&count); err == nil {
+			err = d.QueryRow(`PRAGMA page_size`).Scan(&page)
+		}
+		return count * page, err
+	}
+	if before, err = size(); err != nil {
+		return 0, 0, err
+	}
+	if _, err = d.Exec(`VACUUM`); err != nil {
+		return 0, 0, err
+	}
+	after, err = size()
+	return before, after, err
+}
+
+// Backup returns ErrNotSQLite.
+func (m *Memory) Backup(w io.Writer) error {
+	return ErrNotSQLite
+}
+
+// Restore returns ErrNotSQLite.
+func (m *Memory) Restore(r io.Reader) error {
+	return ErrNotSQLite
+}
+
+// Check checks that timestamps are sane.
+func (m *Memory) Check() ([]string, error) {
+	return checkRecords(m, time.Now())
+}
+
+// Vacuum returns ErrNotSQLite.
+func (m *Memory) Vacuum() (before, after int64, err error) {
+	return 0, 0, ErrNotSQLite
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+func TestNewerVersion(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"2.2", "2.1", true},
+		{"2.10", "2.9", true},
+		{"2", "2.1", false},
+		{"2.2", "2.2", false},
+		{"3", "2.2", true},
+	}
+	for _, v := range tests {
+		if got := NewerVersion(v.a, v.b); got != v.want {
+			t.Errorf("NewerVersion(%s, %s): wanted %v, got %v", v.a, v.b, v.want, got)
+		}
+	}
+}
+
+func TestMaintain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewSQLite(dir+"/db.sqlite3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// Restore encrypts backups the way the database is.
+	if _, err = s.Encrypt([]byte("secret"), conf.ENCRYPT_COMMANDS); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	for i, c := range []string{"ls", "make", "git status"} {
+		if err = s.AddRecord("u", "h", c, now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func() int {
+		all, err := s.Purge(func(Record) bool { return true }, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(all)
+	}
+
+	// maintain runs op and checks its report starts with want.
+	maintain := func(op string, r []byte, want string) []byte {
+		var w bytes.Buffer
+		report, err := Maintain(s, op, bytes.NewReader(r), &w)
+		if err != nil {
+			t.Fatalf("%s failed: %s", op, err)
+		}
+		if !strings.HasPrefix(report, want) {
+			t.Errorf("%s: wanted report %q, got %q", op, want, report)
+		}
+		return w.Bytes()
+	}
+
+	backup := maintain(conf.BACKUP, nil, "Backed up the database.")
+	if _, err = s.Trash([]int{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.EmptyTrash(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	maintain(conf.VACUUM, nil, "Vacuumed the database from ")
+	maintain(conf.RESTORE, backup, "Restored the database.")
+	if n := count(); n != 3 {
+		t.Errorf("Restore: wanted 3 command lines, got %d", n)
+	}
+	res, err := s.RunQuery(conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%status%", Format: conf.FORMAT_COMMAND_LINE})
+	if err != nil || !strings.HasSuffix(strings.TrimSpace(string(res)), "git status") {
+		t.Errorf("Search after restore: got %q, %v", res, err)
+	}
+	maintain(conf.CHECK, nil, "No problems found.")
+
+	// Check finds an old timestamp and an orphaned working directory.
+	if err = s.AddRecord("u", "h", "old", time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Exec(`INSERT INTO dirs(id, dir) VALUES(1000, '/tmp')`); err != nil {
+		t.Fatal(err)
+	}
+	maintain(conf.CHECK, nil, "Found 2 problems:")
+
+	// Restore refuses what isn't a backup and backups of newer versions.
+	if _, err = Maintain(s, conf.RESTORE, strings.NewReader("not a database"), nil); err == nil {
+		t.Error("Restore of garbage should get error")
+	}
+	newer := dir + "/newer.sqlite3"
+	d, err := NewSQLite(newer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.Exec(`UPDATE admin SET value = '99' WHERE key = 'version'`); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	b, err := ioutil.ReadFile(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Maintain(s, conf.RESTORE, bytes.NewReader(b), nil); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("Restore of a newer version: wanted error, got %v", err)
+	}
+	if n := count(); n != 4 {
+		t.Errorf("Failed restores changed the database: wanted 4 command lines, got %d", n)
+	}
+
+	if err = NewMemory(nil).Backup(ioutil.Discard); err != ErrNotSQLite {
+		t.Errorf("Memory backup: wanted ErrNotSQLite, got %v", err)
+	}
+}
+
+func TestCheckSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewSQLite(dir+"/db.sqlite3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// A rewrite that merges two command lines drops the session of the one
+	// it deletes.
+	now := time.Now().Truncate(time.Second)
+	for _, c := range []string{"dup 1", "dup 2"} {
+		if err = s.AddRecord("u", "h", c, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = s.Exec(`INSERT INTO sessions(id, session) SELECT rowid, 's1' FROM history`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Rewrite(func(c string) string { return strings.Replace(c, "dup 2", "dup 1", 1) }, false); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := s.Check(); err != nil || len(problems) != 0 {
+		t.Errorf("Check after a merging rewrite: got %v, %v", problems, err)
+	}
+
+	if _, err = s.Exec(`INSERT INTO sessions(id, session) VALUES(1000, 's2')`); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := s.Check(); err != nil || len(problems) != 1 || !strings.Contains(problems[0], "sessions") {
+		t.Errorf("Check of an orphaned session: got %v, %v", problems, err)
+	}
+}
@@ -24,18 +24,15 @@ package database
 import (
 	"bufio"
 	"database/sql"
-	"errors"
-	"fmt"
-	"io"
 	"net"
 	"os"
-	"regexp"
 	"strings"
-	"sync"
 	"time"
 
 	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/ignore"
 	"github.com/andmarios/bashistdb/llog"
+	"github.com/andmarios/bashistdb/redact"
 	"github.com/mattn/go-sqlite3"
 )
 
@@ -43,34 +40,86 @@ import (
 const RFC3339alt = "2006-01-02T15:04:05-0700"
 
 // VERSION is the database's schema supported version.
-// If your database is older it will be automatically migrated.
-// If it is newer you have to update your bashistdb copy.
-const VERSION = "2.1"
+// If your database is older it will be automatically migrated, see
+// migrations. If it is newer you have to update your bashistdb copy.
+const VERSION = "2.5"
 
-// A Database holds a bashistdb database.
+// A Database holds a bashistdb SQLite database. It implements Store.
 type Database struct {
 	*sql.DB
 	statements
+	hub  *Hub
+	log  *llog.Logger
+	rest *atRest
 }
 
 type statements struct {
-	insert *sql.Stmt
+	insert        *sql.Stmt
+	insertDir     *sql.Stmt
+	insertSession *sql.Stmt
 }
 
-var log *llog.Logger
+// New returns the Store set in cfg. It doesn't store the command lines
+// cfg.Ignore ignores and removes secrets from the rest, with the built-in
+// rules and the patterns of cfg.Redact. It prunes with cfg.Retention. A
+// SQLite database is encrypted at rest as set in cfg.Encrypt, with cfg.Key;
+// if cfg.Encrypt is unset, it stays as it is.
+func New(cfg *conf.Config) (Store, error) {
+	rd, err := redact.New(cfg.Redact)
+	if err != nil {
+		return nil, err
+	}
+	ig, err := ignore.New(cfg.Ignore)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Open(cfg.Database, cfg.Log)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := s.(Database); ok {
+		n, err := d.Encrypt(cfg.Key, cfg.Encrypt)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		if n > 0 && cfg.Encrypt == conf.ENCRYPT_NONE {
+			cfg.Log.Info.Printf("Decrypted %d command lines at rest.\n", n)
+		} else if n > 0 {
+			cfg.Log.Info.Printf("Encrypted %d command lines at rest.\n", n)
+		}
+	}
+	return Retaining(Ignoring(Redacting(s, rd), ig), cfg.Retention), nil
+}
 
-func init() {
-	log = conf.Log
+// Open returns a Store for filename. If filename is MEMORY, it returns
+// a new in-memory store, else it opens the SQLite database with NewSQLite.
+// If log is nil, nothing is logged.
+func Open(filename string, log *llog.Logger) (Store, error) {
+	log = logger(log)
+	if filename == MEMORY {
+		log.Info.Println("Using an in-memory database. History will be lost on exit.")
+		return NewMemory(log), nil
+	}
+	return NewSQLite(filename, log)
 }
 
-// New returns a new Database instance. It gets the filename for the
-// database from the configuration package. If the file does not exist,
-// it creates a new database. If it exists, it migrates it if it has an
-// older schema version than current.
-func New() (Database, error) {
+// logger returns log or, if it is nil, a silent logger.
+func logger(log *llog.Logger) *llog.Logger {
+	if log == nil {
+		return llog.New(llog.SILENT)
+	}
+	return log
+}
+
+// NewSQLite returns a new Database instance for filename. If the file does
+// not exist, it creates a new database. If it exists, it migrates it if it
+// has an older schema version than current.
+func NewSQLite(filename string, log *llog.Logger) (Database, error) {
+	log = logger(log)
 	// If database file does not exist, set a flag to create file and table.
 	init := false
-	if _, err := os.Stat(conf.Database); os.IsNotExist(err) {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
 		log.Info.Println("Database file not found. Creating new.")
 		init = true
 	} else {
@@ -78,35 +127,41 @@ func New() (Database, error) {
 	}
 	// Open database. SQLite3 provides concurrency in the library level, thus
 	// we don't need to implement locking.
-	db, err := sql.Open("sqlite3", conf.Database)
-	if err != nil {
-		return Database{}, err
-	}
+	rest := &atRest{mode: conf.ENCRYPT_NONE}
+	db := sql.OpenDB(newConnector(filename, rest))
 	// If database is new, initialize it with our tables.
 	// Else migrate it if needed.
 	if init {
-		if err = initDB(db); err != nil {
+		if err := initDB(db); err != nil {
 			_ = db.Close()
 			return Database{}, err
 		}
 	} else {
-		err := migrate(db)
-		if err != nil {
+		if err := migrate(db, filename, log); err != nil {
+			_ = db.Close()
 			return Database{}, err
 		}
 	}
 	// Prepare various statements that may be used frequently.
-	errs := make([]error, 5)
-	var insert *sql.Stmt
-	insert, errs[0] = db.Prepare("INSERT INTO history(user, host, command, datetime) VALUES(?, ?, ?, ?)")
+	errs := make([]error, 3)
+	var insert, insertDir, insertSession *sql.Stmt
+	insert, errs[0] = db.Prepare("INSERT INTO history(user, host, command, datetime) VALUES(sealid(?), sealid(?), seal(?), ?)")
+	insertDir, errs[1] = db.Prepare("INSERT OR REPLACE INTO dirs(id, dir) VALUES(?, ?)")
+	insertSession, errs[2] = db.Prepare("INSERT OR REPLACE INTO sessions(id, session) VALUES(?, ?)")
 	for _, e := range errs {
 		if e != nil {
 			_ = db.Close()
 			return Database{}, e
 		}
 	}
-	stmts := statements{insert}
-	return Database{db, stmts}, nil
+	stmts := statements{insert, insertDir, insertSession}
+	d := Database{db, stmts, newHub(log), log, rest}
+	d.hub.canonical = d.canonical
+	if err := d.loadEncryption(); err != nil {
+		_ = db.Close()
+		return Database{}, err
+	}
+	return d, nil
 }
 
 func initDB(db *sql.DB) error {
@@ -120,6 +175,36 @@ CREATE TABLE history (
 );
 CREATE INDEX HistoryDatetimeIdx ON history(datetime);
 
+CREATE TABLE dirs (
+    id  INTEGER PRIMARY KEY,
+    dir TEXT
+);
+CREATE INDEX DirsDirIdx ON dirs(dir);
+
+CREATE TABLE sessions (
+    id      INTEGER PRIMARY KEY,
+    session TEXT
+);
+CREATE INDEX SessionsSessionIdx ON sessions(session);
+
+CREATE TABLE trash (
+    id       INTEGER PRIMARY KEY,
+    row      INTEGER,
+    user     TEXT,
+    host     TEXT,
+    command  TEXT,
+    datetime DATETIME,
+    dir      TEXT,
+    session  TEXT
+);
+
+CREATE TABLE aliases (
+    kind      TEXT,
+    alias     TEXT,
+    canonical TEXT,
+    PRIMARY KEY (kind, alias)
+);
+
 CREATE TABLE admin (
     key   TEXT PRIMARY KEY,
     value TEXT
@@ -158,32 +243,31 @@ CREATE VIEW connections AS
 // Note: function isn't used anywhere, may need testing if used.
 func (d Database) AddRecord(user, host, command string, time time.Time) error {
 	// Try to insert row
-	_, err := d.insert.Exec(user, host, command, time)
+	res, err := d.insert.Exec(user, host, command, time)
+	if err == nil {
+		if id, err := res.LastInsertId(); err == nil {
+			d.hub.publish(Record{Row: int(id), User: user, Host: host, Command: command, Datetime: time})
+		}
+	}
 	if err != nil {
 		// If failed due to duplicate primary key, then ignore error
 		// We expect for ease of use, the user to resubmit the whole
 		// history from time to time.
-		if driverErr, ok := err.(sqlite3.Error); ok {
-			if driverErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
-				log.Debug.Println("Duplicate entry. Ignoring.", user, host, command, time)
-			} else {
-				return err
-			}
-		} else { // Normally we can never reach this. Should we omit it?
+		if !isDuplicate(err) {
 			return err
 		}
+		d.log.Debug.Println("Duplicate entry. Ignoring.", user, host, command, time)
 	}
 	return nil
 }
 
-// A parseline parses history output lines of the following format:
-//     LINENUM RFC3339_DATETIME COMMAND
-var parseLine = regexp.MustCompile(`^ *[0-9]+\*? *([0-9T:+-]{24,24}) *(.*)`)
-
-// A parseExportLine parses export formatted output from bashistdb:
-//     USER HOSTNAME RFC3339_DATETIME COMMAND
-//([a-zA-Z_][a-zA-Z0-9_-]*) ([a-zA-Z0-9][a-zA-Z0-9.-]*) *([0-9T:+-]{24,24}) *(.*)
-var parseExportLine = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_-]*) ([a-zA-Z0-9][a-zA-Z0-9.-]*) *([0-9T:+-]{24,24}) *(.*)`)
+// isDuplicate checks if err is SQLite's primary key constraint error.
+func isDuplicate(err error) bool {
+	if driverErr, ok := err.(sqlite3.Error); ok {
+		return driverErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
 
 // AddFromBuffer reads from a buffered Reader and scans for lines that match
 // history command's structure:
@@ -192,76 +276,63 @@ var parseExportLine = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_-]*) ([a-zA-Z0-9
 // total lines read and lines failed to insert into the database —usually
 // because they already exist. It reports the results in a sentence (stats
 // string) because we don't anything fancier currently.
-func (d Database) AddFromBuffer(r *bufio.Reader, user, host string) (stats string, e error) {
-	//                                  LINENUM        DATETIME         CM
-	tx, _ := d.Begin()
+// If dir is set, it is stored as the working directory of the new lines,
+// and if session is set, as their shell session.
+func (d Database) AddFromBuffer(r *bufio.Reader, user, host, dir, session string) (stats string, e error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return "", err
+	}
 	stmt := tx.Stmt(d.insert)
-	total, failed := 0, 0
-	lineFormat := 1 // 1 means default history format, 3 is for export format
-	var once sync.Once
-	for {
-		historyLine, err := r.ReadString('\n')
-		total++
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				return "", errors.New("Error while reading stdin: " + err.Error())
-			}
-		}
-
-		args := parseLine.FindStringSubmatch(historyLine)
-		if len(args) != 3 {
-			args = parseExportLine.FindStringSubmatch(historyLine)
-			if len(args) != 5 {
-				log.Info.Println("Could't decode line, unknown format. Skipping:", historyLine)
-				failed++
-				continue
-			}
-			once.Do(func() { log.Info.Println("Bashistdb export format detected.") })
-			lineFormat = 3
-		}
-
-		time, err := time.Parse(RFC3339alt, args[lineFormat])
-		if err != nil {
-			tx.Rollback()
-			return "", err
-		}
-
-		switch lineFormat {
-		case 1:
-			_, err = stmt.Exec(user, host, strings.TrimSuffix(args[2], "\n"), time)
-		case 3:
-			_, err = stmt.Exec(args[1], args[2], strings.TrimSuffix(args[4], "\n"), time)
-		}
+	stmtDir := tx.Stmt(d.insertDir)
+	stmtSession := tx.Stmt(d.insertSession)
+	var inserted []Record // we publish these to subscribers after commit
+	stats, err = readHistory(r, user, host, d.log, func(rec *Record) (bool, error) {
+		res, err := stmt.Exec(rec.User, rec.Host, rec.Command, rec.Datetime)
 		if err != nil {
 			// If failed due to duplicate primary key, then ignore error
 			// We expect for ease of use, the user to resubmit the whole
 			// history from time to time.
-			if driverErr, ok := err.(sqlite3.Error); ok {
-				if driverErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
-					switch lineFormat {
-					case 1:
-						log.Debug.Println("Duplicate entry. Ignoring.", user, host, strings.TrimSuffix(args[2], "\n"), time)
-					case 3:
-						log.Debug.Println("Duplicate entry. Ignoring.", args[1], args[2], strings.TrimSuffix(args[4], "\n"), time)
-					}
-					failed++
-				} else {
-					tx.Rollback()
-					return "", err
+			if isDuplicate(err) {
+				return true, nil
+			}
+			return false, err
+		}
+		if id, err := res.LastInsertId(); err == nil {
+			rec.Row = int(id)
+			if dir != "" {
+				if _, err = stmtDir.Exec(id, dir); err != nil {
+					return false, err
+				}
+				rec.Dir = dir
+			}
+			if session != "" {
+				if _, err = stmtSession.Exec(id, session); err != nil {
+					return false, err
 				}
-			} else { // Normally we can never reach this. Should we omit it?
-				return "", err
+				rec.Session = session
 			}
+			inserted = append(inserted, *rec)
 		}
+		return false, nil
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+	if err = tx.Commit(); err != nil {
+		return "", err
 	}
-	tx.Commit()
-	total--
-	stats = fmt.Sprintf("Processed %d entries, successful %d, failed %d.", total, total-failed, failed)
+	d.hub.publish(inserted...)
 	return stats, nil
 }
 
+// Subscribe returns a subscription to records that are inserted from now
+// on and match the user, host and command of qp.
+func (d Database) Subscribe(qp conf.QueryParams) (*Subscription, error) {
+	return d.hub.Subscribe(qp)
+}
+
 // LogConn logs the remote's IP address and connection time into connlog table.
 // Also if it can't find a reverse lookup for the IP address inside table rlookup,
 // it performs it asynchronously. Reverse lookup may fail, but we don't care.
@@ -284,7 +355,7 @@ func (d Database) LogConn(remote net.Addr) (err error) {
 					}
 				}
 				if err != nil {
-					log.Info.Println(err)
+					d.log.Info.Println(err)
 				}
 			}()
 		}
@@ -292,71 +363,16 @@ func (d Database) LogConn(remote net.Addr) (err error) {
 	return
 }
 
-// migrate is a unexported function that handles database migrations.
-// It is safe to run on databases that already are on latest version.
-func migrate(d *sql.DB) error {
-	var version string
-	err := d.QueryRow(`SELECT value FROM admin WHERE key LIKE "version"`).Scan(&version)
-	if err != nil {
-		return err
-	}
-
-	switch version {
-	case "1":
-		tx, err := d.Begin()
-		if err != nil {
-			return err
-		}
-		stmt := `CREATE TABLE connlog_new(
-                             datetime TEXT PRIMARY KEY,
-                             remote   TEXT);
-                         INSERT INTO connlog_new
-                            SELECT datetime, remote FROM connlog;
-                         DROP TABLE connlog;
-                         ALTER TABLE connlog_new RENAME TO 'connlog';
-                         CREATE TABLE rlookup (
-                             ip      TEXT PRIMARY KEY,
-                             reverse TEXT
-                         );
-                         CREATE VIEW connections AS
-                             SELECT datetime, remote, reverse
-                                FROM connlog AS c
-                                LEFT JOIN rlookup AS r
-                                ON c.remote = r.ip;`
-		if _, err = tx.Exec(stmt); err != nil {
-			return err
-		}
-		if _, err = tx.Exec(`UPDATE admin SET value=? WHERE key LIKE 'version'`, "2"); err != nil {
-			return err
-		}
-		if err = tx.Commit(); err != nil {
-			return err
-		}
-		log.Info.Println("Database upgraded to version 2.")
-		fallthrough
-	case "2":
-		tx, err := d.Begin()
-		if err != nil {
-			return err
-		}
-		if _, err = tx.Exec(`CREATE INDEX HistoryDatetimeIdx ON history(datetime)`); err != nil {
-			return err
-		}
-		if _, err = tx.Exec(`UPDATE admin SET value=? WHERE key LIKE 'version'`, VERSION); err != nil {
-			return err
-		}
-		if err = tx.Commit(); err != nil {
-			return err
-		}
-		log.Info.Println("Database upgraded to latest version (2.1).")
-		return nil
-	case "2.1":
-		log.Debug.Println("Database on latest version.")
+// SchemaVersion returns the schema version of the SQLite database in filename,
+// without creating or migrating it.
+func SchemaVersion(filename string) (string, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return "", err
 	}
-
-	if version != VERSION {
-		return errors.New("Database version different than code version but couldn't fix it.")
+	db, err := sql.Open("sqlite3", "file:"+filename+"?mode=ro")
+	if err != nil {
+		return "", err
 	}
-
-	return nil
+	defer db.Close()
+	return schemaVersion(db)
 }
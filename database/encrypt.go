@@ -0,0 +1,377 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/crypto/nacl/secretbox"
+	"github.com/andmarios/crypto/scrypt"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Fields encrypted at rest are stored as BLOBs: a nonce and the value sealed
+// with NaCl's secretbox. The nonce is a keyed hash of the value, so equal
+// values are sealed equally; it is a blind index that keeps the primary key,
+// GROUP BY and DISTINCT working. Queries open the fields in SQLite, with the
+// plain() function, so LIKE searches work, but they open every row: no index
+// helps them. Plain values are TEXT, so a database may hold both while it is
+// encrypted or decrypted.
+
+// Errors of encryption at rest.
+var (
+	ErrLocked     = errors.New("Database is encrypted at rest, set its passphrase (key).")
+	ErrPassphrase = errors.New("Wrong passphrase for the database encrypted at rest.")
+)
+
+// keyCheck is what we store sealed, to tell a wrong passphrase.
+const keyCheck = "bashistdb"
+
+// A sealer seals and opens fields with keys derived from a passphrase.
+type sealer struct {
+	key [32]byte // secretbox key
+	mac []byte   // key of the nonces
+}
+
+// newSealer derives the keys of passphrase and salt with scrypt.
+func newSealer(passphrase, salt []byte) (*sealer, error) {
+	k, err := scrypt.Key(passphrase, salt, 1<<14, 8, 1, 64)
+	if err != nil {
+		return nil, err
+	}
+	s := &sealer{mac: k[32:]}
+	copy(s.key[:], k[:32])
+	return s, nil
+}
+
+func (s *sealer) seal(v string) []byte {
+	h := hmac.New(sha256.New, s.mac)
+	h.Write([]byte(v))
+	var nonce [24]byte
+	copy(nonce[:], h.Sum(nil))
+	return secretbox.Seal(nonce[:], []byte(v), &nonce, &s.key)
+}
+
+func (s *sealer) open(b []byte) (string, error) {
+	var nonce [24]byte
+	if len(b) < len(nonce) {
+		return "", ErrPassphrase
+	}
+	copy(nonce[:], b)
+	v, ok := secretbox.Open(nil, b[len(nonce):], &nonce, &s.key)
+	if !ok {
+		return "", ErrPassphrase
+	}
+	return string(v), nil
+}
+
+// atRest is the encryption state of a database, shared by its connections.
+type atRest struct {
+	mu     sync.RWMutex
+	mode   string  // what new rows get sealed, as conf.Config's Encrypt
+	sealer *sealer // nil until unlocked
+
+	// The arguments of the last Encrypt, so a restored database is
+	// encrypted the same way.
+	passphrase []byte
+	want       string
+}
+
+// plain is the plain() SQLite function: it opens sealed fields and returns
+// the rest as they are.
+func (a *atRest) plain(v interface{}) (interface{}, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return v, nil
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.sealer == nil {
+		return nil, ErrLocked
+	}
+	return a.sealer.open(b)
+}
+
+// sealFunc returns a SQLite function that seals its argument if mode is
+// one of modes.
+func (a *atRest) sealFunc(modes ...string) func(v string) (interface{}, error) {
+	return func(v string) (interface{}, error) {
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		for _, m := range modes {
+			if a.mode != m {
+				continue
+			}
+			if a.sealer == nil {
+				return nil, ErrLocked
+			}
+			return a.sealer.seal(v), nil
+		}
+		return v, nil
+	}
+}
+
+// usable returns ErrLocked if the database is encrypted but not unlocked.
+func (a *atRest) usable() error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.mode != conf.ENCRYPT_NONE && a.sealer == nil {
+		return ErrLocked
+	}
+	return nil
+}
+
+// connector opens connections to a SQLite database with our functions.
+type connector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func newConnector(dsn string, a *atRest) connector {
+	return connector{dsn, &sqlite3.SQLiteDriver{ConnectHook: func(c *sqlite3.SQLiteConn) error {
+		if err := c.RegisterFunc("plain", a.plain, true); err != nil {
+			return err
+		}
+		if err := c.RegisterFunc("seal", a.sealFunc(conf.ENCRYPT_COMMANDS, conf.ENCRYPT_ALL), false); err != nil {
+			return err
+		}
+		return c.RegisterFunc("sealid", a.sealFunc(conf.ENCRYPT_ALL), false)
+	}}}
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) { return c.driver.Open(c.dsn) }
+
+func (c connector) Driver() driver.Driver { return c.driver }
+
+// admin returns the value of key in the admin table, or "" if it isn't set.
+func admin(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, key string) (string, error) {
+	var v string
+	err := q.QueryRow(`SELECT value FROM admin WHERE key = ?`, key).Scan(&v)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return v, err
+}
+
+// loadEncryption reads how the database is encrypted.
+func (d Database) loadEncryption() error {
+	mode, err := admin(d, "encrypt")
+	if err != nil {
+		return err
+	}
+	if mode == "" { // never encrypted
+		mode = conf.ENCRYPT_NONE
+	}
+	d.rest.mu.Lock()
+	d.rest.mode = mode
+	d.rest.mu.Unlock()
+	return nil
+}
+
+// Encrypt unlocks the database with passphrase, if it is encrypted, and
+// encrypts or decrypts it at rest to mode, one of conf.Config's Encrypt;
+// conf.ENCRYPT_KEEP leaves it as it is. It returns how many rows, of
+// history, the trash and aliases, it changed. A database keeps the salt of
+// its keys until it is decrypted; to change the passphrase, decrypt with
+// the old one and encrypt with the new.
+func (d Database) Encrypt(passphrase []byte, mode string) (int, error) {
+	salt, err := admin(d, "salt")
+	if err != nil {
+		return 0, err
+	}
+	var old *sealer
+	if salt != "" {
+		if old, err = unlock(d, passphrase, salt); err != nil {
+			return 0, err
+		}
+	}
+	d.rest.mu.Lock()
+	d.rest.sealer = old
+	current := d.rest.mode
+	if mode == conf.ENCRYPT_KEEP {
+		mode = current
+	}
+	d.rest.passphrase, d.rest.want = passphrase, mode
+	d.rest.mu.Unlock()
+	if current == mode {
+		return 0, nil
+	}
+
+	s := old
+	if s == nil && mode != conf.ENCRYPT_NONE {
+		b := make([]byte, 16)
+		if _, err = rand.Read(b); err != nil {
+			return 0, err
+		}
+		salt = hex.EncodeToString(b)
+		if s, err = newSealer(passphrase, b); err != nil {
+			return 0, err
+		}
+	}
+	// The SQLite functions seal new rows with the new mode once we commit.
+	d.rest.mu.Lock()
+	defer d.rest.mu.Unlock()
+	next := &atRest{mode: mode, sealer: s}
+	tx, err := d.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	n := 0
+	for _, t := range sealedTables {
+		changed, err := reseal(tx, t.name, t.id, t.fields, old, next)
+		if err != nil {
+			return 0, err
+		}
+		n += changed
+	}
+	admins := map[string]string{"encrypt": mode, "salt": "", "keycheck": ""}
+	if mode != conf.ENCRYPT_NONE {
+		admins["salt"], admins["keycheck"] = salt, hex.EncodeToString(s.seal(keyCheck))
+	}
+	for k, v := range admins {
+		if _, err = tx.Exec(`INSERT OR REPLACE INTO admin(key, value) VALUES(?, ?)`, k, v); err != nil {
+			return 0, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	d.rest.mode, d.rest.sealer = next.mode, next.sealer
+	return n, nil
+}
+
+// unlock returns the sealer of passphrase and salt, after it checks that
+// the passphrase is right.
+func unlock(d Database, passphrase []byte, salt string) (*sealer, error) {
+	b, err := hex.DecodeString(salt)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSealer(passphrase, b)
+	if err != nil {
+		return nil, err
+	}
+	check, err := admin(d, "keycheck")
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := hex.DecodeString(check)
+	if err != nil {
+		return nil, err
+	}
+	if v, err := s.open(sealed); err != nil || v != keyCheck {
+		return nil, ErrPassphrase
+	}
+	return s, nil
+}
+
+// sealedTables are the tables with fields encrypted at rest, with their
+// ids. Command lines are encrypted in any mode, the rest only with all.
+var sealedTables = []struct {
+	name, id string
+	fields   []string
+}{
+	{"history", "rowid", []string{"user", "host", "command"}},
+	{"trash", "id", []string{"user", "host", "command"}},
+	{"aliases", "rowid", []string{"alias", "canonical"}},
+}
+
+// reseal rewrites the fields of table, opened with old, as next would store
+// them. It returns how many rows changed.
+func reseal(tx *sql.Tx, table, id string, fields []string, old *sealer, next *atRest) (int, error) {
+	rows, err := tx.Query(`SELECT ` + id + `, ` + strings.Join(fields, ", ") + ` FROM ` + table)
+	if err != nil {
+		return 0, err
+	}
+	type row struct {
+		id     int
+		fields []interface{}
+	}
+	var changed []row
+	for rows.Next() {
+		r := row{fields: make([]interface{}, len(fields))}
+		dest := []interface{}{&r.id}
+		for i := range r.fields {
+			dest = append(dest, &r.fields[i])
+		}
+		if err = rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		before := append([]interface{}{}, r.fields...)
+		for i, f := range r.fields {
+			if b, ok := f.([]byte); ok {
+				if old == nil {
+					rows.Close()
+					return 0, ErrLocked
+				}
+				if f, err = old.open(b); err != nil {
+					rows.Close()
+					return 0, err
+				}
+			}
+			seal := next.sealFunc(conf.ENCRYPT_ALL)
+			if fields[i] == "command" {
+				seal = next.sealFunc(conf.ENCRYPT_COMMANDS, conf.ENCRYPT_ALL)
+			}
+			if r.fields[i], err = seal(asString(f)); err != nil {
+				rows.Close()
+				return 0, err
+			}
+		}
+		if !reflect.DeepEqual(before, r.fields) {
+			changed = append(changed, r)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	set := strings.Join(fields, "=?, ") + "=?"
+	for _, r := range changed {
+		if _, err = tx.Exec(`UPDATE `+table+` SET `+set+` WHERE `+id+`=?`, append(r.fields, r.id)...); err != nil {
+			return 0, err
+		}
+	}
+	return len(changed), nil
+}
+
+// asString returns a field as a string; NULL fields are empty.
+func asString(f interface{}) string {
+	switch v := f.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
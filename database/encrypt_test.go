@@ -0,0 +1,116 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/llog"
+)
+
+func TestEncrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &conf.Config{Database: dir + "/db.sqlite3", Log: llog.New(llog.SILENT), Key: []byte("secret"), Encrypt: conf.ENCRYPT_ALL}
+
+	// The store works the same when encrypted.
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+	s.Close()
+
+	// types returns the count of each storage class of user, host and command.
+	types := func() map[string]int {
+		raw, err := sql.Open("sqlite3", cfg.Database)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer raw.Close()
+		rows, err := raw.Query(`SELECT 'user ' || typeof(user), 'host ' || typeof(host), 'command ' || typeof(command) FROM history`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		m := make(map[string]int)
+		for rows.Next() {
+			var u, h, c string
+			rows.Scan(&u, &h, &c)
+			m[u]++
+			m[h]++
+			m[c]++
+		}
+		return m
+	}
+	if m := types(); m["user text"]+m["host text"]+m["command text"] > 0 {
+		t.Fatalf("Fields stored in plain text: %v", m)
+	}
+
+	cfg.Key = []byte("wrong")
+	if _, err = New(cfg); err != ErrPassphrase {
+		t.Fatalf("Opening with a wrong passphrase returned %v", err)
+	}
+	d, err := NewSQLite(cfg.Database, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.RunQuery(conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%%"}); err != ErrLocked {
+		t.Fatalf("Query without the passphrase returned %v", err)
+	}
+	if err = d.AddRecord("user", "host", "ls", time.Now()); err == nil {
+		t.Fatal("AddRecord without the passphrase should fail")
+	}
+	d.Close()
+
+	// Without a setting, the database stays as it is.
+	cfg.Key = []byte("secret")
+	for _, v := range []struct {
+		mode          string
+		user, command string
+	}{
+		{conf.ENCRYPT_KEEP, "blob", "blob"},
+		{conf.ENCRYPT_COMMANDS, "text", "blob"},
+		{conf.ENCRYPT_KEEP, "text", "blob"},
+		{conf.ENCRYPT_NONE, "text", "text"},
+		{conf.ENCRYPT_KEEP, "text", "text"},
+		{conf.ENCRYPT_ALL, "blob", "blob"},
+	} {
+		cfg.Encrypt = v.mode
+		s, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := s.ReturnRow(conf.QueryParams{Type: conf.QUERY_ROW, Kappa: 20})
+		s.Close()
+		if err != nil || string(res) != "row 20" {
+			t.Fatalf("Encrypt %q: row 20 is %q %v", v.mode, res, err)
+		}
+		if m := types(); m["user "+v.user] == 0 || m["user "+v.user] != m["command "+v.command] || m["host "+v.user] != m["user "+v.user] {
+			t.Fatalf("Encrypt %q: wrong storage classes %v", v.mode, m)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/llog"
+)
+
+// subscriptionBuffer is how many records a slow subscriber may fall behind
+// before we start dropping records for it.
+const subscriptionBuffer = 256
+
+// A Record is a history line as stored in the database.
+type Record struct {
+	Row      int
+	User     string
+	Host     string
+	Command  string
+	Datetime time.Time
+	Dir      string // working directory, if known
+	Session  string // shell session, if known
+}
+
+// A Hub broadcasts newly inserted records to subscribers. It is fed by the
+// insert path of the database, so it only sees records inserted by this
+// process.
+type Hub struct {
+	mu        sync.Mutex
+	subs      map[*Subscription]bool
+	log       *llog.Logger
+	canonical func(r Record) Record // if set, gives records the canonical names of their user and host
+}
+
+// A Subscription receives from C the newly inserted records that match
+// its query parameters. Call Close to stop receiving.
+type Subscription struct {
+	C     <-chan Record
+	c     chan Record
+	qp    conf.QueryParams
+	regex *regexp.Regexp
+	hub   *Hub
+}
+
+func newHub(log *llog.Logger) *Hub {
+	return &Hub{subs: make(map[*Subscription]bool), log: log}
+}
+
+// Subscribe returns a new subscription for records that match the user,
+// host and command of qp. Matching follows DefaultQuery: LIKE semantics,
+// or a regular expression for the command if qp.Regex is set.
+func (h *Hub) Subscribe(qp conf.QueryParams) (*Subscription, error) {
+	s := &Subscription{qp: qp, hub: h}
+	if qp.Regex {
+		var err error
+		if s.regex, err = regexp.Compile(qp.Command); err != nil {
+			return nil, err
+		}
+	}
+	s.c = make(chan Record, subscriptionBuffer)
+	s.C = s.c
+
+	h.mu.Lock()
+	h.subs[s] = true
+	h.mu.Unlock()
+	return s, nil
+}
+
+// Close removes the subscription from its hub and closes its channel.
+// It is safe to call Close more than once.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if s.hub.subs[s] {
+		delete(s.hub.subs, s)
+		close(s.c)
+	}
+}
+
+// match checks if a record satisfies the subscription's query parameters.
+func (s *Subscription) match(r Record) bool {
+	if !like(s.qp.User, r.User, false) || !like(s.qp.Host, r.Host, false) {
+		return false
+	}
+	if s.qp.Regex {
+		return s.regex.MatchString(r.Command)
+	}
+	return like(s.qp.Command, r.Command, true)
+}
+
+// publish sends records to every matching subscriber, by the canonical
+// names of their users and hosts as queries do. It never blocks; if a
+// subscriber's buffer is full, the record is dropped for it.
+func (h *Hub) publish(records ...Record) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) > 0 && h.canonical != nil {
+		canonical := make([]Record, len(records))
+		for i, r := range records {
+			canonical[i] = h.canonical(r)
+		}
+		records = canonical
+	}
+	for s := range h.subs {
+		for _, r := range records {
+			if !s.match(r) {
+				continue
+			}
+			select {
+			case s.c <- r:
+			default:
+				h.log.Info.Println("Subscriber too slow, dropped record:", r.Row)
+			}
+		}
+	}
+}
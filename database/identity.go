@@ -0,0 +1,358 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// Queries return users and hosts by their canonical names. Aliases are
+// stored sealed, like the history, so we look them up by the stored name.
+const (
+	userOf = `plain(IFNULL((SELECT canonical FROM aliases WHERE kind = 'user' AND alias = user), user))`
+	hostOf = `plain(IFNULL((SELECT canonical FROM aliases WHERE kind = 'host' AND alias = host), host))`
+)
+
+// An Alias is another name of a user or host.
+type Alias struct {
+	Kind      string // conf.IDENTITY_USER or conf.IDENTITY_HOST
+	Alias     string
+	Canonical string
+}
+
+// checkIdentity checks the kind and names of an alias or rename.
+func checkIdentity(kind, from, to string, rename bool) error {
+	switch {
+	case kind != conf.IDENTITY_USER && kind != conf.IDENTITY_HOST:
+		return errors.New("Unknown kind of name: " + kind + ", use " + conf.IDENTITY_USER + " or " + conf.IDENTITY_HOST + ".")
+	case from == "" || (rename && to == ""):
+		return errors.New("Names can't be empty.")
+	case from == to:
+		return errors.New("A name can't be an alias of itself or be renamed to itself.")
+	}
+	return nil
+}
+
+// aliasesMessage formats aliases.
+func aliasesMessage(aliases []Alias) []byte {
+	if len(aliases) == 0 {
+		return []byte("No aliases.")
+	}
+	var b bytes.Buffer
+	for i, a := range aliases {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		fmt.Fprintf(&b, "%s %s -> %s", a.Kind, a.Alias, a.Canonical)
+	}
+	return b.Bytes()
+}
+
+// aliasMessage reports an alias query.
+func aliasMessage(p conf.QueryParams) []byte {
+	if p.To == "" {
+		return []byte(fmt.Sprintf("Removed the alias %s %s.", p.Identity, p.From))
+	}
+	return []byte(fmt.Sprintf("%s %s is now shown as %s.", p.Identity, p.From, p.To))
+}
+
+// renameMessage reports a rename query.
+func renameMessage(p conf.QueryParams, renamed, trashed int) []byte {
+	s := fmt.Sprintf("Renamed %s %s to %s in %d command lines.", p.Identity, p.From, p.To, renamed)
+	if trashed > 0 {
+		s += fmt.Sprintf(" Moved %d command lines %s already had to the trash.", trashed, p.To)
+	}
+	return []byte(s)
+}
+
+// Alias makes alias another name of canonical. If canonical is itself an
+// alias, alias gets its canonical name, and aliases of alias become aliases
+// of canonical, so there are no chains. An empty canonical removes alias.
+func (d Database) Alias(kind, alias, canonical string) error {
+	if err := checkIdentity(kind, alias, canonical, false); err != nil {
+		return err
+	}
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if canonical == "" {
+		if _, err = tx.Exec(`DELETE FROM aliases WHERE kind = ? AND alias = sealid(?)`, kind, alias); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	var c string
+	switch err = tx.QueryRow(`SELECT plain(canonical) FROM aliases WHERE kind = ? AND alias = sealid(?)`, kind, canonical).Scan(&c); err {
+	case nil:
+		if c == alias {
+			return errors.New(canonical + " is an alias of " + alias + ", remove it first.")
+		}
+		canonical = c
+	case sql.ErrNoRows:
+	default:
+		return err
+	}
+	if _, err = tx.Exec(`UPDATE aliases SET canonical = sealid(?) WHERE kind = ? AND canonical = sealid(?)`, canonical, kind, alias); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`INSERT OR REPLACE INTO aliases(kind, alias, canonical) VALUES(?, sealid(?), sealid(?))`, kind, alias, canonical); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Aliases returns the aliases of users and hosts.
+func (d Database) Aliases() ([]Alias, error) {
+	rows, err := d.Query(`SELECT kind, plain(alias) AS a, plain(canonical) AS c FROM aliases ORDER BY kind DESC, c, a`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var aliases []Alias
+	for rows.Next() {
+		var a Alias
+		if err = rows.Scan(&a.Kind, &a.Alias, &a.Canonical); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, a)
+	}
+	return aliases, rows.Err()
+}
+
+// Rename stores the command lines of the user or host old as new's, in
+// history and the trash, and makes aliases of old aliases of new. Since a
+// user can't run a command line twice at the same time, the command lines
+// of old that new also has are moved to the trash; their working
+// directories are kept, if new's don't have one. It returns how many
+// command lines were renamed and how many moved to the trash.
+func (d Database) Rename(kind, old, new string) (renamed, trashed int, err error) {
+	if err = checkIdentity(kind, old, new, true); err != nil {
+		return 0, 0, err
+	}
+	if err = d.rest.usable(); err != nil {
+		return 0, 0, err
+	}
+	tx, err := d.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	// The primary key of history is user, command and datetime.
+	if kind == conf.IDENTITY_USER {
+		for _, q := range []string{
+			`INSERT OR IGNORE INTO dirs(id, dir)
+			SELECT n.rowid, dirs.dir FROM history AS o
+				JOIN history AS n ON n.command = o.command AND n.datetime = o.datetime AND n.user = sealid(?)
+				JOIN dirs ON dirs.id = o.rowid
+			WHERE o.user = sealid(?)`,
+			`INSERT OR IGNORE INTO sessions(id, session)
+			SELECT n.rowid, sessions.session FROM history AS o
+				JOIN history AS n ON n.command = o.command AND n.datetime = o.datetime AND n.user = sealid(?)
+				JOIN sessions ON sessions.id = o.rowid
+			WHERE o.user = sealid(?)`,
+		} {
+			if _, err = tx.Exec(q, new, old); err != nil {
+				return 0, 0, err
+			}
+		}
+		rows, err := tx.Query(`SELECT o.rowid FROM history AS o
+				JOIN history AS n ON n.command = o.command AND n.datetime = o.datetime AND n.user = sealid(?)
+			WHERE o.user = sealid(?)`, new, old)
+		if err != nil {
+			return 0, 0, err
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err = rows.Scan(&id); err != nil {
+				rows.Close()
+				return 0, 0, err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if trashed, err = trashRows(tx, ids); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// kind is a column name, checked above.
+	res, err := tx.Exec(`UPDATE history SET `+kind+` = sealid(?) WHERE `+kind+` = sealid(?)`, new, old)
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, q := range []string{
+		`UPDATE trash SET ` + kind + ` = sealid(?) WHERE ` + kind + ` = sealid(?)`,
+		`UPDATE aliases SET canonical = sealid(?) WHERE kind = '` + kind + `' AND canonical = sealid(?)`,
+	} {
+		if _, err = tx.Exec(q, new, old); err != nil {
+			return 0, 0, err
+		}
+	}
+	return int(n), trashed, tx.Commit()
+}
+
+// canonical returns r with the canonical names of its user and host.
+func (d Database) canonical(r Record) Record {
+	for _, v := range []struct {
+		kind string
+		name *string
+	}{{conf.IDENTITY_USER, &r.User}, {conf.IDENTITY_HOST, &r.Host}} {
+		var c string
+		if err := d.QueryRow(`SELECT plain(canonical) FROM aliases WHERE kind = ? AND alias = sealid(?)`, v.kind, *v.name).Scan(&c); err == nil {
+			*v.name = c
+		}
+	}
+	return r
+}
+
+// canonical returns r with the canonical names of its user and host.
+func (m *Memory) canonical(r Record) Record {
+	if c, ok := m.aliases[[2]string{conf.IDENTITY_USER, r.User}]; ok {
+		r.User = c
+	}
+	if c, ok := m.aliases[[2]string{conf.IDENTITY_HOST, r.Host}]; ok {
+		r.Host = c
+	}
+	return r
+}
+
+// Alias works as the SQLite store's Alias.
+func (m *Memory) Alias(kind, alias, canonical string) error {
+	if err := checkIdentity(kind, alias, canonical, false); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{kind, alias}
+	if canonical == "" {
+		delete(m.aliases, key)
+		return nil
+	}
+	if c, ok := m.aliases[[2]string{kind, canonical}]; ok {
+		if c == alias {
+			return errors.New(canonical + " is an alias of " + alias + ", remove it first.")
+		}
+		canonical = c
+	}
+	for k, c := range m.aliases {
+		if k[0] == kind && c == alias {
+			m.aliases[k] = canonical
+		}
+	}
+	m.aliases[key] = canonical
+	return nil
+}
+
+// Aliases works as the SQLite store's Aliases.
+func (m *Memory) Aliases() ([]Alias, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var aliases []Alias
+	for k, c := range m.aliases {
+		aliases = append(aliases, Alias{k[0], k[1], c})
+	}
+	sort.Slice(aliases, func(i, j int) bool {
+		a, b := aliases[i], aliases[j]
+		if a.Kind != b.Kind {
+			return a.Kind > b.Kind
+		}
+		if a.Canonical != b.Canonical {
+			return a.Canonical < b.Canonical
+		}
+		return a.Alias < b.Alias
+	})
+	return aliases, nil
+}
+
+// Rename works as the SQLite store's Rename.
+func (m *Memory) Rename(kind, old, new string) (renamed, trashed int, err error) {
+	if err = checkIdentity(kind, old, new, true); err != nil {
+		return 0, 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name := func(r *Record) *string {
+		if kind == conf.IDENTITY_USER {
+			return &r.User
+		}
+		return &r.Host
+	}
+
+	if kind == conf.IDENTITY_USER {
+		var ids []int
+		for _, r := range m.records {
+			if r.User != old {
+				continue
+			}
+			n := r
+			n.User = new
+			if !m.keys[keyOf(n)] {
+				continue
+			}
+			ids = append(ids, r.Row)
+			for i := range m.records {
+				if keyOf(m.records[i]) != keyOf(n) {
+					continue
+				}
+				if m.records[i].Dir == "" {
+					m.records[i].Dir = r.Dir
+				}
+				if m.records[i].Session == "" {
+					m.records[i].Session = r.Session
+				}
+			}
+		}
+		trashed = m.trashRows(ids)
+	}
+
+	for i := range m.records {
+		r := &m.records[i]
+		if *name(r) != old {
+			continue
+		}
+		delete(m.keys, keyOf(*r))
+		*name(r) = new
+		m.keys[keyOf(*r)] = true
+		renamed++
+	}
+	for i := range m.trash {
+		if r := &m.trash[i].Record; *name(r) == old {
+			*name(r) = new
+		}
+	}
+	for k, c := range m.aliases {
+		if k[0] == kind && c == old {
+			m.aliases[k] = new
+		}
+	}
+	return renamed, trashed, nil
+}
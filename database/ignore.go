@@ -0,0 +1,85 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/ignore"
+)
+
+// ignoring is a Store that doesn't store the command lines an Ignorer
+// ignores.
+type ignoring struct {
+	Store
+	ig *ignore.Ignorer
+}
+
+// Ignoring returns a Store that passes to s only the command lines ig
+// doesn't ignore. It also runs the PURGE query, which deletes from s the
+// command lines ig ignores.
+func Ignoring(s Store, ig *ignore.Ignorer) Store {
+	return ignoring{s, ig}
+}
+
+func (s ignoring) AddRecord(user, host, command string, t time.Time) error {
+	if s.ig.Ignore(user, host, command) {
+		return nil
+	}
+	return s.Store.AddRecord(user, host, command, t)
+}
+
+func (s ignoring) AddFromBuffer(r *bufio.Reader, user, host, dir, session string) (string, error) {
+	history, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	history, ignored := FilterHistory(history, user, host, s.ig.Ignore)
+	stats, err := s.Store.AddFromBuffer(bufio.NewReader(bytes.NewReader(history)), user, host, dir, session)
+	if err == nil && ignored > 0 {
+		stats += fmt.Sprintf(" Ignored %d.", ignored)
+	}
+	return stats, err
+}
+
+func (s ignoring) Merge(file string, passphrase []byte, fn func(r *Record) bool) ([]MergeStat, error) {
+	return s.Store.Merge(file, passphrase, func(r *Record) bool {
+		return fn(r) && !s.ig.Ignore(r.User, r.Host, r.Command)
+	})
+}
+
+func (s ignoring) RunQuery(p conf.QueryParams) ([]byte, error) {
+	if p.Type != conf.PURGE {
+		return s.Store.RunQuery(p)
+	}
+	purged, err := s.Store.Purge(func(r Record) bool {
+		return s.ig.Ignore(r.User, r.Host, r.Command)
+	}, p.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	if p.DryRun {
+		return report(purged, p, "Would purge %d command lines"), nil
+	}
+	return report(purged, p, "Purged %d command lines"), nil
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/ignore"
+)
+
+func TestIgnoring(t *testing.T) {
+	ig, err := ignore.New(conf.IgnoreRules{Patterns: []string{"ls"}, IgnoreSpace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := NewMemory(nil)
+	tt := time.Date(2015, 1, 1, 1, 1, 0, 0, time.UTC)
+	// Stored before the rule was set up.
+	mem.AddRecord("user", "host", "ls", tt)
+
+	s := Ignoring(mem, ig)
+	s.AddRecord("user", "host", "ls", tt.Add(time.Second))
+	history := "    1  2015-10-12T12:00:05+0300 ls\n" +
+		"    2  2015-10-12T12:00:06+0300  make secret\n" +
+		"    3  2015-10-12T12:00:07+0300 make\n"
+	stats, err := s.AddFromBuffer(bufio.NewReader(strings.NewReader(history)), "user", "host", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Processed 1 entries, successful 1, failed 0. Ignored 2."; stats != want {
+		t.Fatalf("Wanted stats: %s\nGot: %s", want, stats)
+	}
+
+	qp := conf.QueryParams{Type: conf.PURGE, DryRun: true, Format: conf.FORMAT_COMMAND_LINE}
+	res, err := s.RunQuery(qp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Would purge 1 command lines:\n1 ls"; string(res) != want {
+		t.Fatalf("Wanted:\n%s\nGot:\n%s", want, res)
+	}
+	qp.DryRun = false
+	if _, err = s.RunQuery(qp); err != nil {
+		t.Fatal(err)
+	}
+	res, _ = s.RunQuery(conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%%"})
+	if string(res) != "2 make" {
+		t.Fatalf("Wanted only make stored, got:\n%s", res)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andmarios/bashistdb/llog"
+)
+
+// A parseline parses history output lines of the following format:
+//     LINENUM RFC3339_DATETIME COMMAND
+var parseLine = regexp.MustCompile(`^ *[0-9]+\*? *([0-9T:+-]{24,24}) *(.*)`)
+
+// A parseExportLine parses export formatted output from bashistdb:
+//     USER HOSTNAME RFC3339_DATETIME COMMAND
+//([a-zA-Z_][a-zA-Z0-9_-]*) ([a-zA-Z0-9][a-zA-Z0-9.-]*) *([0-9T:+-]{24,24}) *(.*)
+var parseExportLine = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_-]*) ([a-zA-Z0-9][a-zA-Z0-9.-]*) *([0-9T:+-]{24,24}) *(.*)`)
+
+// readHistory is the common part of every store's AddFromBuffer. It reads
+// from a buffered Reader lines either in history command's or in bashistdb's
+// export format and passes each decoded record to insert. Insert reports
+// whether the record already existed. If insert returns an error, reading
+// stops and the error is returned, so the caller may roll back.
+func readHistory(r *bufio.Reader, user, host string, log *llog.Logger, insert func(rec *Record) (duplicate bool, err error)) (stats string, e error) {
+	total, failed := 0, 0
+	var once sync.Once
+	for {
+		historyLine, err := r.ReadString('\n')
+		total++
+		if err != nil {
+			if err == io.EOF {
+				break
+			} else {
+				return "", errors.New("Error while reading stdin: " + err.Error())
+			}
+		}
+
+		lineFormat := 1 // 1 means default history format, 3 is for export format
+		args := parseLine.FindStringSubmatch(historyLine)
+		if len(args) != 3 {
+			args = parseExportLine.FindStringSubmatch(historyLine)
+			if len(args) != 5 {
+				log.Info.Println("Could't decode line, unknown format. Skipping:", historyLine)
+				failed++
+				continue
+			}
+			once.Do(func() { log.Info.Println("Bashistdb export format detected.") })
+			lineFormat = 3
+		}
+
+		t, err := time.Parse(RFC3339alt, args[lineFormat])
+		if err != nil {
+			return "", err
+		}
+
+		rec := Record{User: user, Host: host, Command: strings.TrimSuffix(args[2], "\n"), Datetime: t}
+		if lineFormat == 3 {
+			rec = Record{User: args[1], Host: args[2], Command: strings.TrimSuffix(args[4], "\n"), Datetime: t}
+		}
+		duplicate, err := insert(&rec)
+		if err != nil {
+			return "", err
+		}
+		if duplicate {
+			log.Debug.Println("Duplicate entry. Ignoring.", rec.User, rec.Host, rec.Command, rec.Datetime)
+			failed++
+		}
+	}
+	total--
+	stats = fmt.Sprintf("Processed %d entries, successful %d, failed %d.", total, total-failed, failed)
+	return stats, nil
+}
+
+// FilterHistory returns history, in history command's or in bashistdb's
+// export format, without the lines ignore reports. Lines in history format
+// are user's at host. Commands are passed with their leading spaces, but
+// for the one after the timestamp. It also returns how many lines it removed.
+func FilterHistory(history []byte, user, host string, ignore func(user, host, command string) bool) ([]byte, int) {
+	var out bytes.Buffer
+	ignored := 0
+	for _, l := range strings.SplitAfter(string(history), "\n") {
+		u, h, command, ok := user, host, "", false
+		if m := parseLine.FindStringSubmatchIndex(l); m != nil {
+			command, ok = l[m[3]:], true
+		} else if m := parseExportLine.FindStringSubmatchIndex(l); m != nil {
+			u, h, command, ok = l[m[2]:m[3]], l[m[4]:m[5]], l[m[7]:], true
+		}
+		command = strings.TrimSuffix(strings.TrimPrefix(command, " "), "\n")
+		if ok && ignore(u, h, command) {
+			ignored++
+			continue
+		}
+		out.WriteString(l)
+	}
+	return out.Bytes(), ignored
+}
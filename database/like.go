@@ -0,0 +1,81 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import "unicode"
+
+// like reports whether s matches pattern using SQLite's LIKE semantics:
+// percent (%) matches any sequence, underscore (_) matches a single character
+// and ASCII letters are compared case insensitively. If escape is set,
+// backslash (\) escapes the character that follows it, as in our
+// "LIKE ? ESCAPE '\'" queries.
+func like(pattern, s string, escape bool) bool {
+	p, str := []rune(pattern), []rune(s)
+	pi, si := 0, 0
+	starP, starS := -1, 0
+	for si < len(str) {
+		if pi < len(p) {
+			c := p[pi]
+			switch {
+			case c == '%':
+				starP, starS = pi, si
+				pi++
+				continue
+			case c == '_':
+				pi++
+				si++
+				continue
+			case escape && c == '\\' && pi+1 < len(p):
+				if foldEqual(p[pi+1], str[si]) {
+					pi += 2
+					si++
+					continue
+				}
+			default:
+				if foldEqual(c, str[si]) {
+					pi++
+					si++
+					continue
+				}
+			}
+		}
+		// Mismatch, backtrack to the last percent sign if there is one.
+		if starP < 0 {
+			return false
+		}
+		starS++
+		si = starS
+		pi = starP + 1
+	}
+	for pi < len(p) && p[pi] == '%' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// foldEqual compares two runes, ignoring case only for ASCII letters
+// like SQLite does.
+func foldEqual(a, b rune) bool {
+	if a == b {
+		return true
+	}
+	if a < unicode.MaxASCII && b < unicode.MaxASCII {
+		return unicode.ToLower(a) == unicode.ToLower(b)
+	}
+	return false
+}
@@ -0,0 +1,626 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"net"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/llog"
+	"github.com/andmarios/bashistdb/result"
+)
+
+// A Memory is a pure Go, in-memory Store. It is meant for tests and
+// ephemeral servers; its contents are lost when the process exits.
+// It mimics the SQLite store, including how rowids are assigned.
+type Memory struct {
+	mu      sync.RWMutex
+	records []Record // ordered by rowid
+	keys    map[memoryKey]bool
+	connlog []connection
+	trash   []trashed            // ordered by id
+	aliases map[[2]string]string // kind and alias to canonical
+	hub     *Hub
+	log     *llog.Logger
+}
+
+// A trashed is a row of the trash table: a record, whose Row is its id in
+// the trash, and the rowid it had.
+type trashed struct {
+	Record
+	row int
+}
+
+// memoryKey is the primary key of the history table.
+type memoryKey struct {
+	user, command string
+	datetime      time.Time
+}
+
+// A connection is a row of the connlog table.
+type connection struct {
+	datetime time.Time
+	remote   string
+}
+
+// NewMemory returns a new, empty, in-memory store. If log is nil, nothing
+// is logged.
+func NewMemory(log *llog.Logger) *Memory {
+	log = logger(log)
+	m := &Memory{keys: make(map[memoryKey]bool), aliases: make(map[[2]string]string), hub: newHub(log), log: log}
+	m.hub.canonical = func(r Record) Record {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		return m.canonical(r)
+	}
+	return m
+}
+
+func keyOf(r Record) memoryKey {
+	return memoryKey{r.User, r.Command, r.Datetime.UTC()}
+}
+
+// nextRow returns the rowid the next record will get. Like SQLite, this is
+// the largest rowid plus one.
+func (m *Memory) nextRow() int {
+	if len(m.records) == 0 {
+		return 1
+	}
+	return m.records[len(m.records)-1].Row + 1
+}
+
+// AddRecord tries to insert a new record in the store.
+// If the record already exists, it is ignored.
+func (m *Memory) AddRecord(user, host, command string, time time.Time) error {
+	m.mu.Lock()
+	rec := Record{Row: m.nextRow(), User: user, Host: host, Command: command, Datetime: time}
+	if m.keys[keyOf(rec)] {
+		m.mu.Unlock()
+		m.log.Debug.Println("Duplicate entry. Ignoring.", user, host, command, time)
+		return nil
+	}
+	m.keys[keyOf(rec)] = true
+	m.records = append(m.records, rec)
+	m.mu.Unlock()
+
+	m.hub.publish(rec)
+	return nil
+}
+
+// AddFromBuffer works as the SQLite store's AddFromBuffer. Records are
+// added only if the whole buffer is read without errors.
+func (m *Memory) AddFromBuffer(r *bufio.Reader, user, host, dir, session string) (stats string, e error) {
+	m.mu.Lock()
+	var staged []Record
+	stagedKeys := make(map[memoryKey]bool)
+	stats, err := readHistory(r, user, host, m.log, func(rec *Record) (bool, error) {
+		k := keyOf(*rec)
+		if m.keys[k] || stagedKeys[k] {
+			return true, nil
+		}
+		rec.Row = m.nextRow() + len(staged)
+		rec.Dir, rec.Session = dir, session
+		stagedKeys[k] = true
+		staged = append(staged, *rec)
+		return false, nil
+	})
+	if err != nil {
+		m.mu.Unlock()
+		return "", err
+	}
+	for k := range stagedKeys {
+		m.keys[k] = true
+	}
+	m.records = append(m.records, staged...)
+	m.mu.Unlock()
+
+	m.hub.publish(staged...)
+	return stats, nil
+}
+
+// RunQuery is a wrapper around various queries.
+func (m *Memory) RunQuery(p conf.QueryParams) ([]byte, error) {
+	return runQuery(m, p)
+}
+
+// matcher returns a function that checks a record against the user, host
+// and command of qp, the way our SQL queries do.
+func matcher(qp conf.QueryParams) (func(r Record) bool, error) {
+	if qp.Regex {
+		regex, err := regexp.Compile(qp.Command)
+		if err != nil {
+			return nil, err
+		}
+		return func(r Record) bool {
+			return like(qp.User, r.User, false) && like(qp.Host, r.Host, false) && regex.MatchString(r.Command)
+		}, nil
+	}
+	return func(r Record) bool {
+		return like(qp.User, r.User, false) && like(qp.Host, r.Host, false) && like(qp.Command, r.Command, true)
+	}, nil
+}
+
+// selected reports whether r has one of the rowids of qp and is in its time
+// range, if they are set.
+func selected(qp conf.QueryParams, r Record) bool {
+	if len(qp.Rows) > 0 {
+		found := false
+		for _, row := range qp.Rows {
+			found = found || row == r.Row
+		}
+		if !found {
+			return false
+		}
+	}
+	return (qp.Since.IsZero() || !r.Datetime.Before(qp.Since)) && (qp.Until.IsZero() || r.Datetime.Before(qp.Until))
+}
+
+// filter returns the records that satisfy match, in rowid order, with
+// canonical users and hosts.
+func (m *Memory) filter(match func(r Record) bool) []Record {
+	var out []Record
+	for _, r := range m.records {
+		if r = m.canonical(r); match(r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// latest keeps only the most recent execution of each command.
+func latest(records []Record) []Record {
+	last := make(map[string]int)
+	var out []Record
+	for _, r := range records {
+		if i, ok := last[r.Command]; ok {
+			if r.Datetime.After(out[i].Datetime) {
+				out[i] = r
+			}
+			continue
+		}
+		last[r.Command] = len(out)
+		out = append(out, r)
+	}
+	return out
+}
+
+// sortByDatetime sorts records chronologically, using rowid for ties.
+func sortByDatetime(records []Record) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Datetime.Equal(records[j].Datetime) {
+			return records[i].Row < records[j].Row
+		}
+		return records[i].Datetime.Before(records[j].Datetime)
+	})
+}
+
+// format adds records to a new result in the requested format.
+func format(records []Record, f string) []byte {
+	res := result.New(f)
+	for _, r := range records {
+		res.AddRow(r.Row, r.User, r.Host, r.Command, r.Datetime)
+	}
+	return res.Formatted()
+}
+
+// TopK returns the k most frequent command lines in history
+func (m *Memory) TopK(qp conf.QueryParams) ([]byte, error) {
+	qp.Regex = false // TopK uses LIKE even for regex searches
+	match, _ := matcher(qp)
+
+	m.mu.RLock()
+	counts := make(map[string]int)
+	for _, r := range m.filter(match) {
+		counts[r.Command]++
+	}
+	m.mu.RUnlock()
+
+	commands := make([]string, 0, len(counts))
+	for c := range counts {
+		commands = append(commands, c)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		if counts[commands[i]] == counts[commands[j]] {
+			return commands[i] < commands[j]
+		}
+		return counts[commands[i]] > counts[commands[j]]
+	})
+	if len(commands) > qp.Kappa {
+		commands = commands[:qp.Kappa]
+	}
+
+	res := result.New(qp.Format)
+	for _, c := range commands {
+		res.AddCountRow(counts[c], c)
+	}
+	return res.Formatted(), nil
+}
+
+// LastK returns the k most recent command lines in history
+func (m *Memory) LastK(qp conf.QueryParams) ([]byte, error) {
+	qp.Regex = false // LastK uses LIKE even for regex searches
+	match, _ := matcher(qp)
+	if qp.Dir != "" {
+		commandMatch := match
+		match = func(r Record) bool { return r.Dir == qp.Dir && commandMatch(r) }
+	}
+
+	m.mu.RLock()
+	records := m.filter(match)
+	m.mu.RUnlock()
+
+	if qp.Unique {
+		records = latest(records)
+	}
+	sortByDatetime(records)
+	if len(records) > qp.Kappa {
+		records = records[len(records)-qp.Kappa:]
+	}
+	return format(records, qp.Format), nil
+}
+
+// DefaultQuery returns history within the search criteria in the format requested
+func (m *Memory) DefaultQuery(qp conf.QueryParams) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var records []Record
+	if qp.Regex {
+		// Like the SQLite store, unique applies before the regular expression.
+		regex, err := regexp.Compile(qp.Command)
+		if err != nil {
+			return []byte{}, err
+		}
+		records = m.filter(func(r Record) bool {
+			return like(qp.User, r.User, false) && like(qp.Host, r.Host, false) && selected(qp, r)
+		})
+		if qp.Unique {
+			records = latest(records)
+		}
+		var matched []Record
+		for _, r := range records {
+			if regex.MatchString(r.Command) {
+				matched = append(matched, r)
+			}
+		}
+		records = matched
+	} else {
+		match, _ := matcher(qp)
+		records = m.filter(func(r Record) bool { return match(r) && selected(qp, r) })
+		if qp.Unique {
+			records = latest(records)
+		}
+	}
+	if qp.Unique {
+		sortByDatetime(records)
+	}
+	return format(records, qp.Format), nil
+}
+
+// Users returns unique user@host pairs from the store.
+func (m *Memory) Users(qp conf.QueryParams) ([]byte, error) {
+	qp.Regex = false
+	match, _ := matcher(qp)
+
+	m.mu.RLock()
+	seen := make(map[[2]string]bool)
+	var pairs [][2]string
+	for _, r := range m.filter(match) {
+		p := [2]string{r.User, r.Host}
+		if !seen[p] {
+			seen[p] = true
+			pairs = append(pairs, p)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] == pairs[j][0] {
+			return pairs[i][1] < pairs[j][1]
+		}
+		return pairs[i][0] < pairs[j][0]
+	})
+
+	res := result.New(qp.Format)
+	for _, p := range pairs {
+		res.AddUserRow(p[0], p[1])
+	}
+	return usersHeader(qp, res.Formatted()), nil
+}
+
+// Demo returns some stats from the store to showcase bashistdb.
+func (m *Memory) Demo(qp conf.QueryParams) ([]byte, error) {
+	m.mu.RLock()
+	users := make(map[[2]string]bool)
+	hosts := make(map[string]bool)
+	commands := make(map[string]bool)
+	for _, r := range m.records {
+		r = m.canonical(r)
+		users[[2]string{r.User, r.Host}] = true
+		hosts[r.Host] = true
+		commands[r.Command] = true
+	}
+	c := demoCounts{len(users), len(hosts), len(m.records), len(commands)}
+	m.mu.RUnlock()
+
+	return demo(m, qp, c)
+}
+
+// row returns the index of rowid in records, or -1.
+func (m *Memory) row(rowid int) int {
+	i := sort.Search(len(m.records), func(i int) bool { return m.records[i].Row >= rowid })
+	if i < len(m.records) && m.records[i].Row == rowid {
+		return i
+	}
+	return -1
+}
+
+// ReturnRow returns a single row with no other data.
+func (m *Memory) ReturnRow(qp conf.QueryParams) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	i := m.row(qp.Kappa)
+	if i < 0 {
+		return []byte{}, sql.ErrNoRows
+	}
+	return []byte(m.records[i].Command), nil
+}
+
+// DeleteRows moves a range of rows to the trash.
+func (m *Memory) DeleteRows(qp conf.QueryParams) ([]byte, error) {
+	n, err := m.Trash(qp.Rows)
+	if err != nil {
+		return []byte{}, err
+	}
+	return trashMessage(n), nil
+}
+
+// Trash works as the SQLite store's Trash.
+func (m *Memory) Trash(rows []int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.trashRows(rows), nil
+}
+
+// trashRows is Trash, with m locked.
+func (m *Memory) trashRows(rows []int) int {
+	n := 0
+	for _, v := range rows {
+		i := m.row(v)
+		if i < 0 {
+			continue
+		}
+		id := 1
+		if len(m.trash) > 0 {
+			id = m.trash[len(m.trash)-1].Row + 1
+		}
+		t := trashed{m.records[i], v}
+		t.Row = id
+		m.trash = append(m.trash, t)
+		delete(m.keys, keyOf(m.records[i]))
+		m.records = append(m.records[:i], m.records[i+1:]...)
+		n++
+	}
+	return n
+}
+
+// Trashed works as the SQLite store's Trashed.
+func (m *Memory) Trashed() ([]Record, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var records []Record
+	for _, t := range m.trash {
+		records = append(records, t.Record)
+	}
+	return records, nil
+}
+
+// takeTrash removes from the trash the records with the given ids, all if
+// none, and returns them.
+func (m *Memory) takeTrash(ids []int, dryRun bool) []trashed {
+	want := make(map[int]bool)
+	for _, id := range ids {
+		want[id] = true
+	}
+	var taken, kept []trashed
+	for _, t := range m.trash {
+		if len(ids) == 0 || want[t.Row] {
+			taken = append(taken, t)
+		} else {
+			kept = append(kept, t)
+		}
+	}
+	if !dryRun {
+		m.trash = kept
+	}
+	return taken
+}
+
+// Untrash works as the SQLite store's Untrash.
+func (m *Memory) Untrash(ids []int) ([]Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var restored []Record
+	for _, t := range m.takeTrash(ids, false) {
+		r := t.Record
+		if m.keys[keyOf(r)] { // imported again meanwhile
+			continue
+		}
+		r.Row = t.row
+		if m.row(r.Row) >= 0 {
+			r.Row = m.nextRow()
+		}
+		i := sort.Search(len(m.records), func(i int) bool { return m.records[i].Row >= r.Row })
+		m.records = append(m.records[:i], append([]Record{r}, m.records[i:]...)...)
+		m.keys[keyOf(r)] = true
+		restored = append(restored, r)
+	}
+	return restored, nil
+}
+
+// EmptyTrash works as the SQLite store's EmptyTrash.
+func (m *Memory) EmptyTrash(ids []int, dryRun bool) ([]Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var records []Record
+	for _, t := range m.takeTrash(ids, dryRun) {
+		records = append(records, t.Record)
+	}
+	return records, nil
+}
+
+// Rewrite works as the SQLite store's Rewrite.
+func (m *Memory) Rewrite(fn func(command string) string, dryRun bool) ([]Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var changed []Record
+	for _, r := range m.records {
+		if c := fn(r.Command); c != r.Command {
+			r.Command = c
+			changed = append(changed, r)
+		}
+	}
+	if dryRun {
+		return changed, nil
+	}
+	for _, r := range changed {
+		i := m.row(r.Row)
+		delete(m.keys, keyOf(m.records[i]))
+		if m.keys[keyOf(r)] { // duplicate
+			m.records = append(m.records[:i], m.records[i+1:]...)
+			continue
+		}
+		m.keys[keyOf(r)] = true
+		m.records[i].Command = r.Command
+	}
+	return changed, nil
+}
+
+// Purge works as the SQLite store's Purge.
+func (m *Memory) Purge(fn func(r Record) bool, dryRun bool) ([]Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var purged []Record
+	kept := m.records[:0:0]
+	for _, r := range m.records {
+		if !fn(m.canonical(r)) {
+			kept = append(kept, r)
+			continue
+		}
+		purged = append(purged, m.canonical(r))
+		if !dryRun {
+			delete(m.keys, keyOf(r))
+		}
+	}
+	if !dryRun {
+		m.records = kept
+	}
+	return purged, nil
+}
+
+// ContentQuery returns matches of a row plus rows before or after the
+// match. It follows the stages of the SQLite store's ContentQuery.
+func (m *Memory) ContentQuery(qp conf.QueryParams) ([]byte, error) {
+	commandMatch, err := matcher(qp)
+	if err != nil {
+		return []byte{}, err
+	}
+	match := commandMatch
+	if qp.Kappa > 0 {
+		match = func(r Record) bool { return r.Row == qp.Kappa && commandMatch(r) }
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Stage 1: find matches
+	hits := m.filter(match)
+
+	// Stage 2: for each match create a slice with its content by rowid
+	content := m.filter(func(r Record) bool {
+		return like(qp.User, r.User, false) && like(qp.Host, r.Host, true)
+	})
+	sortByDatetime(content)
+	var hitsContent [][]int
+	for _, h := range hits {
+		// The first record after the ones with datetime <= hit's datetime.
+		after := sort.Search(len(content), func(i int) bool { return content[i].Datetime.After(h.Datetime) })
+		before := after - (qp.BeforeContent + 1)
+		if before < 0 {
+			before = 0
+		}
+		end := after + qp.AfterContent
+		if end > len(content) {
+			end = len(content)
+		}
+		var rows []int
+		for _, r := range content[before:end] {
+			rows = append(rows, r.Row)
+		}
+		hitsContent = append(hitsContent, rows)
+	}
+
+	// Stage 3: let's merge the sets that overlap
+	hitsContent = mergeContent(hitsContent)
+
+	// Stage 4: get the records for each set's rowids and format them
+	var out bytes.Buffer
+	for i, set := range hitsContent {
+		var records []Record
+		for _, v := range set {
+			if k := m.row(v); k >= 0 {
+				records = append(records, m.canonical(m.records[k]))
+			}
+		}
+		sortByDatetime(records)
+		out.Write(format(records, qp.Format))
+		if i < len(hitsContent)-1 {
+			out.WriteString(result.CONTENT_SEPARATOR)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// LogConn logs the remote's IP address and connection time.
+// The in-memory store does not perform reverse lookups.
+func (m *Memory) LogConn(remote net.Addr) error {
+	if ip, _, err := net.SplitHostPort(remote.String()); err == nil {
+		m.mu.Lock()
+		m.connlog = append(m.connlog, connection{time.Now(), ip})
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+// Subscribe returns a subscription to records that are inserted from now
+// on and match the user, host and command of qp.
+func (m *Memory) Subscribe(qp conf.QueryParams) (*Subscription, error) {
+	return m.hub.Subscribe(qp)
+}
+
+// Close is a no-op for the in-memory store.
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,241 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/llog"
+)
+
+// A MergeStat counts the command lines of a user@host of a merged
+// database: how many it has and how many we didn't have.
+type MergeStat struct {
+	User, Host string
+	Read       int
+	Added      int
+}
+
+// MergeDatabase merges the bashistdb database in file into s, unlocking it
+// with passphrase if it is encrypted at rest. Users and hosts of file are
+// renamed as m maps them. It returns a report with counts per user@host
+// of file.
+func MergeDatabase(s Store, file string, passphrase []byte, m conf.MergeParams) (string, error) {
+	stats, err := s.Merge(file, passphrase, func(r *Record) bool {
+		if u, ok := m.Users[r.User]; ok {
+			r.User = u
+		}
+		if h, ok := m.Hosts[r.Host]; ok {
+			r.Host = h
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	var read, added int
+	var lines []string
+	for _, st := range stats {
+		read, added = read+st.Read, added+st.Added
+		lines = append(lines, fmt.Sprintf("    %s@%s: %d command lines, %d new", st.User, st.Host, st.Read, st.Added))
+	}
+	report := fmt.Sprintf("Merged %d new command lines out of %d from %s.", added, read, file)
+	if len(lines) > 0 {
+		report += "\n" + strings.Join(lines, "\n")
+	}
+	return report, nil
+}
+
+// mergeSource copies the bashistdb database in file to dir, so we neither
+// change nor lock it, and returns its records, decrypted with passphrase,
+// and the path of the copy. The copy is migrated to our schema.
+func mergeSource(file, dir string, passphrase []byte, log *llog.Logger) ([]Record, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	path := filepath.Join(dir, "merge.sqlite3")
+	src, err := openCopy(f, path, "database", log)
+	if err != nil {
+		return nil, "", err
+	}
+	defer src.Close()
+	if _, err = src.Encrypt(passphrase, conf.ENCRYPT_NONE); err != nil {
+		return nil, "", err
+	}
+	// A dry run purge lists the records.
+	records, err := src.Purge(func(Record) bool { return true }, true)
+	return records, path, err
+}
+
+// merger counts merged records per user@host of the source.
+type merger map[[2]string]*MergeStat
+
+// count counts r, which was added if added is set.
+func (m merger) count(r Record, added bool) {
+	k := [2]string{r.User, r.Host}
+	if m[k] == nil {
+		m[k] = &MergeStat{User: r.User, Host: r.Host}
+	}
+	m[k].Read++
+	if added {
+		m[k].Added++
+	}
+}
+
+// stats returns the counts, ordered by user and host.
+func (m merger) stats() []MergeStat {
+	var stats []MergeStat
+	for _, st := range m {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].User != stats[j].User {
+			return stats[i].User < stats[j].User
+		}
+		return stats[i].Host < stats[j].Host
+	})
+	return stats
+}
+
+// Merge imports the history, with working directories and sessions, and the
+// connection log of the bashistdb database in file, unlocking it with
+// passphrase if it is encrypted at rest. Each record passes through fn, which
+// may change it or return false to skip it. Records we already have are
+// skipped too. It returns counts per user@host of file.
+func (d Database) Merge(file string, passphrase []byte, fn func(r *Record) bool) ([]MergeStat, error) {
+	if err := d.rest.usable(); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "bashistdb-merge")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	records, path, err := mergeSource(file, dir, passphrase, d.log)
+	if err != nil {
+		return nil, err
+	}
+
+	// Attached databases are per connection, so we stay on one.
+	ctx := context.Background()
+	conn, err := d.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, `ATTACH DATABASE ? AS src`, path); err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(ctx, `DETACH DATABASE src`)
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt, stmtDir, stmtSession := tx.Stmt(d.insert), tx.Stmt(d.insertDir), tx.Stmt(d.insertSession)
+	m := make(merger)
+	var inserted []Record // we publish these to subscribers after commit
+	for _, r := range records {
+		source := r
+		if !fn(&r) {
+			m.count(source, false)
+			continue
+		}
+		res, err := stmt.Exec(r.User, r.Host, r.Command, r.Datetime)
+		if isDuplicate(err) {
+			m.count(source, false)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		r.Row = int(id)
+		if r.Dir != "" {
+			if _, err = stmtDir.Exec(id, r.Dir); err != nil {
+				return nil, err
+			}
+		}
+		if r.Session != "" {
+			if _, err = stmtSession.Exec(id, r.Session); err != nil {
+				return nil, err
+			}
+		}
+		m.count(source, true)
+		inserted = append(inserted, r)
+	}
+	for _, q := range []string{
+		`INSERT OR IGNORE INTO connlog(datetime, remote) SELECT datetime, remote FROM src.connlog`,
+		`INSERT OR IGNORE INTO rlookup(ip, reverse) SELECT ip, reverse FROM src.rlookup`,
+	} {
+		if _, err = tx.Exec(q); err != nil {
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	d.hub.publish(inserted...)
+	return m.stats(), nil
+}
+
+// Merge works as the SQLite store's Merge, without the connection log.
+func (m *Memory) Merge(file string, passphrase []byte, fn func(r *Record) bool) ([]MergeStat, error) {
+	dir, err := ioutil.TempDir("", "bashistdb-merge")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	records, _, err := mergeSource(file, dir, passphrase, m.log)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	stats := make(merger)
+	var inserted []Record
+	for _, r := range records {
+		source := r
+		if !fn(&r) || m.keys[keyOf(r)] {
+			stats.count(source, false)
+			continue
+		}
+		r.Row = m.nextRow()
+		m.keys[keyOf(r)] = true
+		m.records = append(m.records, r)
+		stats.count(source, true)
+		inserted = append(inserted, r)
+	}
+	m.mu.Unlock()
+
+	m.hub.publish(inserted...)
+	return stats.stats(), nil
+}
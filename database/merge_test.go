@@ -0,0 +1,102 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+func TestMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The database we merge is encrypted and has two users.
+	file := dir + "/laptop.sqlite3"
+	src, err := NewSQLite(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = src.Encrypt([]byte("secret"), conf.ENCRYPT_ALL); err != nil {
+		t.Fatal(err)
+	}
+	history := []byte("1  2015-10-12T12:00:00+0000 ls\n2  2015-10-12T12:00:05+0000 git status\n")
+	if _, err = src.AddFromBuffer(bufio.NewReader(bytes.NewReader(history)), "me", "laptop", "/home/me", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = src.AddRecord("root", "laptop", "reboot", time.Date(2015, 10, 12, 13, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	src.Close()
+
+	m := conf.MergeParams{Users: map[string]string{"me": "marios"}, Hosts: map[string]string{"laptop": "work"}}
+	want := []Record{
+		{User: "marios", Host: "work", Command: "ls", Dir: "/home/me"},
+		{User: "marios", Host: "work", Command: "git status", Dir: "/home/me"},
+		{User: "root", Host: "work", Command: "reboot"},
+	}
+	dst, err := NewSQLite(dir+"/db.sqlite3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	for name, s := range map[string]Store{"sqlite": dst, "memory": NewMemory(nil)} {
+		// We already have ls.
+		if err = s.AddRecord("marios", "work", "ls", time.Date(2015, 10, 12, 12, 0, 0, 0, time.UTC)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = MergeDatabase(s, file, []byte("wrong"), m); err != ErrPassphrase {
+			t.Errorf("%s: merge with a wrong passphrase: wanted ErrPassphrase, got %v", name, err)
+		}
+		report, err := MergeDatabase(s, file, []byte("secret"), m)
+		if err != nil {
+			t.Fatalf("%s: merge failed: %s", name, err)
+		}
+		wantReport := "Merged 2 new command lines out of 3 from " + file + ".\n" +
+			"    me@laptop: 2 command lines, 1 new\n" +
+			"    root@laptop: 1 command lines, 1 new"
+		if report != wantReport {
+			t.Errorf("%s: wanted report:\n%s\ngot:\n%s", name, wantReport, report)
+		}
+
+		all, err := s.Purge(func(Record) bool { return true }, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []Record
+		for _, r := range all {
+			got = append(got, Record{User: r.User, Host: r.Host, Command: r.Command, Dir: r.Dir})
+		}
+		// The ls we had has no working directory.
+		want[0].Dir = ""
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: wanted records %v, got %v", name, want, got)
+		}
+		want[0].Dir = "/home/me"
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andmarios/bashistdb/llog"
+)
+
+// A migration upgrades the schema of a database by one version. Migrations
+// are numbered by their place in migrations, starting from 1; databases
+// that no migration created are on version 1.
+type migration struct {
+	version string              // schema version after the migration
+	up      func(*sql.Tx) error // changes the schema
+}
+
+// migrations are the schema upgrades, oldest first. The last one upgrades
+// to VERSION. Add new ones at the end and don't change the rest: databases
+// out there have run them.
+var migrations = []migration{
+	{"2", exec(`CREATE TABLE connlog_new(
+                        datetime TEXT PRIMARY KEY,
+                        remote   TEXT);
+                    INSERT INTO connlog_new
+                        SELECT datetime, remote FROM connlog;
+                    DROP TABLE connlog;
+                    ALTER TABLE connlog_new RENAME TO 'connlog';
+                    CREATE TABLE rlookup (
+                        ip      TEXT PRIMARY KEY,
+                        reverse TEXT
+                    );
+                    CREATE VIEW connections AS
+                        SELECT datetime, remote, reverse
+                           FROM connlog AS c
+                           LEFT JOIN rlookup AS r
+                           ON c.remote = r.ip;`)},
+	{"2.1", exec(`CREATE INDEX HistoryDatetimeIdx ON history(datetime)`)},
+	{"2.2", exec(`CREATE TABLE dirs (
+                        id  INTEGER PRIMARY KEY,
+                        dir TEXT
+                    );
+                    CREATE INDEX DirsDirIdx ON dirs(dir);`)},
+	{"2.3", exec(`CREATE TABLE trash (
+                        id       INTEGER PRIMARY KEY,
+                        row      INTEGER,
+                        user     TEXT,
+                        host     TEXT,
+                        command  TEXT,
+                        datetime DATETIME,
+                        dir      TEXT
+                    );`)},
+	{"2.4", exec(`CREATE TABLE aliases (
+                        kind      TEXT,
+                        alias     TEXT,
+                        canonical TEXT,
+                        PRIMARY KEY (kind, alias)
+                    );`)},
+	{"2.5", exec(`CREATE TABLE sessions (
+                        id      INTEGER PRIMARY KEY,
+                        session TEXT
+                    );
+                    CREATE INDEX SessionsSessionIdx ON sessions(session);
+                    ALTER TABLE trash ADD COLUMN session TEXT;`)},
+}
+
+// exec returns a migration step that runs the SQL statements stmt.
+func exec(stmt string) func(*sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(stmt)
+		return err
+	}
+}
+
+// migrationKey is the key of admin where we store when migration n ran.
+func migrationKey(n int) string {
+	return "migration " + strconv.Itoa(n)
+}
+
+// pending returns the number of the first migration a database on version
+// needs, or len(migrations)+1 if it is on the latest version.
+func pending(version string) (int, error) {
+	if version == "1" {
+		return 1, nil
+	}
+	for i, m := range migrations {
+		if m.version == version {
+			return i + 2, nil
+		}
+	}
+	if NewerVersion(version, VERSION) {
+		return 0, errors.New("The database has schema version " + version + ", newer than " + VERSION +
+			" that this bashistdb supports. Please update bashistdb.")
+	}
+	return 0, errors.New("Unknown database schema version: " + version + ".")
+}
+
+// migrate upgrades the database d, stored in filename, to VERSION. It
+// first backs it up next to filename. Each migration runs in its own
+// transaction, so if one fails, the database stays on the version before
+// it. It is safe to run on databases that already are on latest version.
+func migrate(d *sql.DB, filename string, log *llog.Logger) error {
+	version, err := schemaVersion(d)
+	if err != nil {
+		return err
+	}
+	first, err := pending(version)
+	if err != nil {
+		return err
+	}
+	if first > len(migrations) {
+		log.Debug.Println("Database on latest version.")
+		return nil
+	}
+
+	// Keep earlier backups, they may be from failed migrations.
+	backup := fmt.Sprintf("%s.v%s.bak", filename, version)
+	for i := 1; fileExists(backup); i++ {
+		backup = fmt.Sprintf("%s.v%s.%d.bak", filename, version, i)
+	}
+	if _, err = d.Exec(`VACUUM INTO ?`, backup); err != nil {
+		return errors.New("Couldn't back up the database before migrating it: " + err.Error())
+	}
+	log.Info.Println("Backed up the database to " + backup + " before migrating it.")
+
+	for n := first; n <= len(migrations); n++ {
+		m := migrations[n-1]
+		if err = runMigration(d, n, m); err != nil {
+			return fmt.Errorf("Migration %d to schema version %s failed, the database is on version %s: %s", n, m.version, version, err)
+		}
+		version = m.version
+		log.Info.Println("Database upgraded to version " + version + ".")
+	}
+	return nil
+}
+
+// runMigration runs migration m, numbered n, in a transaction and records
+// it in admin. On error it rolls the transaction back.
+func runMigration(d *sql.DB, n int, m migration) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	err = m.up(tx)
+	if err == nil {
+		_, err = tx.Exec(`UPDATE admin SET value = ? WHERE key LIKE 'version'`, m.version)
+	}
+	if err == nil {
+		_, err = tx.Exec(`INSERT OR REPLACE INTO admin(key, value) VALUES(?, ?)`,
+			migrationKey(n), time.Now().Format(RFC3339alt))
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// fileExists reports whether there is a file named name.
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return !os.IsNotExist(err)
+}
+
+// schemaVersion returns the schema version stored in the admin table of d.
+func schemaVersion(d *sql.DB) (string, error) {
+	var version string
+	err := d.QueryRow(`SELECT value FROM admin WHERE key LIKE "version"`).Scan(&version)
+	return version, err
+}
+
+// MigrationStatus reports the schema version of the SQLite database in
+// filename and which migrations it had and needs, without migrating it.
+// Migrations that ran before bashistdb recorded them have no time.
+func MigrationStatus(filename string) (string, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return "", err
+	}
+	db, err := sql.Open("sqlite3", "file:"+filename+"?mode=ro")
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	version, err := schemaVersion(db)
+	if err != nil {
+		return "", errors.New("Not a bashistdb database: " + err.Error())
+	}
+	lines := []string{"Schema version " + version + ", this bashistdb supports " + VERSION + "."}
+	first, err := pending(version)
+	if err != nil {
+		return strings.Join(append(lines, err.Error()), "\n"), nil
+	}
+	for i, m := range migrations {
+		n := i + 1
+		status := "pending"
+		if n < first {
+			status = "applied"
+			var at string
+			err = db.QueryRow(`SELECT value FROM admin WHERE key = ?`, migrationKey(n)).Scan(&at)
+			switch err {
+			case nil:
+				status += " at " + at
+			case sql.ErrNoRows:
+			default:
+				return "", err
+			}
+		}
+		lines = append(lines, fmt.Sprintf("Migration %d to version %s: %s.", n, m.version, status))
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	if last := migrations[len(migrations)-1].version; last != VERSION {
+		t.Fatalf("The last migration upgrades to version %s instead of %s.", last, VERSION)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "db.sqlite3")
+	s, err := NewSQLite(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	// downgrade turns the database back to version 2.3.
+	downgrade := func(version string) {
+		db, err := sql.Open("sqlite3", file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err = db.Exec(`DROP TABLE IF EXISTS aliases; DROP TABLE IF EXISTS sessions;
+			ALTER TABLE trash DROP COLUMN session; UPDATE admin SET value = ? WHERE key = 'version'`, version); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A failed migration leaves the database on the version before it.
+	downgrade("2.3")
+	saved := migrations[4]
+	migrations[4].up = func(tx *sql.Tx) error {
+		if err := exec(`CREATE TABLE aliases (kind TEXT)`)(tx); err != nil {
+			return err
+		}
+		return errors.New("Failed.")
+	}
+	_, err = NewSQLite(file, nil)
+	migrations[4] = saved
+	if err == nil || !strings.Contains(err.Error(), "Migration 5 to schema version 2.4 failed") {
+		t.Fatalf("A failed migration returned: %v", err)
+	}
+	if version, err := SchemaVersion(file); err != nil || version != "2.3" {
+		t.Fatalf("A failed migration left version %s: %v", version, err)
+	}
+	status, err := MigrationStatus(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Schema version 2.3, this bashistdb supports " + VERSION + ".\nMigration 1 to version 2: applied."; !strings.HasPrefix(status, want) ||
+		!strings.HasSuffix(status, fmt.Sprintf("Migration %d to version %s: pending.", len(migrations), VERSION)) {
+		t.Fatalf("Migration status: wanted it to start with:\n%s\nand end with pending, got:\n%s", want, status)
+	}
+
+	// A successful one backs up the database and records when it ran.
+	s, err = NewSQLite(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Aliases(); err != nil {
+		t.Fatal("Migrated database has no aliases: " + err.Error())
+	}
+	s.Close()
+	backups, err := filepath.Glob(file + ".v2.3*.bak")
+	if err != nil || len(backups) != 2 {
+		t.Fatalf("Wanted two backups before migrating, got %v: %v", backups, err)
+	}
+	if status, err = MigrationStatus(file); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(status, "Migration 5 to version 2.4: applied at ") {
+		t.Fatalf("Migration status doesn't record migration 5:\n%s", status)
+	}
+
+	// Newer databases are refused.
+	downgrade("3")
+	if _, err = NewSQLite(file, nil); err == nil || !strings.Contains(err.Error(), "newer than "+VERSION) {
+		t.Fatalf("Opening a newer database returned: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"sort"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/result"
+)
+
+// nextCommands is the next query: it returns the qp.Kappa command lines
+// that most often followed the ones qp.Command matches, run at or after
+// qp.Since and before qp.Until, with how many times each did. A command line
+// follows another if it is the next one of the same shell session, run
+// within sessionGap. An empty qp.Command stands for the most recent command
+// line of the users and hosts of qp. With the command line format, only the
+// command lines are returned, for shell widgets; else they are count rows.
+func nextCommands(s Store, qp conf.QueryParams) ([]byte, error) {
+	sessions, err := s.Sessions(qp)
+	if err != nil {
+		return []byte{}, err
+	}
+	match, err := matcher(qp)
+	if err != nil {
+		return []byte{}, err
+	}
+	if qp.Command == "" && !qp.Regex {
+		var last Record
+		for _, ss := range sessions {
+			if r := ss.Records[len(ss.Records)-1]; !r.Datetime.Before(last.Datetime) {
+				last = r
+			}
+		}
+		match = func(r Record) bool { return r.Command == last.Command }
+	}
+
+	counts := make(map[string]int)
+	for _, ss := range sessions {
+		for i, r := range ss.Records[:len(ss.Records)-1] {
+			next := ss.Records[i+1]
+			if (!qp.Since.IsZero() && r.Datetime.Before(qp.Since)) || (!qp.Until.IsZero() && !r.Datetime.Before(qp.Until)) {
+				continue
+			}
+			if match(r) && next.Datetime.Sub(r.Datetime) <= sessionGap {
+				counts[next.Command]++
+			}
+		}
+	}
+	commands := make([]string, 0, len(counts))
+	for c := range counts {
+		commands = append(commands, c)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		if counts[commands[i]] == counts[commands[j]] {
+			return commands[i] < commands[j]
+		}
+		return counts[commands[i]] > counts[commands[j]]
+	})
+	if len(commands) > qp.Kappa {
+		commands = commands[:qp.Kappa]
+	}
+
+	if qp.Format == conf.FORMAT_COMMAND_LINE {
+		var out bytes.Buffer
+		for i, c := range commands {
+			if i > 0 {
+				out.WriteString("\n")
+			}
+			out.WriteString(c)
+		}
+		return out.Bytes(), nil
+	}
+	res := result.New(qp.Format)
+	for _, c := range commands {
+		res.AddCountRow(counts[c], c)
+	}
+	return res.Formatted(), nil
+}
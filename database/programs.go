@@ -0,0 +1,128 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"sort"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/result"
+	"github.com/andmarios/bashistdb/shell"
+)
+
+// Programs returns the qp.Kappa most used programs, subcommands or flags,
+// as qp.Group says, in the command lines qp matches. Each command line is
+// split into its simple commands, so a pipeline counts every program in it.
+func (d Database) Programs(qp conf.QueryParams) ([]byte, error) {
+	counts, err := d.commandCounts(qp)
+	if err != nil {
+		return []byte{}, err
+	}
+	return programs(counts, qp), nil
+}
+
+// commandCounts returns the command lines qp matches and how many times
+// each ran. It uses LIKE even for regex searches.
+func (d Database) commandCounts(qp conf.QueryParams) (map[string]int, error) {
+	rows, err := d.Query(`SELECT plain(command), count(*) FROM history
+                               WHERE `+userOf+` LIKE ? AND `+hostOf+` LIKE ? AND plain(command) LIKE ? ESCAPE '\'
+                               GROUP BY command`,
+		qp.User, qp.Host, qp.Command)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var command string
+		var count int
+		if err = rows.Scan(&command, &count); err != nil {
+			return nil, err
+		}
+		counts[command] += count
+	}
+	return counts, rows.Err()
+}
+
+// Programs works as the SQLite store's Programs.
+func (m *Memory) Programs(qp conf.QueryParams) ([]byte, error) {
+	return programs(m.commandCounts(qp), qp), nil
+}
+
+// commandCounts works as the SQLite store's commandCounts.
+func (m *Memory) commandCounts(qp conf.QueryParams) map[string]int {
+	qp.Regex = false
+	match, _ := matcher(qp)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	counts := make(map[string]int)
+	for _, r := range m.filter(match) {
+		counts[r.Command]++
+	}
+	return counts
+}
+
+// programs counts the programs, subcommands or flags of commands, which
+// are command lines and how many times each ran, and formats the qp.Kappa
+// most used.
+func programs(commands map[string]int, qp conf.QueryParams) []byte {
+	counts := make(map[string]int)
+	for line, n := range commands {
+		for _, c := range shell.Parse(line) {
+			if qp.Program != "" && c.Program != qp.Program {
+				continue
+			}
+			switch qp.Group {
+			case conf.GROUP_SUBCOMMAND:
+				if c.Subcommand != "" {
+					counts[c.Program+" "+c.Subcommand] += n
+				} else {
+					counts[c.Program] += n
+				}
+			case conf.GROUP_FLAG:
+				for _, f := range c.Flags {
+					counts[c.Program+" "+f] += n
+				}
+			default:
+				counts[c.Program] += n
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] == counts[keys[j]] {
+			return keys[i] < keys[j]
+		}
+		return counts[keys[i]] > counts[keys[j]]
+	})
+	if len(keys) > qp.Kappa {
+		keys = keys[:qp.Kappa]
+	}
+
+	res := result.New(qp.Format)
+	for _, k := range keys {
+		res.AddCountRow(counts[k], k)
+	}
+	return res.Formatted()
+}
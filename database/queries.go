@@ -24,8 +24,6 @@ package database
 import (
 	"bytes"
 	"database/sql"
-	"errors"
-	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
@@ -37,16 +35,16 @@ import (
 
 // TopK returns the k most frequent command lines in history
 func (d Database) TopK(qp conf.QueryParams) ([]byte, error) {
-	rows, err := d.Query(`SELECT command, count(*) as count FROM history
-                               WHERE user LIKE ? AND host LIKE ? AND command LIKE ? ESCAPE '\'
-                               GROUP BY command ORDER BY count DESC LIMIT ?`,
+	rows, err := d.Query(`SELECT plain(command), count(*) as count FROM history
+                               WHERE `+userOf+` LIKE ? AND `+hostOf+` LIKE ? AND plain(command) LIKE ? ESCAPE '\'
+                               GROUP BY command ORDER BY count DESC, plain(command) ASC LIMIT ?`,
 		qp.User, qp.Host, qp.Command, qp.Kappa)
 	if err != nil {
 		return []byte{}, err
 	}
 	defer rows.Close()
 
-	res := result.New("")
+	res := result.New(qp.Format)
 	for rows.Next() {
 		var command string
 		var count int
@@ -63,19 +61,23 @@ func (d Database) LastK(qp conf.QueryParams) ([]byte, error) {
 	switch qp.Unique {
 	case true:
 		rows, err = d.Query(`SELECT * FROM
-                                      (SELECT rowid, * FROM history
-                                         WHERE user LIKE ? AND host LIKE ? AND command LIKE ? ESCAPE '\'
-                                         GROUP BY command
-                                         ORDER BY datetime DESC LIMIT ?)
-                                      ORDER BY datetime ASC`,
-			qp.User, qp.Host, qp.Command, qp.Kappa)
+                                      (SELECT rowid, `+userOf+`, `+hostOf+`, plain(command), datetime FROM history
+                                         WHERE rowid IN (SELECT id FROM
+                                           (SELECT rowid AS id, max(datetime) FROM history
+                                              WHERE `+userOf+` LIKE ? AND `+hostOf+` LIKE ? AND plain(command) LIKE ? ESCAPE '\'
+                                                AND (? = '' OR rowid IN (SELECT id FROM dirs WHERE dir = ?))
+                                              GROUP BY command))
+                                         ORDER BY datetime DESC, rowid DESC LIMIT ?)
+                                      ORDER BY datetime ASC, rowid ASC`,
+			qp.User, qp.Host, qp.Command, qp.Dir, qp.Dir, qp.Kappa)
 	default:
 		rows, err = d.Query(`SELECT * FROM
-                                      (SELECT rowid, * FROM history
-                                         WHERE user LIKE ? AND host LIKE ? AND command LIKE ? ESCAPE '\'
-                                         ORDER BY datetime DESC LIMIT ?)
-                                   ORDER BY datetime ASC`,
-			qp.User, qp.Host, qp.Command, qp.Kappa)
+                                      (SELECT rowid, `+userOf+`, `+hostOf+`, plain(command), datetime FROM history
+                                         WHERE `+userOf+` LIKE ? AND `+hostOf+` LIKE ? AND plain(command) LIKE ? ESCAPE '\'
+                                           AND (? = '' OR rowid IN (SELECT id FROM dirs WHERE dir = ?))
+                                         ORDER BY datetime DESC, rowid DESC LIMIT ?)
+                                   ORDER BY datetime ASC, rowid ASC`,
+			qp.User, qp.Host, qp.Command, qp.Dir, qp.Dir, qp.Kappa)
 	}
 	if err != nil {
 		return []byte{}, err
@@ -93,7 +95,8 @@ func (d Database) LastK(qp conf.QueryParams) ([]byte, error) {
 	return res.Formatted(), nil
 }
 
-// DefaultQuery returns history within the search criteria in the format requested
+// DefaultQuery returns history within the search criteria in the format requested.
+// The rowids and the time range of qp, if set, narrow the search.
 func (d Database) DefaultQuery(qp conf.QueryParams) ([]byte, error) {
 	// SQLite's regexp extension is problematic; most systems don't have it, loading
 	// it is extremely error prone (almost impossible to get right), even we manage
@@ -103,7 +106,7 @@ func (d Database) DefaultQuery(qp conf.QueryParams) ([]byte, error) {
 	// to anything but the DefaultQuery
 	var regex *regexp.Regexp
 	var err error
-	commandQuery := "AND command LIKE ?" // This is used for normal searches. Fast.
+	commandQuery := "AND plain(command) LIKE ?" // This is used for normal searches. It opens every row, but with no regexp.
 	if qp.Regex {
 		regex, err = regexp.Compile(qp.Command)
 		if err != nil {
@@ -111,18 +114,28 @@ func (d Database) DefaultQuery(qp conf.QueryParams) ([]byte, error) {
 		}
 		commandQuery = "" // For PCRE we do the search, so we want everything. Slow.
 	}
+	args := []interface{}{qp.User, qp.Host}
+	if !qp.Regex {
+		args = append(args, qp.Command)
+	}
+	selected, selectedArgs := selection(qp)
+	args = append(args, selectedArgs...)
 
 	var rows *sql.Rows
 	switch qp.Unique {
 	case true:
-		rows, err = d.Query(`SELECT rowid, * FROM history
-                                        WHERE user LIKE ? AND host LIKE ? `+commandQuery+` ESCAPE '\'
-                                        GROUP BY command ORDER BY DATETIME ASC`,
-			qp.User, qp.Host, qp.Command)
+		// We want the most recent execution of each command.
+		rows, err = d.Query(`SELECT rowid, `+userOf+`, `+hostOf+`, plain(command), datetime FROM history
+                                        WHERE rowid IN (SELECT id FROM
+                                          (SELECT rowid AS id, max(datetime) FROM history
+                                             WHERE `+userOf+` LIKE ? AND `+hostOf+` LIKE ? `+commandQuery+` ESCAPE '\'`+selected+`
+                                             GROUP BY command))
+                                        ORDER BY datetime ASC, rowid ASC`,
+			args...)
 	default:
-		rows, err = d.Query(`SELECT rowid, * FROM history
-                                         WHERE user LIKE ? AND host LIKE ? `+commandQuery+` ESCAPE '\'`,
-			qp.User, qp.Host, qp.Command)
+		rows, err = d.Query(`SELECT rowid, `+userOf+`, `+hostOf+`, plain(command), datetime FROM history
+                                         WHERE `+userOf+` LIKE ? AND `+hostOf+` LIKE ? `+commandQuery+` ESCAPE '\'`+selected,
+			args...)
 	}
 	if err != nil {
 		return nil, err
@@ -148,133 +161,352 @@ func (d Database) DefaultQuery(qp conf.QueryParams) ([]byte, error) {
 	return res.Formatted(), nil
 }
 
+// selection returns the SQL condition, and its arguments, of the rowids and
+// the time range of qp, if set.
+func selection(qp conf.QueryParams) (string, []interface{}) {
+	var q string
+	var args []interface{}
+	if len(qp.Rows) > 0 {
+		ids := make([]string, len(qp.Rows))
+		for i, r := range qp.Rows {
+			ids[i] = strconv.Itoa(r)
+		}
+		q += ` AND rowid IN (` + strings.Join(ids, ", ") + `)`
+	}
+	if !qp.Since.IsZero() {
+		q, args = q+` AND julianday(datetime) >= julianday(?)`, append(args, qp.Since)
+	}
+	if !qp.Until.IsZero() {
+		q, args = q+` AND julianday(datetime) < julianday(?)`, append(args, qp.Until)
+	}
+	return q, args
+}
+
 // RunQuery is a wrapper around various queries.
 func (d Database) RunQuery(p conf.QueryParams) ([]byte, error) {
-	switch p.Type {
-	case conf.QUERY:
-		return d.DefaultQuery(p)
-	case conf.QUERY_LASTK:
-		return d.LastK(p)
-	case conf.QUERY_TOPK:
-		return d.TopK(p)
-	case conf.QUERY_USERS:
-		return d.Users(p)
-	case conf.QUERY_DEMO:
-		return d.Demo(p)
-	case conf.QUERY_ROW:
-		return d.ReturnRow(p)
-	case conf.DELETE:
-		return d.DeleteRows(p)
-	case conf.QUERY_CONTENT:
-		return d.ContentQuery(p)
-	}
-
-	return []byte{}, errors.New("Unknown query type.")
+	if err := d.rest.usable(); err != nil {
+		return []byte{}, err
+	}
+	return runQuery(d, p)
 }
 
 // Users returns unique user@host pairs from the database.
-func (d Database) Users(qp conf.QueryParams) (res []byte, e error) {
-	var result bytes.Buffer
-	result.WriteString(fmt.Sprintf("Unique user-hosts pairs:"))
-	rows, e := d.Query(`SELECT distinct(user), host FROM history
-                               WHERE user LIKE ? AND host LIKE ? AND command LIKE ? ESCAPE '\'`,
+func (d Database) Users(qp conf.QueryParams) ([]byte, error) {
+	rows, err := d.Query(`SELECT DISTINCT `+userOf+` AS user, `+hostOf+` AS host FROM history
+                               WHERE `+userOf+` LIKE ? AND `+hostOf+` LIKE ? AND plain(command) LIKE ? ESCAPE '\'
+                               ORDER BY user, host`,
 		qp.User, qp.Host, qp.Command)
-	if e != nil {
-		return result.Bytes(), e
+	if err != nil {
+		return []byte{}, err
 	}
 	defer rows.Close()
 
+	res := result.New(qp.Format)
 	for rows.Next() {
 		var user string
 		var host string
 		rows.Scan(&user, &host)
-		result.WriteString(fmt.Sprintf("\n%s@%s", user, host))
+		res.AddUserRow(user, host)
 	}
-	return result.Bytes(), e
+	return usersHeader(qp, res.Formatted()), nil
 }
 
 // Demo returns some stats from the database to showcase bashistdb.
 func (d Database) Demo(qp conf.QueryParams) (res []byte, e error) {
-	var result bytes.Buffer
-
-	var numUsers int
-	err := d.QueryRow("SELECT count(*) FROM (SELECT distinct(user), host FROM history)").Scan(&numUsers)
+	var c demoCounts
+	err := d.QueryRow("SELECT count(*) FROM (SELECT DISTINCT " + userOf + ", " + hostOf + " FROM history)").Scan(&c.users)
 	if err != nil {
-		return result.Bytes(), err
+		return []byte{}, err
 	}
 
-	var numHosts int
-	err = d.QueryRow("SELECT count(distinct(host)) FROM history").Scan(&numHosts)
+	err = d.QueryRow("SELECT count(DISTINCT " + hostOf + ") FROM history").Scan(&c.hosts)
 	if err != nil {
-		return result.Bytes(), err
+		return []byte{}, err
 	}
 
-	var numLines int
-	err = d.QueryRow("SELECT count(command) FROM history").Scan(&numLines)
+	err = d.QueryRow("SELECT count(command) FROM history").Scan(&c.lines)
 	if err != nil {
-		return result.Bytes(), err
+		return []byte{}, err
 	}
 
-	var numUniqueLines int
-	err = d.QueryRow("SELECT count(distinct(command)) FROM history").Scan(&numUniqueLines)
+	err = d.QueryRow("SELECT count(distinct(command)) FROM history").Scan(&c.uniqueLines)
 	if err != nil {
-		return result.Bytes(), err
+		return []byte{}, err
 	}
 
-	qp.Kappa = 15
-	restop, err := d.TopK(qp)
+	return demo(d, qp, c)
+}
+
+// ReturnRow returns a single row with no other data.
+// It is useful to pipe to bash.
+func (d Database) ReturnRow(qp conf.QueryParams) ([]byte, error) {
+	var command string
+	err := d.QueryRow("SELECT plain(command) FROM history WHERE rowid = ?", qp.Kappa).Scan(&command)
 	if err != nil {
-		return result.Bytes(), err
+		return []byte{}, err
 	}
+	return []byte(command), nil
+}
 
-	qp.Kappa = 10
-	reslast, err := d.LastK(qp)
+// DeleteRows moves a range of rows to the trash.
+func (d Database) DeleteRows(qp conf.QueryParams) ([]byte, error) {
+	n, err := d.Trash(qp.Rows)
 	if err != nil {
-		return result.Bytes(), err
+		return []byte{}, err
 	}
+	return trashMessage(n), nil
+}
 
-	result.WriteString(fmt.Sprintf("There are %d command lines (%d unique) in your database from %d users across %d hosts.\n\n", numLines, numUniqueLines, numUsers, numHosts))
+// deleteRows deletes a range of rows for good.
+func (d Database) deleteRows(rows []int) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i := len(rows) - 1; i >= 0; i-- {
+		if _, err = tx.Exec(`DELETE FROM history WHERE rowid=?`, rows[i]); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`DELETE FROM dirs WHERE id=?`, rows[i]); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`DELETE FROM sessions WHERE id=?`, rows[i]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
 
-	result.WriteString(fmt.Sprintf("Top-15 commands for user %s@%s:\n", qp.User, qp.Host))
-	result.Write(restop)
+// Trash moves rows to the trash table, with their working directories and
+// sessions.
+func (d Database) Trash(rows []int) (int, error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	n, err := trashRows(tx, rows)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
 
-	result.WriteString(fmt.Sprintf("\n\nLast 10 commands user %s@%s ran:\n", qp.User, qp.Host))
-	result.Write(reslast)
+// trashRows is Trash in tx.
+func trashRows(tx *sql.Tx, rows []int) (int, error) {
+	n := 0
+	for _, row := range rows {
+		res, err := tx.Exec(`INSERT INTO trash(row, user, host, command, datetime, dir, session)
+			SELECT history.rowid, user, host, command, datetime, dir, session
+			FROM history LEFT JOIN dirs ON dirs.id = history.rowid
+				LEFT JOIN sessions ON sessions.id = history.rowid
+			WHERE history.rowid=?`, row)
+		if err != nil {
+			return 0, err
+		}
+		if moved, _ := res.RowsAffected(); moved == 0 {
+			continue
+		}
+		n++
+		if _, err = tx.Exec(`DELETE FROM history WHERE rowid=?`, row); err != nil {
+			return 0, err
+		}
+		if _, err = tx.Exec(`DELETE FROM dirs WHERE id=?`, row); err != nil {
+			return 0, err
+		}
+		if _, err = tx.Exec(`DELETE FROM sessions WHERE id=?`, row); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
 
-	return result.Bytes(), nil
+// Trashed returns the records in the trash. Their Row is their id in the
+// trash.
+func (d Database) Trashed() ([]Record, error) {
+	records, _, err := d.trashed(nil)
+	return records, err
 }
 
-// ReturnRow returns a single row with no other data.
-// It is useful to pipe to bash.
-func (d Database) ReturnRow(qp conf.QueryParams) ([]byte, error) {
-	var command string
-	err := d.QueryRow("SELECT command FROM history WHERE rowid = ?", qp.Kappa).Scan(&command)
+// trashed returns the records in the trash with the given ids, all if none,
+// and the rowids they had.
+func (d Database) trashed(ids []int) (records []Record, rowids []int, err error) {
+	want := make(map[int]bool)
+	for _, id := range ids {
+		want[id] = true
+	}
+	rows, err := d.Query(`SELECT id, row, plain(user), plain(host), plain(command), datetime, IFNULL(dir, ''), IFNULL(session, '') FROM trash ORDER BY id`)
 	if err != nil {
-		return []byte{}, err
+		return nil, nil, err
 	}
-	return []byte(command), nil
+	defer rows.Close()
+	for rows.Next() {
+		var r Record
+		var rowid int
+		if err = rows.Scan(&r.Row, &rowid, &r.User, &r.Host, &r.Command, &r.Datetime, &r.Dir, &r.Session); err != nil {
+			return nil, nil, err
+		}
+		if len(ids) == 0 || want[r.Row] {
+			records = append(records, r)
+			rowids = append(rowids, rowid)
+		}
+	}
+	return records, rowids, rows.Err()
 }
 
-// DeleteRows deletes a range of rows.
-func (d Database) DeleteRows(qp conf.QueryParams) ([]byte, error) {
+// Untrash moves records back from the trash. They get the rowid they had,
+// if it is free.
+func (d Database) Untrash(ids []int) ([]Record, error) {
+	records, rowids, err := d.trashed(ids)
+	if err != nil {
+		return nil, err
+	}
 	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Rollback()
+	var restored []Record
+	for i, r := range records {
+		row := rowids[i]
+		if _, err = tx.Exec(`DELETE FROM trash WHERE id=?`, r.Row); err != nil {
+			return nil, err
+		}
+		var taken int
+		tx.QueryRow(`SELECT COUNT(*) FROM history WHERE rowid=?`, row).Scan(&taken)
+		var res sql.Result
+		if taken == 0 {
+			res, err = tx.Exec(`INSERT INTO history(rowid, user, host, command, datetime) VALUES(?, sealid(?), sealid(?), seal(?), ?)`,
+				row, r.User, r.Host, r.Command, r.Datetime)
+		} else {
+			res, err = tx.Exec(`INSERT INTO history(user, host, command, datetime) VALUES(sealid(?), sealid(?), seal(?), ?)`,
+				r.User, r.Host, r.Command, r.Datetime)
+		}
+		if isDuplicate(err) { // imported again meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		r.Row = int(id)
+		if r.Dir != "" {
+			if _, err = tx.Exec(`INSERT OR REPLACE INTO dirs(id, dir) VALUES(?, ?)`, r.Row, r.Dir); err != nil {
+				return nil, err
+			}
+		}
+		if r.Session != "" {
+			if _, err = tx.Exec(`INSERT OR REPLACE INTO sessions(id, session) VALUES(?, ?)`, r.Row, r.Session); err != nil {
+				return nil, err
+			}
+		}
+		restored = append(restored, r)
+	}
+	return restored, tx.Commit()
+}
+
+// EmptyTrash deletes records from the trash for good.
+func (d Database) EmptyTrash(ids []int, dryRun bool) ([]Record, error) {
+	records, _, err := d.trashed(ids)
+	if err != nil || dryRun {
+		return records, err
+	}
+	tx, err := d.Begin()
 	if err != nil {
-		return []byte{}, err
+		return nil, err
 	}
-	stmt, err := tx.Prepare(`DELETE FROM history WHERE rowid=?`)
+	defer tx.Rollback()
+	for _, r := range records {
+		if _, err = tx.Exec(`DELETE FROM trash WHERE id=?`, r.Row); err != nil {
+			return nil, err
+		}
+	}
+	return records, tx.Commit()
+}
+
+// Rewrite replaces every command line with fn(command). If a new command
+// line is a duplicate of an existing record, the row is deleted instead.
+func (d Database) Rewrite(fn func(command string) string, dryRun bool) ([]Record, error) {
+	rows, err := d.Query(`SELECT rowid, plain(user), plain(host), plain(command), datetime FROM history ORDER BY rowid`)
 	if err != nil {
-		return []byte{}, err
+		return nil, err
+	}
+	var changed []Record
+	for rows.Next() {
+		var r Record
+		if err = rows.Scan(&r.Row, &r.User, &r.Host, &r.Command, &r.Datetime); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if c := fn(r.Command); c != r.Command {
+			r.Command = c
+			changed = append(changed, r)
+		}
+	}
+	rows.Close()
+	if dryRun || len(changed) == 0 {
+		return changed, nil
 	}
 
-	for i := len(qp.Rows) - 1; i >= 0; i-- {
-		_, err = stmt.Exec(qp.Rows[i])
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for _, r := range changed {
+		_, err = tx.Exec(`UPDATE history SET command=seal(?) WHERE rowid=?`, r.Command, r.Row)
+		if err != nil && isDuplicate(err) {
+			if _, err = tx.Exec(`DELETE FROM history WHERE rowid=?`, r.Row); err == nil {
+				if _, err = tx.Exec(`DELETE FROM dirs WHERE id=?`, r.Row); err == nil {
+					_, err = tx.Exec(`DELETE FROM sessions WHERE id=?`, r.Row)
+				}
+			}
+		}
 		if err != nil {
-			return []byte{}, err
+			return nil, err
 		}
 	}
-	tx.Commit()
-	return []byte("No errors during deletion."), nil
+	return changed, tx.Commit()
+}
+
+// Purge deletes the records fn reports, with their working directories and
+// sessions.
+func (d Database) Purge(fn func(r Record) bool, dryRun bool) ([]Record, error) {
+	rows, err := d.Query(`SELECT history.rowid, ` + userOf + `, ` + hostOf + `, plain(command), datetime, IFNULL(dir, ''), IFNULL(session, '')
+		FROM history LEFT JOIN dirs ON dirs.id = history.rowid
+			LEFT JOIN sessions ON sessions.id = history.rowid
+		ORDER BY history.rowid`)
+	if err != nil {
+		return nil, err
+	}
+	var purged []Record
+	for rows.Next() {
+		var r Record
+		if err = rows.Scan(&r.Row, &r.User, &r.Host, &r.Command, &r.Datetime, &r.Dir, &r.Session); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if fn(r) {
+			purged = append(purged, r)
+		}
+	}
+	rows.Close()
+	if dryRun || len(purged) == 0 {
+		return purged, nil
+	}
+
+	var ids []int
+	for _, r := range purged {
+		ids = append(ids, r.Row)
+	}
+	if err = d.deleteRows(ids); err != nil {
+		return nil, err
+	}
+	return purged, nil
 }
 
 // ContentQuery returns matches of a row plus rows before or after the match.
@@ -284,11 +516,12 @@ func (d Database) DeleteRows(qp conf.QueryParams) ([]byte, error) {
 // 2. for each match, get the content asked by rowid
 // 3. if the content of two matches overlap, join them
 // 4. given the sets of rowids, get them from the database
+// If qp.Kappa is set, only the row with this rowid is a match.
 func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 	// Using Goland regexp library. Check DefaultQuery() for more info.
 	var regex *regexp.Regexp
 	var err error
-	commandQuery := "AND command LIKE ?" // This is used for normal searches. Fast.
+	commandQuery := "AND plain(command) LIKE ?" // This is used for normal searches. It opens every row, but with no regexp.
 	if qp.Regex {
 		regex, err = regexp.Compile(qp.Command)
 		if err != nil {
@@ -297,10 +530,15 @@ func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 		commandQuery = "" // For PCRE we do the search, so we want everything. Slow.
 	}
 
+	rowQuery := ""
+	if qp.Kappa > 0 {
+		rowQuery = " AND rowid = " + strconv.Itoa(qp.Kappa)
+	}
+
 	// Stage 1: find matches and get an array with their datetime
 	var rows *sql.Rows
-	rows, err = d.Query(`SELECT datetime, command FROM history
-                                         WHERE user LIKE ? AND host LIKE ? `+commandQuery+` ESCAPE '\'`,
+	rows, err = d.Query(`SELECT datetime, plain(command) FROM history
+                                         WHERE `+userOf+` LIKE ? AND `+hostOf+` LIKE ? `+commandQuery+` ESCAPE '\'`+rowQuery,
 		qp.User, qp.Host, qp.Command)
 
 	if err != nil {
@@ -330,9 +568,9 @@ func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 		// Before query also includes the current command, thus is always run.
 		rows, err = d.Query(`SELECT rowid, datetime FROM
                                       (SELECT rowid, datetime FROM history
-	                                     WHERE datetime <= ? AND user LIKE ? AND host LIKE ? ESCAPE '\'
-                                         ORDER BY datetime DESC LIMIT ?)
-                                      ORDER BY datetime ASC`,
+	                                     WHERE datetime <= ? AND `+userOf+` LIKE ? AND `+hostOf+` LIKE ? ESCAPE '\'
+                                         ORDER BY datetime DESC, rowid DESC LIMIT ?)
+                                      ORDER BY datetime ASC, rowid ASC`,
 			v, qp.User, qp.Host, qp.BeforeContent+1) // Here we include current query to before
 		if err != nil {
 			return nil, err
@@ -347,8 +585,8 @@ func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 		// After runs only if needed.
 		if qp.AfterContent > 0 {
 			rows, err = d.Query(`SELECT rowid, datetime FROM history
-	                                         WHERE datetime > ? AND user LIKE ? AND host LIKE ? ESCAPE '\'
-                                             ORDER BY datetime ASC LIMIT ?`,
+	                                         WHERE datetime > ? AND `+userOf+` LIKE ? AND `+hostOf+` LIKE ? ESCAPE '\'
+                                             ORDER BY datetime ASC, rowid ASC LIMIT ?`,
 				v, qp.User, qp.Host, qp.AfterContent)
 			if err != nil {
 				return nil, err
@@ -365,19 +603,7 @@ func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 	}
 
 	// Stage 3: let's merge the sets that overlap
-	for i := len(hitsContent) - 2; i >= 0; i-- {
-		for k, v := range hitsContent[i] {
-			if v == hitsContent[i+1][0] {
-				hitsContent[i] = append(hitsContent[i][:k], hitsContent[i+1]...)
-				if len(hitsContent) > i+2 {
-					hitsContent = append(hitsContent[:i+1], hitsContent[i+2:]...)
-				} else {
-					hitsContent = hitsContent[:i+1]
-				}
-				break
-			}
-		}
-	}
+	hitsContent = mergeContent(hitsContent)
 
 	var out bytes.Buffer
 
@@ -387,9 +613,9 @@ func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 		for _, v := range hitsContent[i] {
 			rowids = append(rowids, strconv.Itoa(v))
 		}
-		rows, err = d.Query(`SELECT rowid, * FROM history
+		rows, err = d.Query(`SELECT rowid, ` + userOf + `, ` + hostOf + `, plain(command), datetime FROM history
                                   WHERE rowid IN (` + strings.Join(rowids, ",") + `)
-                                  ORDER BY datetime ASC`)
+                                  ORDER BY datetime ASC, rowid ASC`)
 		if err != nil {
 			return nil, err
 		}
@@ -405,7 +631,7 @@ func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 		}
 		out.Write(res.Formatted())
 		if i < len(hitsContent)-1 {
-			out.WriteString("\n------------------\n")
+			out.WriteString(result.CONTENT_SEPARATOR)
 		}
 	}
 	return out.Bytes(), nil
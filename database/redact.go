@@ -0,0 +1,79 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/redact"
+)
+
+// redacting is a Store that removes secrets from command lines before
+// they are stored.
+type redacting struct {
+	Store
+	rd *redact.Redactor
+}
+
+// Redacting returns a Store that removes secrets with rd from the command
+// lines it passes to s. It also runs the REDACT query, which removes them
+// from the command lines s already has.
+func Redacting(s Store, rd *redact.Redactor) Store {
+	return redacting{s, rd}
+}
+
+func (s redacting) AddRecord(user, host, command string, t time.Time) error {
+	return s.Store.AddRecord(user, host, s.rd.Redact(command), t)
+}
+
+func (s redacting) AddFromBuffer(r *bufio.Reader, user, host, dir, session string) (string, error) {
+	history, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	r = bufio.NewReader(bytes.NewReader(s.rd.Lines(history)))
+	return s.Store.AddFromBuffer(r, user, host, dir, session)
+}
+
+func (s redacting) Merge(file string, passphrase []byte, fn func(r *Record) bool) ([]MergeStat, error) {
+	return s.Store.Merge(file, passphrase, func(r *Record) bool {
+		if !fn(r) {
+			return false
+		}
+		r.Command = s.rd.Redact(r.Command)
+		return true
+	})
+}
+
+func (s redacting) RunQuery(p conf.QueryParams) ([]byte, error) {
+	if p.Type != conf.REDACT {
+		return s.Store.RunQuery(p)
+	}
+	changed, err := s.Store.Rewrite(s.rd.Redact, p.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	if p.DryRun {
+		return report(changed, p, "Would redact %d command lines"), nil
+	}
+	return report(changed, p, "Redacted %d command lines"), nil
+}
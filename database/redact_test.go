@@ -0,0 +1,72 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/redact"
+)
+
+func TestRedacting(t *testing.T) {
+	rd, err := redact.New([]string{`pin (\d+)`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := NewMemory(nil)
+	tt := time.Date(2015, 1, 1, 1, 1, 0, 0, time.UTC)
+	// Stored before redaction was set up.
+	mem.AddRecord("user", "host", "unlock pin 1234", tt)
+
+	s := Redacting(mem, rd)
+	s.AddRecord("user", "host", "mysql -u root -phunter2 db", tt)
+	history := "    1  2015-10-12T12:00:05+0300 export GITHUB_TOKEN=ghp_abc\n" +
+		"user host 2015-10-12T12:00:06+0300 curl -u me:hunter2 https://example.com\n"
+	if _, err = s.AddFromBuffer(bufio.NewReader(strings.NewReader(history)), "user", "host", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	qp := conf.QueryParams{Type: conf.REDACT, DryRun: true, Format: conf.FORMAT_COMMAND_LINE}
+	res, err := s.RunQuery(qp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Would redact 1 command lines:\n1 unlock pin " + redact.Mask; string(res) != want {
+		t.Fatalf("Wanted:\n%s\nGot:\n%s", want, res)
+	}
+	qp.DryRun = false
+	if _, err = s.RunQuery(qp); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ = s.RunQuery(qp); string(res) != "Redacted 0 command lines." {
+		t.Fatalf("Redact left secrets: %s", res)
+	}
+
+	res, err = s.RunQuery(conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(res), "hunter2") || strings.Contains(string(res), "ghp_") || strings.Contains(string(res), "1234") ||
+		strings.Count(string(res), redact.Mask) != 4 {
+		t.Fatalf("Secrets were stored:\n%s", res)
+	}
+}
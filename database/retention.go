@@ -0,0 +1,208 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// retaining is a Store that runs the PRUNE query with a retention policy.
+type retaining struct {
+	Store
+	rules conf.RetentionRules
+}
+
+// Retaining returns a Store that runs the PRUNE query on s with rules.
+func Retaining(s Store, rules conf.RetentionRules) Store {
+	return retaining{s, rules}
+}
+
+func (s retaining) RunQuery(p conf.QueryParams) ([]byte, error) {
+	if p.Type != conf.PRUNE {
+		return s.Store.RunQuery(p)
+	}
+	pruned, err := s.Store.Prune(s.rules, time.Now(), p.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	if p.DryRun {
+		return report(pruned, p, "Would prune %d command lines"), nil
+	}
+	return report(pruned, p, "Pruned %d command lines"), nil
+}
+
+// Prune deletes the records rules don't keep as of now and returns them.
+// If dryRun is set, nothing is deleted. SQLite ranks the command lines of
+// each user@host, so we read only the ones it prunes.
+func (d Database) Prune(rules conf.RetentionRules, now time.Time, dryRun bool) ([]Record, error) {
+	if !rules.Enabled() {
+		return nil, nil
+	}
+	// The users, as stored, of each policy.
+	rows, err := d.Query(`SELECT user, ` + userOf + ` FROM (SELECT DISTINCT user FROM history)`)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[conf.RetentionPolicy][]interface{})
+	for rows.Next() {
+		var stored interface{}
+		var user string
+		if err = rows.Scan(&stored, &user); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if p := policy(rules, user); p != (conf.RetentionPolicy{}) {
+			users[p] = append(users[p], stored)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var pruned []Record
+	for p, u := range users {
+		records, err := d.expired(p, u, now)
+		if err != nil {
+			return nil, err
+		}
+		pruned = append(pruned, records...)
+	}
+	if dryRun || len(pruned) == 0 {
+		return pruned, nil
+	}
+	sort.Slice(pruned, func(i, j int) bool { return pruned[i].Row < pruned[j].Row })
+	var ids []int
+	for _, r := range pruned {
+		ids = append(ids, r.Row)
+	}
+	return pruned, d.deleteRows(ids)
+}
+
+// expired returns the records of users, as stored, that p doesn't keep as
+// of now. Newest first, a record is pruned if it is older than p.MaxAge, if
+// p.KeepLatest newer runs of its command line are kept or if p.MaxRows newer
+// records of its user@host are kept.
+func (d Database) expired(p conf.RetentionPolicy, users []interface{}, now time.Time) ([]Record, error) {
+	var cutoff time.Time
+	if p.MaxAge != "" {
+		age, err := conf.ParseAge(p.MaxAge)
+		if err != nil {
+			return nil, err
+		}
+		cutoff = now.Add(-age)
+	}
+	args := append(append([]interface{}{}, users...), !cutoff.IsZero(), cutoff, p.KeepLatest, p.KeepLatest, p.MaxRows, p.MaxRows)
+	rows, err := d.Query(`WITH ranked AS (SELECT rowid AS id, `+userOf+` AS u, `+hostOf+` AS h, julianday(datetime) AS day,
+	                                 row_number() OVER (PARTITION BY `+userOf+`, `+hostOf+`, command
+	                                                    ORDER BY julianday(datetime) DESC, rowid DESC) AS run
+	                               FROM history WHERE user IN (?`+strings.Repeat(", ?", len(users)-1)+`)),
+	                          old AS (SELECT id, u, h, day, (? AND day < julianday(?)) OR (? > 0 AND run > ?) AS old FROM ranked),
+	                          kept AS (SELECT id, old, row_number() OVER (PARTITION BY u, h, old ORDER BY day DESC, id DESC) AS kept FROM old)
+	                      SELECT history.rowid, `+userOf+`, `+hostOf+`, plain(command), datetime, IFNULL(dir, ''), IFNULL(session, '')
+	                        FROM history LEFT JOIN dirs ON dirs.id = history.rowid
+	                          LEFT JOIN sessions ON sessions.id = history.rowid
+	                        WHERE history.rowid IN (SELECT id FROM kept WHERE old OR (? > 0 AND kept > ?))
+	                        ORDER BY history.rowid`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []Record
+	for rows.Next() {
+		var r Record
+		if err = rows.Scan(&r.Row, &r.User, &r.Host, &r.Command, &r.Datetime, &r.Dir, &r.Session); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// Prune works as the SQLite store's Prune.
+func (m *Memory) Prune(rules conf.RetentionRules, now time.Time, dryRun bool) ([]Record, error) {
+	if !rules.Enabled() {
+		return nil, nil
+	}
+	// A dry run purge of everything lists the records.
+	all, err := m.Purge(func(Record) bool { return true }, true)
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]Record)
+	for _, r := range all {
+		groups[r.User+"@"+r.Host] = append(groups[r.User+"@"+r.Host], r)
+	}
+	prune := make(map[int]bool)
+	for _, records := range groups {
+		p := policy(rules, records[0].User)
+		var cutoff time.Time
+		if p.MaxAge != "" {
+			age, err := conf.ParseAge(p.MaxAge)
+			if err != nil {
+				return nil, err
+			}
+			cutoff = now.Add(-age)
+		}
+		// Newest first
+		sort.Slice(records, func(i, j int) bool {
+			if records[i].Datetime.Equal(records[j].Datetime) {
+				return records[i].Row > records[j].Row
+			}
+			return records[i].Datetime.After(records[j].Datetime)
+		})
+		kept := 0
+		runs := make(map[string]int)
+		for _, r := range records {
+			runs[r.Command]++
+			switch {
+			case !cutoff.IsZero() && r.Datetime.Before(cutoff),
+				p.KeepLatest > 0 && runs[r.Command] > p.KeepLatest,
+				p.MaxRows > 0 && kept >= p.MaxRows:
+				prune[r.Row] = true
+			default:
+				kept++
+			}
+		}
+	}
+	if len(prune) == 0 {
+		return nil, nil
+	}
+	return m.Purge(func(r Record) bool { return prune[r.Row] }, dryRun)
+}
+
+// policy returns the retention policy of user.
+func policy(rules conf.RetentionRules, user string) conf.RetentionPolicy {
+	names := make([]string, 0, len(rules.Users))
+	for name := range rules.Users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	p := rules.RetentionPolicy
+	for _, name := range names {
+		if ok, _ := path.Match(name, user); ok {
+			p = rules.Users[name]
+		}
+	}
+	return p
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2015, 10, 12, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	tests := []struct {
+		rules conf.RetentionRules
+		want  []string
+	}{
+		{conf.RetentionRules{}, nil},
+		{conf.RetentionRules{RetentionPolicy: conf.RetentionPolicy{MaxAge: "7d"}}, []string{"a old", "b old"}},
+		{conf.RetentionRules{RetentionPolicy: conf.RetentionPolicy{MaxRows: 2}}, []string{"a old"}},
+		{conf.RetentionRules{RetentionPolicy: conf.RetentionPolicy{KeepLatest: 1}}, []string{"a ls"}},
+		{conf.RetentionRules{RetentionPolicy: conf.RetentionPolicy{MaxAge: "7d", MaxRows: 1}}, []string{"a ls", "a old", "b old"}},
+		{conf.RetentionRules{RetentionPolicy: conf.RetentionPolicy{MaxAge: "7d"},
+			Users: map[string]conf.RetentionPolicy{"b*": {KeepLatest: 5}}}, []string{"a old"}},
+	}
+	dir, err := ioutil.TempDir("", "test-bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i, v := range tests {
+		sqlite, err := NewSQLite(fmt.Sprintf("%s/%d.sqlite3", dir, i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range []Store{NewMemory(nil), sqlite} {
+			m.AddRecord("a", "host", "old", now.Add(-30*day))
+			m.AddRecord("a", "host", "ls", now.Add(-2*day))
+			m.AddRecord("a", "host", "ls", now.Add(-day))
+			m.AddRecord("b", "host", "old", now.Add(-8*day))
+
+			for _, dryRun := range []bool{true, false} {
+				pruned, err := m.Prune(v.rules, now, dryRun)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, r := range pruned {
+					got = append(got, r.User+" "+r.Command)
+				}
+				sort.Strings(got)
+				if len(got) != len(v.want) {
+					t.Fatalf("Test %d %T (dry run %v): wanted %v, got %v", i, m, dryRun, v.want, got)
+				}
+				for k := range got {
+					if got[k] != v.want[k] {
+						t.Fatalf("Test %d %T (dry run %v): wanted %v, got %v", i, m, dryRun, v.want, got)
+					}
+				}
+			}
+			if left, _ := m.Prune(v.rules, now, true); len(left) != 0 {
+				t.Fatalf("Test %d %T: prune left %d records to prune", i, m, len(left))
+			}
+			m.Close()
+		}
+	}
+}
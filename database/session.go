@@ -0,0 +1,214 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/result"
+)
+
+// sessionGap is how long a user@host may stay idle before we infer that
+// a new shell session started, for command lines without a session.
+const sessionGap = 30 * time.Minute
+
+// A Session is the command lines a user ran in one shell at a host. The
+// shell hooks send the session of each command line. Command lines without
+// one, e.g from hooks of earlier versions, are grouped per user@host into
+// sessions that end when the user stays idle for sessionGap; their id is
+// a tilde and the rowid of their first command line.
+type Session struct {
+	ID      string
+	User    string
+	Host    string
+	Start   time.Time
+	End     time.Time
+	Records []Record `json:"-"`
+}
+
+// sessionsOf groups records, ordered by time, into sessions.
+func sessionsOf(records []Record) []Session {
+	var sessions []Session
+	known := make(map[[3]string]int) // user, host and id to index in sessions
+	inferred := make(map[[2]string]int)
+	for _, r := range records {
+		k := [3]string{r.User, r.Host, r.Session}
+		if r.Session == "" {
+			i, ok := inferred[[2]string{r.User, r.Host}]
+			if ok && r.Datetime.Sub(sessions[i].End) <= sessionGap {
+				sessions[i].add(r)
+				continue
+			}
+			inferred[[2]string{r.User, r.Host}] = len(sessions)
+			k[2] = "~" + strconv.Itoa(r.Row)
+		} else if i, ok := known[k]; ok {
+			sessions[i].add(r)
+			continue
+		}
+		known[k] = len(sessions)
+		sessions = append(sessions, Session{ID: k[2], User: r.User, Host: r.Host, Start: r.Datetime, End: r.Datetime, Records: []Record{r}})
+	}
+	return sessions
+}
+
+// add appends r, which is not older than the records of s, to s.
+func (s *Session) add(r Record) {
+	s.Records = append(s.Records, r)
+	s.End = r.Datetime
+}
+
+// Sessions returns the sessions of the users and hosts of qp that overlap
+// qp.Since and qp.Until, ordered by their start. SQLite finds where the
+// sessions without an id start, so we read only the command lines of the
+// sessions we return.
+func (d Database) Sessions(qp conf.QueryParams) ([]Session, error) {
+	rows, err := d.Query(`WITH h AS (SELECT history.rowid AS id, `+userOf+` AS u, `+hostOf+` AS hst,
+	                                        julianday(datetime) AS day, NULLIF(session, '') AS s
+	                                   FROM history LEFT JOIN sessions ON sessions.id = history.rowid
+	                                   WHERE `+userOf+` LIKE ? AND `+hostOf+` LIKE ? ESCAPE '\'),
+	                          gaps AS (SELECT *, IFNULL(round((day - lag(day) OVER (PARTITION BY u, hst, s IS NULL ORDER BY day, id)) * 86400000) > ?, 1) AS idle
+	                                   FROM h),
+	                          g AS (SELECT id, u, hst, day, s,
+	                                       CASE WHEN s IS NULL THEN sum(idle) OVER (PARTITION BY u, hst, s IS NULL ORDER BY day, id) END AS n
+	                                  FROM gaps),
+	                          k AS (SELECT u, hst, s, n FROM g GROUP BY u, hst, s, n
+	                                  HAVING (? OR max(day) >= julianday(?)) AND (? OR min(day) < julianday(?)))
+	                      SELECT history.rowid, `+userOf+`, `+hostOf+`, plain(command), datetime, IFNULL(dir, ''), IFNULL(session, '')
+	                        FROM g JOIN k ON g.u = k.u AND g.hst = k.hst AND g.s IS k.s AND g.n IS k.n
+	                          JOIN history ON history.rowid = g.id
+	                          LEFT JOIN dirs ON dirs.id = history.rowid
+	                          LEFT JOIN sessions ON sessions.id = history.rowid
+	                        ORDER BY g.day, g.id`,
+		qp.User, qp.Host, int64(sessionGap/time.Millisecond), qp.Since.IsZero(), qp.Since, qp.Until.IsZero(), qp.Until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []Record
+	for rows.Next() {
+		var r Record
+		if err = rows.Scan(&r.Row, &r.User, &r.Host, &r.Command, &r.Datetime, &r.Dir, &r.Session); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessionsOf(records), nil
+}
+
+// Sessions works as the SQLite store's Sessions.
+func (m *Memory) Sessions(qp conf.QueryParams) ([]Session, error) {
+	m.mu.RLock()
+	records := m.filter(func(r Record) bool {
+		return like(qp.User, r.User, false) && like(qp.Host, r.Host, false)
+	})
+	m.mu.RUnlock()
+	sortByDatetime(records)
+	var found []Session
+	for _, ss := range sessionsOf(records) {
+		if (qp.Since.IsZero() || !ss.End.Before(qp.Since)) && (qp.Until.IsZero() || ss.Start.Before(qp.Until)) {
+			found = append(found, ss)
+		}
+	}
+	return found, nil
+}
+
+// listSessions returns the sessions of the users and hosts of qp in s
+// that overlap qp.Since and qp.Until and have a command line that matches.
+func listSessions(s Store, qp conf.QueryParams) ([]byte, error) {
+	match, err := matcher(qp)
+	if err != nil {
+		return []byte{}, err
+	}
+	sessions, err := s.Sessions(qp)
+	if err != nil {
+		return []byte{}, err
+	}
+	var found []Session
+	for _, ss := range sessions {
+		for _, r := range ss.Records {
+			if match(r) {
+				found = append(found, ss)
+				break
+			}
+		}
+	}
+	return sessionsMessage(found, qp.Format), nil
+}
+
+// sessionsMessage formats sessions, one per line, or as JSON.
+func sessionsMessage(sessions []Session, format string) []byte {
+	if format == conf.FORMAT_JSON {
+		type sessionJSON struct {
+			Session
+			Lines int
+		}
+		out := []sessionJSON{}
+		for _, ss := range sessions {
+			out = append(out, sessionJSON{ss, len(ss.Records)})
+		}
+		res, _ := json.Marshal(out)
+		return res
+	}
+	if len(sessions) == 0 {
+		return []byte("No sessions.")
+	}
+	var out bytes.Buffer
+	for i, ss := range sessions {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		start, end := ss.Start.Local(), ss.End.Local()
+		fmt.Fprintf(&out, "%s %s@%s %s - %s, %d command lines", ss.ID, ss.User, ss.Host,
+			start.Format("2006-01-02 15:04"), end.Format("15:04"), len(ss.Records))
+	}
+	return out.Bytes()
+}
+
+// sessionContent is the content query with qp.Sessions set: it returns the
+// whole sessions of the matches, and of the row qp.Kappa if it is set.
+func sessionContent(s Store, qp conf.QueryParams) ([]byte, error) {
+	match, err := matcher(qp)
+	if err != nil {
+		return []byte{}, err
+	}
+	sessions, err := s.Sessions(qp)
+	if err != nil {
+		return []byte{}, err
+	}
+	var out bytes.Buffer
+	for _, ss := range sessions {
+		for _, r := range ss.Records {
+			if match(r) && (qp.Kappa == 0 || r.Row == qp.Kappa) {
+				if out.Len() > 0 {
+					out.WriteString(result.CONTENT_SEPARATOR)
+				}
+				out.Write(format(ss.Records, qp.Format))
+				break
+			}
+		}
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,400 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// Stats are the aggregations of the stats query. Periods are in local time,
+// weeks start on Monday and are numbered as SQLite's %W does.
+type Stats struct {
+	Lines    int       // command lines
+	Unique   int       // distinct command lines
+	Users    int       // distinct users
+	Hosts    int       // distinct hosts
+	First    time.Time // when the first command line ran
+	Last     time.Time // when the last command line ran
+	New      int       // distinct command lines first run in the range
+	Repeated int       // distinct command lines that ran before the range too
+	Days     []Count   // command lines per day, oldest first, days without any left out
+	Weeks    []Count   // command lines per week, as YYYY-WNN
+	Months   []Count   // command lines per month, as YYYY-MM
+	// Heatmap counts command lines per weekday, Sunday first, and hour.
+	Heatmap       [7][24]int
+	TopUsers      []Count // busiest users, most command lines first
+	TopHosts      []Count // busiest hosts
+	LongestStreak int     // most consecutive days with command lines
+	CurrentStreak int     // consecutive days with command lines up to today or yesterday
+}
+
+// A Count is how many command lines a period, user or host has.
+type Count struct {
+	Key   string
+	Count int
+}
+
+// statsTop is how many users and hosts Stats ranks.
+const statsTop = 10
+
+// Stats returns the statistics of the command lines the user, host and
+// command of qp match, run in the time range of qp.Since and qp.Until. A
+// distinct command line is new if its first run that qp matches, of any of
+// its users and hosts, is in the range; else it is repeated.
+func (d Database) Stats(qp conf.QueryParams) (Stats, error) {
+	var st Stats
+	filter := ` WHERE ` + userOf + ` LIKE ? AND ` + hostOf + ` LIKE ? AND plain(command) LIKE ? ESCAPE '\'`
+	args := []interface{}{qp.User, qp.Host, qp.Command}
+	// inRange is the time range on expression e, a julian day.
+	inRange := func(e string) (string, []interface{}) {
+		var q string
+		var args []interface{}
+		if !qp.Since.IsZero() {
+			q, args = q+` AND `+e+` >= julianday(?)`, append(args, qp.Since)
+		}
+		if !qp.Until.IsZero() {
+			q, args = q+` AND `+e+` < julianday(?)`, append(args, qp.Until)
+		}
+		return q, args
+	}
+	q, rangeArgs := inRange(`julianday(datetime)`)
+	where, whereArgs := filter+q, append(append([]interface{}{}, args...), rangeArgs...)
+
+	var first, last sql.NullFloat64
+	err := d.QueryRow(`SELECT count(*), count(DISTINCT command), count(DISTINCT `+userOf+`), count(DISTINCT `+hostOf+`),
+			min(julianday(datetime)), max(julianday(datetime)) FROM history`+where, whereArgs...).
+		Scan(&st.Lines, &st.Unique, &st.Users, &st.Hosts, &first, &last)
+	if err != nil {
+		return st, err
+	}
+	if st.Lines == 0 {
+		return st, nil
+	}
+	st.First, st.Last = fromJulianDay(first.Float64), fromJulianDay(last.Float64)
+
+	q, rangeArgs = inRange(`first`)
+	err = d.QueryRow(`SELECT count(*) FROM (SELECT min(julianday(datetime)) AS first FROM history`+filter+` GROUP BY command)
+			WHERE 1`+q, append(append([]interface{}{}, args...), rangeArgs...)...).Scan(&st.New)
+	if err != nil {
+		return st, err
+	}
+	st.Repeated = st.Unique - st.New
+
+	// counts runs a query that returns keys and counts.
+	counts := func(query string) ([]Count, error) {
+		rows, err := d.Query(query, whereArgs...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var counts []Count
+		for rows.Next() {
+			var c Count
+			if err = rows.Scan(&c.Key, &c.Count); err != nil {
+				return nil, err
+			}
+			counts = append(counts, c)
+		}
+		return counts, rows.Err()
+	}
+	period := func(format string) string {
+		return `SELECT strftime('` + format + `', datetime, 'localtime') AS p, count(*) FROM history` + where + ` GROUP BY p ORDER BY p`
+	}
+	top := func(name string) string {
+		return `SELECT ` + name + ` AS n, count(*) AS c FROM history` + where + ` GROUP BY n ORDER BY c DESC, n LIMIT ` + strconv.Itoa(statsTop)
+	}
+	for _, c := range []struct {
+		counts *[]Count
+		query  string
+	}{
+		{&st.Days, period("%Y-%m-%d")},
+		{&st.Weeks, period("%Y-W%W")},
+		{&st.Months, period("%Y-%m")},
+		{&st.TopUsers, top(userOf)},
+		{&st.TopHosts, top(hostOf)},
+	} {
+		if *c.counts, err = counts(c.query); err != nil {
+			return st, err
+		}
+	}
+
+	hours, err := counts(`SELECT strftime('%w %H', datetime, 'localtime') AS h, count(*) FROM history` + where + ` GROUP BY h`)
+	if err != nil {
+		return st, err
+	}
+	for _, h := range hours {
+		var day, hour int
+		fmt.Sscanf(h.Key, "%d %d", &day, &hour)
+		st.Heatmap[day][hour] = h.Count
+	}
+
+	st.LongestStreak, st.CurrentStreak = streaks(st.Days, time.Now())
+	return st, nil
+}
+
+// fromJulianDay returns the time of the julian day jd.
+func fromJulianDay(jd float64) time.Time {
+	ms := math.Round((jd - 2440587.5) * 86400000)
+	return time.Unix(0, int64(ms)*int64(time.Millisecond))
+}
+
+// Stats works as the SQLite store's Stats.
+func (m *Memory) Stats(qp conf.QueryParams) (Stats, error) {
+	var st Stats
+	qp.Regex = false // Stats uses LIKE even for regex searches
+	match, _ := matcher(qp)
+	inRange := func(t time.Time) bool {
+		return (qp.Since.IsZero() || !t.Before(qp.Since)) && (qp.Until.IsZero() || t.Before(qp.Until))
+	}
+	m.mu.RLock()
+	records := m.filter(match)
+	m.mu.RUnlock()
+
+	firstRun := make(map[string]time.Time)
+	commands, users, hosts := make(map[string]bool), make(map[string]int), make(map[string]int)
+	days, weeks, months := make(map[string]int), make(map[string]int), make(map[string]int)
+	for _, r := range records {
+		if f, ok := firstRun[r.Command]; !ok || r.Datetime.Before(f) {
+			firstRun[r.Command] = r.Datetime
+		}
+		if !inRange(r.Datetime) {
+			continue
+		}
+		if st.Lines == 0 || r.Datetime.Before(st.First) {
+			st.First = r.Datetime
+		}
+		if st.Lines == 0 || r.Datetime.After(st.Last) {
+			st.Last = r.Datetime
+		}
+		st.Lines++
+		commands[r.Command] = true
+		users[r.User]++
+		hosts[r.Host]++
+		t := r.Datetime.Local()
+		days[t.Format("2006-01-02")]++
+		weeks[fmt.Sprintf("%d-W%02d", t.Year(), (t.YearDay()-1+7-(int(t.Weekday())+6)%7)/7)]++
+		months[t.Format("2006-01")]++
+		st.Heatmap[t.Weekday()][t.Hour()]++
+	}
+	if st.Lines == 0 {
+		return Stats{}, nil
+	}
+	for _, f := range firstRun {
+		if inRange(f) {
+			st.New++
+		}
+	}
+	st.Unique, st.Users, st.Hosts = len(commands), len(users), len(hosts)
+	st.Repeated = st.Unique - st.New
+	st.Days, st.Weeks, st.Months = byKey(days), byKey(weeks), byKey(months)
+	st.TopUsers, st.TopHosts = byCount(users), byCount(hosts)
+	st.LongestStreak, st.CurrentStreak = streaks(st.Days, time.Now())
+	return st, nil
+}
+
+// byKey returns counts ordered by key.
+func byKey(counts map[string]int) []Count {
+	var out []Count
+	for k, c := range counts {
+		out = append(out, Count{k, c})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// byCount returns the statsTop largest counts, largest first.
+func byCount(counts map[string]int) []Count {
+	out := byKey(counts)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Count > out[j].Count })
+	if len(out) > statsTop {
+		out = out[:statsTop]
+	}
+	return out
+}
+
+// streaks returns the most consecutive days and the consecutive days up to
+// the day of now, or the day before, in days, which are ordered YYYY-MM-DD.
+func streaks(days []Count, now time.Time) (longest, current int) {
+	var prev time.Time
+	run := 0
+	for _, d := range days {
+		t, err := time.ParseInLocation("2006-01-02", d.Key, time.Local)
+		if err != nil {
+			continue
+		}
+		if run > 0 && t.Equal(prev.AddDate(0, 0, 1)) {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longest {
+			longest = run
+		}
+		prev = t
+	}
+	now = now.Local()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	if run > 0 && (prev.Equal(today) || prev.Equal(today.AddDate(0, 0, -1))) {
+		current = run
+	}
+	return longest, current
+}
+
+// weekdays are the rows of the heatmap chart, Monday first.
+var weekdays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday}
+
+// statsMessage formats st as a terminal chart, JSON or CSV.
+func statsMessage(st Stats, format string) []byte {
+	switch format {
+	case conf.FORMAT_JSON:
+		res, _ := json.Marshal(st)
+		return res
+	case conf.FORMAT_CSV:
+		return statsCSV(st)
+	}
+	if st.Lines == 0 {
+		return []byte("No command lines.")
+	}
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "%d command lines (%d unique) from %d users across %d hosts, %s to %s.\n",
+		st.Lines, st.Unique, st.Users, st.Hosts, st.First.Local().Format("2006-01-02"), st.Last.Local().Format("2006-01-02"))
+	fmt.Fprintf(&out, "Unique command lines new: %d (%d%%), repeated: %d (%d%%).\n",
+		st.New, percent(st.New, st.Unique), st.Repeated, percent(st.Repeated, st.Unique))
+	fmt.Fprintf(&out, "Longest streak: %d days, current streak: %d days.\n", st.LongestStreak, st.CurrentStreak)
+	barChart(&out, "Command lines per day, last 14 active days:", last(st.Days, 14))
+	barChart(&out, "Command lines per week, last 12 active weeks:", last(st.Weeks, 12))
+	barChart(&out, "Command lines per month, last 12 active months:", last(st.Months, 12))
+
+	out.WriteString("\nCommand lines per hour and weekday:\n    ")
+	for h := 0; h < 24; h += 3 {
+		fmt.Fprintf(&out, "%-6d", h)
+	}
+	out.Truncate(len(bytes.TrimRight(out.Bytes(), " ")))
+	max := 0
+	for _, day := range st.Heatmap {
+		for _, c := range day {
+			if c > max {
+				max = c
+			}
+		}
+	}
+	shades := []rune(" ░▒▓█")
+	for _, wd := range weekdays {
+		fmt.Fprintf(&out, "\n%s ", wd.String()[:3])
+		for _, c := range st.Heatmap[wd] {
+			s := 0
+			if c > 0 {
+				s = 1 + (len(shades)-2)*c/max
+			}
+			out.WriteString(strings.Repeat(string(shades[s]), 2))
+		}
+	}
+	out.WriteString("\n")
+
+	barChart(&out, "Busiest users:", st.TopUsers)
+	barChart(&out, "Busiest hosts:", st.TopHosts)
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n"))
+}
+
+// percent returns a as a percentage of b.
+func percent(a, b int) int {
+	if b == 0 {
+		return 0
+	}
+	return int(math.Round(100 * float64(a) / float64(b)))
+}
+
+// last returns the last n counts.
+func last(counts []Count, n int) []Count {
+	if len(counts) > n {
+		return counts[len(counts)-n:]
+	}
+	return counts
+}
+
+// barChartWidth is the width of the longest bar.
+const barChartWidth = 40
+
+// barChart writes counts as a horizontal bar chart with a title.
+func barChart(out *bytes.Buffer, title string, counts []Count) {
+	fmt.Fprintf(out, "\n%s\n", title)
+	width, max := 0, 0
+	for _, c := range counts {
+		if len(c.Key) > width {
+			width = len(c.Key)
+		}
+		if c.Count > max {
+			max = c.Count
+		}
+	}
+	for _, c := range counts {
+		bar := c.Count * barChartWidth / max
+		if bar == 0 {
+			bar = 1
+		}
+		fmt.Fprintf(out, "%-*s %s %d\n", width, c.Key, strings.Repeat("█", bar), c.Count)
+	}
+}
+
+// statsCSV formats st as CSV records of section, key and value.
+func statsCSV(st Stats) []byte {
+	var out bytes.Buffer
+	w := csv.NewWriter(&out)
+	w.Write([]string{"section", "key", "value"})
+	for _, t := range []struct {
+		key   string
+		value int
+	}{
+		{"lines", st.Lines}, {"unique", st.Unique}, {"users", st.Users}, {"hosts", st.Hosts},
+		{"new", st.New}, {"repeated", st.Repeated}, {"longest_streak", st.LongestStreak}, {"current_streak", st.CurrentStreak},
+	} {
+		w.Write([]string{"total", t.key, strconv.Itoa(t.value)})
+	}
+	if st.Lines > 0 {
+		w.Write([]string{"time", "first", st.First.Format(RFC3339alt)})
+		w.Write([]string{"time", "last", st.Last.Format(RFC3339alt)})
+	}
+	for _, s := range []struct {
+		section string
+		counts  []Count
+	}{
+		{"day", st.Days}, {"week", st.Weeks}, {"month", st.Months}, {"user", st.TopUsers}, {"host", st.TopHosts},
+	} {
+		for _, c := range s.counts {
+			w.Write([]string{s.section, c.Key, strconv.Itoa(c.Count)})
+		}
+	}
+	for _, wd := range weekdays {
+		for h, c := range st.Heatmap[wd] {
+			w.Write([]string{"hour", fmt.Sprintf("%s %02d", wd.String()[:3], h), strconv.Itoa(c)})
+		}
+	}
+	w.Flush()
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n"))
+}
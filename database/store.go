@@ -0,0 +1,328 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/result"
+)
+
+// MEMORY is the database filename that selects the in-memory store.
+const MEMORY = ":memory:"
+
+// A Store is a storage backend for bashistdb. Queries return their
+// results formatted according to the query parameters. Every
+// implementation should pass the conformance tests in store_test.go.
+type Store interface {
+	// AddRecord inserts a single record, ignoring duplicates.
+	AddRecord(user, host, command string, time time.Time) error
+	// AddFromBuffer imports history or export formatted lines. If dir is
+	// set, it is stored as the working directory of the new lines, and if
+	// session is set, as their shell session.
+	AddFromBuffer(r *bufio.Reader, user, host, dir, session string) (stats string, e error)
+
+	// RunQuery runs the query set in p.Type.
+	RunQuery(p conf.QueryParams) ([]byte, error)
+	DefaultQuery(qp conf.QueryParams) ([]byte, error)
+	LastK(qp conf.QueryParams) ([]byte, error)
+	TopK(qp conf.QueryParams) ([]byte, error)
+	Programs(qp conf.QueryParams) ([]byte, error)
+	SuggestAliases(qp conf.QueryParams) ([]byte, error)
+	Users(qp conf.QueryParams) ([]byte, error)
+	Demo(qp conf.QueryParams) ([]byte, error)
+	ReturnRow(qp conf.QueryParams) ([]byte, error)
+	ContentQuery(qp conf.QueryParams) ([]byte, error)
+	DeleteRows(qp conf.QueryParams) ([]byte, error)
+	// Rewrite replaces every stored command line with fn(command). It
+	// returns the records that changed, with their new command lines. If
+	// dryRun is set, nothing is changed.
+	Rewrite(fn func(command string) string, dryRun bool) ([]Record, error)
+	// Purge deletes the records fn reports. It returns them. If dryRun
+	// is set, nothing is deleted.
+	Purge(fn func(r Record) bool, dryRun bool) ([]Record, error)
+	// Prune deletes the records rules don't keep as of now and returns
+	// them. If dryRun is set, nothing is deleted.
+	Prune(rules conf.RetentionRules, now time.Time, dryRun bool) ([]Record, error)
+
+	// Trash moves the records with the given rowids to the trash, with
+	// their working directories. It returns how many it moved.
+	Trash(rowids []int) (int, error)
+	// Trashed returns the records in the trash. Their Row is their id in
+	// the trash.
+	Trashed() ([]Record, error)
+	// Untrash moves the records with the given ids, all if none, back from
+	// the trash and returns them with their new rowids. Records that were
+	// imported again meanwhile are dropped.
+	Untrash(ids []int) ([]Record, error)
+	// EmptyTrash deletes the records with the given ids, all if none, from
+	// the trash for good and returns them. If dryRun is set, nothing is
+	// deleted.
+	EmptyTrash(ids []int, dryRun bool) ([]Record, error)
+
+	// Alias makes alias, a user or host name as kind says, another name of
+	// canonical; queries return canonical instead. An empty canonical
+	// removes alias.
+	Alias(kind, alias, canonical string) error
+	// Aliases returns the aliases of users and hosts.
+	Aliases() ([]Alias, error)
+	// Rename stores the command lines of the user or host old as new's.
+	// The ones new already has are moved to the trash. It returns how many
+	// were renamed and how many moved to the trash.
+	Rename(kind, old, new string) (renamed, trashed int, err error)
+
+	// Sessions returns the sessions of the users and hosts of qp that
+	// overlap qp.Since and qp.Until, ordered by their start.
+	Sessions(qp conf.QueryParams) ([]Session, error)
+	// Stats returns the statistics of the command lines qp matches.
+	Stats(qp conf.QueryParams) (Stats, error)
+
+	// LogConn logs a connection from remote.
+	LogConn(remote net.Addr) error
+	// Subscribe returns a subscription to records inserted from now on.
+	Subscribe(qp conf.QueryParams) (*Subscription, error)
+
+	// Merge imports the history of the bashistdb database in file,
+	// unlocking it with passphrase if it is encrypted at rest. Each record
+	// passes through fn, which may change it or return false to skip it.
+	// It returns counts per user@host of file.
+	Merge(file string, passphrase []byte, fn func(r *Record) bool) ([]MergeStat, error)
+
+	// Backup writes a copy of the database to w.
+	Backup(w io.Writer) error
+	// Restore replaces the database with the backup r reads.
+	Restore(r io.Reader) error
+	// Check returns the problems it finds in the database.
+	Check() ([]string, error)
+	// Vacuum reclaims free space and returns the size of the database
+	// before and after.
+	Vacuum() (before, after int64, err error)
+
+	Close() error
+}
+
+// runQuery is the common implementation of RunQuery.
+func runQuery(s Store, p conf.QueryParams) ([]byte, error) {
+	switch p.Type {
+	case conf.QUERY:
+		return s.DefaultQuery(p)
+	case conf.QUERY_LASTK:
+		return s.LastK(p)
+	case conf.QUERY_TOPK:
+		return s.TopK(p)
+	case conf.QUERY_PROGRAMS:
+		return s.Programs(p)
+	case conf.QUERY_SUGGEST_ALIASES:
+		return s.SuggestAliases(p)
+	case conf.QUERY_USERS:
+		return s.Users(p)
+	case conf.QUERY_DEMO:
+		return s.Demo(p)
+	case conf.QUERY_ROW:
+		return s.ReturnRow(p)
+	case conf.DELETE:
+		if p.DryRun {
+			return deleteQuery(s, p)
+		}
+		return s.DeleteRows(p)
+	case conf.QUERY_CONTENT:
+		if p.Sessions {
+			return sessionContent(s, p)
+		}
+		return s.ContentQuery(p)
+	case conf.QUERY_SESSIONS:
+		return listSessions(s, p)
+	case conf.QUERY_NEXT:
+		return nextCommands(s, p)
+	case conf.QUERY_TYPOS:
+		return typoReport(s, p)
+	case conf.DELETE_TYPOS:
+		return deleteTypos(s, p)
+	case conf.QUERY_STATS:
+		st, err := s.Stats(p)
+		if err != nil {
+			return []byte{}, err
+		}
+		return statsMessage(st, p.Format), nil
+	case conf.DELETE_QUERY:
+		return deleteQuery(s, p)
+	case conf.QUERY_TRASH:
+		records, err := s.Trashed()
+		if err != nil {
+			return []byte{}, err
+		}
+		return format(records, p.Format), nil
+	case conf.UNDELETE:
+		records, err := s.Untrash(p.Rows)
+		if err != nil {
+			return []byte{}, err
+		}
+		return report(records, p, "Restored %d command lines"), nil
+	case conf.ALIAS:
+		if err := s.Alias(p.Identity, p.From, p.To); err != nil {
+			return []byte{}, err
+		}
+		return aliasMessage(p), nil
+	case conf.QUERY_ALIASES:
+		aliases, err := s.Aliases()
+		if err != nil {
+			return []byte{}, err
+		}
+		return aliasesMessage(aliases), nil
+	case conf.RENAME:
+		renamed, trashed, err := s.Rename(p.Identity, p.From, p.To)
+		if err != nil {
+			return []byte{}, err
+		}
+		return renameMessage(p, renamed, trashed), nil
+	case conf.PURGE_TRASH:
+		records, err := s.EmptyTrash(p.Rows, p.DryRun)
+		if err != nil {
+			return []byte{}, err
+		}
+		if p.DryRun {
+			return report(records, p, "Would delete %d command lines for good"), nil
+		}
+		return report(records, p, "Deleted %d command lines for good"), nil
+	}
+
+	return []byte{}, errors.New("Unknown query type.")
+}
+
+// deleteQuery moves the records that match p to the trash. The rowids of
+// p.Rows, if set, and the time range of p.Since and p.Until also have to
+// match.
+func deleteQuery(s Store, p conf.QueryParams) ([]byte, error) {
+	// The search lists the matches.
+	search := p
+	search.Type, search.Format, search.Unique = conf.QUERY, conf.FORMAT_JSON, false
+	res, err := s.DefaultQuery(search)
+	if err != nil {
+		return []byte{}, err
+	}
+	rows, err := result.Decode(res)
+	if err != nil {
+		return []byte{}, err
+	}
+	if p.DryRun {
+		var records []Record
+		for _, r := range rows {
+			records = append(records, Record{Row: r.Row, User: r.User, Host: r.Host, Command: r.Command, Datetime: r.Datetime})
+		}
+		return report(records, p, "Would move %d command lines to the trash"), nil
+	}
+	var ids []int
+	for _, r := range rows {
+		ids = append(ids, r.Row)
+	}
+	n, err := s.Trash(ids)
+	if err != nil {
+		return []byte{}, err
+	}
+	return trashMessage(n), nil
+}
+
+// trashMessage is the result of moving n command lines to the trash.
+func trashMessage(n int) []byte {
+	return []byte(fmt.Sprintf("Moved %d command lines to the trash. 'bashistdb trash' lists them, 'bashistdb undelete' restores them.", n))
+}
+
+// report formats records with a header, such as "Pruned %d command lines".
+// JSON results get no header.
+func report(records []Record, p conf.QueryParams, header string) []byte {
+	res := format(records, p.Format)
+	if p.Format == conf.FORMAT_JSON {
+		return res
+	}
+	if len(records) == 0 {
+		return []byte(fmt.Sprintf(header+".", 0))
+	}
+	return append([]byte(fmt.Sprintf(header+":\n", len(records))), res...)
+}
+
+// demoCounts are the totals that Demo reports.
+type demoCounts struct {
+	users, hosts, lines, uniqueLines int
+}
+
+// demo is the common implementation of Demo. It runs the TopK and LastK
+// queries of s and formats them together with the totals.
+func demo(s Store, qp conf.QueryParams, c demoCounts) ([]byte, error) {
+	var result bytes.Buffer
+
+	qp.Kappa = 15
+	restop, err := s.TopK(qp)
+	if err != nil {
+		return result.Bytes(), err
+	}
+
+	qp.Kappa = 10
+	reslast, err := s.LastK(qp)
+	if err != nil {
+		return result.Bytes(), err
+	}
+
+	result.WriteString(fmt.Sprintf("There are %d command lines (%d unique) in your database from %d users across %d hosts.\n\n", c.lines, c.uniqueLines, c.users, c.hosts))
+
+	result.WriteString(fmt.Sprintf("Top-15 commands for user %s@%s:\n", qp.User, qp.Host))
+	result.Write(restop)
+
+	result.WriteString(fmt.Sprintf("\n\nLast 10 commands user %s@%s ran:\n", qp.User, qp.Host))
+	result.Write(reslast)
+
+	return result.Bytes(), nil
+}
+
+// usersHeader prepends the header of the Users query to its formatted
+// result. JSON results get no header.
+func usersHeader(qp conf.QueryParams, res []byte) []byte {
+	if qp.Format == conf.FORMAT_JSON {
+		return res
+	}
+	header := "Unique user-hosts pairs:"
+	if len(res) > 0 {
+		header += "\n"
+	}
+	return append([]byte(header), res...)
+}
+
+// mergeContent merges the rowid sets of ContentQuery's matches that
+// overlap, so each row is printed once.
+func mergeContent(hitsContent [][]int) [][]int {
+	for i := len(hitsContent) - 2; i >= 0; i-- {
+		for k, v := range hitsContent[i] {
+			if v == hitsContent[i+1][0] {
+				hitsContent[i] = append(hitsContent[i][:k], hitsContent[i+1]...)
+				if len(hitsContent) > i+2 {
+					hitsContent = append(hitsContent[:i+1], hitsContent[i+2:]...)
+				} else {
+					hitsContent = hitsContent[:i+1]
+				}
+				break
+			}
+		}
+	}
+	return hitsContent
+}
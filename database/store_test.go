@@ -0,0 +1,792 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/result"
+)
+
+func TestMemory(t *testing.T) {
+	s, err := Open(MEMORY, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*Memory); !ok {
+		t.Fatalf("Open returned a %T instead of a Memory store.", s)
+	}
+	testStore(t, s)
+}
+
+// testStore is the conformance test suite for Store implementations.
+// It expects an empty store.
+func testStore(t *testing.T, s Store) {
+	// Subscribe before we add records, so we can check what we get.
+	sub, err := s.Subscribe(conf.QueryParams{User: "user1", Host: "host1", Command: "%lastk%"})
+	if err != nil {
+		t.Fatal("Subscribe failed: " + err.Error())
+	}
+
+	// Test add record
+	tt := time.Date(2015, 1, 1, 1, 1, 0, 0, time.UTC)
+	err = s.AddRecord("user1", "host1", "htop", tt)
+	if err != nil {
+		t.Fatal("AddRecord failed: " + err.Error())
+	}
+	// Test try to add duplicate record
+	err = s.AddRecord("user1", "host1", "htop", tt)
+	if err != nil {
+		t.Fatal("AddRecord failed: " + err.Error())
+	}
+
+	// Test add from buffer: default (history pipe) import:
+	// also test for duplicate records
+	br := bufio.NewReader(bytes.NewReader(entriesDefault))
+	stats, err := s.AddFromBuffer(br, "user", "test", "/home/user", "")
+	if err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+	if stats != entriesDefaultExpect {
+		t.Fatalf("AddFromBuffer returned wrong stats.\n"+
+			"Wanted: %s\nGot   : %s", entriesDefaultExpect, stats)
+	}
+
+	// Test add from buffer, restore (bashist export) format:
+	// also test for bad records
+	br = bufio.NewReader(bytes.NewReader(entriesImport))
+	stats, err = s.AddFromBuffer(br, "", "", "", "")
+	if err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+	if stats != entriesImportExpect {
+		t.Fatalf("AddFromBuffer returned wrong stats.\n"+
+			"Wanted: %s\nGot   : %s", entriesImportExpect, stats)
+	}
+
+	// Test log connection
+	na, _ := net.ResolveTCPAddr("tcp", "localhost:25625")
+	err = s.LogConn(na)
+	if err != nil {
+		t.Fatal("LogConn failed.")
+	}
+
+	const (
+		_ = iota
+		OK
+		ER
+	)
+
+	queries := []struct {
+		params conf.QueryParams
+		expect int
+		want   string
+		test   string
+	}{
+		{ // TopK
+			params: conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 2, User: "user1", Host: "host1", Command: "%%"},
+			expect: OK,
+			want:   "4 | topk 1\n" + "3 | topk 2",
+			test:   "topk",
+		},
+		{ // TopK with global
+			params: conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 2, User: "%", Host: "%", Format: conf.FORMAT_COMMAND_LINE, Command: "%%"},
+			expect: OK,
+			want:   "7 | topk 1\n" + "4 | topk 2",
+			test:   "topk global",
+		},
+		{ // default query
+			params: conf.QueryParams{Type: conf.QUERY, User: "user1", Host: "host1", Format: conf.FORMAT_COMMAND_LINE, Command: "%default%"},
+			expect: OK,
+			want:   "18 default query\n" + "19 default query",
+			test:   "default query",
+		},
+		{ // default query with unique (should return latest command instance)
+			params: conf.QueryParams{Type: conf.QUERY, User: "user1", Host: "host1", Format: conf.FORMAT_COMMAND_LINE, Command: "%default%", Unique: true},
+			expect: OK,
+			want:   "19 default query",
+			test:   "default query unique",
+		},
+		{ // users
+			params: conf.QueryParams{Type: conf.QUERY_USERS, User: "%", Host: "%", Format: conf.FORMAT_COMMAND_LINE, Command: "%%", Unique: true},
+			expect: OK,
+			want:   "Unique user-hosts pairs:\n" + "user@test\n" + "user1@host1\n" + "user1@host2\n" + "user2@host1\n" + "user3@host2",
+			test:   "users",
+		},
+		{ // users at host
+			params: conf.QueryParams{Type: conf.QUERY_USERS, User: "%", Host: "host2", Format: conf.FORMAT_COMMAND_LINE, Command: "%%", Unique: true},
+			expect: OK,
+			want:   "Unique user-hosts pairs:\n" + "user1@host2\n" + "user3@host2",
+			test:   "users at host",
+		},
+		{ // users in json
+			params: conf.QueryParams{Type: conf.QUERY_USERS, User: "%", Host: "host2", Format: conf.FORMAT_JSON, Command: "%%"},
+			expect: OK,
+			want:   "[\n" + `{"User":"user1","Host":"host2"},` + "\n" + `{"User":"user3","Host":"host2"}` + "\n]",
+			test:   "users in json",
+		},
+		{ // TopK in json
+			params: conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 2, User: "user1", Host: "host1", Format: conf.FORMAT_JSON, Command: "%%"},
+			expect: OK,
+			want:   "[\n" + `{"Count":4,"Command":"topk 1"},` + "\n" + `{"Count":3,"Command":"topk 2"}` + "\n]",
+			test:   "topk in json",
+		},
+		{ // row
+			params: conf.QueryParams{Type: conf.QUERY_ROW, Kappa: 20, User: "user1", Host: "host1", Command: "%%"},
+			expect: OK,
+			want:   "row 20",
+			test:   "row",
+		},
+		{ // content of a single row
+			params: conf.QueryParams{Type: conf.QUERY_CONTENT, Kappa: 18, User: "user1", Host: "host1", Format: conf.FORMAT_COMMAND_LINE, Command: "%%", BeforeContent: 1, AfterContent: 1},
+			expect: OK,
+			want:   "17 topk 2\n" + "18 default query\n" + "19 default query",
+			test:   "content of row",
+		},
+		{ // LastK in directory
+			params: conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 2, User: "%", Host: "%", Format: conf.FORMAT_COMMAND_LINE, Command: "%%", Dir: "/home/user"},
+			expect: OK,
+			want:   "4 go run bashistdb.go --local -db test.sqlite3 -format rows -lastk 40\n" + "5 history",
+			test:   "lastk in directory",
+		},
+		{ // LastK in directory, unique, no matches
+			params: conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 2, User: "%", Host: "%", Format: conf.FORMAT_COMMAND_LINE, Command: "%%", Dir: "/tmp", Unique: true},
+			expect: OK,
+			want:   "",
+			test:   "lastk in other directory",
+		},
+		{ // delete rows
+			params: conf.QueryParams{Type: conf.DELETE, Rows: []int{21, 22, 10000}},
+			expect: OK,
+			want:   "Moved 2 command lines to the trash. 'bashistdb trash' lists them, 'bashistdb undelete' restores them.",
+			test:   "delete rows",
+		},
+		{ // check row deleted
+			params: conf.QueryParams{Type: conf.QUERY_ROW, Kappa: 21, User: "user1", Host: "host1", Command: "%%"},
+			expect: ER,
+			want:   "",
+			test:   "check deleted rows",
+		},
+		{ // LastK
+			params: conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 2, User: "%", Host: "%", Format: conf.FORMAT_COMMAND_LINE, Command: "%%"},
+			expect: OK,
+			want:   "24 lastk 2\n" + "25 lastk 2",
+			test:   "lastk",
+		},
+		{ // LastK unique
+			params: conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 2, User: "%", Host: "%", Format: conf.FORMAT_COMMAND_LINE, Command: "%%", Unique: true},
+			expect: OK,
+			want:   "23 lastk 1\n" + "25 lastk 2",
+			test:   "lastk unique",
+		},
+		{ // Unkown Command
+			params: conf.QueryParams{Type: "bad command", Kappa: 2, User: "%", Host: "%", Format: conf.FORMAT_COMMAND_LINE, Command: "%%", Unique: true},
+			expect: ER,
+			want:   "",
+			test:   "unknown command",
+		},
+		{ // demo
+			params: conf.QueryParams{Type: conf.QUERY_DEMO, User: "%", Host: "%", Format: conf.FORMAT_COMMAND_LINE, Command: "%%"},
+			expect: OK,
+			want:   demoResponse,
+			test:   "demo",
+		},
+	}
+
+	for _, v := range queries {
+		res, err := s.RunQuery(v.params)
+		switch v.expect {
+		case OK:
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if string(res) != v.want {
+				t.Fatalf("Test '%s'\nWanted: %s\nGot   : %s",
+					v.test, v.want, string(res))
+			}
+		case ER:
+			if err == nil {
+				t.Fatalf("Test '%s' should have returned error. "+
+					"Instead  returned: %s.", v.test, string(res))
+			}
+		}
+	}
+
+	// Test subscription got the new records that matched
+	sub.Close()
+	var got []string
+	for r := range sub.C {
+		got = append(got, r.Command)
+	}
+	if len(got) != 3 || got[0] != "lastk 1" || got[2] != "lastk 2" {
+		t.Fatalf("Subscription got wrong records: %v", got)
+	}
+
+	// Test rewrite, first as a dry run
+	rename := func(c string) string { return strings.Replace(c, "topk", "top", -1) }
+	topk := conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 2, User: "%", Host: "%", Command: "%%"}
+	for _, dryRun := range []bool{true, false} {
+		changed, err := s.Rewrite(rename, dryRun)
+		if err != nil {
+			t.Fatal("Rewrite failed: " + err.Error())
+		}
+		if len(changed) != 12 || changed[0].Command != "top" {
+			t.Fatalf("Rewrite (dry run %v) returned wrong records: %v", dryRun, changed)
+		}
+	}
+	if res, _ := s.RunQuery(topk); string(res) != "7 | top 1\n"+"4 | top 2" {
+		t.Fatalf("Rewrite did not change the records, got:\n%s", res)
+	}
+	// Records that become duplicates are deleted.
+	s.AddRecord("user4", "host4", "dup 1", tt)
+	s.AddRecord("user4", "host4", "dup 2", tt)
+	changed, err := s.Rewrite(func(c string) string { return strings.Replace(c, "dup 2", "dup 1", 1) }, false)
+	if err != nil || len(changed) != 1 {
+		t.Fatalf("Rewrite to a duplicate failed: %v %v", changed, err)
+	}
+	lastk := conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 5, User: "user4", Host: "host4", Command: "%%", Format: conf.FORMAT_COMMAND_LINE}
+	if res, _ := s.RunQuery(lastk); !strings.HasSuffix(string(res), " dup 1") || strings.Count(string(res), "dup") != 1 {
+		t.Fatalf("Rewrite to a duplicate left:\n%s", res)
+	}
+
+	// Test purge, first as a dry run
+	top1 := func(r Record) bool { return r.Command == "top 1" }
+	for _, v := range []struct {
+		dryRun bool
+		want   int
+	}{{true, 7}, {false, 7}, {true, 0}} {
+		purged, err := s.Purge(top1, v.dryRun)
+		if err != nil {
+			t.Fatal("Purge failed: " + err.Error())
+		}
+		if len(purged) != v.want {
+			t.Fatalf("Purge (dry run %v) returned %d records instead of %d.", v.dryRun, len(purged), v.want)
+		}
+	}
+
+	// Test delete by query, the trash and undelete
+	s.AddRecord("user5", "host5", "rm old", tt)
+	s.AddRecord("user5", "host5", "rm new", tt.Add(time.Hour))
+	s.AddRecord("user5", "host5", "ls", tt.Add(time.Hour))
+	del := conf.QueryParams{Type: conf.DELETE_QUERY, User: "user5", Host: "%", Command: "rm%",
+		Since: tt.Add(time.Minute), Format: conf.FORMAT_COMMAND_LINE, DryRun: true}
+	if res, err := s.RunQuery(del); err != nil || !strings.HasPrefix(string(res), "Would move 1 command lines to the trash:\n") {
+		t.Fatalf("Delete query dry run returned: %s %v", res, err)
+	}
+	regex := conf.QueryParams{Type: conf.DELETE_QUERY, User: "user5", Host: "%", Command: "^rm", Regex: true,
+		Rows: []int{1}, Format: conf.FORMAT_COMMAND_LINE, DryRun: true}
+	if res, err := s.RunQuery(regex); err != nil || string(res) != "Would move 0 command lines to the trash." {
+		t.Fatalf("Delete query dry run of other rows returned: %s %v", res, err)
+	}
+	del.DryRun = false
+	if res, err := s.RunQuery(del); err != nil || !strings.HasPrefix(string(res), "Moved 1 command lines") {
+		t.Fatalf("Delete query returned: %s %v", res, err)
+	}
+	trashed, err := s.Trashed()
+	// The rows deleted earlier are there too.
+	if err != nil || len(trashed) != 3 || trashed[2].Command != "rm new" {
+		t.Fatalf("Trash has wrong records: %v %v", trashed, err)
+	}
+	user5 := conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 5, User: "user5", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE}
+	before, _ := s.RunQuery(user5)
+	restored, err := s.Untrash([]int{trashed[2].Row})
+	if err != nil || len(restored) != 1 {
+		t.Fatalf("Untrash failed: %v %v", restored, err)
+	}
+	if res, _ := s.RunQuery(user5); strings.Count(string(res), "\n") != strings.Count(string(before), "\n")+1 ||
+		!strings.Contains(string(res), fmt.Sprintf("%d rm new", restored[0].Row)) {
+		t.Fatalf("Untrash did not restore the record, got:\n%s", res)
+	}
+	if n, err := s.Trash([]int{restored[0].Row}); err != nil || n != 1 {
+		t.Fatalf("Trash moved %d records: %v", n, err)
+	}
+	for _, v := range []struct {
+		dryRun bool
+		want   int
+	}{{true, 3}, {false, 3}, {false, 0}} {
+		deleted, err := s.EmptyTrash(nil, v.dryRun)
+		if err != nil || len(deleted) != v.want {
+			t.Fatalf("EmptyTrash (dry run %v) returned %d records instead of %d: %v", v.dryRun, len(deleted), v.want, err)
+		}
+	}
+
+	// Test aliases and renames
+	s.AddRecord("me", "laptop.example.com", "make", tt)
+	s.AddRecord("me", "laptop", "make test", tt)
+	s.AddRecord("marios", "laptop", "make", tt)
+	s.AddRecord("marios", "laptop", "ls", tt)
+	laptop := conf.QueryParams{Type: conf.QUERY_USERS, User: "%", Host: "laptop%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE, Unique: true}
+	for _, v := range []struct {
+		params conf.QueryParams
+		want   string
+	}{
+		{conf.QueryParams{Type: conf.ALIAS, Identity: conf.IDENTITY_HOST, From: "laptop.example.com", To: "laptop"}, "host laptop.example.com is now shown as laptop."},
+		{conf.QueryParams{Type: conf.ALIAS, Identity: conf.IDENTITY_USER, From: "me", To: "m"}, "user me is now shown as m."},
+		{conf.QueryParams{Type: conf.ALIAS, Identity: conf.IDENTITY_USER, From: "m", To: "marios"}, "user m is now shown as marios."},
+		{conf.QueryParams{Type: conf.QUERY_ALIASES}, "user m -> marios\nuser me -> marios\nhost laptop.example.com -> laptop"},
+		{laptop, "Unique user-hosts pairs:\nmarios@laptop"},
+		{conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 5, User: "marios", Host: "laptop", Command: "make%", Format: conf.FORMAT_COMMAND_LINE},
+			"make\nmake test\nmake"},
+		{conf.QueryParams{Type: conf.ALIAS, Identity: conf.IDENTITY_USER, From: "me"}, "Removed the alias user me."},
+		{conf.QueryParams{Type: conf.RENAME, Identity: conf.IDENTITY_USER, From: "me", To: "marios"},
+			"Renamed user me to marios in 1 command lines. Moved 1 command lines marios already had to the trash."},
+		{conf.QueryParams{Type: conf.RENAME, Identity: conf.IDENTITY_HOST, From: "laptop.example.com", To: "laptop"},
+			"Renamed host laptop.example.com to laptop in 0 command lines."},
+		{conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 5, User: "marios", Host: "laptop", Command: "%%"}, "1 | ls\n1 | make\n1 | make test"},
+	} {
+		res, err := s.RunQuery(v.params)
+		if err != nil {
+			t.Fatalf("%s %s failed: %s", v.params.Type, v.params.From, err)
+		}
+		if v.params.Type == conf.QUERY_LASTK {
+			res = []byte(regexp.MustCompile(`(?m)^\d+ `).ReplaceAllString(string(res), ""))
+		}
+		if string(res) != v.want {
+			t.Fatalf("%s %s: wanted:\n%s\ngot:\n%s", v.params.Type, v.params.From, v.want, res)
+		}
+	}
+	for _, p := range []conf.QueryParams{
+		{Type: conf.ALIAS, Identity: conf.IDENTITY_HOST, From: "laptop", To: "laptop.example.com"},
+		{Type: conf.ALIAS, Identity: "group", From: "a", To: "b"},
+		{Type: conf.RENAME, Identity: conf.IDENTITY_USER, From: "marios"},
+	} {
+		if _, err := s.RunQuery(p); err == nil {
+			t.Fatalf("%s %s %s to %q should get error", p.Type, p.Identity, p.From, p.To)
+		}
+	}
+	// Subscriptions match and get the canonical names too.
+	if err = s.Alias(conf.IDENTITY_USER, "mm", "marios"); err != nil {
+		t.Fatal("Alias failed: " + err.Error())
+	}
+	follow, err := s.Subscribe(conf.QueryParams{User: "marios", Host: "laptop", Command: "%%"})
+	if err != nil {
+		t.Fatal("Subscribe failed: " + err.Error())
+	}
+	s.AddRecord("mm", "laptop.example.com", "tail", tt)
+	follow.Close()
+	if r, ok := <-follow.C; !ok || r.User != "marios" || r.Host != "laptop" || r.Command != "tail" {
+		t.Fatalf("Subscription to an aliased user got %+v, %v", r, ok)
+	}
+
+	// Test sessions, explicit and inferred from time gaps
+	history := []struct{ session, lines string }{
+		{"s1", "1  2015-10-01T10:00:00+0000 vim notes\n2  2015-10-01T10:01:00+0000 make\n"},
+		{"s2", "1  2015-10-01T10:00:30+0000 top\n"},
+		{"", "1  2015-10-01T12:00:00+0000 ls\n2  2015-10-01T12:20:00+0000 make\n3  2015-10-01T14:00:00+0000 cd\n"},
+	}
+	for _, h := range history {
+		if _, err = s.AddFromBuffer(bufio.NewReader(strings.NewReader(h.lines)), "sess", "box", "", h.session); err != nil {
+			t.Fatal("AddFromBuffer with a session failed: " + err.Error())
+		}
+	}
+	sessions := conf.QueryParams{Type: conf.QUERY_SESSIONS, User: "sess", Host: "box", Command: "%%", Format: conf.FORMAT_COMMAND_LINE}
+	since := sessions
+	since.Since = time.Date(2015, 10, 1, 11, 0, 0, 0, time.UTC)
+	// Sessions that overlap the range are listed whole.
+	overlap := sessions
+	overlap.Since, overlap.Until = time.Date(2015, 10, 1, 10, 0, 45, 0, time.UTC), time.Date(2015, 10, 1, 12, 10, 0, 0, time.UTC)
+	matching := sessions
+	matching.Command = "%make%"
+	content := conf.QueryParams{Type: conf.QUERY_CONTENT, Sessions: true, User: "sess", Host: "box", Command: "%make%", Format: conf.FORMAT_COMMAND_LINE}
+	for _, v := range []struct {
+		params conf.QueryParams
+		want   []string
+	}{
+		{sessions, []string{"s1 sess@box", "2 command lines", "s2 sess@box", "1 command lines", "~", "2 command lines", "~", "1 command lines"}},
+		{since, []string{"~", "2 command lines", "~", "1 command lines"}},
+		{overlap, []string{"s1 sess@box", "2 command lines", "~", "2 command lines"}},
+		{matching, []string{"s1 sess@box", "2 command lines", "~", "2 command lines"}},
+		{content, []string{"vim notes\nmake", "ls\nmake"}},
+	} {
+		res, err := s.RunQuery(v.params)
+		if err != nil {
+			t.Fatalf("Sessions query failed: %s", err)
+		}
+		// Sessions are listed one per line, want has a prefix and suffix
+		// of each; content has them separated, want has each.
+		got, n := strings.Split(string(res), "\n"), len(v.want)/2
+		if v.params.Type == conf.QUERY_CONTENT {
+			got = strings.Split(regexp.MustCompile(`(?m)^\d+ `).ReplaceAllString(string(res), ""), result.CONTENT_SEPARATOR)
+			n = len(v.want)
+		}
+		if len(got) != n {
+			t.Fatalf("Sessions query %+v: wanted %d sessions, got:\n%s", v.params, n, res)
+		}
+		for i, g := range got {
+			if v.params.Type == conf.QUERY_CONTENT {
+				if g != v.want[i] {
+					t.Fatalf("Session content: wanted:\n%s\ngot:\n%s", v.want[i], g)
+				}
+			} else if !strings.HasPrefix(g, v.want[2*i]) || !strings.HasSuffix(g, v.want[2*i+1]) {
+				t.Fatalf("Sessions: wanted a line like %s...%s, got:\n%s", v.want[2*i], v.want[2*i+1], res)
+			}
+		}
+	}
+
+	// Test stats
+	_, err = s.AddFromBuffer(bufio.NewReader(strings.NewReader(`stat box 2015-10-01T12:00:00+0000 ls
+stat box 2015-10-01T12:05:00+0000 make
+stat box 2015-10-02T12:00:00+0000 ls
+stat box 2015-10-04T12:00:00+0000 git status
+stat2 box2 2015-10-04T13:00:00+0000 ls
+`)), "", "", "", "")
+	if err != nil {
+		t.Fatal("AddFromBuffer for stats failed: " + err.Error())
+	}
+	statsQuery := conf.QueryParams{Type: conf.QUERY_STATS, User: "stat%", Host: "%", Command: "%%", Format: conf.FORMAT_CHART}
+	statsSince := statsQuery
+	statsSince.Since = time.Date(2015, 10, 2, 0, 0, 0, 0, time.UTC)
+	statsLs := statsQuery
+	statsLs.Command = "%ls%"
+	for _, v := range []struct {
+		params                                    conf.QueryParams
+		lines, unique, users, hosts, new, longest int
+		days, topUsers                            []Count
+	}{
+		{statsQuery, 5, 3, 2, 2, 3, 2, []Count{{"2015-10-01", 2}, {"2015-10-02", 1}, {"2015-10-04", 2}}, []Count{{"stat", 4}, {"stat2", 1}}},
+		{statsSince, 3, 2, 2, 2, 1, 1, []Count{{"2015-10-02", 1}, {"2015-10-04", 2}}, []Count{{"stat", 2}, {"stat2", 1}}},
+		{statsLs, 3, 1, 2, 2, 1, 2, []Count{{"2015-10-01", 1}, {"2015-10-02", 1}, {"2015-10-04", 1}}, []Count{{"stat", 2}, {"stat2", 1}}},
+	} {
+		st, err := s.Stats(v.params)
+		if err != nil {
+			t.Fatalf("Stats failed: %s", err)
+		}
+		if st.Lines != v.lines || st.Unique != v.unique || st.Users != v.users || st.Hosts != v.hosts ||
+			st.New != v.new || st.Repeated != v.unique-v.new || st.LongestStreak != v.longest || st.CurrentStreak != 0 {
+			t.Fatalf("Stats %+v: wrong totals: %+v", v.params, st)
+		}
+		if !reflect.DeepEqual(st.Days, v.days) || !reflect.DeepEqual(st.TopUsers, v.topUsers) {
+			t.Fatalf("Stats %+v: wanted days %v and users %v, got %v and %v", v.params, v.days, v.topUsers, st.Days, st.TopUsers)
+		}
+		if len(st.Weeks) != 1 || st.Weeks[0] != (Count{"2015-W39", v.lines}) || len(st.Months) != 1 || st.Months[0] != (Count{"2015-10", v.lines}) {
+			t.Fatalf("Stats %+v: wrong weeks %v or months %v", v.params, st.Weeks, st.Months)
+		}
+		heat := 0
+		for _, day := range st.Heatmap {
+			for _, c := range day {
+				heat += c
+			}
+		}
+		if noon := time.Date(2015, 10, 2, 12, 0, 0, 0, time.UTC).Local(); heat != v.lines || st.Heatmap[noon.Weekday()][noon.Hour()] != 1 {
+			t.Fatalf("Stats %+v: wrong heatmap %v", v.params, st.Heatmap)
+		}
+	}
+	for format, want := range map[string]string{
+		conf.FORMAT_CHART: "5 command lines (3 unique) from 2 users across 2 hosts, 2015-10-0",
+		conf.FORMAT_JSON:  `{"Lines":5,"Unique":3,"Users":2,"Hosts":2,`,
+		conf.FORMAT_CSV:   "section,key,value\ntotal,lines,5\n",
+	} {
+		statsQuery.Format = format
+		res, err := s.RunQuery(statsQuery)
+		if err != nil {
+			t.Fatalf("Stats query failed: %s", err)
+		}
+		if !strings.HasPrefix(string(res), want) {
+			t.Fatalf("Stats query, format %s: wanted a prefix of:\n%s\ngot:\n%s", format, want, res)
+		}
+	}
+	statsQuery.User, statsQuery.Format = "nobody", conf.FORMAT_CHART
+	if res, err := s.RunQuery(statsQuery); err != nil || string(res) != "No command lines." {
+		t.Fatalf("Stats query with no matches: got %q, %v", res, err)
+	}
+
+	// Test programs, subcommands and flags
+	_, err = s.AddFromBuffer(bufio.NewReader(strings.NewReader(`prog box 2015-10-01T12:00:00+0000 git commit -m "a"
+prog box 2015-10-01T12:01:00+0000 git commit -m "b"
+prog box 2015-10-01T12:02:00+0000 git -C src status
+prog box 2015-10-01T12:03:00+0000 sudo apt-get install -y vim
+prog box 2015-10-01T12:04:00+0000 ls -la | grep go && git status
+`)), "", "", "", "")
+	if err != nil {
+		t.Fatal("AddFromBuffer for programs failed: " + err.Error())
+	}
+	programs := conf.QueryParams{Type: conf.QUERY_PROGRAMS, Kappa: 2, User: "prog", Host: "box", Command: "%%", Format: conf.FORMAT_COMMAND_LINE, Group: conf.GROUP_PROGRAM}
+	subcommands := programs
+	subcommands.Group, subcommands.Program, subcommands.Kappa = conf.GROUP_SUBCOMMAND, "git", 10
+	flags := programs
+	flags.Group, flags.Kappa = conf.GROUP_FLAG, 10
+	query := programs
+	query.Command, query.Kappa = "%grep%", 10
+	for _, v := range []struct {
+		params conf.QueryParams
+		want   string
+	}{
+		{programs, "4 | git\n1 | apt-get"},
+		{subcommands, "2 | git commit\n2 | git status"},
+		{flags, "2 | git -m\n1 | apt-get -y\n1 | git -C\n1 | ls -la"},
+		{query, "1 | git\n1 | grep\n1 | ls"},
+	} {
+		res, err := s.RunQuery(v.params)
+		if err != nil {
+			t.Fatalf("Programs query failed: %s", err)
+		}
+		if string(res) != v.want {
+			t.Fatalf("Programs query %+v: wanted:\n%s\ngot:\n%s", v.params, v.want, res)
+		}
+	}
+
+	// Test alias suggestions; gcm is installed where we ask, kgpw is in history.
+	var lines []string
+	for i, c := range []string{`git commit -m "fix"`, `git commit -m "fix"`, `git commit -m "docs"`, "git commit --amend",
+		"docker compose logs -f web", "docker compose logs -f web", "docker compose logs -f web", "docker compose logs -f web",
+		"make clean && make build", "make clean && make build", "make clean && make build",
+		"kubectl get pods -w", "kubectl get pods -w", "kubectl get pods -w", "kgpw", "ls -la", "ls -la", "ls -la"} {
+		lines = append(lines, fmt.Sprintf("sugg box 2015-10-01T12:%02d:00+0000 %s", i, c))
+	}
+	_, err = s.AddFromBuffer(bufio.NewReader(strings.NewReader(strings.Join(lines, "\n")+"\n")), "", "", "", "")
+	if err != nil {
+		t.Fatal("AddFromBuffer for suggestions failed: " + err.Error())
+	}
+	suggestQuery := conf.QueryParams{Type: conf.QUERY_SUGGEST_ALIASES, Kappa: 10, User: "sugg", Host: "box", Command: "%%", Format: conf.FORMAT_JSON,
+		Taken: []string{"gcm"}}
+	res, err := s.RunQuery(suggestQuery)
+	if err != nil {
+		t.Fatalf("Suggest aliases query failed: %s", err)
+	}
+	var suggestions []Suggestion
+	if err = json.Unmarshal(res, &suggestions); err != nil {
+		t.Fatalf("Suggest aliases returned bad JSON: %s\n%s", err, res)
+	}
+	wantSuggestions := []Suggestion{
+		{"dclfw", "alias dclfw='docker compose logs -f web'", "docker compose logs -f web", 4, 84, false},
+		{"mcmb", "mcmb() { make clean && make build; }", "make clean && make build", 3, 60, true},
+		{"kgpw2", "alias kgpw2='kubectl get pods -w'", "kubectl get pods -w", 3, 42, false},
+		{"gcm2", "alias gcm2='git commit -m'", "git commit -m", 3, 27, false},
+	}
+	if !reflect.DeepEqual(suggestions, wantSuggestions) {
+		t.Fatalf("Suggest aliases: wanted:\n%+v\ngot:\n%+v", wantSuggestions, suggestions)
+	}
+	suggestQuery.Format, suggestQuery.Kappa = conf.FORMAT_COMMAND_LINE, 1
+	want := "alias dclfw='docker compose logs -f web' # 4 runs, saves 84 keystrokes"
+	if res, err = s.RunQuery(suggestQuery); err != nil || string(res) != want {
+		t.Fatalf("Suggest aliases: wanted:\n%s\ngot:\n%s", want, res)
+	}
+	suggestQuery.Command = "%nothing%"
+	if res, err = s.RunQuery(suggestQuery); err != nil || string(res) != "No suggestions." {
+		t.Fatalf("Suggest aliases with no matches: got %q, %v", res, err)
+	}
+
+	// Test next command prediction, in explicit and inferred sessions
+	for _, h := range []struct{ session, lines string }{
+		{"t1", "1  2015-10-01T10:00:00+0000 terraform plan\n2  2015-10-01T10:05:00+0000 terraform apply\n3  2015-10-01T10:06:00+0000 ls\n"},
+		{"t2", "1  2015-10-01T11:00:00+0000 terraform plan\n2  2015-10-01T11:02:00+0000 terraform apply\n" +
+			"3  2015-10-01T11:03:00+0000 terraform plan -out p\n4  2015-10-01T11:04:00+0000 ls\n"},
+		{"", "1  2015-10-01T13:00:00+0000 terraform plan\n2  2015-10-01T13:01:00+0000 git diff\n3  2015-10-01T15:00:00+0000 terraform plan\n"},
+		// Too late to follow.
+		{"t4", "1  2015-10-01T16:00:00+0000 vim main.tf\n2  2015-10-01T16:50:00+0000 terraform plan\n"},
+	} {
+		if _, err = s.AddFromBuffer(bufio.NewReader(strings.NewReader(h.lines)), "nxt", "box", "", h.session); err != nil {
+			t.Fatal("AddFromBuffer for next failed: " + err.Error())
+		}
+	}
+	next := conf.QueryParams{Type: conf.QUERY_NEXT, Kappa: 5, User: "nxt", Host: "box", Command: "terraform plan", Format: conf.FORMAT_ALL}
+	wildcard := next
+	wildcard.Command = "terraform plan%"
+	last := next
+	last.Command = ""
+	widget := next
+	widget.Kappa, widget.Format = 1, conf.FORMAT_COMMAND_LINE
+	later := next
+	later.Since = time.Date(2015, 10, 1, 11, 30, 0, 0, time.UTC)
+	for _, v := range []struct {
+		params conf.QueryParams
+		want   string
+	}{
+		{next, "2 | terraform apply\n1 | git diff"},
+		{wildcard, "2 | terraform apply\n1 | git diff\n1 | ls"},
+		{last, "2 | terraform apply\n1 | git diff"},
+		{widget, "terraform apply"},
+		{later, "1 | git diff"},
+	} {
+		res, err := s.RunQuery(v.params)
+		if err != nil {
+			t.Fatalf("Next query failed: %s", err)
+		}
+		if string(res) != v.want {
+			t.Fatalf("Next query %+v: wanted:\n%s\ngot:\n%s", v.params, v.want, res)
+		}
+	}
+	next.Format = conf.FORMAT_JSON
+	if res, err = s.RunQuery(next); err != nil {
+		t.Fatalf("Next query failed: %s", err)
+	}
+	rows, err := result.Decode(res)
+	if err != nil || len(rows) != 2 || rows[0].Command != "terraform apply" || rows[0].Count != 2 {
+		t.Fatalf("Next query as JSON: got %+v, %v from:\n%s", rows, err, res)
+	}
+
+	// Test the typo report and deleting typos
+	lines = nil
+	for i, c := range []string{"git status", "git status", "git status", "git status", "git status", "git status", "git status", "git status"} {
+		lines = append(lines, fmt.Sprintf("%d  2015-10-01T09:%02d:00+0000 %s", i, 2*i, c))
+	}
+	lines = append(lines, "20  2015-10-01T09:20:00+0000 gti status", "21  2015-10-01T09:20:10+0000 git status",
+		"22  2015-10-01T09:25:00+0000 gti status", "23  2015-10-01T09:25:10+0000 git status",
+		"30  2015-10-01T09:30:00+0000 gti log",
+		"35  2015-10-01T09:35:00+0000 ls", "37  2015-10-01T09:37:00+0000 ls", "39  2015-10-01T09:39:00+0000 ls", "41  2015-10-01T09:41:00+0000 ls",
+		"45  2015-10-01T09:45:00+0000 sl", "50  2015-10-01T09:50:00+0000 vi notes",
+		"55  2015-10-01T09:55:00+0000 ls -l", "58  2015-10-01T09:58:00+0000 ls -la")
+	_, err = s.AddFromBuffer(bufio.NewReader(strings.NewReader(strings.Join(lines, "\n")+"\n")), "typo", "box", "", "a")
+	if err != nil {
+		t.Fatal("AddFromBuffer for typos failed: " + err.Error())
+	}
+	typoQuery := conf.QueryParams{Type: conf.QUERY_TYPOS, Kappa: 10, User: "typo", Host: "box", Command: "%%", Format: conf.FORMAT_COMMAND_LINE}
+	sl := typoQuery
+	sl.Command = "%sl%"
+	deleteQuery := typoQuery
+	deleteQuery.Type, deleteQuery.DryRun = conf.DELETE_TYPOS, true
+	for _, v := range []struct {
+		params conf.QueryParams
+		want   string
+	}{
+		{typoQuery, `git status (10 runs), mistyped 2 times:
+    2 | gti status, retyped 2 times; alias gti='git'
+git (10 runs), mistyped 1 times:
+    1 | gti log -> git log; alias gti='git'
+ls (6 runs), mistyped 1 times:
+    1 | sl; alias sl='ls'`},
+		{sl, "ls (6 runs), mistyped 1 times:\n    1 | sl; alias sl='ls'"},
+		{deleteQuery, "Would move 4 command lines to the trash:\ngti status\ngti status\ngti log\nsl"},
+	} {
+		res, err := s.RunQuery(v.params)
+		if err != nil {
+			t.Fatalf("Typos query failed: %s", err)
+		}
+		// Rowids depend on the records added before.
+		if res = regexp.MustCompile(`(?m)^\d+ `).ReplaceAll(res, nil); string(res) != v.want {
+			t.Fatalf("Typos query %+v: wanted:\n%s\ngot:\n%s", v.params, v.want, res)
+		}
+	}
+	deleteQuery.DryRun = false
+	if res, err = s.RunQuery(deleteQuery); err != nil || !strings.HasPrefix(string(res), "Moved 4 command lines to the trash.") {
+		t.Fatalf("Delete typos: got %s, %v", res, err)
+	}
+	if res, err = s.RunQuery(typoQuery); err != nil || string(res) != "No typos." {
+		t.Fatalf("Typos query after deleting them: got %s, %v", res, err)
+	}
+
+	// Test ties: top command lines of the same count are in alphabetical
+	// order, command lines of the same time in rowid order, and unique
+	// searches return the last run of each command line.
+	for _, r := range []struct {
+		command string
+		at      time.Duration
+	}{{"b", 0}, {"a", 0}, {"c", 0}, {"b", time.Minute}} {
+		if err = s.AddRecord("tie", "box", r.command, tt.Add(r.at)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tie := conf.QueryParams{User: "tie", Host: "box", Command: "%%", Format: conf.FORMAT_COMMAND_LINE}
+	topTie, lastTie, uniqueTie := tie, tie, tie
+	topTie.Type, topTie.Kappa = conf.QUERY_TOPK, 3
+	lastTie.Type, lastTie.Kappa = conf.QUERY_LASTK, 3
+	uniqueTie.Type, uniqueTie.Kappa, uniqueTie.Unique = conf.QUERY_LASTK, 3, true
+	for _, v := range []struct {
+		params conf.QueryParams
+		want   string
+	}{
+		{topTie, "2 | b\n1 | a\n1 | c"},
+		{lastTie, "a\nc\nb"},
+		{uniqueTie, "a\nc\nb"},
+	} {
+		res, err := s.RunQuery(v.params)
+		if err != nil {
+			t.Fatalf("Ties query failed: %s", err)
+		}
+		if v.params.Type == conf.QUERY_LASTK {
+			res = regexp.MustCompile(`(?m)^\d+ `).ReplaceAll(res, nil)
+		}
+		if string(res) != v.want {
+			t.Fatalf("Ties %s query: wanted:\n%s\ngot:\n%s", v.params.Type, v.want, res)
+		}
+	}
+}
+
+// Test add from buffer, default format
+// Out of 5, 4 are accepted, one is duplicate.
+var entriesDefault = []byte(`99  2015-10-12T12:00:00+0000 ls
+100  2015-10-12T12:00:05+0000 git status
+101  2015-10-12T12:00:10+0000 go run bashistdb.go --local -db test.sqlite3 -format rows -lastk 40
+102  2015-10-12T12:00:15+0000 history
+103  2015-10-12T12:00:15+0000 history
+`)
+var entriesDefaultExpect = "Processed 5 entries, successful 4, failed 1."
+
+// Test add from buffer, export format
+// Out of 18, 17 are accepted, one is bad.
+var entriesImport = []byte(`user1 host1 2015-10-12T12:00:40+0000 topk
+user1 host1 2015-10-12T12:00:41+0000 topk 1
+user1 host1 2015-10-12T12:00:42+0000 topk 1
+user1 host1 2015-10-12T12:00:43+0000 topk 1
+user1 host1 2015-10-12T12:00:44+0000 topk 1
+user2 host1 2015-10-12T12:00:45+0000 topk 1
+user2 host1 2015-10-12T12:00:46+0000 topk 1
+user3 host2 2015-10-12T12:00:47+0000 topk 1
+user1 host2 2015-10-12T12:00:48+0000 topk 2
+user1 host1 2015-10-12T12:00:49+0000 topk 2
+user1 host1 2015-10-12T12:00:50+0000 topk 2
+user1 host1 2015-10-12T12:00:55+0000 topk 2
+user1 host1 2015-10-12T12:01:40+0000 default query
+user1 host1 2015-10-12T12:01:50+0000 default query
+user1 host1 2015-10-12T12:02:40+0000 row 20
+user1 host1 2015-10-12T12:02:45+0000 delete 21
+user1 host1 2015-10-12T12:02:50+0000 delete 22
+user1 host1 2015-10-12T12:03:40+0000 lastk 1
+user1 host1 2015-10-12T12:03:45+0000 lastk 2
+user1 host1 2015-10-12T12:03:50+0000 lastk 2
+user1 host1 nodate command
+`)
+var entriesImportExpect = "Processed 21 entries, successful 20, failed 1."
+
+var demoResponse = `There are 23 command lines (12 unique) in your database from 5 users across 3 hosts.
+
+Top-15 commands for user %@%:
+7 | topk 1
+4 | topk 2
+2 | default query
+2 | lastk 2
+1 | git status
+1 | go run bashistdb.go --local -db test.sqlite3 -format rows -lastk 40
+1 | history
+1 | htop
+1 | lastk 1
+1 | ls
+1 | row 20
+1 | topk
+
+Last 10 commands user %@% ran:
+14 topk 2
+15 topk 2
+16 topk 2
+17 topk 2
+18 default query
+19 default query
+20 row 20
+23 lastk 1
+24 lastk 2
+25 lastk 2`
@@ -0,0 +1,232 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/shell"
+)
+
+// What makes a command line, or the start of one, worth an alias.
+const (
+	suggestMinRuns   = 3  // it ran at least this many times
+	suggestMinLength = 12 // it is at least this long
+	suggestMaxName   = 8  // its alias is at most this long
+)
+
+// A Suggestion is an alias or function that saves retyping a command line.
+type Suggestion struct {
+	Name       string // Name of the alias or function
+	Definition string // Definition to paste into .bashrc
+	Command    string // Command is what Name stands for
+	Runs       int    // Runs is how many times Command was typed
+	Saved      int    // Saved is how many keystrokes Name would have saved
+	Function   bool   // Function is set if Definition is a function, else it is an alias
+}
+
+// SuggestAliases returns the qp.Kappa aliases and functions that would save
+// the most typing in the command lines qp matches. Their names skip the
+// commands in qp.Taken.
+func (d Database) SuggestAliases(qp conf.QueryParams) ([]byte, error) {
+	counts, err := d.commandCounts(qp)
+	if err != nil {
+		return []byte{}, err
+	}
+	return suggestionsMessage(suggest(counts, qp.Kappa, qp.Taken), qp.Format), nil
+}
+
+// SuggestAliases works as the SQLite store's SuggestAliases.
+func (m *Memory) SuggestAliases(qp conf.QueryParams) ([]byte, error) {
+	return suggestionsMessage(suggest(m.commandCounts(qp), qp.Kappa, qp.Taken), qp.Format), nil
+}
+
+// suggest returns the k suggestions that save the most keystrokes, given
+// command lines, how many times each ran and the names of the installed
+// commands, which it skips. Command lines with one simple
+// command, and their starts of two words or more, become aliases; to these
+// you may add arguments. Lists and pipelines become functions.
+// A start is left out if a longer start, or the whole command line, ran as
+// many times.
+func suggest(commands map[string]int, k int, installed []string) []Suggestion {
+	prefixes := make(map[string]int)           // starts of command lines, whole ones too
+	longer := make(map[string]map[string]bool) // the starts one word longer of each start
+	functions := make(map[string]int)          // lists and pipelines
+	taken := make(map[string]bool)             // names of programs we've seen or are installed
+	for _, n := range installed {
+		taken[n] = true
+	}
+	for line, n := range commands {
+		line = strings.TrimSpace(line)
+		if strings.ContainsAny(line, "\n") || strings.Contains(line, " #") {
+			continue
+		}
+		for _, c := range shell.Parse(line) {
+			taken[c.Program] = true
+		}
+		if len(shell.Split(line)) > 1 {
+			if !strings.HasSuffix(line, "&") || strings.HasSuffix(line, "&&") {
+				functions[strings.TrimRight(line, "; ")] += n
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// Starts end before the first word we can't cut after safely.
+		var starts []string
+		for i := 1; i < len(fields) && !strings.ContainsAny(fields[i-1], "'\"`\\$;&|<>()#"); i++ {
+			if i > 1 {
+				starts = append(starts, strings.Join(fields[:i], " "))
+			}
+		}
+		starts = append(starts, line)
+		for i, p := range starts {
+			prefixes[p] += n
+			if i > 0 {
+				if longer[starts[i-1]] == nil {
+					longer[starts[i-1]] = make(map[string]bool)
+				}
+				longer[starts[i-1]][p] = true
+			}
+		}
+	}
+	extended := make(map[string]int) // runs of the most used start one word longer
+	for p, children := range longer {
+		for c := range children {
+			if prefixes[c] > extended[p] {
+				extended[p] = prefixes[c]
+			}
+		}
+	}
+
+	var candidates []Suggestion
+	for p, n := range prefixes {
+		if n >= suggestMinRuns && len(p) >= suggestMinLength && extended[p] < n {
+			candidates = append(candidates, Suggestion{Command: p, Runs: n})
+		}
+	}
+	for f, n := range functions {
+		if n >= suggestMinRuns && len(f) >= suggestMinLength {
+			candidates = append(candidates, Suggestion{Command: f, Runs: n, Function: true})
+		}
+	}
+	// Rank by what a name of initials would save; longer names save less.
+	for i := range candidates {
+		candidates[i].Saved = candidates[i].Runs * (len(candidates[i].Command) - len(initials(candidates[i].Command)))
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Saved == candidates[j].Saved {
+			return candidates[i].Command < candidates[j].Command
+		}
+		return candidates[i].Saved > candidates[j].Saved
+	})
+
+	var suggestions []Suggestion
+	for _, s := range candidates {
+		if len(suggestions) == k {
+			break
+		}
+		if s.Name = name(s.Command, taken); s.Name == "" {
+			continue
+		}
+		taken[s.Name] = true
+		s.Saved = s.Runs * (len(s.Command) - len(s.Name))
+		if s.Function {
+			s.Definition = s.Name + "() { " + s.Command + "; }"
+		} else {
+			s.Definition = "alias " + s.Name + "='" + strings.Replace(s.Command, "'", `'\''`, -1) + "'"
+		}
+		suggestions = append(suggestions, s)
+	}
+	return suggestions
+}
+
+// initials returns the first letter or digit of each word of command, in
+// lower case, up to suggestMaxName of them.
+func initials(command string) string {
+	var name []rune
+	for _, w := range strings.Fields(command) {
+		for _, r := range w {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				if r < unicode.MaxASCII {
+					name = append(name, unicode.ToLower(r))
+				}
+				break
+			}
+		}
+		if len(name) == suggestMaxName {
+			break
+		}
+	}
+	return string(name)
+}
+
+// name returns a name for command, its initials, or with a number if they
+// are taken or a builtin. It returns an empty name if none is free.
+func name(command string, taken map[string]bool) string {
+	base := initials(command)
+	if len(base) < 2 || !unicode.IsLetter(rune(base[0])) {
+		return ""
+	}
+	for i := 1; i < 10; i++ {
+		n := base
+		if i > 1 {
+			n += strconv.Itoa(i)
+		}
+		if taken[n] || shell.IsBuiltin(n) {
+			continue
+		}
+		return n
+	}
+	return ""
+}
+
+// suggestionsMessage formats suggestions as lines to paste into .bashrc,
+// or as JSON.
+func suggestionsMessage(suggestions []Suggestion, format string) []byte {
+	if format == conf.FORMAT_JSON {
+		res, _ := json.Marshal(suggestions)
+		return res
+	}
+	if len(suggestions) == 0 {
+		return []byte("No suggestions.")
+	}
+	width := 0
+	for _, s := range suggestions {
+		if len(s.Definition) > width {
+			width = len(s.Definition)
+		}
+	}
+	var out bytes.Buffer
+	for i, s := range suggestions {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		fmt.Fprintf(&out, "%-*s # %d runs, saves %d keystrokes", width, s.Definition, s.Runs, s.Saved)
+	}
+	return out.Bytes()
+}
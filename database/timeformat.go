@@ -0,0 +1,300 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A TimeFormat reads the lines bash's history command prints when
+// HISTTIMEFORMAT is set to a strftime(3) format:
+//     LINENUM TIMESTAMP COMMAND
+type TimeFormat struct {
+	format     string
+	re         *regexp.Regexp
+	directives []byte // the directive of each submatch of re, the last is the command
+}
+
+// strftime directives that are made of others.
+var composite = map[byte]string{
+	'F': "%Y-%m-%d",
+	'T': "%H:%M:%S",
+	'D': "%m/%d/%y",
+	'R': "%H:%M",
+	'r': "%I:%M:%S %p",
+	'c': "%a %b %e %H:%M:%S %Y",
+	'h': "%b",
+}
+
+// directives are the strftime directives we read, with what they match.
+var directives = map[byte]string{
+	'Y': `[0-9]{4}`,
+	'y': `[0-9]{2}`,
+	'm': `[0-9]{1,2}`,
+	'd': `[0-9]{1,2}`,
+	'e': ` ?[0-9]{1,2}`,
+	'j': `[0-9]{3}`,
+	'H': `[0-9]{1,2}`,
+	'k': ` ?[0-9]{1,2}`,
+	'I': `[0-9]{1,2}`,
+	'l': ` ?[0-9]{1,2}`,
+	'M': `[0-9]{2}`,
+	'S': `[0-9]{2}`,
+	'p': `[AaPp][Mm]`,
+	'b': `[A-Za-z]{3}`,
+	'B': `[A-Za-z]+`,
+	'a': `[A-Za-z]+`,
+	'A': `[A-Za-z]+`,
+	'z': `[+-][0-9]{4}`,
+	'Z': `[A-Za-z]+|[+-][0-9]{2,4}`,
+	's': `[0-9]+`,
+}
+
+// detect are the formats we try when none is set or the one set fails,
+// most specific first. Not %s: a command line without a timestamp, like
+// "5 1000 echo", would read as one of 1970.
+var detect = []string{"%FT%T%z ", "%F %T %z ", "%FT%T ", "%F %T "}
+
+// NewTimeFormat returns a TimeFormat for the HISTTIMEFORMAT format. The
+// format has to include a date.
+func NewTimeFormat(format string) (*TimeFormat, error) {
+	f := &TimeFormat{format: format}
+	// Bash puts the command right after the timestamp. Trailing spaces
+	// have to be there, so e.g %s doesn't take the year of a date; more
+	// are the command's, which may start with a space.
+	trimmed := strings.TrimRight(format, " \t")
+	sep := ` *`
+	if trimmed != format {
+		sep = `\s{` + strconv.Itoa(len(format)-len(trimmed)) + `}`
+	}
+	format = trimmed
+
+	var re bytes.Buffer
+	re.WriteString(`^ *[0-9]+\*? *`)
+	seen := make(map[byte]bool)
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			re.WriteString(regexp.QuoteMeta(format[i : i+1]))
+			continue
+		}
+		i++
+		d := format[i]
+		switch d {
+		case '%':
+			re.WriteString("%")
+			continue
+		case 'n', 't':
+			re.WriteString(`\s`)
+			continue
+		}
+		if c, ok := composite[d]; ok {
+			format = format[:i-1] + c + format[i+1:]
+			i -= 2
+			continue
+		}
+		m, ok := directives[d]
+		if !ok {
+			return nil, errors.New("HISTTIMEFORMAT directive %" + string(d) + " is not supported.")
+		}
+		re.WriteString("(" + m + ")")
+		f.directives = append(f.directives, d)
+		seen[d] = true
+	}
+	re.WriteString(sep + `(.*)`)
+
+	year := seen['Y'] || seen['y']
+	day := (seen['m'] || seen['b'] || seen['B']) && (seen['d'] || seen['e'])
+	if !seen['s'] && !(year && (day || seen['j'])) {
+		return nil, errors.New("HISTTIMEFORMAT " + strconv.Quote(f.format) + " has no date.")
+	}
+
+	var err error
+	if f.re, err = regexp.Compile(re.String()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// String returns the format.
+func (f *TimeFormat) String() string {
+	return f.format
+}
+
+// Parse decodes a history line. Times without a zone are in loc. It reports
+// whether the line was in the format.
+func (f *TimeFormat) Parse(line string, loc *time.Location) (t time.Time, command string, ok bool) {
+	m := f.re.FindStringSubmatch(strings.TrimSuffix(line, "\n"))
+	if m == nil {
+		return t, "", false
+	}
+	year, month, day, yday, hour, min, sec := 0, 0, 1, 0, 0, 0, 0
+	pm, twelve, epoch := false, false, int64(-1)
+	if loc == nil {
+		loc = time.Local
+	}
+	zone := loc
+	for i, d := range f.directives {
+		v := strings.TrimSpace(m[i+1])
+		n, _ := strconv.Atoi(v)
+		switch d {
+		case 'Y':
+			year = n
+		case 'y':
+			year = 2000 + n
+			if n >= 69 { // as strptime(3)
+				year = 1900 + n
+			}
+		case 'm':
+			month = n
+		case 'b', 'B':
+			if month = monthNumber(v); month == 0 {
+				return t, "", false
+			}
+		case 'd', 'e':
+			day = n
+		case 'j':
+			yday = n
+		case 'H', 'k':
+			hour = n
+		case 'I', 'l':
+			hour, twelve = n, true
+		case 'M':
+			min = n
+		case 'S':
+			sec = n
+		case 'p':
+			pm = strings.EqualFold(v, "pm")
+		case 'z':
+			offset := n/100*3600 + n%100*60
+			zone = time.FixedZone(v, offset)
+		case 'Z':
+			if v == "UTC" || v == "GMT" {
+				zone = time.UTC
+			}
+		case 's':
+			epoch, _ = strconv.ParseInt(v, 10, 64)
+		}
+	}
+	command = m[len(m)-1]
+
+	if epoch >= 0 {
+		return time.Unix(epoch, 0).In(loc), command, true
+	}
+	if twelve {
+		if hour == 12 {
+			hour = 0
+		}
+		if pm {
+			hour += 12
+		}
+	}
+	if yday > 0 {
+		month, day = 1, yday
+	}
+	t = time.Date(year, time.Month(month), day, hour, min, sec, 0, zone)
+	// time.Date normalizes, e.g. February 30th to March 2nd.
+	if yday == 0 && (t.Month() != time.Month(month) || t.Day() != day) || hour > 23 || min > 59 || sec > 60 {
+		return time.Time{}, "", false
+	}
+	return t, command, true
+}
+
+// monthNumber returns the number of a month's name or abbreviation, or 0.
+func monthNumber(name string) int {
+	for m := time.January; m <= time.December; m++ {
+		if strings.EqualFold(name, m.String()) || strings.EqualFold(name, m.String()[:3]) {
+			return int(m)
+		}
+	}
+	return 0
+}
+
+// ParseHistoryLine decodes a line of bash's history command with HISTTIMEFORMAT
+// format. If format is empty or the line isn't in it, common formats are
+// tried. Times without a zone are in loc.
+func ParseHistoryLine(line, format string, loc *time.Location) (time.Time, string, error) {
+	formats, err := timeFormats(format)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	for _, f := range formats {
+		if t, command, ok := f.Parse(line, loc); ok {
+			return t, command, nil
+		}
+	}
+	return time.Time{}, "", errors.New("Line is not in the format of bash's history command with timestamps: " + line)
+}
+
+// timeFormats returns the TimeFormat of format, if set, and of the formats
+// we detect.
+func timeFormats(format string) ([]*TimeFormat, error) {
+	var formats []*TimeFormat
+	if format != "" {
+		f, err := NewTimeFormat(format)
+		if err != nil {
+			return nil, err
+		}
+		formats = append(formats, f)
+	}
+	for _, d := range detect {
+		f, _ := NewTimeFormat(d)
+		formats = append(formats, f)
+	}
+	return formats, nil
+}
+
+// NormalizeHistory rewrites the timestamps of history, as printed by bash's
+// history command with HISTTIMEFORMAT format, to the format bashistdb
+// stores. If format is empty or a line isn't in it, common formats are
+// tried. Times without a zone are in loc. Lines in bashistdb's export format
+// and lines we can't read are copied as they are, for import to report.
+func NormalizeHistory(history []byte, format string, loc *time.Location) ([]byte, error) {
+	formats, err := timeFormats(format)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	lines := strings.SplitAfter(string(history), "\n")
+	for i, l := range lines {
+		if parseExportLine.MatchString(l) {
+			out.WriteString(l)
+			continue
+		}
+		matched := false
+		for _, f := range formats {
+			if t, command, ok := f.Parse(l, loc); ok {
+				fmt.Fprintf(&out, "%5d  %s %s", i+1, t.Format(RFC3339alt), command)
+				if strings.HasSuffix(l, "\n") {
+					out.WriteString("\n")
+				}
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			out.WriteString(l)
+		}
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHistoryLine(t *testing.T) {
+	athens, err := time.LoadLocation("Europe/Athens")
+	if err != nil {
+		t.Skip("No time zone database: " + err.Error())
+	}
+	want := time.Date(2015, 10, 12, 12, 0, 5, 0, athens) // +0300
+	tests := []struct {
+		format, line string
+		ok           bool
+	}{
+		{"", "    1  2015-10-12T12:00:05+0300 ls -l", true},
+		{"", "    1* 2015-10-12T09:00:05+0000 ls -l", true},
+		{"", "    1  2015-10-12 12:00:05 ls -l", true},
+		{"", "    1  2015-10-12 11:00:05 +0200 ls -l", true},
+		{"%s ", "    1  1444640405 ls -l", true},
+		{"", "    1  1444640405 ls -l", false},
+		{"", "    1  1234 42 make", false},
+		{"", "    1  12/10/15 12:00:05 ls -l", false},
+		{"%d/%m/%y %T ", "    1  12/10/15 12:00:05 ls -l", true},
+		{"%b %e %Y %r ", "    1  Oct 12 2015 12:00:05 PM ls -l", true},
+		{"[%d %B %Y, %H:%M:%S %Z] ", "    1  [12 October 2015, 09:00:05 UTC] ls -l", true},
+		{"%Y %j %T ", "    1  2015 285 12:00:05 ls -l", true},
+		{"%F %T ", "    1  2015-02-30 12:00:05 ls -l", false},
+	}
+	for _, v := range tests {
+		got, command, err := ParseHistoryLine(v.line, v.format, athens)
+		if !v.ok {
+			if err == nil {
+				t.Errorf("%q %q: wanted error, got %v", v.format, v.line, got)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(want) || command != "ls -l" {
+			t.Errorf("%q %q: wanted %v, got %v %q %v", v.format, v.line, want, got, command, err)
+		}
+	}
+
+	for _, format := range []string{"%T ", "%F %Q "} {
+		if _, err := NewTimeFormat(format); err == nil {
+			t.Errorf("%q should return an error", format)
+		}
+	}
+}
+
+func TestNormalizeHistory(t *testing.T) {
+	history := "    1  1444640405 ls\nuser host 2015-10-12T12:00:05+0300 cd\nno timestamp\n    4  1444640405  secret\n"
+	out, err := NormalizeHistory([]byte(history), "%s ", time.FixedZone("", 3*3600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "    1  2015-10-12T12:00:05+0300 ls\nuser host 2015-10-12T12:00:05+0300 cd\nno timestamp\n" +
+		"    4  2015-10-12T12:00:05+0300  secret\n" // the leading space is kept
+	if string(out) != want {
+		t.Fatalf("Wanted:\n%s\nGot:\n%s", want, out)
+	}
+
+	// Without HISTTIMEFORMAT, numbers that start a command line are not a
+	// timestamp.
+	history = "    1  5 1000 echo\n"
+	if out, err = NormalizeHistory([]byte(history), "", time.UTC); err != nil || string(out) != history {
+		t.Fatalf("Wanted:\n%s\nGot:\n%s %v", history, out, err)
+	}
+}
+
+func TestFilterHistory(t *testing.T) {
+	history := "    1  2015-10-12T12:00:05+0300 ls\n" +
+		"    2  2015-10-12T12:00:06+0300  make secret\n" +
+		"root host 2015-10-12T12:00:07+0300 ls\n" +
+		"    3  2015-10-12T12:00:08+0300 ls -l\n" +
+		"unknown\n"
+	ignore := func(user, host, command string) bool {
+		return (command == "ls" && user == "me") || strings.HasPrefix(command, " ")
+	}
+	out, ignored := FilterHistory([]byte(history), "me", "host", ignore)
+	want := "root host 2015-10-12T12:00:07+0300 ls\n" + "    3  2015-10-12T12:00:08+0300 ls -l\n" + "unknown\n"
+	if string(out) != want || ignored != 2 {
+		t.Fatalf("Wanted:\n%s\nGot %d ignored:\n%s", want, ignored, out)
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/shell"
+)
+
+// What makes a command line a typo.
+const (
+	typoRetype = time.Minute // it was retyped, corrected, within this
+	typoRatio  = 3           // its correction ran at least this many times as often
+)
+
+// A Typo is a command line that is a mistyped version of another one.
+type Typo struct {
+	Command    string
+	Runs       int
+	Correction string // Correction is the command line it should have been
+	Retyped    int    // Retyped is how many times it was corrected right after
+	Alias      string // Alias fixes the typo if it is in the program's name
+	Rows       []int  `json:"-"`
+}
+
+// A TypoCluster is a command line, or a program, and its typos.
+type TypoCluster struct {
+	Command string
+	Runs    int
+	Typos   []Typo
+}
+
+// typos finds the typos of the users and hosts of qp, among the command
+// lines that match qp. A command line is a typo of one that ran typoRatio
+// times as often if it was usually retyped as it within typoRetype, in the
+// same session, and they are near. These are clustered by the command line.
+// Else it is a typo if its program is a swap of two letters of a program
+// that ran typoRatio times as often; these are clustered by the program.
+func typos(s Store, qp conf.QueryParams) ([]TypoCluster, error) {
+	match, err := matcher(qp)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := s.Sessions(qp)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)             // runs of each command line
+	rows := make(map[string][]int)             // rowids of the command lines that match
+	programs := make(map[string]int)           // runs of each program
+	retyped := make(map[string]map[string]int) // command lines corrected right after, to what
+	for _, ss := range sessions {
+		for i, r := range ss.Records {
+			counts[r.Command]++
+			if match(r) {
+				rows[r.Command] = append(rows[r.Command], r.Row)
+			}
+			if i+1 == len(ss.Records) {
+				continue
+			}
+			next := ss.Records[i+1]
+			if next.Command != r.Command && next.Datetime.Sub(r.Datetime) <= typoRetype && near(r.Command, next.Command) {
+				if retyped[r.Command] == nil {
+					retyped[r.Command] = make(map[string]int)
+				}
+				retyped[r.Command][next.Command]++
+			}
+		}
+	}
+	for c, n := range counts {
+		if p := program(c); p != "" {
+			programs[p] += n
+		}
+	}
+
+	clusters := make(map[string]*TypoCluster)
+	for command, ids := range rows {
+		t := Typo{Command: command, Runs: counts[command], Rows: ids}
+		// The most frequent retyping wins.
+		for c, n := range retyped[command] {
+			if 2*n >= t.Runs && counts[c] >= typoRatio*t.Runs &&
+				(n > t.Retyped || (n == t.Retyped && counts[c] > counts[t.Correction])) {
+				t.Correction, t.Retyped = c, n
+			}
+		}
+		cluster := TypoCluster{Command: t.Correction, Runs: counts[t.Correction]}
+		p := program(command)
+		if q := programTypo(p, programs); t.Correction == "" && q != "" {
+			t.Correction = replaceWord(command, p, q)
+			t.Retyped = retyped[command][t.Correction]
+			cluster = TypoCluster{Command: q, Runs: programs[q]}
+		}
+		if t.Correction == "" {
+			continue
+		}
+		if q := program(t.Correction); q != p && replaceWord(command, p, q) == t.Correction {
+			t.Alias = "alias " + p + "='" + q + "'"
+		}
+		if clusters[cluster.Command] == nil {
+			clusters[cluster.Command] = &cluster
+		}
+		clusters[cluster.Command].Typos = append(clusters[cluster.Command].Typos, t)
+	}
+
+	var out []TypoCluster
+	for _, c := range clusters {
+		sort.Slice(c.Typos, func(i, j int) bool {
+			if c.Typos[i].Runs == c.Typos[j].Runs {
+				return c.Typos[i].Command < c.Typos[j].Command
+			}
+			return c.Typos[i].Runs > c.Typos[j].Runs
+		})
+		out = append(out, *c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].mistyped() == out[j].mistyped() {
+			return out[i].Command < out[j].Command
+		}
+		return out[i].mistyped() > out[j].mistyped()
+	})
+	return out, nil
+}
+
+// mistyped returns how many times the command line of c was mistyped.
+func (c TypoCluster) mistyped() int {
+	n := 0
+	for _, t := range c.Typos {
+		n += t.Runs
+	}
+	return n
+}
+
+// program returns the program the first simple command of command runs.
+func program(command string) string {
+	if c := shell.Parse(command); len(c) > 0 {
+		return c[0].Program
+	}
+	return ""
+}
+
+// programTypo returns the program p is a typo of, the most used of those
+// that differ from it in a swap of two adjacent letters and ran typoRatio
+// times as often, or an empty string.
+func programTypo(p string, programs map[string]int) string {
+	best := ""
+	if len(p) < 2 || shell.IsBuiltin(p) {
+		return best
+	}
+	for q, n := range programs {
+		if n >= typoRatio*programs[p] && n > programs[best] && swapped(p, q) {
+			best = q
+		}
+	}
+	return best
+}
+
+// swapped reports whether a is b with two adjacent characters swapped.
+func swapped(a, b string) bool {
+	x, y := []rune(a), []rune(b)
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return i+1 < len(x) && x[i] == y[i+1] && x[i+1] == y[i] && string(x[i+2:]) == string(y[i+2:])
+		}
+	}
+	return false
+}
+
+// near reports whether a and b are near enough for one to be a typo of
+// the other: an edit distance up to 1 for command lines shorter than 8
+// characters, else 2.
+func near(a, b string) bool {
+	limit := 2
+	if len(a) < 8 || len(b) < 8 {
+		limit = 1
+	}
+	return distance(a, b) <= limit
+}
+
+// distance returns the optimal string alignment distance of a and b: how
+// many insertions, deletions, substitutions and swaps of adjacent
+// characters turn one into the other, editing no part twice.
+func distance(a, b string) int {
+	x, y := []rune(a), []rune(b)
+	d := make([][]int, len(x)+1)
+	for i := range d {
+		d[i] = make([]int, len(y)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(x); i++ {
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i-1] == y[j-1] {
+				cost = 0
+			}
+			d[i][j] = d[i-1][j-1] + cost
+			if d[i-1][j]+1 < d[i][j] {
+				d[i][j] = d[i-1][j] + 1
+			}
+			if d[i][j-1]+1 < d[i][j] {
+				d[i][j] = d[i][j-1] + 1
+			}
+			if i > 1 && j > 1 && x[i-1] == y[j-2] && x[i-2] == y[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(x)][len(y)]
+}
+
+// replaceWord replaces the first word of command that is old with new.
+func replaceWord(command, old, new string) string {
+	words := strings.Fields(command)
+	for i, w := range words {
+		if w == old {
+			words[i] = new
+			return strings.Join(words, " ")
+		}
+	}
+	return command
+}
+
+// typoReport is the typos query: it returns the qp.Kappa command lines and
+// programs mistyped most, with their typos, how many times each ran and was
+// retyped, its correction and an alias that fixes it.
+func typoReport(s Store, qp conf.QueryParams) ([]byte, error) {
+	clusters, err := typos(s, qp)
+	if err != nil {
+		return []byte{}, err
+	}
+	if len(clusters) > qp.Kappa {
+		clusters = clusters[:qp.Kappa]
+	}
+	if qp.Format == conf.FORMAT_JSON {
+		if clusters == nil {
+			clusters = []TypoCluster{}
+		}
+		res, _ := json.Marshal(clusters)
+		return res, nil
+	}
+	if len(clusters) == 0 {
+		return []byte("No typos."), nil
+	}
+	var out bytes.Buffer
+	for i, c := range clusters {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		fmt.Fprintf(&out, "%s (%d runs), mistyped %d times:", c.Command, c.Runs, c.mistyped())
+		for _, t := range c.Typos {
+			fmt.Fprintf(&out, "\n    %d | %s", t.Runs, t.Command)
+			if t.Correction != c.Command {
+				fmt.Fprintf(&out, " -> %s", t.Correction)
+			}
+			if t.Retyped > 0 {
+				fmt.Fprintf(&out, ", retyped %d times", t.Retyped)
+			}
+			if t.Alias != "" {
+				fmt.Fprintf(&out, "; %s", t.Alias)
+			}
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// deleteTypos moves the typos of the users and hosts of qp that match qp,
+// and have one of qp.Rows if set, to the trash. It works as deleteQuery.
+func deleteTypos(s Store, qp conf.QueryParams) ([]byte, error) {
+	clusters, err := typos(s, qp)
+	if err != nil {
+		return []byte{}, err
+	}
+	ids := make(map[int]bool)
+	for _, c := range clusters {
+		for _, t := range c.Typos {
+			for _, r := range t.Rows {
+				ids[r] = true
+			}
+		}
+	}
+	rows := make(map[int]bool)
+	for _, r := range qp.Rows {
+		rows[r] = true
+	}
+	// A dry run purge lists the typos.
+	records, err := s.Purge(func(r Record) bool {
+		return ids[r.Row] && (len(rows) == 0 || rows[r.Row])
+	}, true)
+	if err != nil {
+		return []byte{}, err
+	}
+	if qp.DryRun {
+		return report(records, qp, "Would move %d command lines to the trash"), nil
+	}
+	var trash []int
+	for _, r := range records {
+		trash = append(trash, r.Row)
+	}
+	return s.DeleteRows(conf.QueryParams{Rows: trash})
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import "testing"
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		distance int
+		swapped  bool
+	}{
+		{"git status", "git status", 0, false},
+		{"gti status", "git status", 1, true},
+		{"gti", "git", 1, true},
+		{"sl", "ls", 1, true},
+		{"git push", "git pull", 2, false},
+		{"ls -l", "ls -la", 1, false},
+		{"ca", "abc", 3, false},
+		{"", "ls", 2, false},
+	}
+	for _, v := range tests {
+		if d := distance(v.a, v.b); d != v.distance {
+			t.Errorf("distance(%q, %q): wanted %d, got %d", v.a, v.b, v.distance, d)
+		}
+		if s := swapped(v.a, v.b); s != v.swapped {
+			t.Errorf("swapped(%q, %q): wanted %v, got %v", v.a, v.b, v.swapped, s)
+		}
+	}
+}
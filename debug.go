@@ -11,12 +11,14 @@ import (
 )
 
 func init() {
-	if conf.Mode == conf.MODE_SERVER { // Currently debug only needed for server
-		Version += "-pprof"
-		// Set up debug server
-		go func() {
-			fmt.Println(http.ListenAndServe("localhost:6060", nil))
-		}()
-		conf.Log.Info.Print("pprof is running at localhost:6060")
+	debugHook = func(cfg *conf.Config) {
+		if cfg.Mode == conf.MODE_SERVER { // Currently debug only needed for server
+			v += "-pprof"
+			// Set up debug server
+			go func() {
+				fmt.Println(http.ListenAndServe("localhost:6060", nil))
+			}()
+			cfg.Log.Info.Print("pprof is running at localhost:6060")
+		}
 	}
 }
@@ -43,11 +43,41 @@ the RFC3339 time format.
 If you want to also import your current history, you need to add unique
 timestamps to it. Bashistdb can perform these steps for you in one step:
 
-    $ bashistdb -init
+    $ bashistdb init
 
 That's it. Logout and login (or source your bashrc) for the changes to take
 effect.
 
+Init keeps what it adds to your rc file in a marked block. Running it again
+replaces the block, `bashistdb init -uninstall` removes it. Before it adds
+timestamps to your bash_history, init backs it up next to it. Init sets up
+bash by default, or your login shell if it is zsh or fish; zsh gets `precmd`
+and `preexec` hooks and fish a `fish_postexec` hook. Use `-shell` to choose.
+
+To also bind Ctrl-R to bashistdb's interactive search, add `-keys`. With
+`-up host` the up and down arrows walk your bashistdb history at this host, with
+`-up dir` only the command lines you run in the current directory. Bindings
+are added to the same block:
+
+    $ bashistdb init -keys -up dir
+
+The hook runs in the background and hides its errors. If history stops being
+recorded, ask bashistdb what is wrong; doctor checks HISTTIMEFORMAT, the hook
+in your rc file, the database, the configuration file and, in client mode, the
+server, the passphrase and the clock skew between you, and tells you how to
+fix what fails:
+
+    $ bashistdb doctor
+
+Bashistdb reads history timestamps in any HISTTIMEFORMAT that has a date,
+e.g `%F %T ` or `%s `. If you export another HISTTIMEFORMAT than `%FT%T%z `,
+init leaves it alone and saves it to the configuration file, so bashistdb
+knows how to read it; if you don't export it, give it to init with
+`-histtimeformat`. Timestamps without a time zone are in local time, unless
+you set one with `-timezone`:
+
+    $ bashistdb config -histtimeformat "%d/%m/%y %T " -timezone Europe/Athens -save
+
 #### Initializing manually ####
 
 If you don't like the automatic setup above, you can perform the steps
@@ -57,8 +87,8 @@ In order to set up your bash to log and report RFC3339 timestamps, run:
 
     $ export HISTTIMEFORMAT="%FT%T%z "
     $ echo 'HISTTIMEFORMAT="%FT%T%z "' >> ~/.bash_rc
-    $ export PROMPT_COMMAND="${PROMPT_COMMAND}; (history 1 | bashistdb 2>/dev/null &)"
-    $ echo 'export PROMPT_COMMAND="${PROMPT_COMMAND}; (history 1 | bashistdb 2>/dev/null &)"' >> ~/.bashrc
+    $ export PROMPT_COMMAND="${PROMPT_COMMAND}; (history 1 | bashistdb import -dir \"\$PWD\" 2>/dev/null &)"
+    $ echo 'export PROMPT_COMMAND="${PROMPT_COMMAND}; (history 1 | bashistdb import -dir \"\$PWD\" 2>/dev/null &)"' >> ~/.bashrc
 
 Add distinct timestamps to your current bash_history:
 
@@ -75,29 +105,200 @@ In local mode your history is stored on your computer.
 Import your current history. You can import it as many times as you want. It is
 very fast and only new lines will be added.
 
-    $ history | bashistdb
+    $ history | bashistdb import
+
+Check some stats: command lines per day, week and month, an hour by weekday
+heatmap, the busiest users and hosts, how many unique command lines were new
+and your streaks. They take a query term, a time range and -g for all users and
+hosts, and print as a terminal chart, json or csv:
+
+    $ bashistdb stats
+    $ bashistdb stats -g -since 30d -f csv git
+
+See which programs you use most. Command lines are split like your shell
+splits them, so each program of a pipeline counts and sudo or env prefixes are
+skipped. Count subcommands, e.g `git commit`, or the flags of each program:
+
+    $ bashistdb programs
+    $ bashistdb programs -program git
+    $ bashistdb programs -by flag docker
+
+Let bashistdb suggest aliases and functions for the long command lines you
+retype, ready to paste into your .bashrc. Names that are builtins, commands
+installed on your computer, even if the database is on a server, or programs
+in your history are skipped:
+
+    $ bashistdb suggest-aliases
+    alias dclfw='docker compose logs -f web' # 40 runs, saves 840 keystrokes
 
-Check some stats:
+Ask what you usually run next. Bashistdb counts the command lines that came
+right after a command line in the same shell session. Without a command line,
+it predicts what follows the last one you ran:
 
-    $ bashistdb -v 1
+    $ bashistdb next 'terraform plan'
+    $ bashistdb next
+
+With `-f command_line` it prints only the command lines, so a shell widget can
+use it. E.g in bash, Alt-n fills in your likely next command line:
+
+    __bashistdb_next() { READLINE_LINE=$(bashistdb next -n 1 -f command_line); READLINE_POINT=${#READLINE_LINE}; }
+    bind -x '"\en": __bashistdb_next'
+
+See the command lines you mistype most. A command line you usually retyped
+within a minute with a letter or two changed is a typo, and so is one whose
+program has two letters swapped, e.g `gti` for `git`; the report suggests
+aliases for these. With `-delete`, typos go to the trash, after you agree:
+
+    $ bashistdb typos
+    $ bashistdb typos -delete
 
 Perform a query:
 
-    $ bashistdb <SEARCH TERM>
+    $ bashistdb search <SEARCH TERM>
+
+Search interactively. Results update as you type and Enter prints the
+selected command line. Alt-u, Alt-h and Alt-g switch between your user, your
+host and everything, Ctrl-r toggles unique results. `bashistdb init -keys`
+binds it to Ctrl-R.
 
 Restore your history file, percent sign (%) acts as wildcard for the query:
 
-    $ bashistdb -format restore % > ~/.bash_history
+    $ bashistdb search -format restore % > ~/.bash_history
+
+The hooks `bashistdb init` installs tell bashistdb which shell session, i.e
+terminal, each command line ran in. List your sessions of today, print the
+session of a command line by its row id, or search and print the whole
+session of each match instead of the lines around it, which may come from
+other terminals. Command lines stored without a session are grouped into
+sessions that end after 30 minutes without commands:
+
+    $ bashistdb sessions
+    $ bashistdb session 1042
+    $ bashistdb search -session make
+
+Secrets in command lines, like `export GITHUB_TOKEN=...`, `mysql -pPASSWORD`,
+`curl -u user:password`, Authorization headers, passwords in URLs and tokens
+of well known services, are replaced with `[REDACTED]` before they are stored;
+in client mode, before they leave your computer. You may add your own regular
+expressions to the `redact` list of the configuration file; if a pattern has
+a group, only the group is replaced:
+
+    "redact": ["vault-pass (\\S+)"]
+
+Then remove the secrets from the command lines already stored. With
+`-dry-run`, see what would change first:
+
+    $ bashistdb redact -dry-run
+
+Much like bash's HISTIGNORE, you may keep command lines out of your history
+with the `ignore` rules of the configuration file. Patterns are globs that
+match the whole command line, or regular expressions if prefixed with `re:`.
+With `ignorespace`, command lines that start with a space are not recorded.
+Overrides for hosts or users, by glob, add patterns, keep command lines that
+would be ignored, or change `ignorespace`; users' win over hosts' and later
+names, alphabetically, over earlier. The rules apply where a command line is
+imported: in client mode, both your computer's and the server's rules apply.
+Command lines that pipe history to bashistdb are always ignored, unless kept.
+
+    "ignore": {
+        "patterns": ["ls", "cd *", "[bf]g", "re:^git (status|diff)"],
+        "ignorespace": true,
+        "hosts": {"prod-*": {"keep": ["ls"]}},
+        "users": {"root": {"patterns": ["*"]}}
+    }
+
+Delete the command lines you stored before you added a rule; `-dry-run`
+prints them instead:
+
+    $ bashistdb purge -dry-run
+
+To keep your history from growing forever, set a retention policy in the
+configuration file: `maxage` removes older command lines (e.g `720h`, `90d`
+or `52w`), `maxrows` keeps only the newest command lines of each user@host
+and `keeplatest` only the newest runs of each command line of each
+user@host. Overrides for users, by glob, replace the policy. Server mode
+prunes every `interval`, an hour unless set; else, and in client mode too,
+prune on demand:
+
+    "retention": {
+        "maxage": "365d",
+        "keeplatest": 100,
+        "users": {"root": {"maxage": "30d"}}
+    }
+
+    $ bashistdb prune -dry-run
+
+The database keeps your command lines in plain text, unless you set `encrypt`
+in the configuration file: `commands` encrypts the command lines and `all`
+the users and hosts too, with NaCl's secretbox and a key derived from your
+passphrase (`key`) with scrypt. Searches work as before, but they decrypt
+every command line they look at, so they are slower. Bashistdb encrypts, or
+decrypts with `"encrypt": "none"`, the database when it opens it after you
+change the setting; without the setting, the database stays as it is. To
+change the passphrase, decrypt with the old one and encrypt with the new. In
+client mode, the server's setting applies.
+
+    "key": "my passphrase",
+    "encrypt": "all"
+
+Delete command lines by row id or by search: a query term (`-R` for a regular
+expression), user, host and a time range. Bashistdb prints how many command
+lines match and some of them, and asks before it moves them to the trash;
+`-y` skips the question. List the trash, restore from it by id, or empty it:
+
+    $ bashistdb delete -g -q password -since 2015-10-01 -until 7d
+    $ bashistdb trash
+    $ bashistdb undelete 3-5
+    $ bashistdb purge-trash
+
+Back up the database while bashistdb keeps recording, restore a backup, check
+the database for damage and reclaim the space deleted command lines left.
+Restore refuses damaged backups and backups from newer versions, and asks
+before it replaces the database:
+
+    $ bashistdb backup ~/bashistdb-backup.sqlite3
+    $ bashistdb restore ~/bashistdb-backup.sqlite3
+    $ bashistdb check
+    $ bashistdb vacuum
+
+Bashistdb upgrades the schema of older databases when it opens them, after it
+backs them up next to the database file, and refuses databases of newer
+versions. See which schema migrations your database had:
+
+    $ bashistdb migrate-status
+
+Merge the database of another computer, e.g one you used in local mode before
+you set up a server, into yours. Command lines you have are skipped; users
+and hosts may be renamed:
+
+    $ bashistdb merge -map-user me=marios -map-host laptop=work laptop.sqlite3
+
+If you have different login names on different computers, or a host is
+sometimes known by its full name, make one name an alias of the other; queries
+then show and search both as one. Rename changes the stored command lines
+instead:
+
+    $ bashistdb alias user me marios
+    $ bashistdb alias host laptop.example.com laptop
+    $ bashistdb alias
+    $ bashistdb rename user me marios
+
+Bashistdb has a command for each task: `import`, `search`, `find`, `top`,
+`programs`, `suggest-aliases`, `next`, `typos`, `tail`, `back`, `sessions`, `session`, `users`, `alias`, `rename`, `row`, `delete`, `trash`, `undelete`, `purge-trash`,
+`redact`, `purge`, `prune`, `merge`, `backup`, `restore`, `check`, `vacuum`,
+`migrate-status`, `stats`, `server`, `init`, `config` and `doctor`. Run `bashistdb help` to list them and `bashistdb help <COMMAND>` to see the options
+of each. The flags of earlier versions (e.g `bashistdb -topk 10`) still work;
+`bashistdb help flags` describes them.
 
 ### Server - Client mode ###
 
 Start your server¹:
 
-    $ bashistdb -server -key <PASSPHRASE>
+    $ bashistdb server -key <PASSPHRASE>
 
 From your client machine run bashistdb in client mode:
 
-    $ history | bashistdb -remote <SERVER> -key <PASSPHRASE>
+    $ history | bashistdb import -remote <SERVER> -key <PASSPHRASE>
 
 You may use a configuration file or environment variables to setup bashistdb.
 
@@ -105,16 +306,42 @@ Environment variables:
 
     $ export BASHISTDB_REMOTE=<SERVER>
     $ export BASHISTDB_KEY=<PASSPHRASE>
-    $ bashistdb -verbose 1
+    $ bashistdb stats -verbose 1
 
 Configuration file (~/.bashistdb.conf) is better. You can create it and update
 it with bashistdb:
 
-    $ bashistdb -r <SERVER> -k <PASSPHRASE> -p <PORT> -save
+    $ bashistdb config -r <SERVER> -k <PASSPHRASE> -p <PORT> -save
 
 Update a variable in the configuration:
 
-    $ bashistdb -k <NEW PASSPHRASE> -save
+    $ bashistdb config -k <NEW PASSPHRASE> -save
+
+Show your current settings:
+
+    $ bashistdb config
+
+Watch, much like `tail -f`, the commands that are stored in the server as they
+arrive. You may limit them with a query and the user and host flags:
+
+    $ bashistdb tail -follow [QUERY]
+
+Backup, restore, check and vacuum work in client mode too, if the server has
+an admin key and you give the same one. Without one, the server refuses them.
+So it refuses the commands that change history in bulk or who it belongs to:
+delete with a search, typos -delete, purge-trash, redact, purge, prune, alias
+and rename. Delete with row ids alone and undelete need no admin key.
+Keep `adminkey` only in the configuration files of the server and of the
+computers you administer it from:
+
+    $ bashistdb server -key <PASSPHRASE> -admin-key <ADMIN KEY>
+    $ bashistdb backup -admin-key <ADMIN KEY> server-backup.sqlite3
+
+Programs may push and query history too, using the Go client package
+`github.com/andmarios/bashistdb/client`. It talks to a bashistdb server with the
+same passphrase and returns decoded rows and typed errors. Servers report
+failed requests with an error reply, which clients of earlier versions don't
+know: they print nothing, so upgrade them with the server.
 
 Messages are encrypted using NaCl secret-key authenticated encryption and
 scrypt key derivation. Check <https://github.com/andmarios/crypto/nacl/saltsecret>
@@ -125,8 +352,8 @@ may get a listen address configuration option in the future.
 
 ### Knobs ###
 
-Run `bashistdb -h` to get a glimpse of available options. They are easy to understand.
-Currently the most useful command not covered until here is `-g`. G stands for global
+Run `bashistdb help` to get a glimpse of available commands and options. They are easy
+to understand. Currently the most useful option not covered until here is `-g`. G stands for global
 and makes your query to search for commands from all users at any host.
 
 License
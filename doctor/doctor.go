@@ -0,0 +1,288 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+/*
+Package doctor checks what recording history with bashistdb depends on.
+The hook hides its errors so it won't disturb the prompt, so when history
+stops being recorded, doctor is where to look.
+*/
+package doctor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andmarios/bashistdb/client"
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/database"
+	"github.com/andmarios/bashistdb/setup"
+)
+
+// Results of a check.
+const (
+	PASS = "PASS"
+	WARN = "WARN"
+	FAIL = "FAIL"
+	SKIP = "SKIP"
+)
+
+// Limits of the clock skew against the server. History timestamps come
+// from the clients, so skewed clocks mix up the order of command lines.
+const (
+	skewWarn = 5 * time.Second
+	skewFail = time.Minute
+)
+
+// timeout is how long we wait for the server.
+const timeout = 5 * time.Second
+
+// A Check is the result of a single check.
+type Check struct {
+	Name    string // Name is what was checked
+	Result  string // Result is PASS, WARN, FAIL or SKIP
+	Message string // Message explains the result
+	Fix     string // Fix, if set, tells how to fix a failure or warning
+}
+
+// A doctor runs the checks. The environment and how history lines are
+// printed may be replaced by tests.
+type doctor struct {
+	cfg     *conf.Config
+	getenv  func(string) string
+	history func(format string) (string, error)
+}
+
+// Run runs the checks for cfg and prints a report to w. It returns an
+// error if any check failed.
+func Run(cfg *conf.Config, w io.Writer) error {
+	d := &doctor{cfg: cfg, getenv: os.Getenv, history: bashHistory}
+	failed := 0
+	for _, c := range d.checks() {
+		fmt.Fprintf(w, "%s  %-14s %s\n", c.Result, c.Name, c.Message)
+		if c.Fix != "" && (c.Result == FAIL || c.Result == WARN) {
+			fmt.Fprintf(w, "      %-14s fix: %s\n", "", c.Fix)
+		}
+		if c.Result == FAIL {
+			failed++
+		}
+	}
+	switch failed {
+	case 0:
+		return nil
+	case 1:
+		return errors.New("1 check failed.")
+	}
+	return errors.New(strconv.Itoa(failed) + " checks failed.")
+}
+
+// checks runs all the checks, in the order the hook depends on them.
+func (d *doctor) checks() []Check {
+	checks := []Check{d.histTimeFormat(), d.hook(), d.confFile(), d.database()}
+	return append(checks, d.remote()...)
+}
+
+// histTimeFormat checks that bash prints history lines we can read.
+func (d *doctor) histTimeFormat() Check {
+	c := Check{Name: "HISTTIMEFORMAT"}
+	if d.cfg.Setup.Shell != conf.SHELL_BASH {
+		c.Result, c.Message = SKIP, "The "+d.cfg.Setup.Shell+" hook sets its own timestamps."
+		return c
+	}
+	fix := `export HISTTIMEFORMAT="` + conf.HISTTIMEFORMAT_DEFAULT + `" in ~/.bashrc, or save yours with 'bashistdb config -histtimeformat FORMAT -save'`
+	// Bash's HISTTIMEFORMAT may not be exported, then the one bashistdb
+	// is set to use is our best guess.
+	format := d.getenv("HISTTIMEFORMAT")
+	if format == "" {
+		format = d.cfg.HistTimeFormat
+	}
+	if format == "" {
+		c.Result, c.Message, c.Fix = FAIL, "Not set, bash history has no timestamps.", fix
+		return c
+	}
+	line, err := d.history(format)
+	if err != nil {
+		c.Result, c.Message = WARN, "Could not run bash to test "+strconv.Quote(format)+": "+err.Error()
+		return c
+	}
+	if _, _, err = database.ParseHistoryLine(line, d.cfg.HistTimeFormat, d.cfg.Location); err != nil {
+		c.Result, c.Message, c.Fix = FAIL, strconv.Quote(format)+" gives lines bashistdb can't read: "+strconv.Quote(line), fix
+		return c
+	}
+	c.Result, c.Message = PASS, strconv.Quote(format)+" gives lines bashistdb reads."
+	return c
+}
+
+// bashHistory returns a history line as bash prints it with format.
+func bashHistory(format string) (string, error) {
+	cmd := exec.Command("bash", "-c", `set -o history; history -s "echo bashistdb"; history 1`)
+	cmd.Env = append(os.Environ(), "HISTTIMEFORMAT="+format, "HISTFILE=/dev/null")
+	out, err := cmd.Output()
+	return strings.TrimRight(string(out), "\n"), err
+}
+
+// hook checks that the hook is installed once in the rc file and, if the
+// environment shows it, in PROMPT_COMMAND.
+func (d *doctor) hook() Check {
+	shell := d.cfg.Setup.Shell
+	c := Check{Name: "hook", Fix: "run 'bashistdb init -shell " + shell + "' and start a new shell"}
+	in, err := setup.Inspect(shell)
+	switch {
+	case err != nil:
+		c.Result, c.Message = FAIL, err.Error()
+	case in.Blocks+in.Legacy == 0:
+		c.Result, c.Message = FAIL, "Not installed in "+in.RC+"."
+	case in.Blocks+in.Legacy > 1:
+		c.Result, c.Message = FAIL, "Installed "+strconv.Itoa(in.Blocks+in.Legacy)+" times in "+in.RC+", every command would be stored many times."
+		c.Fix = "remove the bashistdb lines from " + in.RC + ", then " + c.Fix
+	case in.Legacy > 0:
+		c.Result, c.Message = WARN, "An earlier version's hook is installed in "+in.RC+"."
+	case !in.Current:
+		c.Result, c.Message = WARN, "The block in "+in.RC+" is from another bashistdb version (v"+strconv.Itoa(in.Version)+")."
+	default:
+		c.Result, c.Message = PASS, "Installed once in "+in.RC+"."
+	}
+	if c.Result == FAIL || shell != conf.SHELL_BASH {
+		return c
+	}
+
+	// PROMPT_COMMAND is usually not exported; if it is, check it too.
+	if pc := d.getenv("PROMPT_COMMAND"); pc != "" {
+		if n := strings.Count(pc, "bashistdb"); n > 1 {
+			c.Result, c.Message = FAIL, "PROMPT_COMMAND runs bashistdb "+strconv.Itoa(n)+" times: "+pc
+			c.Fix = "remove the bashistdb lines you added by hand, or start a new shell"
+		}
+	}
+	return c
+}
+
+// confFile checks that the configuration file parses.
+func (d *doctor) confFile() Check {
+	c := Check{Name: "configuration"}
+	switch _, err := os.Stat(d.cfg.ConfFile); {
+	case d.cfg.ConfErr != nil:
+		c.Result, c.Message = FAIL, d.cfg.ConfErr.Error()
+		c.Fix = "fix the JSON in " + d.cfg.ConfFile + ", or remove it and run 'bashistdb config -save'"
+	case os.IsNotExist(err):
+		c.Result, c.Message = PASS, "No configuration file, settings come from the environment."
+	case err != nil:
+		c.Result, c.Message = FAIL, err.Error()
+	default:
+		c.Result, c.Message = PASS, d.cfg.ConfFile+" parses."
+	}
+	return c
+}
+
+// database checks that the local database opens and is on our schema.
+func (d *doctor) database() Check {
+	c := Check{Name: "database"}
+	switch {
+	case d.cfg.Address != "":
+		c.Result, c.Message = SKIP, "A remote is set, history goes to the server's database."
+		return c
+	case d.cfg.Database == database.MEMORY:
+		c.Result, c.Message = SKIP, "In-memory database, history is lost on exit."
+		return c
+	}
+	version, err := database.SchemaVersion(d.cfg.Database)
+	switch {
+	case os.IsNotExist(err):
+		c.Result, c.Message = WARN, d.cfg.Database+" does not exist, it will be created on the first import."
+	case err != nil:
+		c.Result, c.Message = FAIL, "Could not open "+d.cfg.Database+": "+err.Error()
+		c.Fix = "check the file and its permissions, or set another with -db"
+	case version == database.VERSION:
+		c.Result, c.Message = PASS, d.cfg.Database+" is on schema "+version+"."
+	case database.NewerVersion(version, database.VERSION):
+		c.Result, c.Message = FAIL, d.cfg.Database+" is on schema "+version+", newer than "+database.VERSION+" that this bashistdb supports."
+		c.Fix = "update bashistdb"
+	default:
+		c.Result, c.Message = WARN, d.cfg.Database+" is on schema "+version+", it will be upgraded to "+database.VERSION+" when opened."
+	}
+	return c
+}
+
+// remote checks that the server is reachable, that it shares our key and
+// that our clocks agree. Each check needs the previous to pass.
+func (d *doctor) remote() []Check {
+	reach := Check{Name: "remote"}
+	key := Check{Name: "key", Result: SKIP, Message: "Needs the remote check to pass."}
+	clock := Check{Name: "clock", Result: SKIP, Message: "Needs the key check to pass."}
+
+	addr := d.cfg.Address
+	if addr == "" {
+		reach.Result, reach.Message = SKIP, "No remote set, bashistdb runs in local mode."
+		key.Message, clock.Message = "No remote set.", "No remote set."
+		return []Check{reach, key, clock}
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		reach.Result, reach.Message = FAIL, err.Error()
+		reach.Fix = "check that 'bashistdb server' runs there and -r, -p point to it"
+		return []Check{reach, key, clock}
+	}
+	conn.Close()
+	reach.Result, reach.Message = PASS, addr+" accepts connections."
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cl := client.New(addr, d.cfg.Key)
+	cl.User, cl.Hostname = d.cfg.User, d.cfg.Hostname
+	sent := time.Now()
+	now, err := cl.Ping(ctx)
+	received := time.Now()
+	switch err.(type) {
+	case nil:
+	case *client.ServerError:
+		// Servers of earlier versions decrypt the request but don't know ping.
+		key.Result, key.Message = PASS, "The server decrypts our requests."
+		clock.Message = "The server is too old to report its time."
+		return []Check{reach, key, clock}
+	default:
+		key.Result, key.Message = FAIL, err.Error()
+		if err == client.ErrClosed {
+			key.Message = "The server closed the connection, the passphrase is probably wrong."
+		}
+		key.Fix = "set the server's passphrase with -k, BASHISTDB_KEY or 'bashistdb config -save'"
+		return []Check{reach, key, clock}
+	}
+	key.Result, key.Message = PASS, "The server decrypts our requests."
+
+	// Compare to the middle of the round trip.
+	skew := now.Sub(sent.Add(received.Sub(sent) / 2))
+	if skew < 0 {
+		skew = -skew
+	}
+	clock.Message = "Clocks differ by " + skew.Round(time.Millisecond).String() + "."
+	switch {
+	case skew > skewFail:
+		clock.Result, clock.Fix = FAIL, "sync the clocks of this host and the server, e.g with NTP"
+	case skew > skewWarn:
+		clock.Result, clock.Fix = WARN, "sync the clocks of this host and the server, e.g with NTP"
+	default:
+		clock.Result = PASS
+	}
+	return []Check{reach, key, clock}
+}
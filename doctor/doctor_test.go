@@ -0,0 +1,104 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package doctor
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/database"
+	"github.com/andmarios/bashistdb/llog"
+	"github.com/andmarios/bashistdb/network"
+	"github.com/andmarios/bashistdb/setup"
+)
+
+func TestDoctor(t *testing.T) {
+	home, err := ioutil.TempDir("", "test-bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go network.Serve(l, database.NewMemory(nil), &conf.Config{Key: []byte("secret"), Log: llog.New(llog.SILENT)})
+
+	cfg := &conf.Config{Mode: conf.MODE_DOCTOR, Log: llog.New(llog.SILENT), Setup: conf.SetupParams{Shell: conf.SHELL_BASH},
+		Database: filepath.Join(home, "db.sqlite3"), ConfFile: filepath.Join(home, ".bashistdb.conf")}
+	env := map[string]string{}
+	history := "    1  2015-10-12T12:00:00+0300 echo bashistdb"
+	d := &doctor{cfg: cfg, getenv: func(k string) string { return env[k] },
+		history: func(string) (string, error) { return history, nil }}
+
+	results := func() map[string]string {
+		r := make(map[string]string)
+		for _, c := range d.checks() {
+			r[c.Name] = c.Result
+		}
+		return r
+	}
+	check := func(step string, want map[string]string) {
+		got := results()
+		for name, result := range want {
+			if got[name] != result {
+				t.Errorf("%s: check %s wanted %s, got %s", step, name, result, got[name])
+			}
+		}
+	}
+
+	check("nothing set up", map[string]string{"HISTTIMEFORMAT": FAIL, "hook": FAIL, "configuration": PASS,
+		"database": WARN, "remote": SKIP, "key": SKIP, "clock": SKIP})
+
+	if err = setup.Apply(cfg, false); err != nil {
+		t.Fatal(err)
+	}
+	db, err := database.NewSQLite(cfg.Database, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	env["HISTTIMEFORMAT"] = "%FT%T%z "
+	check("set up", map[string]string{"HISTTIMEFORMAT": PASS, "hook": PASS, "database": PASS})
+
+	history = "    1  2015-10-12 12:00:00 echo bashistdb"
+	env["HISTTIMEFORMAT"] = "%F %T "
+	check("other format", map[string]string{"HISTTIMEFORMAT": PASS})
+
+	history = "    1  12:00 echo bashistdb"
+	env["HISTTIMEFORMAT"] = "%R "
+	env["PROMPT_COMMAND"] = "__bashistdb_hook; (history 1 | bashistdb import &)"
+	cfg.ConfErr = errors.New("Could not parse configuration file.")
+	check("broken", map[string]string{"HISTTIMEFORMAT": FAIL, "hook": FAIL, "configuration": FAIL})
+
+	cfg.Address, cfg.Key = l.Addr().String(), []byte("wrong")
+	check("wrong key", map[string]string{"database": SKIP, "remote": PASS, "key": FAIL, "clock": SKIP})
+	cfg.Key = []byte("secret")
+	check("right key", map[string]string{"remote": PASS, "key": PASS, "clock": PASS})
+	l.Close()
+	check("server down", map[string]string{"remote": FAIL, "key": SKIP})
+}
@@ -0,0 +1,337 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package finder is the interactive, full-screen history search of bashistdb.
+//
+// It draws on the terminal (/dev/tty), so its standard output is free for the
+// selected command line. This way it can be used from a key binding, like
+// the one "bashistdb init" installs for bash:
+//
+//	__bashistdb_find() {
+//	    local line
+//	    line=$(bashistdb find -- "$READLINE_LINE") || return
+//	    [ -n "$line" ] && READLINE_LINE=$line && READLINE_POINT=${#line}
+//	}
+//	bind -x '"\C-r": __bashistdb_find'
+package finder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/result"
+)
+
+// A Source runs queries for the finder. client.Client is a Source and the
+// local package has one for databases.
+type Source interface {
+	Query(ctx context.Context, qp conf.QueryParams) ([]result.Row, error)
+}
+
+const (
+	candidates = 500             // how many matching lines we ask from the source
+	around     = 3               // lines before and after the selection in preview
+	timeout    = 5 * time.Second // per query
+)
+
+// Finder holds the state of a search.
+type Finder struct {
+	src        Source
+	user, host string // the values of scope when filtering is on
+	userOn     bool   // filter by user
+	hostOn     bool   // filter by host
+	unique     bool
+	previewOn  bool
+	query      []rune
+	rows       []result.Row // ranked matches, best first
+	sel        int          // selected row
+	preview    []result.Row // context of the selected row
+	queried    *queried     // the parameters of the last query
+	err        error
+}
+
+type queried struct {
+	user, host, command string
+	unique              bool
+}
+
+// New returns a Finder. Its initial query and scope come from qp (as set by
+// the find command), the user and host to filter with from cfg.
+func New(src Source, cfg *conf.Config) *Finder {
+	qp := cfg.QParams
+	f := &Finder{
+		src:       src,
+		user:      cfg.User,
+		host:      cfg.Hostname,
+		userOn:    qp.User != "%",
+		hostOn:    qp.Host != "%",
+		unique:    qp.Unique,
+		previewOn: true,
+		query:     []rune(strings.TrimSuffix(strings.TrimPrefix(qp.Command, "%"), "%")),
+	}
+	if f.userOn {
+		f.user = qp.User
+	}
+	if f.hostOn {
+		f.host = qp.Host
+	}
+	return f
+}
+
+// Run runs f on the terminal until the user selects a command line, which is
+// written to out, or cancels.
+func (f *Finder) Run(out io.Writer) error {
+	t, err := openTerminal()
+	if err != nil {
+		return err
+	}
+	keys := t.keys()
+
+	f.update()
+	for {
+		w, h := t.size()
+		f.render(t, w, h)
+		k, ok := <-keys
+		if !ok {
+			t.close()
+			return nil
+		}
+		done, selected := f.handle(k)
+		// Apply keys that are already waiting before we query again,
+		// so fast typing or pasting doesn't run a query per key.
+		for !done && len(keys) > 0 {
+			done, selected = f.handle(<-keys)
+		}
+		if done {
+			t.close()
+			if selected != "" {
+				_, err = fmt.Fprintln(out, selected)
+			}
+			return err
+		}
+		f.update()
+	}
+}
+
+// handle applies a key. It returns done when the search is over and the
+// selected command line if there is one.
+func (f *Finder) handle(k key) (done bool, selected string) {
+	if k.alt {
+		switch k.r {
+		case 'u':
+			f.userOn = !f.userOn
+		case 'h':
+			f.hostOn = !f.hostOn
+		case 'g': // global, or back to the user at this host
+			on := !(f.userOn || f.hostOn)
+			f.userOn, f.hostOn = on, on
+		case 'p':
+			f.previewOn = !f.previewOn
+		}
+		return false, ""
+	}
+
+	switch k.r {
+	case keyEnter, keyCtrlJ:
+		if f.sel < len(f.rows) {
+			return true, f.rows[f.sel].Command
+		}
+		return true, ""
+	case keyEsc, keyCtrlC, keyCtrlG, keyCtrlD:
+		return true, ""
+	case keyUp, keyCtrlP:
+		if f.sel > 0 {
+			f.sel--
+		}
+		return false, ""
+	case keyDown, keyCtrlN:
+		if f.sel < len(f.rows)-1 {
+			f.sel++
+		}
+		return false, ""
+	case keyCtrlR:
+		f.unique = !f.unique
+	case keyBackspace, keyCtrlH:
+		if len(f.query) > 0 {
+			f.query = f.query[:len(f.query)-1]
+		}
+	case keyCtrlU:
+		f.query = f.query[:0]
+	case keyCtrlW:
+		i := len(f.query)
+		for i > 0 && f.query[i-1] == ' ' {
+			i--
+		}
+		for i > 0 && f.query[i-1] != ' ' {
+			i--
+		}
+		f.query = f.query[:i]
+	default:
+		if k.r < ' ' || k.r >= keyUp {
+			return false, ""
+		}
+		f.query = append(f.query, k.r)
+	}
+	f.sel = 0
+	return false, ""
+}
+
+// scope returns the user and host search terms.
+func (f *Finder) scope() (user, host string) {
+	user, host = "%", "%"
+	if f.userOn {
+		user = f.user
+	}
+	if f.hostOn {
+		host = f.host
+	}
+	return user, host
+}
+
+// update queries the source for the current query and scope and ranks
+// the results. The source does the fuzzy matching roughly (a LIKE pattern
+// with the characters of the query in order), then we score the lines.
+func (f *Finder) update() {
+	user, host := f.scope()
+	qp := conf.QueryParams{
+		Type:    conf.QUERY_LASTK,
+		Kappa:   candidates,
+		User:    user,
+		Host:    host,
+		Command: likePattern(f.query),
+		Unique:  f.unique,
+	}
+	// Moving the selection doesn't need a new query.
+	q := queried{user, host, qp.Command, f.unique}
+	if f.queried != nil && *f.queried == q && f.err == nil {
+		f.updatePreview()
+		return
+	}
+	f.queried = &q
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	rows, err := f.src.Query(ctx, qp)
+	f.err = err
+	f.rows = rank(f.query, rows)
+	if f.sel >= len(f.rows) {
+		f.sel = 0
+	}
+	f.updatePreview()
+}
+
+// updatePreview fetches the lines around the selected row, from the same
+// user and host, using a content query restricted to the row.
+func (f *Finder) updatePreview() {
+	f.preview = nil
+	if !f.previewOn || f.sel >= len(f.rows) {
+		return
+	}
+	r := f.rows[f.sel]
+	qp := conf.QueryParams{
+		Type:          conf.QUERY_CONTENT,
+		Kappa:         r.Row,
+		User:          r.User,
+		Host:          r.Host,
+		Command:       "%",
+		BeforeContent: around,
+		AfterContent:  around,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	f.preview, _ = f.src.Query(ctx, qp)
+}
+
+// likePattern returns a LIKE pattern that matches lines that include the
+// characters of query in order.
+func likePattern(query []rune) string {
+	var b bytes.Buffer
+	b.WriteByte('%')
+	for _, r := range query {
+		if r == '%' || r == '_' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+		b.WriteByte('%')
+	}
+	return b.String()
+}
+
+// rank scores rows against query and returns the matching ones, best
+// first. Rows come from lastk queries, ordered by time, so at equal score
+// the most recent comes first.
+func rank(query []rune, rows []result.Row) []result.Row {
+	type scored struct {
+		row   result.Row
+		score int
+	}
+	var s []scored
+	for i := len(rows) - 1; i >= 0; i-- {
+		if sc := score(query, rows[i].Command); sc >= 0 {
+			s = append(s, scored{rows[i], sc})
+		}
+	}
+	sort.SliceStable(s, func(i, j int) bool { return s[i].score > s[j].score })
+	ranked := make([]result.Row, len(s))
+	for i, v := range s {
+		ranked[i] = v.row
+	}
+	return ranked
+}
+
+// score returns how well command matches query, or -1 if it doesn't contain
+// the characters of query in order. Matching is case insensitive. Matches at
+// the start of words, consecutive matches and substring matches score more.
+func score(query []rune, command string) int {
+	if len(query) == 0 {
+		return 0
+	}
+	c := []rune(strings.ToLower(command))
+	q := []rune(strings.ToLower(string(query)))
+
+	sc, qi, prev := 0, 0, -2
+	for i, r := range c {
+		if qi == len(q) {
+			break
+		}
+		if r != q[qi] {
+			continue
+		}
+		sc++
+		if i == prev+1 {
+			sc += 2
+		}
+		if i == 0 || !unicode.IsLetter(c[i-1]) && !unicode.IsDigit(c[i-1]) {
+			sc += 2
+		}
+		prev = i
+		qi++
+	}
+	if qi < len(q) {
+		return -1
+	}
+	if strings.Contains(string(c), string(q)) {
+		sc += 2 * len(q)
+	}
+	return sc
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package finder
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/result"
+)
+
+// fakeSource records the queries it gets and returns rows for them.
+type fakeSource struct {
+	queries []conf.QueryParams
+	rows    []result.Row
+}
+
+func (s *fakeSource) Query(ctx context.Context, qp conf.QueryParams) ([]result.Row, error) {
+	s.queries = append(s.queries, qp)
+	if qp.Type == conf.QUERY_CONTENT {
+		return []result.Row{{Row: qp.Kappa - 1, Command: "cd src"}, {Row: qp.Kappa, Command: "make"}}, nil
+	}
+	return s.rows, nil
+}
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		query, command string
+		match          bool
+	}{
+		{"gst", "git status", true},
+		{"GIT", "git status", true},
+		{"tsg", "git status", false},
+		{"", "anything", true},
+	}
+	for _, v := range tests {
+		if got := score([]rune(v.query), v.command) >= 0; got != v.match {
+			t.Errorf("score(%q, %q) match: wanted %v, got %v", v.query, v.command, v.match, got)
+		}
+	}
+
+	// Oldest first, as lastk returns them.
+	rows := []result.Row{
+		{Row: 1, Command: "git status"},
+		{Row: 2, Command: "grep -r st ."},
+		{Row: 3, Command: "git stash"},
+		{Row: 4, Command: "ls"},
+	}
+	var got []int
+	for _, r := range rank([]rune("git st"), rows) {
+		got = append(got, r.Row)
+	}
+	if want := []int{3, 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("rank returned wrong rows. Wanted %v, got %v", want, got)
+	}
+}
+
+func TestLikePattern(t *testing.T) {
+	if got, want := likePattern([]rune("a%_")), `%a%\%%\_%`; got != want {
+		t.Fatalf("Wanted %s, got %s", want, got)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	got := parseKeys([]byte("a\x1b[A\x1bu\r\x1b"))
+	want := []key{{r: 'a'}, {r: keyUp}, {r: 'u', alt: true}, {r: keyEnter}, {r: keyEsc}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Wanted %v, got %v", want, got)
+	}
+}
+
+func TestFinder(t *testing.T) {
+	src := &fakeSource{rows: []result.Row{
+		{Row: 7, User: "u", Host: "h", Command: "make test"},
+		{Row: 9, User: "u", Host: "h", Command: "make"},
+	}}
+	cfg := &conf.Config{User: "u", Hostname: "h",
+		QParams: conf.QueryParams{User: "u", Host: "h", Command: "%ma%"}}
+	f := New(src, cfg)
+	f.update()
+
+	q := src.queries[0]
+	if q.Type != conf.QUERY_LASTK || q.User != "u" || q.Host != "h" || q.Command != "%m%a%" {
+		t.Fatalf("Wrong query: %+v", q)
+	}
+	if p := src.queries[1]; p.Type != conf.QUERY_CONTENT || p.Kappa != 9 {
+		t.Fatalf("Wrong preview query: %+v", p)
+	}
+
+	// Global scope, type, move down: a new query, then only a preview.
+	for _, k := range []key{{r: 'g', alt: true}, {r: 'k'}} {
+		f.handle(k)
+	}
+	f.update()
+	if q := src.queries[2]; q.User != "%" || q.Host != "%" || q.Command != "%m%a%k%" {
+		t.Fatalf("Wrong query after toggles: %+v", q)
+	}
+	f.handle(key{r: keyDown})
+	n := len(src.queries)
+	f.update()
+	if len(src.queries) != n+1 || src.queries[n].Type != conf.QUERY_CONTENT {
+		t.Fatalf("Moving the selection should only update the preview: %+v", src.queries[n:])
+	}
+
+	var b bytes.Buffer
+	f.render(&b, 80, 24)
+	if !strings.Contains(b.String(), "> mak") || !strings.Contains(b.String(), "cd src") {
+		t.Fatalf("Render misses the prompt or the preview:\n%q", b.String())
+	}
+
+	done, selected := f.handle(key{r: keyEnter})
+	if !done || selected != "make test" {
+		t.Fatalf("Wanted to select 'make test', got %v %q", done, selected)
+	}
+	if done, selected = f.handle(key{r: keyEsc}); !done || selected != "" {
+		t.Fatal("Esc should cancel.")
+	}
+}
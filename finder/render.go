@@ -0,0 +1,152 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package finder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ANSI escape sequences we use.
+const (
+	escHome    = "\x1b[H"
+	escClear   = "\x1b[K" // clear to end of line
+	escReverse = "\x1b[7m"
+	escDim     = "\x1b[2m"
+	escReset   = "\x1b[0m"
+)
+
+const help = "Enter select  Esc cancel  Up/Down move  M-u user  M-h host  M-g global  C-r unique  M-p preview"
+
+// render draws the finder in a w x h screen. From top to bottom: the
+// prompt with the scope, the matches (best first), the preview of the
+// selected line and the help line.
+func (f *Finder) render(out io.Writer, w, h int) {
+	var b bytes.Buffer
+	b.WriteString(escHome)
+
+	previewH := 0
+	if f.previewOn && h >= 12 {
+		previewH = 2*around + 2 // title and lines
+	}
+	listH := h - 2 - previewH // minus prompt and help
+	if listH < 1 {
+		listH = 1
+	}
+
+	// Prompt and scope
+	user, host := f.scope()
+	status := user + "@" + host
+	if f.unique {
+		status += " unique"
+	}
+	if f.err != nil {
+		status = "error: " + f.err.Error()
+	}
+	prompt := "> " + printable(string(f.query))
+	if pad := w - len([]rune(prompt)) - len([]rune(status)); pad > 0 {
+		line(&b, prompt+strings.Repeat(" ", pad)+escDim+status+escReset, w+len(escDim)+len(escReset))
+	} else {
+		line(&b, prompt, w)
+	}
+
+	// Matches, scrolled so the selection is visible
+	first := 0
+	if f.sel >= listH {
+		first = f.sel - listH + 1
+	}
+	for i := first; i < first+listH; i++ {
+		if i >= len(f.rows) {
+			line(&b, "", w)
+			continue
+		}
+		l := "  " + printable(f.rows[i].Command)
+		if i == f.sel {
+			l = escReverse + fit(l, w) + escReset
+			line(&b, l, w+len(escReverse)+len(escReset))
+			continue
+		}
+		line(&b, l, w)
+	}
+
+	// Preview
+	if previewH > 0 {
+		title := "-- context --"
+		if f.sel < len(f.rows) {
+			r := f.rows[f.sel]
+			title = fmt.Sprintf("-- %s@%s %s --", r.User, r.Host, r.Datetime.Format("2006-01-02 15:04:05"))
+		}
+		line(&b, escDim+fit(title, w)+escReset, w+len(escDim)+len(escReset))
+		for i := 0; i < previewH-1; i++ {
+			if i >= len(f.preview) {
+				line(&b, "", w)
+				continue
+			}
+			p := f.preview[i]
+			l := fmt.Sprintf("%s  %s", p.Datetime.Format("15:04:05"), printable(p.Command))
+			if f.sel < len(f.rows) && p.Row == f.rows[f.sel].Row {
+				l = escReverse + fit(l, w) + escReset
+				line(&b, l, w+len(escReverse)+len(escReset))
+				continue
+			}
+			line(&b, l, w)
+		}
+	}
+
+	// Help, without a newline so the screen doesn't scroll
+	b.WriteString(escDim + fit(help, w) + escReset + escClear)
+
+	// Cursor at the end of the query
+	fmt.Fprintf(&b, "\x1b[1;%dH", min(w, len([]rune(prompt))+1))
+	out.Write(b.Bytes())
+}
+
+// line writes s, cut at n runes, clears the rest of the line and moves
+// to the next one. Raw mode needs the carriage return.
+func line(b *bytes.Buffer, s string, n int) {
+	b.WriteString(fit(s, n))
+	b.WriteString(escClear + "\r\n")
+}
+
+// fit cuts s to n runes.
+func fit(s string, n int) string {
+	r := []rune(s)
+	if len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+// printable replaces characters that would break our layout.
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package finder
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+)
+
+// Keys that aren't printable characters. Control keys are their ASCII
+// code, the rest are out of the range of runes we accept as input.
+const (
+	keyCtrlC     = 0x03
+	keyCtrlD     = 0x04
+	keyCtrlG     = 0x07
+	keyCtrlH     = 0x08
+	keyCtrlJ     = 0x0a
+	keyEnter     = 0x0d
+	keyCtrlN     = 0x0e
+	keyCtrlP     = 0x10
+	keyCtrlR     = 0x12
+	keyCtrlU     = 0x15
+	keyCtrlW     = 0x17
+	keyEsc       = 0x1b
+	keyBackspace = 0x7f
+)
+
+const (
+	keyUp = utf8.MaxRune + 1 + iota
+	keyDown
+)
+
+// A key is a key press. Alt (or Esc followed by a key) sets alt.
+type key struct {
+	r   rune
+	alt bool
+}
+
+// terminal is the controlling terminal in raw mode.
+type terminal struct {
+	tty   *os.File
+	state string // stty settings to restore
+}
+
+// openTerminal opens /dev/tty, puts it in raw mode and switches to the
+// alternate screen. We use stty, so we need no terminal library.
+func openTerminal() (*terminal, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.New("Interactive search needs a terminal: " + err.Error())
+	}
+	t := &terminal{tty: tty}
+	state, err := t.stty("-g")
+	if err != nil {
+		tty.Close()
+		return nil, err
+	}
+	t.state = strings.TrimSpace(state)
+	if _, err = t.stty("raw", "-echo"); err != nil {
+		tty.Close()
+		return nil, err
+	}
+	fmt.Fprint(tty, "\x1b[?1049h")
+	return t, nil
+}
+
+// stty runs stty on the terminal.
+func (t *terminal) stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = t.tty
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.New("stty " + strings.Join(args, " ") + ": " + err.Error())
+	}
+	return string(out), nil
+}
+
+// size returns the width and height of the terminal, or 80x24 if unknown.
+func (t *terminal) size() (w, h int) {
+	out, err := t.stty("size")
+	if err != nil {
+		return 80, 24
+	}
+	if _, err = fmt.Sscan(out, &h, &w); err != nil || w <= 0 || h <= 0 {
+		return 80, 24
+	}
+	return w, h
+}
+
+// Write writes to the terminal.
+func (t *terminal) Write(p []byte) (int, error) {
+	return t.tty.Write(p)
+}
+
+// close restores the screen and terminal settings.
+func (t *terminal) close() {
+	fmt.Fprint(t.tty, "\x1b[?1049l")
+	t.stty(t.state)
+	t.tty.Close()
+}
+
+// keys reads the terminal and sends the keys it reads. The channel closes
+// when reading fails.
+func (t *terminal) keys() <-chan key {
+	c := make(chan key, 256)
+	go func() {
+		defer close(c)
+		buf := make([]byte, 256)
+		for {
+			n, err := t.tty.Read(buf)
+			if err != nil {
+				return
+			}
+			for _, k := range parseKeys(buf[:n]) {
+				c <- k
+			}
+		}
+	}()
+	return c
+}
+
+// parseKeys splits what we read from the terminal to keys. An escape
+// sequence arrives in a single read, so an Esc at the end of b is a
+// key press.
+func parseKeys(b []byte) []key {
+	var keys []key
+	for len(b) > 0 {
+		if b[0] == keyEsc && len(b) > 1 {
+			if b[1] == '[' || b[1] == 'O' { // cursor keys
+				n := 2
+				for n < len(b) && (b[n] < 0x40 || b[n] > 0x7e) {
+					n++
+				}
+				if n < len(b) {
+					switch b[n] {
+					case 'A':
+						keys = append(keys, key{r: keyUp})
+					case 'B':
+						keys = append(keys, key{r: keyDown})
+					}
+					n++
+				}
+				b = b[n:]
+				continue
+			}
+			r, n := utf8.DecodeRune(b[1:])
+			keys = append(keys, key{r: r, alt: true})
+			b = b[1+n:]
+			continue
+		}
+		r, n := utf8.DecodeRune(b)
+		keys = append(keys, key{r: r})
+		b = b[n:]
+	}
+	return keys
+}
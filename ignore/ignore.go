@@ -0,0 +1,201 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+/*
+Package ignore decides which command lines bashistdb does not record, much
+like bash's HISTIGNORE and HISTCONTROL=ignorespace.
+
+Patterns are globs that match the whole command line, without its leading
+and trailing spaces: * matches any string, ? any character and [...] a
+character class. Patterns prefixed with "re:" are regular expressions that
+may match any part of the command line. An Ignorer also ignores the command
+lines that pipe history to bashistdb, unless an override keeps them.
+*/
+package ignore
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// builtin are the patterns every Ignorer has: what earlier versions of the
+// hook ran, and you may run by hand, to import history.
+var builtin = []string{`re:^history\b.*\|\s*bashistdb\b`}
+
+// A set is the patterns of a scope.
+type set []*regexp.Regexp
+
+func (s set) match(command string) bool {
+	for _, re := range s {
+		if re.MatchString(command) {
+			return true
+		}
+	}
+	return false
+}
+
+// An override is an IgnoreOverride for the hosts or users that match.
+type override struct {
+	match    *regexp.Regexp
+	patterns set
+	keep     set
+	space    *bool
+}
+
+// An Ignorer reports whether a command line should not be recorded. A nil
+// Ignorer ignores nothing.
+type Ignorer struct {
+	patterns set
+	space    bool
+	hosts    []override
+	users    []override
+}
+
+// New returns an Ignorer for rules.
+func New(rules conf.IgnoreRules) (*Ignorer, error) {
+	ig := &Ignorer{space: rules.IgnoreSpace}
+	var err error
+	if ig.patterns, err = compile(append(builtin, rules.Patterns...)); err != nil {
+		return nil, err
+	}
+	if ig.hosts, err = overrides(rules.Hosts); err != nil {
+		return nil, err
+	}
+	if ig.users, err = overrides(rules.Users); err != nil {
+		return nil, err
+	}
+	return ig, nil
+}
+
+// Ignore reports whether the command line user ran at host should not be
+// recorded. If more overrides match, users' win over hosts' and, for
+// ignorespace, later names in alphabetical order over earlier.
+func (ig *Ignorer) Ignore(user, host, command string) bool {
+	if ig == nil {
+		return false
+	}
+	space := ig.space
+	var keep []set
+	ignored := ig.patterns.match(strings.TrimSpace(command))
+	apply := func(overrides []override, name string) {
+		for _, o := range overrides {
+			if !o.match.MatchString(name) {
+				continue
+			}
+			if o.space != nil {
+				space = *o.space
+			}
+			ignored = ignored || o.patterns.match(strings.TrimSpace(command))
+			keep = append(keep, o.keep)
+		}
+	}
+	apply(ig.hosts, host)
+	apply(ig.users, user)
+
+	for _, k := range keep {
+		if k.match(strings.TrimSpace(command)) {
+			return false
+		}
+	}
+	return ignored || (space && strings.HasPrefix(command, " "))
+}
+
+// overrides compiles m, sorted by name so later ones set ignorespace.
+func overrides(m map[string]conf.IgnoreOverride) ([]override, error) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var list []override
+	for _, name := range names {
+		o := m[name]
+		match, err := glob(name)
+		if err != nil {
+			return nil, errors.New("Bad ignore override " + name + ": " + err.Error())
+		}
+		v := override{match: match, space: o.IgnoreSpace}
+		if v.patterns, err = compile(o.Patterns); err != nil {
+			return nil, err
+		}
+		if v.keep, err = compile(o.Keep); err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func compile(patterns []string) (set, error) {
+	var s set
+	for _, p := range patterns {
+		var re *regexp.Regexp
+		var err error
+		if strings.HasPrefix(p, "re:") {
+			re, err = regexp.Compile(strings.TrimPrefix(p, "re:"))
+		} else {
+			re, err = glob(p)
+		}
+		if err != nil {
+			return nil, errors.New("Bad ignore pattern " + p + ": " + err.Error())
+		}
+		s = append(s, re)
+	}
+	return s, nil
+}
+
+// glob returns a regular expression that matches what pattern matches.
+func glob(pattern string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+	p := []rune(pattern)
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '*':
+			re.WriteString(".*")
+		case '?':
+			re.WriteString(".")
+		case '\\':
+			if i+1 < len(p) {
+				i++
+			}
+			re.WriteString(regexp.QuoteMeta(string(p[i])))
+		case '[':
+			end := i + 1
+			for end < len(p) && p[end] != ']' {
+				end++
+			}
+			if end == len(p) {
+				return nil, errors.New("unclosed character class")
+			}
+			class := string(p[i+1 : end])
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i = end
+		default:
+			re.WriteString(regexp.QuoteMeta(string(p[i])))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
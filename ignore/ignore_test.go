@@ -0,0 +1,71 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package ignore
+
+import (
+	"testing"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+func TestIgnore(t *testing.T) {
+	no := false
+	ig, err := New(conf.IgnoreRules{
+		Patterns:    []string{"ls", "cd *", "[bf]g", `re:^git (status|diff)\b`},
+		IgnoreSpace: true,
+		Hosts:       map[string]conf.IgnoreOverride{"prod-*": {Patterns: []string{"rm *"}, Keep: []string{"ls"}}},
+		Users:       map[string]conf.IgnoreOverride{"root": {IgnoreSpace: &no}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user, host, command string
+		want                bool
+	}{
+		{"me", "laptop", "ls", true},
+		{"me", "laptop", "ls -l", false},
+		{"me", "laptop", "cd /tmp", true},
+		{"me", "laptop", "cd", false},
+		{"me", "laptop", "fg", true},
+		{"me", "laptop", "git status -s", true},
+		{"me", "laptop", "git statusx", false},
+		{"me", "laptop", " make secret", true},
+		{"me", "laptop", "history 1 | bashistdb import", true},
+		{"me", "laptop", "rm -rf build", false},
+		{"me", "prod-1", "rm -rf build", true},
+		{"me", "prod-1", "ls", false},
+		{"root", "laptop", " make secret", false},
+		{"root", "laptop", "cd /", true},
+	}
+	for _, v := range tests {
+		if got := ig.Ignore(v.user, v.host, v.command); got != v.want {
+			t.Errorf("Ignore(%s, %s, %q): wanted %v, got %v", v.user, v.host, v.command, v.want, got)
+		}
+	}
+
+	for _, p := range []string{"[ls", "re:(ls"} {
+		if _, err = New(conf.IgnoreRules{Patterns: []string{p}}); err == nil {
+			t.Errorf("Bad pattern %q should return an error", p)
+		}
+	}
+	var none *Ignorer
+	if none.Ignore("me", "laptop", "ls") {
+		t.Error("A nil Ignorer ignored a command line")
+	}
+}
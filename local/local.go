@@ -20,44 +20,141 @@ package local
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 
 	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/confirm"
 	"github.com/andmarios/bashistdb/database"
-	"github.com/andmarios/bashistdb/llog"
+	"github.com/andmarios/bashistdb/finder"
+	"github.com/andmarios/bashistdb/result"
 )
 
-var log *llog.Logger
-
 // Run is the local process of bashistdb.
-func Run() error {
-	db, err := database.New()
+func Run(cfg *conf.Config) error {
+	// Opening the database migrates it, so we report before we open it.
+	if cfg.Operation == conf.OP_MIGRATE_STATUS {
+		report, err := database.MigrationStatus(cfg.Database)
+		if err != nil {
+			return err
+		}
+		fmt.Println(report)
+		return nil
+	}
+
+	db, err := database.New(cfg)
 	if err != nil {
 		return errors.New("Failed to load database: " + err.Error())
 	}
 	defer db.Close()
 
-	log = conf.Log
-
-	switch conf.Operation {
+	switch cfg.Operation {
 	case conf.OP_IMPORT:
-		r := bufio.NewReader(os.Stdin)
-		stats, err := db.AddFromBuffer(r, conf.User, conf.Hostname)
+		history, err := ioutil.ReadAll(cfg.Stdin)
+		if err != nil {
+			return err
+		}
+		if history, err = database.NormalizeHistory(history, cfg.HistTimeFormat, cfg.Location); err != nil {
+			return err
+		}
+		r := bufio.NewReader(bytes.NewReader(history))
+		stats, err := db.AddFromBuffer(r, cfg.User, cfg.Hostname, cfg.Dir, cfg.Session)
 		if err != nil {
 			return errors.New("Error while processing stdin: " +
 				err.Error())
 		}
 		// We print to log because we usually want this to be quiet
 		// as we may run it every time we hit ENTER in a bash prompt.
-		log.Info.Println(stats)
+		cfg.Log.Info.Println(stats)
 	case conf.OP_QUERY:
-		res, err := db.RunQuery(conf.QParams)
+		res, err := db.RunQuery(cfg.QParams)
 		if err != nil {
 			return err
 		}
 		fmt.Println(string(res))
+	case conf.OP_CONFIRM:
+		return confirm.Run(db.RunQuery, cfg.QParams, os.Stdout, confirm.Terminal)
+	case conf.OP_ADMIN:
+		return admin(db, cfg)
+	case conf.OP_MERGE:
+		report, err := database.MergeDatabase(db, cfg.File, cfg.Key, cfg.Merge)
+		if err != nil {
+			return err
+		}
+		fmt.Println(report)
+	case conf.OP_FIND:
+		return finder.New(source{db}, cfg).Run(os.Stdout)
+	case conf.OP_BACK:
+		rows, err := source{db}.Query(context.Background(), cfg.QParams)
+		if err != nil {
+			return err
+		}
+		// Lastk returns the oldest first. If history is shorter, print nothing.
+		if len(rows) == cfg.QParams.Kappa {
+			fmt.Println(rows[0].Command)
+		}
+	}
+	return nil
+}
+
+// admin runs the maintenance operation of cfg on db.
+func admin(db database.Store, cfg *conf.Config) error {
+	op := cfg.QParams.Type
+	var f *os.File
+	var err error
+	switch op {
+	case conf.BACKUP:
+		if f, err = os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			return err
+		}
+	case conf.RESTORE:
+		if f, err = os.Open(cfg.File); err != nil {
+			return err
+		}
+		defer f.Close()
+		if !cfg.Yes {
+			ok, err := confirm.Terminal("Replace the database with " + cfg.File + "?")
+			if err != nil {
+				return err
+			}
+			if !ok {
+				fmt.Println("Nothing changed.")
+				return nil
+			}
+		}
+	}
+	report, err := database.Maintain(db, op, f, f)
+	if op == conf.BACKUP {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(cfg.File)
+		}
+		report = "Backed up the database to " + cfg.File + "."
 	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
 	return nil
 }
+
+// source lets the finder query a database.
+type source struct {
+	db database.Store
+}
+
+// Query runs a query and decodes its rows.
+func (s source) Query(ctx context.Context, qp conf.QueryParams) ([]result.Row, error) {
+	qp.Format = conf.FORMAT_JSON
+	res, err := s.db.RunQuery(qp)
+	if err != nil {
+		return nil, err
+	}
+	return result.Decode(res)
+}
@@ -21,165 +21,343 @@ package network
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"time"
 
+	"github.com/andmarios/bashistdb/client"
 	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/confirm"
 	"github.com/andmarios/bashistdb/database"
+	"github.com/andmarios/bashistdb/finder"
+	"github.com/andmarios/bashistdb/ignore"
 	"github.com/andmarios/bashistdb/llog"
+	"github.com/andmarios/bashistdb/protocol"
+	"github.com/andmarios/bashistdb/redact"
+	"github.com/andmarios/bashistdb/result"
 	"github.com/andmarios/bashistdb/version"
 )
 
-// Message Types
-const (
-	RESULT  = "result"  // (query) results that should be printed
-	HISTORY = "history" // history to import
-	QUERY   = "query"   // query to run
-	LOGINFO = "info"    // results that should go to log.Info
-)
-
-// A Message is the communication unit between server and client.
-type Message struct {
-	Type     string
-	Payload  []byte
-	User     string
-	Hostname string
-	QParams  conf.QueryParams
-	Version  string
-}
-
-var log *llog.Logger
-var db database.Database
-
-func init() {
-	log = conf.Log
+// A server holds the state of a Serve instance.
+type server struct {
+	db       database.Store
+	log      *llog.Logger
+	key      []byte
+	adminKey []byte
 }
 
 // ServerMode is the server process of bashistdb.
-func ServerMode() error {
-	var err error
-	db, err = database.New()
+func ServerMode(cfg *conf.Config) error {
+	db, err := database.New(cfg)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	s, err := net.Listen("tcp", conf.Address)
+	l, err := net.Listen("tcp", cfg.Address)
 	if err != nil {
 		return err
 	}
-	log.Info.Println("Started listening on:", conf.Address)
+	cfg.Log.Info.Println("Started listening on:", cfg.Address)
+	if cfg.Retention.Enabled() {
+		interval := time.Hour
+		if d, err := conf.ParseAge(cfg.Retention.Interval); err == nil && d > 0 {
+			interval = d
+		}
+		go prune(db, cfg.Retention, interval, cfg.Log)
+	}
+	return Serve(l, db, cfg)
+}
+
+// prune prunes db with rules now and every interval.
+func prune(db database.Store, rules conf.RetentionRules, interval time.Duration, log *llog.Logger) {
+	log.Info.Printf("Pruning with retention policy: %s, every %s.\n", rules, interval)
 	for {
-		conn, err := s.Accept()
+		pruned, err := db.Prune(rules, time.Now(), false)
 		if err != nil {
-			log.Info.Println("ERROR:", err.Error())
+			log.Info.Println("ERROR: Pruning failed:", err.Error())
+		} else if len(pruned) > 0 {
+			log.Info.Printf("Pruned %d command lines.\n", len(pruned))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Serve accepts connections on l and serves them from db. The key and
+// logger are taken from cfg, and so is the admin key, without which admin
+// messages are refused. It returns when l is closed.
+func Serve(l net.Listener, db database.Store, cfg *conf.Config) error {
+	srv := &server{db: db, log: cfg.Log, key: cfg.Key, adminKey: cfg.AdminKey}
+	log := cfg.Log
+	if protocol.LOWMEM {
+		log.Debug.Println("Lowmem build.")
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Info.Println("ERROR:", err.Error())
+				continue
+			}
+			return err
 		}
 		log.Info.Printf("Connection from %s.\n", conn.RemoteAddr())
 		err = db.LogConn(conn.RemoteAddr())
 		if err != nil {
 			log.Info.Println("ERROR:", err.Error())
 		}
-		go handleConn(conn)
+		go srv.handleConn(conn)
 	}
-	//	return nil // go vet doesn't like this...
 }
 
 // ClientMode is the client process fo bashistdb.
-func ClientMode() error {
-	log.Debug.Println("Connecting to: ", conf.Address)
-	conn, err := net.Dial("tcp", conf.Address)
+func ClientMode(cfg *conf.Config) error {
+	c := client.New(cfg.Address, cfg.Key)
+	c.User, c.Hostname, c.Dir, c.Session, c.Log, c.AdminKey = cfg.User, cfg.Hostname, cfg.Dir, cfg.Session, cfg.Log, cfg.AdminKey
+	rd, err := redact.New(cfg.Redact)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-
-	var msg Message
+	c.Redactor = rd
+	ctx := context.Background()
 
-	switch conf.Operation {
+	switch cfg.Operation {
 	case conf.OP_IMPORT: // If Operation == OP_IMPORT, attempt to read from Stdin
-		r := bufio.NewReader(os.Stdin)
-		history, err := ioutil.ReadAll(r)
+		history, err := ioutil.ReadAll(cfg.Stdin)
 		if err != nil {
 			return err
 		}
-
-		msg = Message{Type: HISTORY, Payload: history, User: conf.User,
-			Hostname: conf.Hostname}
-
-		log.Info.Println("Sent history.")
+		// The server reads only our timestamps, and it may be in another
+		// time zone.
+		if history, err = database.NormalizeHistory(history, cfg.HistTimeFormat, cfg.Location); err != nil {
+			return err
+		}
+		// The server has its own ignore rules; ours keep lines from
+		// leaving this computer.
+		ig, err := ignore.New(cfg.Ignore)
+		if err != nil {
+			return err
+		}
+		if history, _ = database.FilterHistory(history, cfg.User, cfg.Hostname, ig.Ignore); len(bytes.TrimSpace(history)) == 0 {
+			return nil
+		}
+		_, err = c.Import(ctx, history)
+		return err
 	case conf.OP_QUERY:
-		msg = Message{Type: QUERY, User: conf.User, Hostname: conf.Hostname, QParams: conf.QParams}
+		res, err := c.RunQuery(ctx, cfg.QParams)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(res))
+	case conf.OP_CONFIRM:
+		return confirm.Run(func(qp conf.QueryParams) ([]byte, error) { return c.RunQuery(ctx, qp) }, cfg.QParams, os.Stdout, confirm.Terminal)
+	case conf.OP_ADMIN:
+		return clientAdmin(ctx, c, cfg)
+	case conf.OP_FOLLOW:
+		return c.Follow(ctx, cfg.QParams, func(line []byte) error {
+			fmt.Println(string(line))
+			return nil
+		})
+	case conf.OP_FIND:
+		return finder.New(c, cfg).Run(os.Stdout)
+	case conf.OP_BACK:
+		rows, err := c.Query(ctx, cfg.QParams)
+		if err != nil {
+			return err
+		}
+		// Lastk returns the oldest first. If history is shorter, print nothing.
+		if len(rows) == cfg.QParams.Kappa {
+			fmt.Println(rows[0].Command)
+		}
 	default:
 		return errors.New("unknown function")
 	}
-
-	msg.Version = version.Version
-
-	if err := encryptDispatch(conn, msg); err != nil {
-		return err
-	}
-	log.Info.Println("Sent request.")
-
-	reply, err := receiveDecrypt(conn)
-	if err != nil {
-		return err
-	}
-
-	if reply.Version != version.Version {
-		log.Info.Println("Server runs different bashistdb version from client:", reply.Version)
-	}
-
-	switch reply.Type {
-	case RESULT:
-		fmt.Println(string(reply.Payload))
-	case LOGINFO:
-		log.Info.Println("Received:", string(reply.Payload))
-	}
 	return nil
 }
 
 // handleConn is the server code that handles clients (reads message type and performs relevant operation)
-func handleConn(conn net.Conn) {
+func (s *server) handleConn(conn net.Conn) {
 	defer conn.Close()
 
-	msg, err := receiveDecrypt(conn)
+	msg, err := protocol.Receive(conn, s.key)
 	if err != nil {
-		log.Info.Println(err, "["+conn.RemoteAddr().String()+"]")
+		s.log.Info.Println(err, "["+conn.RemoteAddr().String()+"]")
 		return
 	}
 	if msg.Version != version.Version {
-		log.Info.Println("Client runs different bashistdb version from server:", msg.Version)
+		s.log.Info.Println("Client runs different bashistdb version from server:", msg.Version)
 	}
 
-	var result []byte
+	reply := protocol.Message{Type: protocol.RESULT, Version: version.Version}
 	switch msg.Type {
-	case HISTORY:
+	case protocol.SUBSCRIBE:
+		s.follow(conn, msg)
+		return
+	case protocol.HISTORY:
 		r := bufio.NewReader(bytes.NewReader(msg.Payload))
-		res, err := db.AddFromBuffer(r, msg.User, msg.Hostname)
+		res, err := s.db.AddFromBuffer(r, msg.User, msg.Hostname, msg.Dir, msg.Session)
 		if err != nil {
-			result = []byte(err.Error())
+			s.log.Info.Println("ERROR:", err.Error())
+			reply.Type, reply.Payload = protocol.ERROR, []byte(err.Error())
+		} else {
+			reply.Type, reply.Payload = protocol.LOGINFO, []byte(res)
+			s.log.Info.Println("Client sent history: ", res)
+		}
+	case protocol.QUERY:
+		if protocol.Admin(msg.QParams.Type) {
+			err = errors.New("The " + msg.QParams.Type + " query needs an admin message.")
 		} else {
-			result = []byte(res)
+			reply.Payload, err = s.db.RunQuery(msg.QParams)
 		}
-		log.Info.Println("Client sent history: ", res)
-	case QUERY:
-		result, err = db.RunQuery(msg.QParams)
 		if err != nil {
-			log.Info.Println("ERROR:", err.Error())
-			result = []byte(err.Error())
+			s.log.Info.Println("ERROR:", err.Error())
+			reply.Type, reply.Payload = protocol.ERROR, []byte(err.Error())
 		}
-		log.Info.Printf("Client sent %s query for '%s' as '%s'@'%s', '%s' format.\n",
+		s.log.Info.Printf("Client sent %s query for '%s' as '%s'@'%s', '%s' format.\n",
 			msg.Type, msg.QParams.User, msg.QParams.Host, msg.QParams.Command, msg.QParams.Format)
+	case protocol.PING:
+		reply.Payload = []byte(time.Now().Format(time.RFC3339Nano))
+	case protocol.ADMIN:
+		reply.Payload, err = s.admin(msg)
+		if err != nil {
+			s.log.Info.Println("ERROR:", err.Error())
+			reply.Type, reply.Payload = protocol.ERROR, []byte(err.Error())
+		}
+		s.log.Info.Printf("Client sent %s admin message.\n", msg.QParams.Type)
+	default:
+		reply.Type, reply.Payload = protocol.ERROR, []byte("Unknown message type: "+msg.Type)
+	}
+
+	if err := protocol.Send(conn, reply, s.key); err != nil {
+		s.log.Println(err)
 	}
+}
 
-	reply := Message{Type: RESULT, Payload: result, Version: version.Version}
-	if msg.Type == HISTORY {
-		reply.Type = LOGINFO
+// admin is the server code that runs maintenance operations and admin
+// queries. A backup's reply payload is the backup, the rest reply with their
+// report.
+func (s *server) admin(msg protocol.Message) ([]byte, error) {
+	if len(s.adminKey) == 0 {
+		return nil, errors.New("Admin messages are disabled, start the server with an admin key.")
+	}
+	if subtle.ConstantTimeCompare(msg.AdminKey, s.adminKey) != 1 {
+		return nil, errors.New("Wrong admin key.")
+	}
+	if protocol.Admin(msg.QParams.Type) {
+		return s.db.RunQuery(msg.QParams)
 	}
-	if err := encryptDispatch(conn, reply); err != nil {
-		log.Println(err)
+	var backup bytes.Buffer
+	report, err := database.Maintain(s.db, msg.QParams.Type, bytes.NewReader(msg.Payload), &backup)
+	if err != nil {
+		return nil, err
+	}
+	if msg.QParams.Type == conf.BACKUP {
+		return backup.Bytes(), nil
+	}
+	return []byte(report), nil
+}
+
+// clientAdmin runs the maintenance operation of cfg on the server of c.
+func clientAdmin(ctx context.Context, c *client.Client, cfg *conf.Config) error {
+	var report string
+	var err error
+	switch cfg.QParams.Type {
+	case conf.BACKUP:
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		backup, err := c.Backup(ctx)
+		if err == nil {
+			_, err = f.Write(backup)
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(cfg.File)
+			return err
+		}
+		report = "Backed up the database to " + cfg.File + "."
+	case conf.RESTORE:
+		backup, err := ioutil.ReadFile(cfg.File)
+		if err != nil {
+			return err
+		}
+		if !cfg.Yes {
+			ok, err := confirm.Terminal("Replace the server's database with " + cfg.File + "?")
+			if err != nil {
+				return err
+			}
+			if !ok {
+				fmt.Println("Nothing changed.")
+				return nil
+			}
+		}
+		report, err = c.Restore(ctx, backup)
+	case conf.CHECK:
+		report, err = c.Check(ctx)
+	case conf.VACUUM:
+		report, err = c.Vacuum(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
+	return nil
+}
+
+// follow is the server code that handles subscriptions. It sends to the
+// client every new history line that matches its query, until the client
+// disconnects.
+func (s *server) follow(conn net.Conn, msg protocol.Message) {
+	sub, err := s.db.Subscribe(msg.QParams)
+	if err != nil {
+		s.log.Info.Println("ERROR:", err.Error())
+		reply := protocol.Message{Type: protocol.ERROR, Payload: []byte(err.Error()), Version: version.Version}
+		if err := protocol.Send(conn, reply, s.key); err != nil {
+			s.log.Println(err)
+		}
+		return
+	}
+	defer sub.Close()
+	s.log.Info.Printf("Client subscribed for '%s' as '%s'@'%s', '%s' format.\n",
+		msg.QParams.Command, msg.QParams.User, msg.QParams.Host, msg.QParams.Format)
+
+	reply := protocol.Message{Type: protocol.LOGINFO, Payload: []byte("Subscribed."), Version: version.Version}
+	if err := protocol.Send(conn, reply, s.key); err != nil {
+		s.log.Info.Println(err, "["+conn.RemoteAddr().String()+"]")
+		return
+	}
+
+	// Clients do not send anything after subscribing, so a read returns
+	// only when they disconnect.
+	gone := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, conn)
+		close(gone)
+	}()
+
+	for {
+		select {
+		case r := <-sub.C:
+			res := result.New(msg.QParams.Format)
+			res.AddRow(r.Row, r.User, r.Host, r.Command, r.Datetime)
+			reply := protocol.Message{Type: protocol.RESULT, Payload: res.Formatted(), Version: version.Version}
+			if err := protocol.Send(conn, reply, s.key); err != nil {
+				s.log.Info.Println(err, "["+conn.RemoteAddr().String()+"]")
+				return
+			}
+		case <-gone:
+			s.log.Info.Println("Subscriber disconnected.", "["+conn.RemoteAddr().String()+"]")
+			return
+		}
 	}
 }
@@ -17,24 +17,22 @@
 //      You should have received a copy of the GNU General Public License
 // along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
 
-package network
+package protocol
 
 import (
 	"bytes"
 	"encoding/gob"
-	"net"
+	"io"
 	"runtime/debug"
 
 	"github.com/andmarios/crypto/nacl/saltsecret"
-
-	conf "github.com/andmarios/bashistdb/configuration"
 )
 
-func init() {
-	conf.Log.Debug.Println("Lowmem build.")
-}
+// LOWMEM is set in lowmem builds, so we may log it.
+const LOWMEM = true
 
-func encryptDispatch(conn net.Conn, m Message) error {
+// Send encrypts m with key and writes it to w.
+func Send(w io.Writer, m Message, key []byte) error {
 	// We want to sent encrypted data.
 	// In order to encrypt, we need to first serialize the message.
 	// In order to sent/receive hassle free, we need to serialize the encrypted message
@@ -42,7 +40,7 @@ func encryptDispatch(conn net.Conn, m Message) error {
 
 	// Create encrypter
 	var encMsg bytes.Buffer
-	encrypter, err := saltsecret.NewWriter(&encMsg, conf.Key, saltsecret.ENCRYPT, true)
+	encrypter, err := saltsecret.NewWriter(&encMsg, key, saltsecret.ENCRYPT, true)
 	if err != nil {
 		return err
 	}
@@ -59,7 +57,7 @@ func encryptDispatch(conn net.Conn, m Message) error {
 	}
 
 	// Serialize encrypted message and dispatch it
-	dispatch := gob.NewEncoder(conn)
+	dispatch := gob.NewEncoder(w)
 	if err = dispatch.Encode(encMsg.Bytes()); err != nil {
 		return err
 	}
@@ -67,20 +65,22 @@ func encryptDispatch(conn net.Conn, m Message) error {
 	return nil
 }
 
-func receiveDecrypt(conn net.Conn) (Message, error) {
+// Receive reads a message from r and decrypts it with key. To read
+// many messages from a connection, pass the same buffered reader each time,
+// since the gob decoder may otherwise read ahead and lose data.
+func Receive(r io.Reader, key []byte) (Message, error) {
 	// Our work is:
 	// (receive) -> [de-GOB] -> [DECRYPT] -> [de-GOB] -> msg
 
 	// Receive data and de-serialize to get the encrypted message
 	encMsg := new([]byte)
-	receive := gob.NewDecoder(conn)
+	receive := gob.NewDecoder(r)
 	if err := receive.Decode(encMsg); err != nil {
 		return Message{}, err
 	}
 
 	// Create decrypter and pass it the encrypted message
-	r := bytes.NewReader(*encMsg)
-	decrypter, err := saltsecret.NewReader(r, conf.Key, saltsecret.DECRYPT, false)
+	decrypter, err := saltsecret.NewReader(bytes.NewReader(*encMsg), key, saltsecret.DECRYPT, false)
 	if err != nil {
 		return Message{}, err
 	}
@@ -0,0 +1,72 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+/*
+Package protocol implements the messages bashistdb servers and clients
+exchange. Every message is serialized with gob, encrypted with a key
+derived from the user's passphrase and serialized again, so it can be
+sent over any stream.
+*/
+package protocol
+
+import (
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// Message Types
+const (
+	RESULT    = "result"    // (query) results that should be printed
+	HISTORY   = "history"   // history to import
+	QUERY     = "query"     // query to run
+	LOGINFO   = "info"      // results that should go to log.Info
+	SUBSCRIBE = "subscribe" // subscribe to new history lines
+	ERROR     = "error"     // the request failed, payload is the error message; clients before it print nothing
+	PING      = "ping"      // check the connection, reply payload is the server's time
+	ADMIN     = "admin"     // maintenance operation or admin query in QParams.Type, payload is the backup to restore
+)
+
+// adminQueries are the query types that change or delete stored history in
+// bulk, or who it belongs to. They go in ADMIN messages, with the admin key.
+// Delete and undelete move given rows only, so they need no key.
+var adminQueries = map[string]bool{
+	conf.REDACT:       true,
+	conf.PURGE:        true,
+	conf.PRUNE:        true,
+	conf.DELETE_QUERY: true,
+	conf.DELETE_TYPOS: true,
+	conf.PURGE_TRASH:  true,
+	conf.ALIAS:        true,
+	conf.RENAME:       true,
+}
+
+// Admin reports whether queries of type queryType need an ADMIN message.
+func Admin(queryType string) bool {
+	return adminQueries[queryType]
+}
+
+// A Message is the communication unit between server and client.
+type Message struct {
+	Type     string
+	Payload  []byte
+	User     string
+	Hostname string
+	Dir      string // working directory of imported history, may be empty
+	Session  string // shell session of imported history, may be empty
+	QParams  conf.QueryParams
+	Version  string
+	AdminKey []byte // authenticates admin messages
+}
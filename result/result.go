@@ -39,6 +39,9 @@ const (
 	FORMAT_ROWS_S         = "%d"
 )
 
+// CONTENT_SEPARATOR separates the matches of a content query.
+const CONTENT_SEPARATOR = "\n------------------\n"
+
 // A Result is used to store the formatted output of a query.
 // Result's methods are responsible for formatting according to
 // requested output format.
@@ -69,6 +72,60 @@ type rowJSON struct {
 	Datetime, User, Host, Command string
 }
 
+// A countJSON is rowJSON's counterpart for count rows.
+type countJSON struct {
+	Count   int
+	Command string
+}
+
+// A userJSON is rowJSON's counterpart for user rows.
+type userJSON struct {
+	User, Host string
+}
+
+// A Row is a decoded JSON result row. Depending on the query, some fields
+// may not be set; count queries set only Count and Command, users queries
+// only User and Host.
+type Row struct {
+	Row      int
+	Count    int
+	User     string
+	Host     string
+	Command  string
+	Datetime time.Time
+}
+
+// Decode decodes a JSON formatted result to rows. Content queries return
+// a JSON array for each match; their rows are returned one after the other.
+// A content query without matches returns nothing, so is decoded to no rows.
+func Decode(b []byte) ([]Row, error) {
+	var rows []Row
+	for _, part := range bytes.Split(b, []byte(CONTENT_SEPARATOR)) {
+		if len(bytes.TrimSpace(part)) == 0 {
+			continue
+		}
+		var in []struct {
+			Row, Count                    int
+			Datetime, User, Host, Command string
+		}
+		if err := json.Unmarshal(part, &in); err != nil {
+			return nil, err
+		}
+		for _, v := range in {
+			r := Row{Row: v.Row, Count: v.Count, User: v.User, Host: v.Host, Command: v.Command}
+			if v.Datetime != "" {
+				t, err := time.Parse(RFC3339alt, v.Datetime)
+				if err != nil {
+					return nil, err
+				}
+				r.Datetime = t
+			}
+			rows = append(rows, r)
+		}
+	}
+	return rows, nil
+}
+
 // AddRow adds a query row to a Result struct. This function is not thread safe!
 func (r Result) AddRow(row int, user, host string, command string, datetime time.Time) {
 	var f string
@@ -115,7 +172,7 @@ func (r Result) AddRow(row int, user, host string, command string, datetime time
 
 // Formatted returns the result in the desired format after performing any necessary adjustment.
 func (r Result) Formatted() []byte {
-	if conf.QParams.Format == conf.FORMAT_JSON {
+	if r.format == conf.FORMAT_JSON {
 		r.out.WriteString("\n]")
 	}
 	return r.out.Bytes()
@@ -128,17 +185,49 @@ func (r Result) AddCountRow(count int, command string) {
 
 	switch *r.written {
 	case true:
+		if r.format == conf.FORMAT_JSON {
+			_, _ = r.out.WriteString(",")
+		}
 		_, _ = r.out.WriteString("\n")
 	default:
 		*r.written = true
 		*r.digits = digits(count)
 	}
 
-	f = fmt.Sprintf("%[2]*.[1]d | %[3]s", count, *r.digits, command)
+	switch r.format {
+	case conf.FORMAT_JSON:
+		b, _ := json.Marshal(countJSON{count, command})
+		_, _ = r.out.Write(b)
+		f = ""
+	default:
+		f = fmt.Sprintf("%[2]*.[1]d | %[3]s", count, *r.digits, command)
+	}
 
 	r.out.WriteString(f)
 }
 
+// AddUserRow adds a user@host row to a Result struct. This function is not thread safe!
+// It is used by Users database function.
+func (r Result) AddUserRow(user, host string) {
+	switch *r.written {
+	case true:
+		if r.format == conf.FORMAT_JSON {
+			_, _ = r.out.WriteString(",")
+		}
+		_, _ = r.out.WriteString("\n")
+	default:
+		*r.written = true
+	}
+
+	switch r.format {
+	case conf.FORMAT_JSON:
+		b, _ := json.Marshal(userJSON{user, host})
+		_, _ = r.out.Write(b)
+	default:
+		r.out.WriteString(user + "@" + host)
+	}
+}
+
 func digits(n int) int {
 	if n < 10 {
 		return 1
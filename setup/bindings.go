@@ -0,0 +1,166 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package setup
+
+import (
+	"fmt"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// Key bindings for each shell. Ctrl-R runs the interactive search and puts
+// the selected command line in the prompt. The shell's own reverse search
+// stays available on its other bindings.
+const (
+	bashFind = `__bashistdb_find() {
+    local line
+    line=$(bashistdb find -- "$READLINE_LINE") || return
+    [ -n "$line" ] && READLINE_LINE=$line && READLINE_POINT=${#line}
+}
+bind -x '"\C-r": __bashistdb_find'
+`
+	zshFind = `__bashistdb_find() {
+    local line
+    line=$(bashistdb find -- "$BUFFER" </dev/tty)
+    [[ -n "$line" ]] && BUFFER=$line && CURSOR=${#BUFFER}
+    zle reset-prompt
+}
+zle -N __bashistdb_find
+bindkey '^R' __bashistdb_find
+`
+	fishFind = `function __bashistdb_find
+    set -l line (bashistdb find -- (commandline | string collect) </dev/tty | string collect)
+    test -n "$line"; and commandline -r -- $line
+    commandline -f repaint
+end
+bind \cr __bashistdb_find
+`
+)
+
+// Up and down arrow bindings. They keep how many steps back in history
+// they are; typing or running a command line starts over. %[1]s is the
+// bashistdb back command with its scope flags.
+const (
+	bashUp = `__bashistdb_up() {
+    [ "$READLINE_LINE" != "$__bashistdb_line" ] && __bashistdb_n=0
+    local line
+    line=$(%[1]s $((${__bashistdb_n:-0} + 1)) 2>/dev/null)
+    if [ -n "$line" ]; then
+        __bashistdb_n=$((${__bashistdb_n:-0} + 1))
+        READLINE_LINE=$line
+        READLINE_POINT=${#line}
+    fi
+    __bashistdb_line=$READLINE_LINE
+}
+__bashistdb_down() {
+    [ "$READLINE_LINE" != "$__bashistdb_line" ] && __bashistdb_n=0
+    [ "${__bashistdb_n:-0}" -eq 0 ] && return
+    __bashistdb_n=$((__bashistdb_n - 1))
+    local line=""
+    [ "$__bashistdb_n" -gt 0 ] && line=$(%[1]s $__bashistdb_n 2>/dev/null)
+    READLINE_LINE=$line
+    READLINE_POINT=${#line}
+    __bashistdb_line=$line
+}
+bind -x '"\e[A": __bashistdb_up'
+bind -x '"\eOA": __bashistdb_up'
+bind -x '"\e[B": __bashistdb_down'
+bind -x '"\eOB": __bashistdb_down'
+`
+	zshUp = `__bashistdb_up() {
+    [[ "$BUFFER" != "$__bashistdb_line" ]] && __bashistdb_n=0
+    local line
+    line=$(%[1]s $((${__bashistdb_n:-0} + 1)) 2>/dev/null)
+    if [[ -n "$line" ]]; then
+        __bashistdb_n=$((${__bashistdb_n:-0} + 1))
+        BUFFER=$line
+        CURSOR=${#BUFFER}
+    fi
+    __bashistdb_line=$BUFFER
+}
+__bashistdb_down() {
+    [[ "$BUFFER" != "$__bashistdb_line" ]] && __bashistdb_n=0
+    (( ${__bashistdb_n:-0} == 0 )) && return
+    __bashistdb_n=$((__bashistdb_n - 1))
+    local line=""
+    (( __bashistdb_n > 0 )) && line=$(%[1]s $__bashistdb_n 2>/dev/null)
+    BUFFER=$line
+    CURSOR=${#BUFFER}
+    __bashistdb_line=$BUFFER
+}
+zle -N __bashistdb_up
+zle -N __bashistdb_down
+bindkey '^[[A' __bashistdb_up
+bindkey '^[OA' __bashistdb_up
+bindkey '^[[B' __bashistdb_down
+bindkey '^[OB' __bashistdb_down
+`
+	fishUp = `set -g __bashistdb_n 0
+set -g __bashistdb_line ""
+function __bashistdb_up
+    set -l current (commandline | string collect)
+    test "$current" != "$__bashistdb_line"; and set -g __bashistdb_n 0
+    set -l n (math $__bashistdb_n + 1)
+    set -l line (%[1]s $n 2>/dev/null | string collect)
+    if test -n "$line"
+        set -g __bashistdb_n $n
+        commandline -r -- $line
+    end
+    set -g __bashistdb_line (commandline | string collect)
+end
+function __bashistdb_down
+    set -l current (commandline | string collect)
+    test "$current" != "$__bashistdb_line"; and set -g __bashistdb_n 0
+    test $__bashistdb_n -gt 0; or return
+    set -g __bashistdb_n (math $__bashistdb_n - 1)
+    set -l line ""
+    test $__bashistdb_n -gt 0; and set line (%[1]s $__bashistdb_n 2>/dev/null | string collect)
+    commandline -r -- "$line"
+    set -g __bashistdb_line (commandline | string collect)
+end
+bind \e\[A __bashistdb_up
+bind \eOA __bashistdb_up
+bind \e\[B __bashistdb_down
+bind \eOB __bashistdb_down
+`
+)
+
+// keyBindings returns the key bindings for the shell and up arrow scope
+// of s.
+func keyBindings(s conf.SetupParams) string {
+	find, up := bashFind, bashUp
+	back := `bashistdb back`
+	if s.Up == conf.UP_DIR {
+		back += ` -dir "$PWD"`
+	}
+	switch s.Shell {
+	case conf.SHELL_ZSH:
+		find, up = zshFind, zshUp
+	case conf.SHELL_FISH:
+		find, up = fishFind, fishUp
+		if s.Up == conf.UP_DIR {
+			back = `bashistdb back -dir $PWD`
+		}
+	}
+
+	bindings := "# bashistdb key bindings\n" + find
+	if s.Up != "" {
+		bindings += fmt.Sprintf(up, back)
+	}
+	return bindings
+}
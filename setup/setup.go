@@ -17,51 +17,147 @@
 
 /*
 Package setup provides functions to setup your system for bashistdb.
+
+Setup keeps everything it adds to your shell's rc file in a block between
+two marker lines. Running it again replaces the block, so it is safe to run
+many times, and uninstalling removes it.
 */
 package setup
 
 import (
+	"bytes"
 	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	conf "github.com/andmarios/bashistdb/configuration"
-	"github.com/andmarios/bashistdb/llog"
 	"github.com/andmarios/bashistdb/tools/addTimestamp2Hist/timestamp"
 )
 
-const appendLines = `export HISTTIMEFORMAT="%FT%T%z "
+// blockVersion is the version of the rc block. Increase it when the
+// contents of the block change in a way users should notice.
+const blockVersion = 2
+
+// Markers of the rc block. The begin marker is followed by the version.
+const (
+	blockBegin = "# >>> bashistdb block"
+	blockEnd   = "# <<< bashistdb block <<<"
+)
+
+// legacyLines are what earlier versions appended to ~/.bashrc on every
+// run. We remove them when we install or uninstall the block.
+var legacyLines = []string{
+	`export HISTTIMEFORMAT="%FT%T%z "
 [ ! -z "${PROMPT_COMMAND}" ] && export PROMPT_COMMAND="${PROMPT_COMMAND};"
 export PROMPT_COMMAND="${PROMPT_COMMAND} (history 1 | bashistdb 2>/dev/null &)"
+`,
+	`export HISTTIMEFORMAT="%FT%T%z "
+[ ! -z "${PROMPT_COMMAND}" ] && export PROMPT_COMMAND="${PROMPT_COMMAND};"
+export PROMPT_COMMAND="${PROMPT_COMMAND} (history 1 | bashistdb import 2>/dev/null &)"
+`,
+}
+
+// Hooks that send each command line to bashistdb, with the directory it
+// ran in and the shell session: the time the shell started and its pid,
+// kept if the rc file is sourced again but not passed to child shells. Bash
+// sends its last history line from PROMPT_COMMAND, so history needs to be
+// timestamped; the block sets HISTTIMEFORMAT unless you use another. Zsh and
+// fish keep the command line and the time before it runs and send it after
+// it finishes.
+const (
+	bashHook = `__bashistdb_session=${__bashistdb_session:-$(date +%s)-$$}
+case "$PROMPT_COMMAND" in
+    *__bashistdb_hook*) ;;
+    *) PROMPT_COMMAND="__bashistdb_hook${PROMPT_COMMAND:+; $PROMPT_COMMAND}" ;;
+esac
+__bashistdb_hook() {
+    (history 1 | bashistdb import -dir "$PWD" -session "$__bashistdb_session" >/dev/null 2>&1 &)
+}
 `
+	zshHook = `zmodload zsh/datetime
+__bashistdb_session=${__bashistdb_session:-$EPOCHSECONDS-$$}
+autoload -Uz add-zsh-hook
+__bashistdb_preexec() {
+    __bashistdb_cmd=$1
+    __bashistdb_dir=$PWD
+    strftime -s __bashistdb_time '%Y-%m-%dT%H:%M:%S%z' $EPOCHSECONDS
+}
+__bashistdb_precmd() {
+    [[ -n "$__bashistdb_cmd" ]] || return
+    (print -r -- "1 $__bashistdb_time $__bashistdb_cmd" | bashistdb import -dir "$__bashistdb_dir" -session "$__bashistdb_session" >/dev/null 2>&1 &)
+    unset __bashistdb_cmd
+}
+add-zsh-hook preexec __bashistdb_preexec
+add-zsh-hook precmd __bashistdb_precmd
+`
+	fishHook = `set -q __bashistdb_session; or set -g __bashistdb_session (date +%s)-$fish_pid
+function __bashistdb_preexec --on-event fish_preexec
+    set -g __bashistdb_time (date +%Y-%m-%dT%H:%M:%S%z)
+    set -g __bashistdb_dir $PWD
+end
+function __bashistdb_postexec --on-event fish_postexec
+    test -n "$argv[1]"; or return
+    printf '1 %s %s\n' $__bashistdb_time "$argv[1]" | bashistdb import -dir $__bashistdb_dir -session $__bashistdb_session >/dev/null 2>&1 &
+    disown 2>/dev/null
+end
+`
+)
 
-var log *llog.Logger
+// rcFiles are the rc files of each shell, relative to HOME.
+var rcFiles = map[string]string{
+	conf.SHELL_BASH: ".bashrc",
+	conf.SHELL_ZSH:  ".zshrc",
+	conf.SHELL_FISH: ".config/fish/config.fish",
+}
 
-func init() {
-	log = conf.Log
+// hooks are the hooks of each shell.
+var hooks = map[string]string{
+	conf.SHELL_BASH: bashHook,
+	conf.SHELL_ZSH:  zshHook,
+	conf.SHELL_FISH: fishHook,
 }
 
 // Apply configures your system to use bashistdb:
-// 1. It appends to your ~/.bashrc two lines to make your history timestamped
-//    and your prompt send your commands to bashistdb.
-// 2. It (optionally) adds timestamps to your current history file, so it can
-//    be used with bashistdb. This step is also safe to run many times.
-func Apply(write bool) error {
-	// Setup bashrc for bashistdb
-	bashrc := os.Getenv("HOME") + "/.bashrc"
-	f, err := os.OpenFile(bashrc, os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		return errors.New("Could not open bashrc: " + err.Error())
+// 1. It installs to your shell's rc file the bashistdb block: hooks that send
+//    your commands to bashistdb and, if asked in cfg.Setup, key bindings.
+//    An existing block is replaced.
+// 2. For bash, it (optionally) adds timestamps to your current history file,
+//    so it can be used with bashistdb. The file is backed up first. This step
+//    is also safe to run many times.
+// If cfg.Setup.Uninstall is set, it removes the block instead.
+func Apply(cfg *conf.Config, write bool) error {
+	log := cfg.Log
+	s := cfg.Setup
+	if s.Shell == "" {
+		s.Shell = conf.SHELL_BASH
+	}
+	rc := filepath.Join(os.Getenv("HOME"), rcFiles[s.Shell])
+
+	if s.Uninstall {
+		removed, err := uninstallBlock(rc)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			log.Println("No bashistdb block in " + rc + ".")
+			return nil
+		}
+		log.Println("Removed the bashistdb block from " + rc + ".")
+		return nil
 	}
-	defer f.Close()
 
-	if _, err = f.WriteString(appendLines); err != nil {
-		return errors.New("Could not write bashrc: " + err.Error())
+	b := block(s, cfg.HistTimeFormat)
+	if err := installBlock(rc, b); err != nil {
+		return err
 	}
-	log.Println("Updated " + bashrc + ", appended: \n" + appendLines)
+	log.Println("Updated " + rc + ", installed:\n" + b)
 
 	// Convert bash_history
-	if write {
+	if write && s.Shell == conf.SHELL_BASH {
 		bashHistory := os.Getenv("HOME") + "/.bash_history"
 		historyIn, err := ioutil.ReadFile(bashHistory)
 		if err != nil {
@@ -69,6 +165,15 @@ func Apply(write bool) error {
 		}
 
 		historyOut := timestamp.Convert(historyIn, 12)
+		if bytes.Equal(historyIn, historyOut) {
+			return nil
+		}
+
+		backup := bashHistory + ".bashistdb-" + time.Now().Format("20060102150405")
+		if err = ioutil.WriteFile(backup, historyIn, 0600); err != nil {
+			return errors.New("Could not back up bash_history: " + err.Error())
+		}
+		log.Println("Backed up " + bashHistory + " to " + backup)
 
 		err = ioutil.WriteFile(bashHistory, historyOut, 0600)
 		if err != nil {
@@ -79,3 +184,148 @@ func Apply(write bool) error {
 
 	return nil
 }
+
+// block returns the rc block for s. Bash's HISTTIMEFORMAT is left alone if
+// you have set another; bashistdb reads that from its configuration file.
+func block(s conf.SetupParams, histTimeFormat string) string {
+	b := blockBegin + " v" + strconv.Itoa(blockVersion) + " >>>\n" +
+		"# Managed by 'bashistdb init', changes will be lost. Remove it with\n" +
+		"# 'bashistdb init -uninstall'.\n"
+	if s.Shell == conf.SHELL_BASH && (histTimeFormat == "" || histTimeFormat == conf.HISTTIMEFORMAT_DEFAULT) {
+		b += `export HISTTIMEFORMAT="` + conf.HISTTIMEFORMAT_DEFAULT + `"` + "\n"
+	}
+	b += hooks[s.Shell]
+	if s.Keys {
+		b += keyBindings(s)
+	}
+	return b + blockEnd + "\n"
+}
+
+// installBlock writes b to the rc file, in place of the block that is already
+// there or at the end. It creates the file if needed.
+func installBlock(rc, b string) error {
+	content, err := readRC(rc)
+	if err != nil {
+		return err
+	}
+	rest, i, err := removeBlock(content)
+	if err != nil {
+		return errors.New(rc + ": " + err.Error())
+	}
+	if i < 0 { // no block, append
+		if len(rest) > 0 && !strings.HasSuffix(rest, "\n") {
+			rest += "\n"
+		}
+		i = len(rest)
+	}
+	if err = os.MkdirAll(filepath.Dir(rc), 0700); err != nil {
+		return errors.New("Could not create " + filepath.Dir(rc) + ": " + err.Error())
+	}
+	return writeRC(rc, rest[:i]+b+rest[i:])
+}
+
+// uninstallBlock removes the block from the rc file. It reports whether
+// there was anything to remove.
+func uninstallBlock(rc string) (bool, error) {
+	content, err := readRC(rc)
+	if err != nil {
+		return false, err
+	}
+	rest, _, err := removeBlock(content)
+	if err != nil {
+		return false, errors.New(rc + ": " + err.Error())
+	}
+	if rest == content {
+		return false, nil
+	}
+	return true, writeRC(rc, rest)
+}
+
+// removeBlock returns content without the bashistdb block and the lines of
+// earlier versions, and the offset where the block was, or -1.
+func removeBlock(content string) (rest string, at int, err error) {
+	for _, l := range legacyLines {
+		content = strings.Replace(content, l, "", -1)
+	}
+
+	at = -1
+	lines := strings.SplitAfter(content, "\n")
+	var out bytes.Buffer
+	in := false
+	for _, l := range lines {
+		switch {
+		case strings.HasPrefix(l, blockBegin):
+			if in {
+				return "", -1, errors.New("bashistdb block begins twice, please fix it by hand.")
+			}
+			in = true
+			if at < 0 {
+				at = out.Len()
+			}
+		case strings.HasPrefix(l, blockEnd):
+			if !in {
+				return "", -1, errors.New("bashistdb block ends without beginning, please fix it by hand.")
+			}
+			in = false
+		case !in:
+			out.WriteString(l)
+		}
+	}
+	if in {
+		return "", -1, errors.New("bashistdb block does not end, please fix it by hand.")
+	}
+	return out.String(), at, nil
+}
+
+// An Install describes what bashistdb has installed in a shell's rc file.
+type Install struct {
+	RC      string // RC is the rc file
+	Blocks  int    // Blocks is the number of bashistdb blocks
+	Version int    // Version is the version of the first block
+	Current bool   // Current is set if Version is the version init installs
+	Legacy  int    // Legacy is how many times the lines of earlier versions appear
+}
+
+// Inspect reports what is installed in the rc file of shell.
+func Inspect(shell string) (Install, error) {
+	in := Install{RC: filepath.Join(os.Getenv("HOME"), rcFiles[shell])}
+	content, err := readRC(in.RC)
+	if err != nil {
+		return in, err
+	}
+	for _, l := range legacyLines {
+		in.Legacy += strings.Count(content, l)
+	}
+	for _, l := range strings.Split(content, "\n") {
+		if !strings.HasPrefix(l, blockBegin) {
+			continue
+		}
+		if in.Blocks++; in.Blocks == 1 {
+			v := strings.TrimPrefix(strings.TrimSuffix(strings.TrimPrefix(l, blockBegin), " >>>"), " v")
+			in.Version, _ = strconv.Atoi(v)
+		}
+	}
+	in.Current = in.Blocks > 0 && in.Version == blockVersion
+	return in, nil
+}
+
+// readRC returns the contents of the rc file, empty if it doesn't exist.
+func readRC(rc string) (string, error) {
+	b, err := ioutil.ReadFile(rc)
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.New("Could not read " + rc + ": " + err.Error())
+	}
+	return string(b), nil
+}
+
+// writeRC writes the rc file, keeping its permissions if it exists.
+func writeRC(rc, content string) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(rc); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := ioutil.WriteFile(rc, []byte(content), mode); err != nil {
+		return errors.New("Could not write " + rc + ": " + err.Error())
+	}
+	return nil
+}
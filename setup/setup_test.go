@@ -0,0 +1,107 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package setup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/llog"
+)
+
+func TestApply(t *testing.T) {
+	home, err := ioutil.TempDir("", "test-bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+
+	rc := filepath.Join(home, ".bashrc")
+	history := filepath.Join(home, ".bash_history")
+	user := "alias ll='ls -l'\n" + legacyLines[1] + "export EDITOR=vi"
+	if err = ioutil.WriteFile(rc, []byte(user), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(history, []byte("ls\ncd\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &conf.Config{Log: llog.New(llog.SILENT), Setup: conf.SetupParams{Shell: conf.SHELL_BASH}}
+	// Install twice, the second time with key bindings.
+	if err = Apply(cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Setup.Keys = true
+	if err = Apply(cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(rc)
+	got := string(b)
+	if n := strings.Count(got, blockBegin); n != 1 {
+		t.Fatalf("Wanted one bashistdb block, got %d:\n%s", n, got)
+	}
+	if strings.Contains(got, legacyLines[1]) {
+		t.Fatalf("The lines of earlier versions weren't removed:\n%s", got)
+	}
+	if !strings.Contains(got, "__bashistdb_find") || !strings.HasPrefix(got, "alias ll='ls -l'\nexport EDITOR=vi\n") {
+		t.Fatalf("Wrong rc file:\n%s", got)
+	}
+
+	// History is backed up once, the second time there is nothing to convert.
+	backups, _ := filepath.Glob(history + ".bashistdb-*")
+	if len(backups) != 1 {
+		t.Fatalf("Wanted one history backup, got %v", backups)
+	}
+	if b, _ = ioutil.ReadFile(backups[0]); string(b) != "ls\ncd\n" {
+		t.Fatalf("Wrong history backup: %q", b)
+	}
+
+	// Another HISTTIMEFORMAT is left alone.
+	cfg.HistTimeFormat = "%F %T "
+	if err = Apply(cfg, false); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ = ioutil.ReadFile(rc); strings.Contains(string(b), "HISTTIMEFORMAT") {
+		t.Fatalf("The block overrides the user's HISTTIMEFORMAT:\n%s", b)
+	}
+
+	cfg.Setup.Uninstall = true
+	if err = Apply(cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadFile(rc)
+	if want := "alias ll='ls -l'\nexport EDITOR=vi\n"; string(b) != want {
+		t.Fatalf("Uninstall left wrong rc file.\nWanted: %q\nGot   : %q", want, b)
+	}
+}
+
+func TestRemoveBlock(t *testing.T) {
+	if _, _, err := removeBlock("a\n" + blockBegin + " v1 >>>\nb\n"); err == nil {
+		t.Fatal("A block that does not end should return an error.")
+	}
+	rest, at, err := removeBlock("a\n" + blockBegin + " v0 >>>\nold\n" + blockEnd + "\nc\n")
+	if err != nil || rest != "a\nc\n" || at != 2 {
+		t.Fatalf("Wrong result: %q %d %v", rest, at, err)
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+/*
+Package shell splits command lines the way a POSIX shell would, enough to tell
+which programs they run.
+
+Split breaks a command line into its simple commands, at pipes, && and ||
+lists, semicolons, background & and subshell parentheses, and returns their
+words with quotes and escapes removed and redirections dropped. Command
+substitutions stay inside the word they are in. Parse then finds the program
+each simple command runs, past variable assignments, shell keywords and
+prefixes like sudo and env, and its subcommand and flags.
+*/
+package shell
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A Command is a simple command of a command line.
+type Command struct {
+	Program    string   // Program is the base name of what runs, e.g git
+	Subcommand string   // Subcommand is set for programs we know have them, e.g commit
+	Flags      []string // Flags are the options, without their =value, up to --
+	Args       []string // Args are the words after the program
+}
+
+// Split returns the words of each simple command in line.
+func Split(line string) [][]string {
+	var (
+		commands [][]string
+		words    []string
+		word     []rune
+		inWord   bool
+		skipNext bool // the next word is the target of a redirection
+		depth    int  // nesting of $( and ${ in the current word
+		backtick bool
+	)
+	endWord := func() {
+		if inWord {
+			if skipNext {
+				skipNext = false
+			} else {
+				words = append(words, string(word))
+			}
+		}
+		word, inWord = word[:0], false
+	}
+	endCommand := func() {
+		endWord()
+		if len(words) > 0 {
+			commands = append(commands, words)
+		}
+		words, skipNext = nil, false
+	}
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		next := func() rune {
+			if i+1 < len(runes) {
+				return runes[i+1]
+			}
+			return 0
+		}
+		// Command substitutions are kept whole.
+		if depth > 0 || backtick {
+			word = append(word, c)
+			switch {
+			case c == '\\' && i+1 < len(runes):
+				i++
+				word = append(word, runes[i])
+			case c == '`' && depth == 0:
+				backtick = false
+			case c == '(' || c == '{':
+				depth++
+			case c == ')' || c == '}':
+				depth--
+			}
+			continue
+		}
+		switch c {
+		case '\\':
+			if i+1 < len(runes) {
+				i++
+				if runes[i] != '\n' {
+					word, inWord = append(word, runes[i]), true
+				}
+			}
+		case '\'':
+			inWord = true
+			for i++; i < len(runes) && runes[i] != '\''; i++ {
+				word = append(word, runes[i])
+			}
+		case '"':
+			inWord = true
+			for i++; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("$`\"\\\n", runes[i+1]) {
+					i++
+				}
+				word = append(word, runes[i])
+			}
+		case '$':
+			word, inWord = append(word, c), true
+			if n := next(); n == '(' || n == '{' {
+				i++
+				word, depth = append(word, n), 1
+			}
+		case '`':
+			word, inWord, backtick = append(word, c), true, true
+		case '#':
+			if inWord {
+				word = append(word, c)
+				break
+			}
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			endCommand()
+		case ' ', '\t':
+			endWord()
+		case '\n', ';', '(', ')':
+			endCommand()
+		case '|':
+			if n := next(); n == '|' || n == '&' {
+				i++
+			}
+			endCommand()
+		case '&':
+			switch next() {
+			case '>':
+				// &> and &>> redirect both outputs.
+				endWord()
+				for i+1 < len(runes) && runes[i+1] == '>' {
+					i++
+				}
+				skipNext = true
+			case '&':
+				i++
+				endCommand()
+			default:
+				endCommand()
+			}
+		case '<', '>':
+			// A redirection, maybe after a file descriptor, e.g 2>&1 or <<<.
+			if inWord && strings.Trim(string(word), "0123456789") == "" {
+				word, inWord = word[:0], false
+			}
+			endWord()
+			for i+1 < len(runes) && strings.ContainsRune("<>&|-", runes[i+1]) {
+				i++
+			}
+			skipNext = true
+		default:
+			word, inWord = append(word, c), true
+		}
+	}
+	endCommand()
+	return commands
+}
+
+// keywords are the shell keywords that may start a simple command and are
+// followed by another command.
+var keywords = map[string]bool{
+	"!": true, "{": true, "}": true, "if": true, "then": true, "else": true, "elif": true, "fi": true,
+	"do": true, "done": true, "while": true, "until": true, "esac": true,
+}
+
+// compounds are the shell keywords that start something other than a command.
+var compounds = map[string]bool{"for": true, "case": true, "select": true, "function": true, "in": true, "[[": true, "]]": true}
+
+// prefixes are the programs that run the rest of their arguments as a
+// command, with their options that take a value.
+var prefixes = map[string]map[string]bool{
+	"sudo":    {"-u": true, "-g": true, "-h": true, "-p": true, "-C": true, "-D": true, "-r": true, "-t": true, "-U": true, "-T": true},
+	"doas":    {"-u": true, "-C": true},
+	"env":     {"-u": true, "-C": true, "-S": true},
+	"nohup":   {},
+	"command": {},
+	"builtin": {},
+	"exec":    {"-a": true},
+	"nice":    {"-n": true},
+	"time":    {"-f": true, "-o": true},
+}
+
+// subcommands are the programs with subcommands, with their global options
+// that take a value.
+var subcommands = map[string]map[string]bool{
+	"git":            {"-C": true, "-c": true, "--git-dir": true, "--work-tree": true, "--namespace": true},
+	"docker":         {"-H": true, "--host": true, "-c": true, "--context": true, "--config": true, "-l": true, "--log-level": true},
+	"podman":         {"-c": true, "--connection": true, "--url": true},
+	"kubectl":        {"-n": true, "--namespace": true, "--context": true, "--kubeconfig": true, "-s": true, "--server": true},
+	"helm":           {"-n": true, "--namespace": true, "--kube-context": true},
+	"go":             {},
+	"cargo":          {},
+	"rustup":         {},
+	"npm":            {},
+	"yarn":           {},
+	"pnpm":           {},
+	"pip":            {},
+	"pip3":           {},
+	"apt":            {},
+	"apt-get":        {},
+	"dnf":            {},
+	"yum":            {},
+	"brew":           {},
+	"snap":           {},
+	"flatpak":        {},
+	"systemctl":      {},
+	"docker-compose": {"-f": true, "--file": true, "-p": true, "--project-name": true},
+	"terraform":      {"-chdir": true},
+	"gh":             {"-R": true, "--repo": true},
+	"svn":            {},
+	"hg":             {"-R": true, "--repository": true},
+	"conda":          {},
+	"vagrant":        {},
+	"aws":            {"--profile": true, "--region": true, "--output": true},
+	"gcloud":         {"--project": true},
+	"ip":             {},
+	"openssl":        {},
+}
+
+// assignment matches a variable assignment, e.g LANG=C.
+var assignment = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\[[^]]*\])?\+?=`)
+
+// subcommand matches what we take for a subcommand.
+var subcommand = regexp.MustCompile(`^[a-z][a-z0-9._:-]*$`)
+
+// Parse returns the simple commands of line with their programs,
+// subcommands and flags.
+func Parse(line string) []Command {
+	var commands []Command
+	for _, words := range Split(line) {
+		words = unwrap(words)
+		if len(words) == 0 {
+			continue
+		}
+		c := Command{Program: path.Base(words[0]), Args: words[1:]}
+		for _, a := range c.Args {
+			if a == "--" {
+				break
+			}
+			if len(a) > 1 && a[0] == '-' {
+				if i := strings.IndexByte(a, '='); i > 0 {
+					a = a[:i]
+				}
+				c.Flags = append(c.Flags, a)
+			}
+		}
+		if options, ok := subcommands[c.Program]; ok {
+			c.Subcommand = firstArg(c.Args, options)
+		}
+		commands = append(commands, c)
+	}
+	return commands
+}
+
+// unwrap drops the assignments, keywords and prefixes before the program
+// of a simple command.
+func unwrap(words []string) []string {
+	for len(words) > 0 {
+		w := words[0]
+		switch {
+		case compounds[w]:
+			return nil
+		case keywords[w], assignment.MatchString(w):
+			words = words[1:]
+		case prefixes[w] != nil:
+			words = skipOptions(words[1:], prefixes[w])
+		default:
+			return words
+		}
+	}
+	return words
+}
+
+// skipOptions drops the leading options of args, with their values if
+// options says they take one, and a -- after them.
+func skipOptions(args []string, options map[string]bool) []string {
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		o := args[0]
+		args = args[1:]
+		if o == "--" {
+			break
+		}
+		if options[o] && len(args) > 0 {
+			args = args[1:]
+		}
+	}
+	return args
+}
+
+// firstArg returns the first argument after the options, if it looks like
+// a subcommand.
+func firstArg(args []string, options map[string]bool) string {
+	if args = skipOptions(args, options); len(args) > 0 && subcommand.MatchString(args[0]) {
+		return args[0]
+	}
+	return ""
+}
+
+// builtins are the builtins and keywords of bash and zsh.
+var builtins = strings.Fields(`alias autoload bg bind break builtin caller case cd chdir command compgen
+	complete compopt continue coproc declare dirs disown do done echo elif else emulate enable esac
+	eval exec exit export false fc fg fi for function getopts hash help history if in jobs kill let
+	local logout mapfile popd print printf pushd pwd read readarray readonly rehash return select set
+	setopt shift shopt source suspend test then time times trap true type typeset ulimit umask
+	unalias unfunction unhash unset unsetopt until wait whence where which while`)
+
+// IsBuiltin reports whether name is a builtin or keyword of the shell.
+func IsBuiltin(name string) bool {
+	for _, b := range builtins {
+		if b == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package shell
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want [][]string
+	}{
+		{"ls -la", [][]string{{"ls", "-la"}}},
+		{`git commit -m "fix the \"bug\""`, [][]string{{"git", "commit", "-m", `fix the "bug"`}}},
+		{`echo 'a  b' c\ d ""`, [][]string{{"echo", "a  b", "c d", ""}}},
+		{"make && make test || echo failed; ls &", [][]string{{"make"}, {"make", "test"}, {"echo", "failed"}, {"ls"}}},
+		{"cat a | grep b |& tee c", [][]string{{"cat", "a"}, {"grep", "b"}, {"tee", "c"}}},
+		{"(cd /tmp; ls) > out 2>&1", [][]string{{"cd", "/tmp"}, {"ls"}}},
+		{"sort <in >>out &>/dev/null", [][]string{{"sort"}}},
+		{"cat <<<$x 2> err", [][]string{{"cat"}}},
+		{`echo $(git rev-parse "HEAD") ${HOME} "$(date)"`, [][]string{{"echo", `$(git rev-parse "HEAD")`, "${HOME}", "$(date)"}}},
+		{"echo `date; ls`", [][]string{{"echo", "`date; ls`"}}},
+		{"ls # list files", [][]string{{"ls"}}},
+		{"echo a#b", [][]string{{"echo", "a#b"}}},
+		{"   ", nil},
+	}
+	for _, v := range tests {
+		if got := Split(v.in); !reflect.DeepEqual(got, v.want) {
+			t.Errorf("Split(%q):\nWanted: %q\nGot   : %q", v.in, v.want, got)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []Command
+	}{
+		{`git commit -m "a" --amend`, []Command{{"git", "commit", []string{"-m", "--amend"}, []string{"commit", "-m", "a", "--amend"}}}},
+		{"git -C ~/src log --oneline", []Command{{"git", "log", []string{"-C", "--oneline"}, []string{"-C", "~/src", "log", "--oneline"}}}},
+		{"sudo -u root LANG=C /usr/bin/apt-get install -y vim", []Command{{"apt-get", "install", []string{"-y"}, []string{"install", "-y", "vim"}}}},
+		{"env -i PATH=/bin nohup make -j4", []Command{{"make", "", []string{"-j4"}, []string{"-j4"}}}},
+		{"ls --color=auto -- -x", []Command{{"ls", "", []string{"--color"}, []string{"--color=auto", "--", "-x"}}}},
+		{"docker ps | grep web && kubectl -n prod get pods", []Command{
+			{"docker", "ps", nil, []string{"ps"}},
+			{"grep", "", nil, []string{"web"}},
+			{"kubectl", "get", []string{"-n"}, []string{"-n", "prod", "get", "pods"}},
+		}},
+		{"git ./weird", []Command{{"git", "", nil, []string{"./weird"}}}},
+		{"if true; then time -p go test ./...; fi", []Command{{"true", "", nil, []string{}}, {"go", "test", nil, []string{"test", "./..."}}}},
+		{"for f in *.go; do gofmt -l $f; done", []Command{{"gofmt", "", []string{"-l"}, []string{"-l", "$f"}}}},
+		{"FOO=bar", nil},
+	}
+	for _, v := range tests {
+		if got := Parse(v.in); !reflect.DeepEqual(got, v.want) {
+			t.Errorf("Parse(%q):\nWanted: %+v\nGot   : %+v", v.in, v.want, got)
+		}
+	}
+}